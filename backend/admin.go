@@ -0,0 +1,98 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+const (
+	CMD_SOFT_DELETE = "soft-delete" // The subcommand that soft deletes a row instead of running the server
+	CMD_RESTORE     = "restore"     // The subcommand that restores a soft deleted row instead of running the server
+	CMD_SET_ADMIN   = "set-admin"   // The subcommand that makes a user an admin, or stops them being one, instead of running the server
+
+	API_PARAM_INCLUDE_DELETED = "includeDeleted" // The query parameter with which admins ask for soft deleted entities to be included
+)
+
+// Runs the soft-delete subcommand: "<table> <id>"
+func RunSoftDeleteCommand(db *sql.DB, args []string) error {
+	if len(args) != 2 {
+		return errors.New(ERR_SOFT_DELETE_USAGE)
+	}
+	id, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return errors.New(ERR_SOFT_DELETE_USAGE)
+	}
+	if err = SoftDelete(db, args[0], id); err != nil {
+		return err
+	}
+	fmt.Printf("Soft deleted %d from %s\n", id, args[0])
+	return nil
+}
+
+// Runs the restore subcommand: "<table> <id>"
+func RunRestoreCommand(db *sql.DB, args []string) error {
+	if len(args) != 2 {
+		return errors.New(ERR_RESTORE_USAGE)
+	}
+	id, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return errors.New(ERR_RESTORE_USAGE)
+	}
+	if err = Restore(db, args[0], id); err != nil {
+		return err
+	}
+	fmt.Printf("Restored %d in %s\n", id, args[0])
+	return nil
+}
+
+// Runs the set-admin subcommand: "<user id> true" or "<user id> false"
+func RunSetAdminCommand(db *sql.DB, args []string) error {
+	if len(args) != 2 {
+		return errors.New(ERR_SET_ADMIN_USAGE)
+	}
+	userId, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return errors.New(ERR_SET_ADMIN_USAGE)
+	}
+	admin, err := strconv.ParseBool(args[1])
+	if err != nil {
+		return errors.New(ERR_SET_ADMIN_USAGE)
+	}
+	if err = UpdateUserFields(db, userId, map[string]interface{}{FIELD_USER_ADMIN: admin}); err != nil {
+		return err
+	}
+	if admin {
+		fmt.Printf("User %d is an admin\n", userId)
+	} else {
+		fmt.Printf("User %d is no longer an admin\n", userId)
+	}
+	return nil
+}
+
+// Returns true if the request asks for soft deleted entities to be included
+// with the includeDeleted query parameter; only admins may ask for them
+func IncludeDeleted(db Queryable, req *http.Request, session *Session) (bool, error) {
+	str := req.URL.Query().Get(API_PARAM_INCLUDE_DELETED)
+	if str == "" {
+		return false, nil
+	}
+	includeDeleted, err := strconv.ParseBool(str)
+	if err != nil {
+		return false, NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_PARAM, fmt.Sprintf(ERR_URL_PARAM_INVALID, API_PARAM_INCLUDE_DELETED))
+	}
+	if !includeDeleted {
+		return false, nil
+	}
+	// Admin rights are checked on every request, so that taking them away works right away
+	user, err := GetUser(db, session.UserId)
+	if err != nil {
+		return false, err
+	}
+	if !user.Admin {
+		return false, PUBERR_ADMINS_ONLY
+	}
+	return true, nil
+}
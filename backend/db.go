@@ -19,7 +19,8 @@ type Queryable interface {
 	Prepare(query string) (*sql.Stmt, error)
 }
 
-func SetupDatabase(env *Environment) (*sql.DB, error) {
+// Connects to the database without touching its schema
+func OpenDatabase(env *Environment) (*sql.DB, error) {
 	// Connect using the parameters above
 	connString := fmt.Sprintf(TEMPLATE_PG_CONN_STRING, env.dbUser, env.dbName)
 	if env.dbPass != "" {
@@ -29,31 +30,22 @@ func SetupDatabase(env *Environment) (*sql.DB, error) {
 	if err != nil {
 		return nil, errors.New("Failed to connect to the database with connection string \"" + connString + "\": " + err.Error())
 	}
+	return db, nil
+}
 
-	// Create tables for all the models
-	err = CreateUserTable(db)
-	if err != nil {
-		return nil, errors.New(fmt.Sprintf(ERR_TABLE_CREATION_FAILED, TABLE_NAME_USER, err.Error()))
-	}
-	err = CreateCampaignTable(db)
-	if err != nil {
-		return nil, errors.New(fmt.Sprintf(ERR_TABLE_CREATION_FAILED, TABLE_NAME_CAMPAIGN, err.Error()))
-	}
-	err = CreateContributionTable(db)
-	if err != nil {
-		return nil, errors.New(fmt.Sprintf(ERR_TABLE_CREATION_FAILED, TABLE_NAME_CONTRIBUTION, err.Error()))
-	}
-	err = CreateClaimTable(db)
+// Connects to the database and brings its schema up to date
+func SetupDatabase(env *Environment) (*sql.DB, error) {
+	db, err := OpenDatabase(env)
 	if err != nil {
-		return nil, errors.New(fmt.Sprintf(ERR_TABLE_CREATION_FAILED, TABLE_NAME_CLAIM, err.Error()))
+		return nil, err
 	}
-	err = CreateClaimEvidenceTable(db)
-	if err != nil {
-		return nil, errors.New(fmt.Sprintf(ERR_TABLE_CREATION_FAILED, TABLE_NAME_CLAIM_EVIDENCE, err.Error()))
+	// Apply any pending migrations
+	applied, err := MigrateUp(db, LatestMigrationVersion())
+	for _, migration := range applied {
+		Debug(fmt.Sprintf("Applied migration %d %s", migration.Version, migration.Name))
 	}
-	err = CreateClaimVoteTable(db)
 	if err != nil {
-		return nil, errors.New(fmt.Sprintf(ERR_TABLE_CREATION_FAILED, TABLE_NAME_CLAIM_VOTE, err.Error()))
+		return nil, err
 	}
 
 	return db, nil
@@ -5,28 +5,62 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"time"
 )
 
 const (
-	ENV_VAR_DB_NAME        = "DB_NAME"        // Name of the database name environment variable
-	ENV_VAR_DB_USER        = "DB_USER"        // Name of the database user environment variable
-	ENV_VAR_DB_PASS        = "DB_PASS"        // Name of the database password environment variable
-	ENV_VAR_JWT_SECRET     = "JWT_SECRET"     // Name of JWT secret environment variable
-	ENV_VAR_PORT           = "PORT"           // Name of the HTTP port environment variable
-	ENV_VAR_STRIPE_API_KEY = "STRIPE_API_KEY" // Name of the stripe is environment variable
+	ENV_VAR_DB_NAME          = "DB_NAME"          // Name of the database name environment variable
+	ENV_VAR_DB_USER          = "DB_USER"          // Name of the database user environment variable
+	ENV_VAR_DB_PASS          = "DB_PASS"          // Name of the database password environment variable
+	ENV_VAR_JWT_SECRET       = "JWT_SECRET"       // Name of JWT secret environment variable
+	ENV_VAR_PORT             = "PORT"             // Name of the HTTP port environment variable
+	ENV_VAR_STRIPE_API_KEY   = "STRIPE_API_KEY"   // Name of the stripe is environment variable
+	ENV_VAR_STRIPE_API_URL   = "STRIPE_API_URL"   // Name of the environment variable for the URL of a local fake of the Stripe API
+	ENV_VAR_PAYMENT_PROVIDER = "PAYMENT_PROVIDER" // Name of the environment variable for whether payments are made with "stripe" or "fake"
+
+	ENV_VAR_CLAIM_VOTING_WINDOW   = "CLAIM_VOTING_WINDOW"   // Name of the environment variable for how many hours claims can be voted on
+	ENV_VAR_STRIPE_WEBHOOK_SECRET = "STRIPE_WEBHOOK_SECRET" // Name of the environment variable for the secret Stripe signs webhooks with
+	ENV_VAR_CLAIM_PERIOD          = "CLAIM_PERIOD"          // Name of the environment variable for how many hours past their deadline campaigns accept claims
+	ENV_VAR_PROCESSOR_FEE_RATE    = "PROCESSOR_FEE_RATE"    // Name of the environment variable for the fake payment processor's fee, in basis points
+	ENV_VAR_PROCESSOR_FEE_FIXED   = "PROCESSOR_FEE_FIXED"   // Name of the environment variable for the fake payment processor's fixed fee, in hundredths of a unit
+	ENV_VAR_PLATFORM_FEE_RATE     = "PLATFORM_FEE_RATE"     // Name of the environment variable for the platform's fee, in basis points
+	ENV_VAR_PLATFORM_FEE_FIXED    = "PLATFORM_FEE_FIXED"    // Name of the environment variable for the platform's fixed fee, in hundredths of a unit
+	ENV_VAR_MAILER                = "MAILER"                // Name of the environment variable for whether emails are written to "file"s or sent over "smtp"
+	ENV_VAR_MAIL_DIR              = "MAIL_DIR"              // Name of the environment variable for the directory the file mailer writes emails to
+	ENV_VAR_MAIL_FROM             = "MAIL_FROM"             // Name of the environment variable for the address emails are from
+	ENV_VAR_SMTP_ADDR             = "SMTP_ADDR"             // Name of the environment variable for the host and port of the SMTP server emails are sent through
+	ENV_VAR_PASSWORD_RESET_URL    = "PASSWORD_RESET_URL"    // Name of the environment variable for the page password reset tokens are appended to in emails
+
+	DEFAULT_CLAIM_VOTING_WINDOW = time.Hour * 24 * 7      // How long claims can be voted on when not otherwise specified
+	DEFAULT_CLAIM_PERIOD        = time.Hour * 24 * 30     // How long past their deadline campaigns accept claims when not otherwise specified
+	DEFAULT_PAYMENT_PROVIDER    = PAYMENT_PROVIDER_STRIPE // Who payments are made with when not otherwise specified
 )
 
 type Environment struct {
-	dbName       string
-	dbUser       string
-	dbPass       string
-	jwtSecret    string
-	port         int
-	stripeAPIKey string
+	dbName          string
+	dbUser          string
+	dbPass          string
+	jwtSecret       string
+	port            int
+	stripeAPIKey    string
+	stripeAPIURL    string
+	paymentProvider string
+
+	claimVotingWindow   time.Duration
+	claimPeriod         time.Duration
+	stripeWebhookSecret string
+	processorFees       FeeSchedule
+	platformFees        FeeSchedule
+
+	mailer           string
+	mailDir          string
+	mailFrom         string
+	smtpAddr         string
+	passwordResetURL string
 }
 
-func NewEnvironment() (*Environment, error) {
-	// Required variables
+// Reads only the variables needed to connect to the database
+func NewDatabaseEnvironment() (*Environment, error) {
 	dbName := os.Getenv(ENV_VAR_DB_NAME)
 	if dbName == "" {
 		return nil, errors.New(fmt.Sprintf(ERR_ENV_VAR_MISSING, ENV_VAR_DB_NAME))
@@ -35,6 +69,20 @@ func NewEnvironment() (*Environment, error) {
 	if dbUser == "" {
 		return nil, errors.New(fmt.Sprintf(ERR_ENV_VAR_MISSING, ENV_VAR_DB_USER))
 	}
+
+	return &Environment{
+		dbName: dbName,
+		dbUser: dbUser,
+		dbPass: os.Getenv(ENV_VAR_DB_PASS),
+	}, nil
+}
+
+func NewEnvironment() (*Environment, error) {
+	// Required variables
+	env, err := NewDatabaseEnvironment()
+	if err != nil {
+		return nil, err
+	}
 	jwtSecret := os.Getenv(ENV_VAR_JWT_SECRET)
 	if jwtSecret == "" {
 		return nil, errors.New(fmt.Sprintf(ERR_ENV_VAR_MISSING, ENV_VAR_JWT_SECRET))
@@ -47,19 +95,107 @@ func NewEnvironment() (*Environment, error) {
 	if err != nil {
 		return nil, errors.New(fmt.Sprintf(ERR_ENV_VAR_MISSING, ENV_VAR_PORT))
 	}
+	paymentProvider := os.Getenv(ENV_VAR_PAYMENT_PROVIDER)
+	if paymentProvider == "" {
+		paymentProvider = DEFAULT_PAYMENT_PROVIDER
+	}
+	if paymentProvider != PAYMENT_PROVIDER_STRIPE && paymentProvider != PAYMENT_PROVIDER_FAKE {
+		return nil, errors.New(fmt.Sprintf(ERR_ENV_VAR_MISSING, ENV_VAR_PAYMENT_PROVIDER))
+	}
+	// Fake payments don't need a Stripe account
 	stripeAPIKey := os.Getenv(ENV_VAR_STRIPE_API_KEY)
-	if stripeAPIKey == "" {
+	if stripeAPIKey == "" && paymentProvider == PAYMENT_PROVIDER_STRIPE {
 		return nil, errors.New(fmt.Sprintf(ERR_ENV_VAR_MISSING, ENV_VAR_STRIPE_API_KEY))
 	}
 	// Optional variables
-	dbPass := os.Getenv(ENV_VAR_DB_PASS)
+	claimVotingWindow := DEFAULT_CLAIM_VOTING_WINDOW
+	if str := os.Getenv(ENV_VAR_CLAIM_VOTING_WINDOW); str != "" {
+		hours, err := strconv.Atoi(str)
+		if err != nil || hours < 1 {
+			return nil, errors.New(fmt.Sprintf(ERR_ENV_VAR_MISSING, ENV_VAR_CLAIM_VOTING_WINDOW))
+		}
+		claimVotingWindow = time.Duration(hours) * time.Hour
+	}
+	claimPeriod := DEFAULT_CLAIM_PERIOD
+	if str := os.Getenv(ENV_VAR_CLAIM_PERIOD); str != "" {
+		hours, err := strconv.Atoi(str)
+		if err != nil || hours < 1 {
+			return nil, errors.New(fmt.Sprintf(ERR_ENV_VAR_MISSING, ENV_VAR_CLAIM_PERIOD))
+		}
+		claimPeriod = time.Duration(hours) * time.Hour
+	}
+	mailer := os.Getenv(ENV_VAR_MAILER)
+	if mailer == "" {
+		mailer = DEFAULT_MAILER
+	}
+	if mailer != MAILER_FILE && mailer != MAILER_SMTP {
+		return nil, errors.New(fmt.Sprintf(ERR_ENV_VAR_MISSING, ENV_VAR_MAILER))
+	}
+	// Only the SMTP mailer needs a server
+	smtpAddr := os.Getenv(ENV_VAR_SMTP_ADDR)
+	if smtpAddr == "" && mailer == MAILER_SMTP {
+		return nil, errors.New(fmt.Sprintf(ERR_ENV_VAR_MISSING, ENV_VAR_SMTP_ADDR))
+	}
+	mailDir := os.Getenv(ENV_VAR_MAIL_DIR)
+	if mailDir == "" {
+		mailDir = DEFAULT_MAIL_DIR
+	}
+	mailFrom := os.Getenv(ENV_VAR_MAIL_FROM)
+	if mailFrom == "" {
+		mailFrom = DEFAULT_MAIL_FROM
+	}
+	passwordResetURL := os.Getenv(ENV_VAR_PASSWORD_RESET_URL)
+	if passwordResetURL == "" {
+		passwordResetURL = "http://localhost:" + portStr + "/#/reset-password?token="
+	}
+	processorFees, err := feeScheduleFromEnv(ENV_VAR_PROCESSOR_FEE_RATE, ENV_VAR_PROCESSOR_FEE_FIXED, FeeSchedule{DEFAULT_PROCESSOR_FEE_RATE, DEFAULT_PROCESSOR_FEE_FIXED})
+	if err != nil {
+		return nil, err
+	}
+	platformFees, err := feeScheduleFromEnv(ENV_VAR_PLATFORM_FEE_RATE, ENV_VAR_PLATFORM_FEE_FIXED, FeeSchedule{DEFAULT_PLATFORM_FEE_RATE, DEFAULT_PLATFORM_FEE_FIXED})
+	if err != nil {
+		return nil, err
+	}
 
-	return &Environment{
-		dbName:       dbName,
-		dbUser:       dbUser,
-		dbPass:       dbPass,
-		jwtSecret:    jwtSecret,
-		port:         port,
-		stripeAPIKey: stripeAPIKey,
-	}, nil
+	env.jwtSecret = jwtSecret
+	env.port = port
+	env.stripeAPIKey = stripeAPIKey
+	env.stripeAPIURL = os.Getenv(ENV_VAR_STRIPE_API_URL)
+	env.paymentProvider = paymentProvider
+	env.claimVotingWindow = claimVotingWindow
+	env.claimPeriod = claimPeriod
+	env.stripeWebhookSecret = os.Getenv(ENV_VAR_STRIPE_WEBHOOK_SECRET)
+	env.processorFees = processorFees
+	env.platformFees = platformFees
+	env.mailer = mailer
+	env.mailDir = mailDir
+	env.mailFrom = mailFrom
+	env.smtpAddr = smtpAddr
+	env.passwordResetURL = passwordResetURL
+
+	return env, nil
+}
+
+// Reads a fee schedule from a pair of optional environment variables; parts
+// that aren't specified are taken from defaults
+func feeScheduleFromEnv(rateVar string, fixedVar string, defaults FeeSchedule) (FeeSchedule, error) {
+	schedule := defaults
+	if str := os.Getenv(rateVar); str != "" {
+		rate, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return schedule, errors.New(fmt.Sprintf(ERR_ENV_VAR_MISSING, rateVar))
+		}
+		schedule.Rate = rate
+	}
+	if str := os.Getenv(fixedVar); str != "" {
+		fixed, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return schedule, errors.New(fmt.Sprintf(ERR_ENV_VAR_MISSING, fixedVar))
+		}
+		schedule.Fixed = fixed
+	}
+	if !schedule.IsValid() {
+		return schedule, errors.New(fmt.Sprintf(ERR_ENV_VAR_MISSING, rateVar))
+	}
+	return schedule, nil
 }
@@ -1,38 +1,105 @@
 package main
 
 import (
+	"fmt"
 	"net/http"
 	"strings"
 )
 
 const (
-	ERRCODE_EMAIL_TAKEN         = "EMAIL_TAKEN"
-	ERRCODE_INTERNAL_ERROR      = "INTERNAL_ERROR"
-	ERRCODE_ENDPOINT_NOT_FOUND  = "ENDPOINT_NOT_FOUND"
-	ERRCODE_INVALID_JSON        = "INVALID_JSON"
-	ERRCODE_INVALID_FIELD       = "INVALID_FIELD"
-	ERRCODE_INVALID_PARAM       = "INVALID_PARAM"
-	ERRCODE_INVALID_AUTH_TOKEN  = "INVALID_AUTH_TOKEN"
-	ERRCODE_INVALID_CREDENTIALS = "INVALID_CREDENTIALS"
-	ERRCODE_ENTITY_NOT_FOUND    = "ENTITY_NOT_FOUND"
+	ERRCODE_EMAIL_TAKEN               = "EMAIL_TAKEN"
+	ERRCODE_INTERNAL_ERROR            = "INTERNAL_ERROR"
+	ERRCODE_ENDPOINT_NOT_FOUND        = "ENDPOINT_NOT_FOUND"
+	ERRCODE_INVALID_JSON              = "INVALID_JSON"
+	ERRCODE_INVALID_FIELD             = "INVALID_FIELD"
+	ERRCODE_INVALID_PARAM             = "INVALID_PARAM"
+	ERRCODE_INVALID_AUTH_TOKEN        = "INVALID_AUTH_TOKEN"
+	ERRCODE_INVALID_CREDENTIALS       = "INVALID_CREDENTIALS"
+	ERRCODE_ENTITY_NOT_FOUND          = "ENTITY_NOT_FOUND"
+	ERRCODE_CAMPAIGN_CLOSED           = "CAMPAIGN_CLOSED"
+	ERRCODE_PAYMENT_FAILED            = "PAYMENT_FAILED"
+	ERRCODE_CAMPAIGN_CLAIMED          = "CAMPAIGN_CLAIMED"
+	ERRCODE_NOT_A_BACKER              = "NOT_A_BACKER"
+	ERRCODE_VOTING_CLOSED             = "VOTING_CLOSED"
+	ERRCODE_CLAIMS_NOT_OPEN           = "CLAIMS_NOT_OPEN"
+	ERRCODE_INVALID_SIGNATURE         = "INVALID_SIGNATURE"
+	ERRCODE_CLAIMS_CLOSED             = "CLAIMS_CLOSED"
+	ERRCODE_FORBIDDEN                 = "FORBIDDEN"
+	ERRCODE_INVALID_HEADER            = "INVALID_HEADER"
+	ERRCODE_IDEMPOTENCY_KEY_IN_USE    = "IDEMPOTENCY_KEY_IN_USE"
+	ERRCODE_IDEMPOTENCY_KEY_REUSED    = "IDEMPOTENCY_KEY_REUSED"
+	ERRCODE_PLEDGES_NOT_ACCEPTED      = "PLEDGES_NOT_ACCEPTED"
+	ERRCODE_PLEDGE_EXISTS             = "PLEDGE_EXISTS"
+	ERRCODE_PLEDGE_CANCELED           = "PLEDGE_CANCELED"
+	ERRCODE_BELOW_REWARD_TIER_MINIMUM = "BELOW_REWARD_TIER_MINIMUM"
+	ERRCODE_REWARD_TIER_SOLD_OUT      = "REWARD_TIER_SOLD_OUT"
+	ERRCODE_CAMPAIGN_HAS_BACKERS      = "CAMPAIGN_HAS_BACKERS"
+	ERRCODE_CAMPAIGN_NOT_CANCELABLE   = "CAMPAIGN_NOT_CANCELABLE"
+	ERRCODE_INVALID_RESET_TOKEN       = "INVALID_RESET_TOKEN"
 
-	ERR_INTERNAL_SERVER_ERROR    = "There was an internal issue"
-	ERR_ENDPOINT_NOT_FOUND       = "Endpoint does not exist"
-	ERR_INVALID_AUTH_TOKEN       = "Authorization token is invalid"
-	ERR_USER_CREATION_FAILED     = "Could not create new user: "
-	ERR_CAMPAIGN_CREATION_FAILED = "Could not create new campaign: "
-	ERR_INVALID_CREDENTIALS      = "Given credentials were invalid"
-	ERR_TABLE_CREATION_FAILED    = "Failed to create database table \"%s\": %s"
-	ERR_ENV_VAR_MISSING          = "The environment variable \"%s\" was either missing or invalid"
-	ERR_COULDNT_START            = "Couldn't start the the server: "
-	ERR_JWT_INVALID_CLAIMS       = "Could not parse JWT token claims" // Error occurs when there was a JWT parsing error
-	ERR_JWT_SESSION_EXPIRED      = "Session has expired"              // Error occurs when the session has expired
-	ERR_BODY_INVALID_JSON        = "Body was invalid JSON"
-	ERR_BODY_FIELD_INVALID       = "The \"%s\" field is invalid or ill-formatted"
-	ERR_URL_PARAM_INVALID        = "The \"%s\" URL parameter is invalid or ill-formatted"
-	ERR_COULD_NOT_HASH_PASS      = "Failed to hash the password field"
-	ERR_COULD_CREATE_USER        = "Failed to create a new user"
-	ERR_ENTITY_NOT_FOUND         = "Could not find entity matching provided information"
+	ERR_INTERNAL_SERVER_ERROR      = "There was an internal issue"
+	ERR_ENDPOINT_NOT_FOUND         = "Endpoint does not exist"
+	ERR_INVALID_AUTH_TOKEN         = "Authorization token is invalid"
+	ERR_USER_CREATION_FAILED       = "Could not create new user: "
+	ERR_CAMPAIGN_CREATION_FAILED   = "Could not create new campaign: "
+	ERR_INVALID_CREDENTIALS        = "Given credentials were invalid"
+	ERR_MIGRATION_FAILED           = "Failed to apply migration %d \"%s\": %s"
+	ERR_MIGRATION_ROLLBACK_FAILED  = "Failed to roll back migration %d \"%s\": %s"
+	ERR_MIGRATE_USAGE              = "Usage: migrate [up [version] | down [steps] | status]"
+	ERR_LEDGER_INCONSISTENT        = "Found %d problems with the ledger"
+	ERR_ENV_VAR_MISSING            = "The environment variable \"%s\" was either missing or invalid"
+	ERR_COULDNT_START              = "Couldn't start the the server: "
+	ERR_JWT_INVALID_CLAIMS         = "Could not parse JWT token claims" // Error occurs when there was a JWT parsing error
+	ERR_JWT_SESSION_EXPIRED        = "Session has expired"              // Error occurs when the session has expired
+	ERR_JWT_SESSION_REVOKED        = "Session has been revoked"
+	ERR_BODY_INVALID_JSON          = "Body was invalid JSON"
+	ERR_BODY_FIELD_INVALID         = "The \"%s\" field is invalid or ill-formatted"
+	ERR_URL_PARAM_INVALID          = "The \"%s\" URL parameter is invalid or ill-formatted"
+	ERR_COULD_NOT_HASH_PASS        = "Failed to hash the password field"
+	ERR_COULD_CREATE_USER          = "Failed to create a new user"
+	ERR_ENTITY_NOT_FOUND           = "Could not find entity matching provided information"
+	ERR_CAMPAIGN_CLOSED            = "Campaign is finished or past its deadline"
+	ERR_PAYMENT_FAILED             = "Payment could not be processed"
+	ERR_CAMPAIGN_CLAIMED           = "Campaign has already been claimed"
+	ERR_NOT_A_BACKER               = "Only those who contributed to the campaign may vote on its claims"
+	ERR_VOTING_CLOSED              = "Voting on this claim has closed"
+	ERR_CLAIMS_NOT_OPEN            = "Campaign is not accepting claims until its deadline has passed"
+	ERR_CLAIMS_CLOSED              = "Campaign is no longer accepting claims"
+	ERR_CURRENCY_MISMATCH          = "Cannot combine amounts in %s and %s"
+	ERR_JOURNAL_ENTRY_UNBALANCED   = "Journal entry \"%s\" does not balance"
+	ERR_BODY_ITEM_FIELD_INVALID    = "The \"%s\" field of item %d of \"%s\" is invalid or ill-formatted"
+	ERR_INVALID_SIGNATURE          = "The request signature is invalid"
+	ERR_STRIPE_SIGNATURE_MALFORMED = "The Stripe-Signature header is missing or ill-formatted"
+	ERR_STRIPE_SIGNATURE_EXPIRED   = "The Stripe-Signature header is too old"
+	ERR_STRIPE_SIGNATURE_MISMATCH  = "The Stripe-Signature header does not match the payload"
+	ERR_STRIPE_EVENT_MALFORMED     = "The Stripe event has no id or type"
+	ERR_SEND_STRIPE_FIXTURE_USAGE  = "Usage: send-stripe-fixture <fixture file> [charge or transfer id]"
+	ERR_FORBIDDEN                  = "Only the user themselves may do this"
+	ERR_FAKE_PAYMENT_DECLINED      = "The fake payment provider declined the request: %s"
+	ERR_FAKE_PAYMENT_UNAVAILABLE   = "The fake payment provider is unavailable"
+	ERR_HEADER_INVALID             = "The \"%s\" header is invalid or ill-formatted"
+	ERR_IDEMPOTENCY_KEY_IN_USE     = "A request with this idempotency key is still being handled"
+	ERR_IDEMPOTENCY_KEY_REUSED     = "This idempotency key was already used for a different request"
+	ERR_SET_CAMPAIGN_FEES_USAGE    = "Usage: set-campaign-fees <campaign id> (<rate in basis points> <fixed fee in hundredths of a unit> | default)"
+	ERR_PLEDGES_NOT_ACCEPTED       = "Campaign only accepts one-off contributions"
+	ERR_PLEDGE_EXISTS              = "You have already pledged to this campaign"
+	ERR_PLEDGE_CANCELED            = "Pledge has been canceled"
+	ERR_BELOW_REWARD_TIER_MINIMUM  = "Contribution is less than the minimum amount of the reward tier"
+	ERR_REWARD_TIER_SOLD_OUT       = "Reward tier has none left"
+	ERR_FIELD_NOT_UPDATABLE        = "The \"%s\" field of %s cannot be updated this way"
+	ERR_TABLE_NOT_SOFT_DELETABLE   = "The rows of %s cannot be updated or soft deleted this way"
+	ERR_ADMINS_ONLY                = "Only admins may do this"
+	ERR_ACCOUNT_DELETED            = "The account was deleted"
+	ERR_SOFT_DELETE_USAGE          = "Usage: soft-delete <table> <id>"
+	ERR_RESTORE_USAGE              = "Usage: restore <table> <id>"
+	ERR_SET_ADMIN_USAGE            = "Usage: set-admin <user id> (true | false)"
+	ERR_NOT_CAMPAIGN_CREATOR       = "Only the creator of the campaign may do this"
+	ERR_CAMPAIGN_HAS_BACKERS       = "The deadline and goal of a campaign cannot be changed once it has backers"
+	ERR_CAMPAIGN_NOT_CANCELABLE    = "Campaign can only be canceled while it is raising money"
+	ERR_CAMPAIGN_CANCELED          = "Campaign was canceled by its creator"
+	ERR_EMAIL_TAKEN                = "Email address is already in use"
+	ERR_INVALID_RESET_TOKEN        = "Password reset token is invalid, expired or already used"
+	ERR_DEADLINE_TOO_FAR           = "All-or-nothing campaigns must end within 6 days"
 )
 
 var (
@@ -43,6 +110,32 @@ var (
 	PUBERR_INVALID_JSON                     = NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_JSON, ERR_BODY_INVALID_JSON)
 	PUBERR_INVALID_CREDENTIALS              = NewPublicError(http.StatusUnauthorized, ERRCODE_INVALID_CREDENTIALS, ERR_INVALID_CREDENTIALS)
 	PUBERR_ENTITY_NOT_FOUND                 = NewPublicError(http.StatusNotFound, ERRCODE_ENTITY_NOT_FOUND, ERR_ENTITY_NOT_FOUND)
+	PUBERR_CAMPAIGN_CLOSED                  = NewPublicError(http.StatusConflict, ERRCODE_CAMPAIGN_CLOSED, ERR_CAMPAIGN_CLOSED)
+	PUBERR_PAYMENT_FAILED                   = NewPublicError(http.StatusPaymentRequired, ERRCODE_PAYMENT_FAILED, ERR_PAYMENT_FAILED)
+	PUBERR_CAMPAIGN_CLAIMED                 = NewPublicError(http.StatusConflict, ERRCODE_CAMPAIGN_CLAIMED, ERR_CAMPAIGN_CLAIMED)
+	PUBERR_NOT_A_BACKER                     = NewPublicError(http.StatusForbidden, ERRCODE_NOT_A_BACKER, ERR_NOT_A_BACKER)
+	PUBERR_VOTING_CLOSED                    = NewPublicError(http.StatusConflict, ERRCODE_VOTING_CLOSED, ERR_VOTING_CLOSED)
+	PUBERR_CLAIMS_NOT_OPEN                  = NewPublicError(http.StatusConflict, ERRCODE_CLAIMS_NOT_OPEN, ERR_CLAIMS_NOT_OPEN)
+	PUBERR_CLAIMS_CLOSED                    = NewPublicError(http.StatusConflict, ERRCODE_CLAIMS_CLOSED, ERR_CLAIMS_CLOSED)
+	PUBERR_FORBIDDEN                        = NewPublicError(http.StatusForbidden, ERRCODE_FORBIDDEN, ERR_FORBIDDEN)
+	PUBERR_INVALID_SIGNATURE                = NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_SIGNATURE, ERR_INVALID_SIGNATURE)
+	PUBERR_INVALID_CURSOR                   = NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_PARAM, fmt.Sprintf(ERR_URL_PARAM_INVALID, "cursor"))
+	PUBERR_INVALID_SORT                     = NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_PARAM, fmt.Sprintf(ERR_URL_PARAM_INVALID, "sort"))
+	PUBERR_INVALID_IDEMPOTENCY_KEY          = NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_HEADER, fmt.Sprintf(ERR_HEADER_INVALID, IDEMPOTENCY_KEY_HEADER))
+	PUBERR_IDEMPOTENCY_KEY_IN_USE           = NewPublicError(http.StatusConflict, ERRCODE_IDEMPOTENCY_KEY_IN_USE, ERR_IDEMPOTENCY_KEY_IN_USE)
+	PUBERR_IDEMPOTENCY_KEY_REUSED           = NewPublicError(http.StatusUnprocessableEntity, ERRCODE_IDEMPOTENCY_KEY_REUSED, ERR_IDEMPOTENCY_KEY_REUSED)
+	PUBERR_PLEDGES_NOT_ACCEPTED             = NewPublicError(http.StatusConflict, ERRCODE_PLEDGES_NOT_ACCEPTED, ERR_PLEDGES_NOT_ACCEPTED)
+	PUBERR_PLEDGE_EXISTS                    = NewPublicError(http.StatusConflict, ERRCODE_PLEDGE_EXISTS, ERR_PLEDGE_EXISTS)
+	PUBERR_PLEDGE_CANCELED                  = NewPublicError(http.StatusConflict, ERRCODE_PLEDGE_CANCELED, ERR_PLEDGE_CANCELED)
+	PUBERR_BELOW_REWARD_TIER_MINIMUM        = NewPublicError(http.StatusBadRequest, ERRCODE_BELOW_REWARD_TIER_MINIMUM, ERR_BELOW_REWARD_TIER_MINIMUM)
+	PUBERR_REWARD_TIER_SOLD_OUT             = NewPublicError(http.StatusConflict, ERRCODE_REWARD_TIER_SOLD_OUT, ERR_REWARD_TIER_SOLD_OUT)
+	PUBERR_EMAIL_TAKEN                      = NewPublicError(http.StatusConflict, ERRCODE_EMAIL_TAKEN, ERR_EMAIL_TAKEN)
+	PUBERR_ADMINS_ONLY                      = NewPublicError(http.StatusForbidden, ERRCODE_FORBIDDEN, ERR_ADMINS_ONLY)
+	PUBERR_NOT_CAMPAIGN_CREATOR             = NewPublicError(http.StatusForbidden, ERRCODE_FORBIDDEN, ERR_NOT_CAMPAIGN_CREATOR)
+	PUBERR_CAMPAIGN_HAS_BACKERS             = NewPublicError(http.StatusConflict, ERRCODE_CAMPAIGN_HAS_BACKERS, ERR_CAMPAIGN_HAS_BACKERS)
+	PUBERR_CAMPAIGN_NOT_CANCELABLE          = NewPublicError(http.StatusConflict, ERRCODE_CAMPAIGN_NOT_CANCELABLE, ERR_CAMPAIGN_NOT_CANCELABLE)
+	PUBERR_INVALID_RESET_TOKEN              = NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_RESET_TOKEN, ERR_INVALID_RESET_TOKEN)
+	PUBERR_DEADLINE_TOO_FAR                 = NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_FIELD, ERR_DEADLINE_TOO_FAR)
 )
 
 type PublicError struct {
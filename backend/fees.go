@@ -0,0 +1,104 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+const (
+	CMD_SET_CAMPAIGN_FEES         = "set-campaign-fees" // The subcommand that overrides the platform's fees on a campaign instead of running the server
+	CMD_SET_CAMPAIGN_FEES_DEFAULT = "default"           // Makes the campaign pay the default fees again
+
+	FEE_RATE_SCALE  = 10000 // Fee rates are in basis points, i.e. hundredths of a percent
+	FEE_FIXED_SCALE = 100   // Fixed fees are in hundredths of a unit of the currency, whatever its minor unit is
+
+	DEFAULT_PROCESSOR_FEE_RATE  = 290 // What the fake payment processor keeps of each contribution when not otherwise specified, in basis points
+	DEFAULT_PROCESSOR_FEE_FIXED = 30  // What the fake payment processor keeps on top of that when not otherwise specified, in hundredths of a unit
+	DEFAULT_PLATFORM_FEE_RATE   = 500 // What the platform keeps of each contribution when not otherwise specified, in basis points
+	DEFAULT_PLATFORM_FEE_FIXED  = 0   // What the platform keeps on top of that when not otherwise specified, in hundredths of a unit
+)
+
+// FeeSchedule is how much of each contribution is kept as a fee: a percentage
+// of the contribution plus a fixed amount in the contribution's currency. The
+// fixed amount is in hundredths of a unit rather than in minor units, so that
+// the same schedule makes sense for currencies without cents, like the yen
+type FeeSchedule struct {
+	Rate  int64 `json:"rate"`  // The percentage kept, in basis points; 290 is 2.9%
+	Fixed int64 `json:"fixed"` // The fixed amount kept, in hundredths of a unit of the currency; 30 is 0.30 USD or 0 JPY
+}
+
+// Returns the fee on an amount; fractions of a minor unit are rounded to the
+// nearest one. The fee is never more than the amount itself
+func (s FeeSchedule) FeeOn(amount Money) Money {
+	scale := minorUnitScale(amount.Currency)
+	fixed := (s.Fixed*scale + FEE_FIXED_SCALE/2) / FEE_FIXED_SCALE
+	fee := (amount.Amount*s.Rate+FEE_RATE_SCALE/2)/FEE_RATE_SCALE + fixed
+	if fee > amount.Amount {
+		fee = amount.Amount
+	}
+	return NewMoney(fee, amount.Currency)
+}
+
+// Returns true if the rate is at most 100% and neither part is negative
+func (s FeeSchedule) IsValid() bool {
+	return s.Rate >= 0 && s.Rate <= FEE_RATE_SCALE && s.Fixed >= 0
+}
+
+// Splits the gross amount of a contribution into the platform's fee and what
+// is left for the claimer. The payment processor's fee comes out first, so the
+// fees never add up to more than the amount
+func SplitContribution(
+	gross Money, // The amount the contributor paid
+	processorFee Money, // What the payment processor kept; nothing if the charge was only authorized
+	platformFees FeeSchedule, // What the platform keeps
+) (platformFee Money, net Money) {
+	return deductFees(gross, processorFee, platformFees.FeeOn(gross))
+}
+
+// Takes the fees out of the gross amount of a contribution, the payment
+// processor's first; returns the platform's fee, cut down to what the
+// processor left of the amount, and what is left for the claimer
+func deductFees(gross Money, processorFee Money, platformFee Money) (Money, Money) {
+	if remaining := gross.Amount - processorFee.Amount; platformFee.Amount > remaining {
+		platformFee.Amount = remaining
+	}
+	return platformFee, NewMoney(gross.Amount-processorFee.Amount-platformFee.Amount, gross.Currency)
+}
+
+// Runs the set-campaign-fees subcommand: either "<campaign id> <rate> <fixed>"
+// or "<campaign id> default". Only contributions made afterwards pay the new fees
+func RunSetCampaignFeesCommand(db *sql.DB, args []string) error {
+	if len(args) < 2 || len(args) > 3 {
+		return errors.New(ERR_SET_CAMPAIGN_FEES_USAGE)
+	}
+	campaignId, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return errors.New(ERR_SET_CAMPAIGN_FEES_USAGE)
+	}
+	// Make sure the campaign exists
+	if _, err = GetCampaign(db, campaignId); err != nil {
+		return err
+	}
+	if len(args) == 2 {
+		if args[1] != CMD_SET_CAMPAIGN_FEES_DEFAULT {
+			return errors.New(ERR_SET_CAMPAIGN_FEES_USAGE)
+		}
+		if err = SetCampaignPlatformFees(db, campaignId, nil); err == nil {
+			fmt.Printf("Campaign %d pays the default fees\n", campaignId)
+		}
+		return err
+	}
+	var fees FeeSchedule
+	if fees.Rate, err = strconv.ParseInt(args[1], 10, 64); err != nil {
+		return errors.New(ERR_SET_CAMPAIGN_FEES_USAGE)
+	}
+	if fees.Fixed, err = strconv.ParseInt(args[2], 10, 64); err != nil || !fees.IsValid() {
+		return errors.New(ERR_SET_CAMPAIGN_FEES_USAGE)
+	}
+	if err = SetCampaignPlatformFees(db, campaignId, &fees); err == nil {
+		fmt.Printf("Campaign %d pays %d basis points plus %d hundredths of a unit\n", campaignId, fees.Rate, fees.Fixed)
+	}
+	return err
+}
@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func TestFeeOn(t *testing.T) {
+	cases := []struct {
+		fees   FeeSchedule
+		amount Money
+		want   int64
+	}{
+		{FeeSchedule{Rate: 290, Fixed: 30}, NewMoney(10000, "USD"), 320},
+		{FeeSchedule{Rate: 290, Fixed: 30}, NewMoney(1000, "EUR"), 59},
+		// Fractions of a minor unit are rounded
+		{FeeSchedule{Rate: 290, Fixed: 0}, NewMoney(50, "USD"), 1},
+		// Yen have no minor units, so the fixed part is in whole yen
+		{FeeSchedule{Rate: 290, Fixed: 30}, NewMoney(10000, "JPY"), 290},
+		{FeeSchedule{Rate: 360, Fixed: 5000}, NewMoney(10000, "JPY"), 410},
+		{FeeSchedule{Rate: 0, Fixed: 50}, NewMoney(1000, "JPY"), 1},
+		// The fee never takes more than the amount
+		{FeeSchedule{Rate: 290, Fixed: 30}, NewMoney(20, "USD"), 20},
+	}
+	for _, c := range cases {
+		fee := c.fees.FeeOn(c.amount)
+		if fee.Amount != c.want || fee.Currency != c.amount.Currency {
+			t.Errorf("%+v on %v is %v, want %d %s", c.fees, c.amount, fee, c.want, c.amount.Currency)
+		}
+	}
+}
+
+func TestSplitContribution(t *testing.T) {
+	platformFees := FeeSchedule{Rate: 500, Fixed: 0}
+	cases := []struct {
+		gross, processorFee Money
+		wantPlatform        int64
+		wantNet             int64
+	}{
+		{NewMoney(10000, "USD"), NewMoney(320, "USD"), 500, 9180},
+		// Authorized charges have no processor fee yet
+		{NewMoney(10000, "USD"), NewMoney(0, "USD"), 500, 9500},
+		// The processor's fee comes first
+		{NewMoney(100, "USD"), NewMoney(98, "USD"), 2, 0},
+	}
+	for _, c := range cases {
+		platformFee, net := SplitContribution(c.gross, c.processorFee, platformFees)
+		if platformFee.Amount != c.wantPlatform || net.Amount != c.wantNet {
+			t.Errorf("%v less %v split into %v and %v, want %d and %d", c.gross, c.processorFee, platformFee, net, c.wantPlatform, c.wantNet)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const (
+	// Ways that campaigns collect the money pledged to them
+	FUNDING_MODE_ALL_OR_NOTHING      = "all_or_nothing"      // Contributions are authorized, and only captured if the goal is met by the deadline
+	FUNDING_MODE_KEEP_WHAT_YOU_RAISE = "keep_what_you_raise" // Contributions are captured immediately whether or not the goal is met
+
+	DEFAULT_FUNDING_MODE = FUNDING_MODE_KEEP_WHAT_YOU_RAISE
+
+	// Stripe releases authorizations that go uncaptured for 7 days, so
+	// all-or-nothing campaigns have to end sooner than that; a day is left
+	// over for their contributions to be captured after the deadline
+	ALL_OR_NOTHING_MAX_DURATION = time.Hour * 24 * 6
+
+	// Outcomes of the funding of campaigns
+	FUNDING_OUTCOME_PENDING   = "pending"   // The deadline hasn't passed yet
+	FUNDING_OUTCOME_SUCCEEDED = "succeeded" // The goal was met by the deadline
+	FUNDING_OUTCOME_FAILED    = "failed"    // The goal wasn't met by the deadline
+	FUNDING_OUTCOME_CANCELED  = "canceled"  // The creator canceled the campaign before its deadline
+)
+
+// Returns true if mode is one of the FUNDING_MODE_* constants
+func IsValidFundingMode(mode string) bool {
+	return mode == FUNDING_MODE_ALL_OR_NOTHING || mode == FUNDING_MODE_KEEP_WHAT_YOU_RAISE
+}
+
+// Returns true if a campaign with the funding mode may have the deadline;
+// all-or-nothing campaigns can't run longer than their authorizations last
+func IsAllowedDeadline(fundingMode string, deadline time.Time) bool {
+	return fundingMode != FUNDING_MODE_ALL_OR_NOTHING || !deadline.After(time.Now().Add(ALL_OR_NOTHING_MAX_DURATION))
+}
+
+// Returns true if contributions to the campaign should be captured as soon as they are made
+func (c *Campaign) CapturesImmediately() bool {
+	return c.FundingMode != FUNDING_MODE_ALL_OR_NOTHING
+}
+
+// Returns true if the campaign has raised at least its goal
+func (c *Campaign) GoalMet() bool {
+	return c.Amount.Amount >= c.Goal
+}
+
+// Returns the percentage of its goal that the campaign has raised; may exceed 100
+func (c *Campaign) PercentFunded() float64 {
+	if c.Goal <= 0 {
+		return 0
+	}
+	return float64(c.Amount.Amount) / float64(c.Goal) * 100
+}
+
+// Returns the outcome of the funding of a campaign whose deadline has passed
+func (c *Campaign) FundingResult() string {
+	if c.GoalMet() {
+		return FUNDING_OUTCOME_SUCCEEDED
+	}
+	return FUNDING_OUTCOME_FAILED
+}
+
+// Captures the authorized contributions of campaigns that met their goal; the
+// contributions of campaigns that missed it are released by the refund
+// workflow instead. Each contribution is settled on its own, so a failure is
+// simply retried the next time around
+func SettleContributions(db *sql.DB, payments PaymentProvider) error {
+	contributions, err := FindUnsettledContributions(db)
+	if err != nil {
+		return err
+	}
+	var firstErr error
+	for _, contribution := range contributions {
+		if err = settleContribution(db, payments, contribution); err != nil {
+			Debug(fmt.Sprintf("Failed to settle contribution %d: ", contribution.Id), err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// Captures an authorized contribution to a campaign that met its goal; a
+// contribution whose capture is declined stops counting towards the campaign
+func settleContribution(db *sql.DB, payments PaymentProvider, contribution *Contribution) error {
+	status := CONTRIBUTION_STATUS_CAPTURED
+	processorFee, err := payments.CaptureCharge(contribution.StripeId)
+	if err != nil {
+		// The payment provider turned the request down, so trying again won't help
+		if IsPaymentDeclined(err) {
+			status = CONTRIBUTION_STATUS_FAILED
+		} else {
+			return err
+		}
+	}
+	// Record the outcome, and move captured money into escrow
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	// A Stripe webhook may have recorded the outcome in the meantime
+	current, err := GetContributionForUpdate(tx, contribution.Id)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if current.Status != CONTRIBUTION_STATUS_AUTHORIZED {
+		return tx.Rollback()
+	}
+	if status == CONTRIBUTION_STATUS_CAPTURED {
+		err = captureContribution(tx, current, processorFee)
+	} else {
+		err = withdrawContribution(tx, current, status)
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Records the capture of an authorized contribution along with what the
+// payment processor kept of it, and moves the money into escrow. The campaign's
+// net amount was counted before the processor's fee was known, so it is
+// corrected as well
+func captureContribution(tx *sql.Tx, contribution *Contribution, processorFee Money) error {
+	currency := contribution.Amount.Currency
+	platformFee, net := deductFees(contribution.Amount, processorFee, NewMoney(contribution.PlatformFee, currency))
+	if err := SetContributionStatus(tx, contribution.Id, CONTRIBUTION_STATUS_CAPTURED); err != nil {
+		return err
+	}
+	if err := SetContributionFees(tx, contribution.Id, processorFee, platformFee, net); err != nil {
+		return err
+	}
+	if err := AddToCampaignAmount(tx, contribution.CampaignId, NewMoney(0, currency), NewMoney(net.Amount-contribution.Net, currency)); err != nil {
+		return err
+	}
+	return PostContribution(tx, contribution)
+}
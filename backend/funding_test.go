@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// Sets up an all-or-nothing campaign with one authorized contribution, ready to be settled
+func newTestSettlement(t *testing.T) (*testFixture, *Contribution) {
+	f := newTestFixture(t, FUNDING_MODE_ALL_OR_NOTHING)
+	return f, newTestContribution(t, f.db, f.payments, f.campaign, f.contributor, 5000)
+}
+
+func TestSettleContributionCaptures(t *testing.T) {
+	f, contribution := newTestSettlement(t)
+	defer f.db.Close()
+
+	if err := settleContribution(f.db, f.payments, contribution); err != nil {
+		t.Fatal(err)
+	}
+	contribution = getTestContribution(t, f.db, contribution.Id)
+	if contribution.Status != CONTRIBUTION_STATUS_CAPTURED {
+		t.Errorf("status is %q, want %q", contribution.Status, CONTRIBUTION_STATUS_CAPTURED)
+	}
+	if !f.payments.charges[contribution.StripeId].captured {
+		t.Errorf("charge %q wasn't captured", contribution.StripeId)
+	}
+	// The processor's fee is only known once the charge is captured
+	fee := f.payments.charges[contribution.StripeId].fee
+	if fee.Amount == 0 || contribution.ProcessorFee != fee.Amount {
+		t.Errorf("processor fee is %d, want the %d that was kept", contribution.ProcessorFee, fee.Amount)
+	}
+	if want := 5000 - contribution.ProcessorFee - contribution.PlatformFee; contribution.Net != want {
+		t.Errorf("net is %d, want %d", contribution.Net, want)
+	}
+	if campaign := getTestCampaign(t, f.db, f.campaign.Id); campaign.Net != contribution.Net {
+		t.Errorf("campaign net is %d, want %d", campaign.Net, contribution.Net)
+	}
+	if balance := getTestBalance(t, f.db, LEDGER_ACCOUNT_CAMPAIGN_ESCROW, f.campaign.Id); balance != 5000 {
+		t.Errorf("escrow holds %d, want 5000", balance)
+	}
+	checkTestLedger(t, f.db)
+}
+
+func TestSettleContributionWithdrawsDecline(t *testing.T) {
+	f, contribution := newTestSettlement(t)
+	defer f.db.Close()
+
+	f.payments.FailNext(FAKE_PAYMENT_OP_CAPTURE_CHARGE, fakeDecline(FAKE_PAYMENT_CODE_DECLINED))
+	if err := settleContribution(f.db, f.payments, contribution); err != nil {
+		t.Fatal(err)
+	}
+	contribution = getTestContribution(t, f.db, contribution.Id)
+	if contribution.Status != CONTRIBUTION_STATUS_FAILED {
+		t.Errorf("status is %q, want %q", contribution.Status, CONTRIBUTION_STATUS_FAILED)
+	}
+	if contribution.Active {
+		t.Error("the declined contribution wasn't withdrawn")
+	}
+	// It no longer counts towards the campaign
+	if campaign := getTestCampaign(t, f.db, f.campaign.Id); campaign.Amount.Amount != 0 || campaign.Net != 0 {
+		t.Errorf("campaign raised %d (%d net), want nothing", campaign.Amount.Amount, campaign.Net)
+	}
+	if balance := getTestBalance(t, f.db, LEDGER_ACCOUNT_CAMPAIGN_ESCROW, f.campaign.Id); balance != 0 {
+		t.Errorf("escrow holds %d, want nothing", balance)
+	}
+	checkTestLedger(t, f.db)
+}
+
+func TestSettleContributionKeepsRetryableFailure(t *testing.T) {
+	f, contribution := newTestSettlement(t)
+	defer f.db.Close()
+
+	f.payments.FailNext(FAKE_PAYMENT_OP_CAPTURE_CHARGE, errors.New(ERR_FAKE_PAYMENT_UNAVAILABLE))
+	if err := settleContribution(f.db, f.payments, contribution); err == nil {
+		t.Fatal("settleContribution succeeded, want the capture's error")
+	}
+	// The capture is tried again later
+	contribution = getTestContribution(t, f.db, contribution.Id)
+	if contribution.Status != CONTRIBUTION_STATUS_AUTHORIZED || !contribution.Active {
+		t.Errorf("status is %q (active %v), want an active %q contribution", contribution.Status, contribution.Active, CONTRIBUTION_STATUS_AUTHORIZED)
+	}
+	if campaign := getTestCampaign(t, f.db, f.campaign.Id); campaign.Amount.Amount != 5000 {
+		t.Errorf("campaign raised %d, want 5000", campaign.Amount.Amount)
+	}
+	checkTestLedger(t, f.db)
+}
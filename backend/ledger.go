@@ -0,0 +1,247 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+const (
+	CMD_CHECK_LEDGER = "check-ledger" // The subcommand that checks the ledger for inconsistencies instead of running the server
+
+	// Descriptions of journal entries
+	JOURNAL_DESC_CONTRIBUTION    = "Contribution %d from user %d to campaign %d"
+	JOURNAL_DESC_REFUND          = "Refund of contribution %d to user %d from campaign %d"
+	JOURNAL_DESC_PAYOUT          = "Payout of campaign %d to user %d"
+	JOURNAL_DESC_DISPUTE         = "Dispute of contribution %d by user %d to campaign %d"
+	JOURNAL_DESC_FEES            = "Fees on campaign %d"
+	JOURNAL_DESC_PAYOUT_REVERSAL = "Reversal of the payout of campaign %d to user %d"
+
+	// Problems the ledger checker can find
+	LEDGER_VIOLATION_UNBALANCED_ENTRY  = "Journal entry %d adds up to %d instead of 0"
+	LEDGER_VIOLATION_CAMPAIGN_AMOUNT   = "Campaign %d has an amount of %d but its contributions add up to %d"
+	LEDGER_VIOLATION_CAMPAIGN_ESCROW   = "Campaign %d has %d in captured contributions but %d was posted to its escrow"
+	LEDGER_VIOLATION_UNPOSTED_CHARGE   = "Contribution %d was captured with charge \"%s\" but no journal entry records it"
+	LEDGER_VIOLATION_MISMATCHED_CHARGE = "Journal entry %d records charge \"%s\" but contribution %d was made with charge \"%s\""
+
+	SQL_SELECT_UNBALANCED_JOURNAL_ENTRIES = `
+		SELECT ` + FIELD_JOURNAL_LINE_ENTRY_ID + `, SUM(amount) FROM ` + TABLE_NAME_JOURNAL_LINE + `
+		GROUP BY ` + FIELD_JOURNAL_LINE_ENTRY_ID + ` HAVING SUM(amount) <> 0 ORDER BY ` + FIELD_JOURNAL_LINE_ENTRY_ID + `;
+	`
+	SQL_SELECT_MISMATCHED_CAMPAIGN_AMOUNTS = `
+		SELECT campaigns.id, campaigns.amount, COALESCE(SUM(contributions.amount), 0) FROM ` + TABLE_NAME_CAMPAIGN + ` campaigns
+			LEFT JOIN ` + TABLE_NAME_CONTRIBUTION + ` contributions ON (contributions.campaign_id = campaigns.id) AND contributions.active
+		GROUP BY campaigns.id HAVING campaigns.amount <> COALESCE(SUM(contributions.amount), 0) ORDER BY campaigns.id;
+	`
+	SQL_SELECT_MISMATCHED_CAMPAIGN_ESCROWS = `
+		SELECT campaigns.id, captured.total, posted.total FROM ` + TABLE_NAME_CAMPAIGN + ` campaigns,
+			LATERAL (
+				SELECT COALESCE(SUM(amount), 0) AS total FROM ` + TABLE_NAME_CONTRIBUTION + `
+				WHERE (campaign_id = campaigns.id) AND (status = '` + CONTRIBUTION_STATUS_CAPTURED + `') AND active
+			) captured,
+			LATERAL (
+				SELECT COALESCE(SUM(lines.amount), 0) AS total FROM ` + TABLE_NAME_JOURNAL_LINE + ` lines
+					INNER JOIN ` + TABLE_NAME_JOURNAL_ENTRY + ` entries ON lines.entry_id = entries.id
+					INNER JOIN ` + TABLE_NAME_LEDGER_ACCOUNT + ` accounts ON lines.account_id = accounts.id
+				WHERE (accounts.type = '` + LEDGER_ACCOUNT_CAMPAIGN_ESCROW + `') AND (accounts.owner_id = campaigns.id)
+					AND (entries.type IN ('` + JOURNAL_ENTRY_CONTRIBUTION + `', '` + JOURNAL_ENTRY_REFUND + `'))
+			) posted
+		WHERE captured.total <> posted.total ORDER BY campaigns.id;
+	`
+	SQL_SELECT_UNPOSTED_CHARGES = `
+		SELECT id, stripe_id FROM ` + TABLE_NAME_CONTRIBUTION + ` contributions
+		WHERE (status = '` + CONTRIBUTION_STATUS_CAPTURED + `') AND active AND NOT EXISTS (
+			SELECT 1 FROM ` + TABLE_NAME_JOURNAL_ENTRY + ` entries
+			WHERE (entries.contribution_id = contributions.id) AND (entries.type = '` + JOURNAL_ENTRY_CONTRIBUTION + `')
+		) ORDER BY id;
+	`
+	SQL_SELECT_MISMATCHED_CHARGES = `
+		SELECT entries.id, entries.stripe_id, contributions.id, contributions.stripe_id FROM ` + TABLE_NAME_JOURNAL_ENTRY + ` entries
+			INNER JOIN ` + TABLE_NAME_CONTRIBUTION + ` contributions ON entries.contribution_id = contributions.id
+		WHERE (entries.type = '` + JOURNAL_ENTRY_CONTRIBUTION + `') AND (entries.stripe_id <> contributions.stripe_id) ORDER BY entries.id;
+	`
+)
+
+// Posts the journal entry for a captured contribution: the money moves from
+// the contributor into the campaign's escrow
+func PostContribution(db Queryable, contribution *Contribution) error {
+	_, err := PostJournalEntry(
+		db,
+		JOURNAL_ENTRY_CONTRIBUTION,
+		fmt.Sprintf(JOURNAL_DESC_CONTRIBUTION, contribution.Id, contribution.ContributorId, contribution.CampaignId),
+		contribution.StripeId,
+		sql.NullInt64{Int64: contribution.Id, Valid: true},
+		contribution.CampaignId,
+		LedgerPosting{LEDGER_ACCOUNT_CONTRIBUTOR, contribution.ContributorId, NewMoney(-contribution.Amount.Amount, contribution.Amount.Currency)},
+		LedgerPosting{LEDGER_ACCOUNT_CAMPAIGN_ESCROW, contribution.CampaignId, contribution.Amount},
+	)
+	return err
+}
+
+// Posts the journal entry for a refunded contribution: the money moves from
+// the campaign's escrow back to the contributor. The payment processor keeps
+// its fee on the refunded charge, so the platform pays it out of its own fees
+func PostRefund(db Queryable, contribution *Contribution, refundId string) error {
+	currency := contribution.Amount.Currency
+	postings := []LedgerPosting{
+		{LEDGER_ACCOUNT_CAMPAIGN_ESCROW, contribution.CampaignId, NewMoney(-contribution.Amount.Amount, currency)},
+		{LEDGER_ACCOUNT_CONTRIBUTOR, contribution.ContributorId, contribution.Amount},
+	}
+	if contribution.ProcessorFee != 0 {
+		postings = append(postings,
+			LedgerPosting{LEDGER_ACCOUNT_PLATFORM_FEES, 0, NewMoney(-contribution.ProcessorFee, currency)},
+			LedgerPosting{LEDGER_ACCOUNT_PROCESSOR_FEES, 0, NewMoney(contribution.ProcessorFee, currency)},
+		)
+	}
+	_, err := PostJournalEntry(
+		db,
+		JOURNAL_ENTRY_REFUND,
+		fmt.Sprintf(JOURNAL_DESC_REFUND, contribution.Id, contribution.ContributorId, contribution.CampaignId),
+		refundId,
+		sql.NullInt64{Int64: contribution.Id, Valid: true},
+		contribution.CampaignId,
+		postings...,
+	)
+	return err
+}
+
+// Posts the journal entry for a disputed contribution: the contributor's bank
+// takes the money back out of the campaign's escrow
+func PostDispute(db Queryable, contribution *Contribution, disputeId string) error {
+	_, err := PostJournalEntry(
+		db,
+		JOURNAL_ENTRY_REFUND,
+		fmt.Sprintf(JOURNAL_DESC_DISPUTE, contribution.Id, contribution.ContributorId, contribution.CampaignId),
+		disputeId,
+		sql.NullInt64{Int64: contribution.Id, Valid: true},
+		contribution.CampaignId,
+		LedgerPosting{LEDGER_ACCOUNT_CAMPAIGN_ESCROW, contribution.CampaignId, NewMoney(-contribution.Amount.Amount, contribution.Amount.Currency)},
+		LedgerPosting{LEDGER_ACCOUNT_CONTRIBUTOR, contribution.ContributorId, contribution.Amount},
+	)
+	return err
+}
+
+// Posts the journal entry for a payout: the money moves from the campaign's
+// escrow to the user whose claim won
+func PostPayout(db Queryable, campaignId int64, claimerId int64, amount Money, transferId string) error {
+	_, err := PostJournalEntry(
+		db,
+		JOURNAL_ENTRY_PAYOUT,
+		fmt.Sprintf(JOURNAL_DESC_PAYOUT, campaignId, claimerId),
+		transferId,
+		sql.NullInt64{},
+		campaignId,
+		LedgerPosting{LEDGER_ACCOUNT_CAMPAIGN_ESCROW, campaignId, NewMoney(-amount.Amount, amount.Currency)},
+		LedgerPosting{LEDGER_ACCOUNT_CLAIMER_PAYOUT, claimerId, amount},
+	)
+	return err
+}
+
+// Posts the journal entry for the fees on a campaign: the money moves from the
+// campaign's escrow to the platform and the payment processor. Does nothing if
+// there are no fees
+func PostFees(db Queryable, campaignId int64, processorFee Money, platformFee Money) error {
+	total, err := processorFee.Add(platformFee)
+	if err != nil || total.Amount == 0 {
+		return err
+	}
+	postings := []LedgerPosting{{LEDGER_ACCOUNT_CAMPAIGN_ESCROW, campaignId, NewMoney(-total.Amount, total.Currency)}}
+	if processorFee.Amount != 0 {
+		postings = append(postings, LedgerPosting{LEDGER_ACCOUNT_PROCESSOR_FEES, 0, processorFee})
+	}
+	if platformFee.Amount != 0 {
+		postings = append(postings, LedgerPosting{LEDGER_ACCOUNT_PLATFORM_FEES, 0, platformFee})
+	}
+	_, err = PostJournalEntry(
+		db,
+		JOURNAL_ENTRY_FEE,
+		fmt.Sprintf(JOURNAL_DESC_FEES, campaignId),
+		"",
+		sql.NullInt64{},
+		campaignId,
+		postings...,
+	)
+	return err
+}
+
+// Posts the journal entry for a transfer that failed to reach the claimer:
+// the money moves back from the claimer to the campaign's escrow
+func PostPayoutReversal(db Queryable, campaignId int64, claimerId int64, amount Money, transferId string) error {
+	_, err := PostJournalEntry(
+		db,
+		JOURNAL_ENTRY_PAYOUT,
+		fmt.Sprintf(JOURNAL_DESC_PAYOUT_REVERSAL, campaignId, claimerId),
+		transferId,
+		sql.NullInt64{},
+		campaignId,
+		LedgerPosting{LEDGER_ACCOUNT_CLAIMER_PAYOUT, claimerId, NewMoney(-amount.Amount, amount.Currency)},
+		LedgerPosting{LEDGER_ACCOUNT_CAMPAIGN_ESCROW, campaignId, amount},
+	)
+	return err
+}
+
+// Checks that the ledger is consistent with itself, with the campaign totals
+// and with the Stripe charges behind contributions; returns a description of
+// every problem found
+func CheckLedger(db Queryable) ([]string, error) {
+	violations := make([]string, 0)
+	// Reads every row of a query and describes each one with a violation template
+	check := func(query string, template string, newRow func() []interface{}) error {
+		rows, err := db.Query(query)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			row := newRow()
+			if err = rows.Scan(row...); err != nil {
+				return err
+			}
+			values := make([]interface{}, len(row))
+			for i, field := range row {
+				switch v := field.(type) {
+				case *int64:
+					values[i] = *v
+				case *string:
+					values[i] = *v
+				}
+			}
+			violations = append(violations, fmt.Sprintf(template, values...))
+		}
+		return rows.Err()
+	}
+	ints := func(n int) func() []interface{} {
+		return func() []interface{} {
+			row := make([]interface{}, n)
+			for i := range row {
+				row[i] = new(int64)
+			}
+			return row
+		}
+	}
+
+	err := check(SQL_SELECT_UNBALANCED_JOURNAL_ENTRIES, LEDGER_VIOLATION_UNBALANCED_ENTRY, ints(2))
+	if err != nil {
+		return nil, err
+	}
+	err = check(SQL_SELECT_MISMATCHED_CAMPAIGN_AMOUNTS, LEDGER_VIOLATION_CAMPAIGN_AMOUNT, ints(3))
+	if err != nil {
+		return nil, err
+	}
+	err = check(SQL_SELECT_MISMATCHED_CAMPAIGN_ESCROWS, LEDGER_VIOLATION_CAMPAIGN_ESCROW, ints(3))
+	if err != nil {
+		return nil, err
+	}
+	err = check(SQL_SELECT_UNPOSTED_CHARGES, LEDGER_VIOLATION_UNPOSTED_CHARGE, func() []interface{} {
+		return []interface{}{new(int64), new(string)}
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = check(SQL_SELECT_MISMATCHED_CHARGES, LEDGER_VIOLATION_MISMATCHED_CHARGE, func() []interface{} {
+		return []interface{}{new(int64), new(string), new(int64), new(string)}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return violations, nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Finishes every campaign whose deadline has passed, records whether it met its
+// goal, and opens it up for claims unless it was all-or-nothing and failed, in
+// which case its contributions are refunded
+func FinishExpiredCampaigns(db *sql.DB) error {
+	campaignIds, err := FindExpiredCampaignIds(db, time.Now())
+	if err != nil {
+		return err
+	}
+	// Finish each campaign on its own so that one failure doesn't hold up the rest
+	var firstErr error
+	for _, campaignId := range campaignIds {
+		if err = finishExpiredCampaign(db, campaignId); err != nil {
+			Debug(fmt.Sprintf("Failed to finish campaign %d: ", campaignId), err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// Finishes a single campaign if its deadline has passed; does nothing if it was already finished
+func finishExpiredCampaign(db *sql.DB, campaignId int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	campaign, err := GetCampaignForUpdate(tx, campaignId)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if campaign.Finished || time.Now().Before(campaign.Deadline) {
+		return tx.Rollback()
+	}
+	var (
+		outcome    = campaign.FundingResult()
+		phase      = CAMPAIGN_PHASE_CLAIMING
+		eventTypes = []string{EVENT_CAMPAIGN_FINISHED, EVENT_CAMPAIGN_FUNDED, EVENT_CAMPAIGN_CLAIMS_OPENED}
+	)
+	if outcome == FUNDING_OUTCOME_FAILED {
+		eventTypes = []string{EVENT_CAMPAIGN_FINISHED, EVENT_CAMPAIGN_FUNDING_FAILED}
+		// Keep-what-you-raise campaigns still have money to claim
+		if campaign.CapturesImmediately() {
+			eventTypes = append(eventTypes, EVENT_CAMPAIGN_CLAIMS_OPENED)
+		} else {
+			phase = CAMPAIGN_PHASE_FAILED
+		}
+	}
+	if err = FinishCampaign(tx, campaign.Id, phase, outcome); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if phase == CAMPAIGN_PHASE_FAILED {
+		if _, err = ScheduleCampaignRefunds(tx, campaign.Id); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	// Record what happened along with the change itself
+	events := make([]*CampaignEvent, 0, len(eventTypes))
+	for _, eventType := range eventTypes {
+		event, err := RecordCampaignEvent(tx, eventType, campaign.Id)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		events = append(events, event)
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	EmitCampaignEvents(events...)
+	return nil
+}
+
+// Stops accepting claims to campaigns whose claim period is over without any
+// claim having won, and refunds their contributions. Campaigns with claims
+// still being voted on are left until those claims are resolved
+func CloseUnclaimedCampaigns(db *sql.DB, claimPeriod time.Duration) error {
+	cutoff := time.Now().Add(-claimPeriod)
+	campaignIds, err := FindUnclaimedCampaignIds(db, cutoff)
+	if err != nil {
+		return err
+	}
+	// Close each campaign on its own so that one failure doesn't hold up the rest
+	var firstErr error
+	for _, campaignId := range campaignIds {
+		if err = closeUnclaimedCampaign(db, campaignId, claimPeriod); err != nil {
+			Debug(fmt.Sprintf("Failed to close unclaimed campaign %d: ", campaignId), err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// Closes a single campaign to claims and schedules the refunds of its
+// contributions; does nothing if it was claimed in the meantime
+func closeUnclaimedCampaign(db *sql.DB, campaignId int64, claimPeriod time.Duration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	campaign, err := GetCampaignForUpdate(tx, campaignId)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if campaign.Phase != CAMPAIGN_PHASE_CLAIMING || campaign.ClaimerId.Valid || time.Now().Before(campaign.ClaimsCloseAt(claimPeriod)) {
+		return tx.Rollback()
+	}
+	if err = SetCampaignPhase(tx, campaign.Id, CAMPAIGN_PHASE_UNCLAIMED); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if _, err = ScheduleCampaignRefunds(tx, campaign.Id); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	// Record what happened along with the change itself
+	event, err := RecordCampaignEvent(tx, EVENT_CAMPAIGN_UNCLAIMED, campaign.Id)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	EmitCampaignEvents(event)
+	return nil
+}
+
+// Cancels a campaign for its creator while it is still raising money; its
+// contributions are refunded and its pledges canceled
+func CancelCampaign(db *sql.DB, campaignId int64, creatorId int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	// Lock the campaign so that nobody can contribute while it is being canceled
+	campaign, err := GetCampaignForUpdate(tx, campaignId)
+	if err == nil && !campaign.Active {
+		err = PUBERR_ENTITY_NOT_FOUND
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if campaign.CreatorId != creatorId {
+		_ = tx.Rollback()
+		return PUBERR_NOT_CAMPAIGN_CREATOR
+	}
+	// Once the deadline passes the money belongs to whoever claims it, even if
+	// the campaign hasn't been finished yet
+	if !campaign.IsOpen() || campaign.Phase != CAMPAIGN_PHASE_FUNDING {
+		_ = tx.Rollback()
+		return PUBERR_CAMPAIGN_NOT_CANCELABLE
+	}
+	if err = FinishCampaign(tx, campaign.Id, CAMPAIGN_PHASE_CANCELED, FUNDING_OUTCOME_CANCELED); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if _, err = ScheduleCampaignRefunds(tx, campaign.Id); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err = CancelCampaignPledges(tx, campaign.Id, ERR_CAMPAIGN_CANCELED); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	// Record what happened along with the change itself
+	event, err := RecordCampaignEvent(tx, EVENT_CAMPAIGN_CANCELED, campaign.Id)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	EmitCampaignEvents(event)
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	MAILER_FILE = "file" // Emails are written to files in a local directory; for development and tests
+	MAILER_SMTP = "smtp" // Emails are handed to an SMTP server, such as a local sink that catches them
+
+	DEFAULT_MAILER    = MAILER_FILE
+	DEFAULT_MAIL_DIR  = "mail"                // The directory emails are written to when not otherwise specified
+	DEFAULT_MAIL_FROM = "noreply@equitize.io" // Who emails are from when not otherwise specified
+)
+
+// Mailer sends emails to users. Emails are plain text
+type Mailer interface {
+	// Sends an email to a single address
+	Send(to string, subject string, body string) error
+}
+
+// FileMailer writes every email to its own file in a directory instead of sending it
+type FileMailer struct {
+	dir  string // The directory emails are written to
+	from string // The address emails are from
+}
+
+// SMTPMailer hands emails to an SMTP server without authenticating, so it is
+// meant for a server that can be trusted, such as a local sink
+type SMTPMailer struct {
+	addr string // The host and port of the SMTP server
+	from string // The address emails are from
+}
+
+// Creates the mailer chosen by the environment
+func NewMailer(env *Environment) (Mailer, error) {
+	switch env.mailer {
+	case MAILER_FILE:
+		Debug("Emails are written to ", env.mailDir, " instead of being sent")
+		return NewFileMailer(env.mailDir, env.mailFrom)
+	case MAILER_SMTP:
+		return &SMTPMailer{addr: env.smtpAddr, from: env.mailFrom}, nil
+	default:
+		return nil, errors.New(fmt.Sprintf(ERR_ENV_VAR_MISSING, ENV_VAR_MAILER))
+	}
+}
+
+// Creates a file mailer; the directory is created if it doesn't exist yet
+func NewFileMailer(dir string, from string) (*FileMailer, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileMailer{dir: dir, from: from}, nil
+}
+
+func (m *FileMailer) Send(to string, subject string, body string) error {
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), strings.Map(safeFileNameRune, to))
+	return writeFileExclusive(filepath.Join(m.dir, name), formatEmail(m.from, to, subject, body))
+}
+
+func (m *SMTPMailer) Send(to string, subject string, body string) error {
+	return smtp.SendMail(m.addr, nil, m.from, []string{to}, formatEmail(m.from, to, subject, body))
+}
+
+// Puts together the headers and body of a plain text email
+func formatEmail(from string, to string, subject string, body string) []byte {
+	return []byte("From: " + from + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" +
+		strings.Replace(body, "\n", "\r\n", -1))
+}
+
+// Replaces the characters of an email address that don't belong in a file name
+func safeFileNameRune(r rune) rune {
+	if IsCharLowerCase(r) || IsCharUpperCase(r) || IsCharDigit(r) || r == '@' || r == '.' || r == '-' || r == '_' {
+		return r
+	}
+	return '_'
+}
+
+// Writes a new file, failing if it already exists; emails may contain reset
+// tokens, so only the owner can read them
+func writeFileExclusive(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err != nil {
+		_ = file.Close()
+		return err
+	}
+	return file.Close()
+}
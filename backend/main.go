@@ -1,11 +1,43 @@
 package main
 
 import (
+	"database/sql"
+	"fmt"
 	"github.com/go-martini/martini"
 	"log"
+	"os"
 )
 
 func main() {
+	// Run a subcommand instead of the server if asked to
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case CMD_MIGRATE:
+			migrate(os.Args[2:])
+			return
+		case CMD_CHECK_LEDGER:
+			checkLedger()
+			return
+		case CMD_REPLAY_STRIPE_EVENTS:
+			replayStripeEvents(os.Args[2:])
+			return
+		case CMD_SEND_STRIPE_FIXTURE:
+			sendStripeFixture(os.Args[2:])
+			return
+		case CMD_SET_CAMPAIGN_FEES:
+			setCampaignFees(os.Args[2:])
+			return
+		case CMD_SOFT_DELETE:
+			runAdminCommand(RunSoftDeleteCommand, os.Args[2:])
+			return
+		case CMD_RESTORE:
+			runAdminCommand(RunRestoreCommand, os.Args[2:])
+			return
+		case CMD_SET_ADMIN:
+			runAdminCommand(RunSetAdminCommand, os.Args[2:])
+			return
+		}
+	}
 	// Read environment variables
 	env, err := NewEnvironment()
 	if err != nil {
@@ -16,12 +48,133 @@ func main() {
 	if err != nil {
 		log.Fatalln(ERR_COULDNT_START + err.Error())
 	}
-	// Setup the Stripe API
-	SetupStripe(env)
+	// Setup the payment provider
+	payments, err := NewPaymentProvider(env)
+	if err != nil {
+		log.Fatalln(ERR_COULDNT_START + err.Error())
+	}
+	// Setup the mailer
+	mailer, err := NewMailer(env)
+	if err != nil {
+		log.Fatalln(ERR_COULDNT_START + err.Error())
+	}
+	// Run the campaign lifecycle in the background
+	scheduler := NewScheduler(db, SCHEDULER_INTERVAL)
+	scheduler.Add("finish expired campaigns", FinishExpiredCampaigns)
+	scheduler.Add("settle contributions", func(db *sql.DB) error {
+		return SettleContributions(db, payments)
+	})
+	scheduler.Add("process stripe events", ProcessStripeEvents)
+	scheduler.Add("resolve claims", func(db *sql.DB) error {
+		return ResolveClaims(db, env.claimVotingWindow)
+	})
+	scheduler.Add("close unclaimed campaigns", func(db *sql.DB) error {
+		return CloseUnclaimedCampaigns(db, env.claimPeriod)
+	})
+	scheduler.Add("refund contributions", func(db *sql.DB) error {
+		return RefundContributions(db, payments)
+	})
+	scheduler.Add("pay out campaigns", func(db *sql.DB) error {
+		return PayOutCampaigns(db, payments)
+	})
+	scheduler.Add("charge pledges", func(db *sql.DB) error {
+		return ChargePledges(db, payments, env)
+	})
+	scheduler.Add("delete expired idempotency keys", DeleteExpiredIdempotencyKeys)
+	scheduler.Start()
 	// Setup server
 	m := martini.Classic()
-	SetupMiddleware(m, db, env)
+	SetupMiddleware(m, db, env, payments, mailer)
 	SetupRoutes(m, db, env)
 	// Start the server
 	m.Run()
 }
+
+// Runs the migrate subcommand; only the database environment variables are needed
+func migrate(args []string) {
+	db := openSubcommandDatabase()
+	if err := RunMigrateCommand(db, args); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// Runs the set-campaign-fees subcommand; only the database environment variables are needed
+func setCampaignFees(args []string) {
+	db := openSubcommandDatabase()
+	if err := RunSetCampaignFeesCommand(db, args); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// Runs the soft-delete, restore or set-admin subcommand; only the database environment variables are needed
+func runAdminCommand(run func(*sql.DB, []string) error, args []string) {
+	db := openSubcommandDatabase()
+	if err := run(db, args); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// Runs the check-ledger subcommand; exits with an error if the ledger is inconsistent
+func checkLedger() {
+	db := openSubcommandDatabase()
+	violations, err := CheckLedger(db)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for _, violation := range violations {
+		fmt.Println(violation)
+	}
+	if len(violations) > 0 {
+		log.Fatalf(ERR_LEDGER_INCONSISTENT, len(violations))
+	}
+	fmt.Println("The ledger is consistent")
+}
+
+// Runs the replay-stripe-events subcommand; processes the Stripe events with
+// the specified ids again, or every unprocessed event if no ids are specified
+func replayStripeEvents(stripeIds []string) {
+	db := openSubcommandDatabase()
+	if err := ReplayStripeEvents(db, stripeIds); err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Println("Replayed the Stripe events")
+}
+
+// Runs the send-stripe-fixture subcommand; signs a fixture from fixtures/stripe
+// with STRIPE_WEBHOOK_SECRET and posts it to the server listening on PORT
+func sendStripeFixture(args []string) {
+	if len(args) < 1 || len(args) > 2 {
+		log.Fatalln(ERR_SEND_STRIPE_FIXTURE_USAGE)
+	}
+	secret := os.Getenv(ENV_VAR_STRIPE_WEBHOOK_SECRET)
+	if secret == "" {
+		log.Fatalf(ERR_ENV_VAR_MISSING, ENV_VAR_STRIPE_WEBHOOK_SECRET)
+	}
+	port := os.Getenv(ENV_VAR_PORT)
+	if port == "" {
+		log.Fatalf(ERR_ENV_VAR_MISSING, ENV_VAR_PORT)
+	}
+	objectId := ""
+	if len(args) > 1 {
+		objectId = args[1]
+	}
+	res, body, err := SendStripeFixture(args[0], objectId, secret, "http://localhost:"+port+API_STRIPE_WEBHOOK)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Println(res.Status)
+	fmt.Println(string(body))
+}
+
+// Connects to the database for a subcommand; only the database environment variables are needed
+func openSubcommandDatabase() *sql.DB {
+	env, err := NewDatabaseEnvironment()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	db, err := OpenDatabase(env)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return db
+}
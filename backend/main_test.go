@@ -0,0 +1,182 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	ENV_VAR_TEST_DB_NAME = "TEST_DB_NAME" // Name of the environment variable for the database tests run against; tests that need one are skipped without it
+	ENV_VAR_TEST_DB_USER = "TEST_DB_USER" // Name of the environment variable for the user of the test database
+	ENV_VAR_TEST_DB_PASS = "TEST_DB_PASS" // Name of the environment variable for the password of the test database
+
+	TEST_CURRENCY = "USD"
+
+	SQL_SELECT_TEST_TABLES = `
+		SELECT tablename FROM pg_tables
+		WHERE (schemaname = 'public') AND (tablename <> '` + TABLE_NAME_SCHEMA_MIGRATION + `');
+	`
+)
+
+var (
+	testProcessorFees = FeeSchedule{Rate: 290, Fixed: 30} // What the payment processor keeps in tests
+	testPlatformFees  = FeeSchedule{Rate: 500, Fixed: 0}  // What the platform keeps in tests
+)
+
+// Connects to the test database, brings its schema up to date and empties
+// every table. The database is wiped, so it must not be used for anything
+// else. Skips the test if there is no test database
+func openTestDatabase(t *testing.T) *sql.DB {
+	dbName := os.Getenv(ENV_VAR_TEST_DB_NAME)
+	if dbName == "" {
+		t.Skip("The " + ENV_VAR_TEST_DB_NAME + " environment variable is needed to run tests against a database")
+	}
+	dbUser := os.Getenv(ENV_VAR_TEST_DB_USER)
+	if dbUser == "" {
+		dbUser = "postgres"
+	}
+	db, err := OpenDatabase(&Environment{dbName: dbName, dbUser: dbUser, dbPass: os.Getenv(ENV_VAR_TEST_DB_PASS)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = MigrateUp(db, LatestMigrationVersion()); err != nil {
+		t.Fatal(err)
+	}
+	// Start every test from nothing
+	rows, err := db.Query(SQL_SELECT_TEST_TABLES)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables := make([]string, 0)
+	for rows.Next() {
+		var table string
+		if err = rows.Scan(&table); err != nil {
+			t.Fatal(err)
+		}
+		tables = append(tables, table)
+	}
+	_ = rows.Close()
+	if len(tables) > 0 {
+		if _, err = db.Exec("TRUNCATE " + strings.Join(tables, ", ") + " RESTART IDENTITY CASCADE;"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+// A campaign and a would-be contributor to it, in an empty test database,
+// with payments made by a fake payment provider
+type testFixture struct {
+	db          *sql.DB
+	payments    *FakePaymentProvider
+	creator     *User
+	contributor *User
+	campaign    *Campaign
+}
+
+// Sets up a campaign of the given funding mode that is still raising money,
+// along with a user to contribute to it. Skips the test if there is no test
+// database; the caller has to close it
+func newTestFixture(t *testing.T, fundingMode string) *testFixture {
+	f := &testFixture{db: openTestDatabase(t), payments: NewFakePaymentProvider(testProcessorFees)}
+	f.creator = newTestUser(t, f.db, f.payments, "creator@example.com")
+	f.contributor = newTestUser(t, f.db, f.payments, "contributor@example.com")
+	f.campaign = newTestCampaign(t, f.db, f.creator.Id, fundingMode)
+	return f
+}
+
+// Creates a user with a customer at the payment provider; returns the user
+func newTestUser(t *testing.T, db *sql.DB, payments PaymentProvider, email string) *User {
+	stripeId, err := payments.NewCustomer(email, 0, "Test", "User")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := CreateNewUser(db, "Test", "User", email, "", stripeId, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := GetUser(db, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// Creates a campaign of the creator that is still raising money; returns the campaign
+func newTestCampaign(t *testing.T, db *sql.DB, creatorId int64, fundingMode string) *Campaign {
+	id, err := CreateNewCampaign(db, "Test campaign", "", "", "", TEST_CURRENCY, 10000, fundingMode, time.Now().Add(time.Hour*24), creatorId, DefaultVotingRules())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return getTestCampaign(t, db, id)
+}
+
+// Charges the contributor and records the contribution the way contributing
+// does, capturing the charge unless the campaign is all-or-nothing; returns the contribution
+func newTestContribution(t *testing.T, db *sql.DB, payments PaymentProvider, campaign *Campaign, contributor *User, units int64) *Contribution {
+	amount := NewMoney(units, campaign.Amount.Currency)
+	status := CONTRIBUTION_STATUS_CAPTURED
+	if !campaign.CapturesImmediately() {
+		status = CONTRIBUTION_STATUS_AUTHORIZED
+	}
+	chargeId, processorFee, err := payments.NewCharge(contributor.StripeId, amount, campaign.CapturesImmediately(), "Test contribution", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	platformFee, net := SplitContribution(amount, processorFee, testPlatformFees)
+	id, err := CreateNewContribution(db, amount, processorFee, platformFee, net, chargeId, status, contributor.Id, campaign.Id, sql.NullInt64{}, sql.NullInt64{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	contribution := getTestContribution(t, db, id)
+	if status == CONTRIBUTION_STATUS_CAPTURED {
+		if err = PostContribution(db, contribution); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = AddToCampaignAmount(db, campaign.Id, amount, net); err != nil {
+		t.Fatal(err)
+	}
+	return contribution
+}
+
+// Reads a campaign as it is now, soft deleted or not
+func getTestCampaign(t *testing.T, db *sql.DB, id int64) *Campaign {
+	campaign, err := GetCampaignIncludingDeleted(db, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return campaign
+}
+
+// Reads a contribution as it is now, withdrawn or not
+func getTestContribution(t *testing.T, db *sql.DB, id int64) *Contribution {
+	contribution, err := GetContributionIncludingDeleted(db, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return contribution
+}
+
+// Reads the balance of a ledger account in the test currency
+func getTestBalance(t *testing.T, db *sql.DB, accountType string, ownerId int64) int64 {
+	balance, err := GetLedgerBalance(db, accountType, ownerId, TEST_CURRENCY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return balance.Amount
+}
+
+// Fails the test unless the ledger is consistent
+func checkTestLedger(t *testing.T, db *sql.DB) {
+	violations, err := CheckLedger(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, violation := range violations {
+		t.Error(violation)
+	}
+}
@@ -5,13 +5,23 @@ import (
 	"github.com/go-martini/martini"
 )
 
-func SetupMiddleware(m *martini.ClassicMartini, db *sql.DB, env *Environment) {
+func SetupMiddleware(m *martini.ClassicMartini, db *sql.DB, env *Environment, payments PaymentProvider, mailer Mailer) {
 	// Add environment vars
 	m.Use(func(c martini.Context) {
 		c.Map(env)
 	})
+	// Add the payment provider
+	m.Use(func(c martini.Context) {
+		c.MapTo(payments, (*PaymentProvider)(nil))
+	})
+	// Add the mailer
+	m.Use(func(c martini.Context) {
+		c.MapTo(mailer, (*Mailer)(nil))
+	})
 	// Authentication & session management
-	m.Use(Sessionize)
+	m.Use(Sessionize(db))
+	// Replaying the responses to retried requests
+	m.Use(Idempotize(db))
 	// Bundle the responder in with req. handlers
 	m.Use(Responderize)
 }
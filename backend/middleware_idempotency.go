@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"github.com/go-martini/martini"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+const (
+	IDEMPOTENCY_KEY_HEADER     = "Idempotency-Key"     // The header clients make requests safe to retry with
+	IDEMPOTENT_REPLAYED_HEADER = "Idempotent-Replayed" // The header set on responses that were replayed
+	IDEMPOTENCY_KEY_MAX_LENGTH = 255                   // The longest idempotency key accepted
+)
+
+// The paths whose POST requests aren't made idempotent. Stripe webhooks are
+// deduplicated by event id instead, and the responses of the others hold
+// session tokens, which must not be stored
+var idempotencyExemptPaths = map[string]bool{
+	API_STRIPE_WEBHOOK: true,
+	API_AUTHENTICATE:   true,
+	API_RESET_PASSWORD: true,
+}
+
+// Records the status and body of a response as it is written
+type idempotentResponseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *idempotentResponseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *idempotentResponseRecorder) Write(data []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(data)
+	return r.ResponseWriter.Write(data)
+}
+
+// Martini middleware that makes POST requests with an Idempotency-Key header
+// safe to retry. The first response to each key of each user is saved for a
+// day and replayed to retries; a key that is reused for a different request is
+// rejected. Keys of requests without a session are scoped to the address they
+// come from. Responses with 5xx statuses aren't saved, since the handlers roll
+// back whatever they did, so those requests may simply be retried. Has to come
+// after Sessionize
+func Idempotize(db *sql.DB) martini.Handler {
+	return func(res http.ResponseWriter, req *http.Request, c martini.Context) {
+		key := req.Header.Get(IDEMPOTENCY_KEY_HEADER)
+		if key == "" || req.Method != "POST" || !strings.HasPrefix(req.URL.Path, API_PREFIX) || idempotencyExemptPaths[req.URL.Path] {
+			c.Next()
+			return
+		}
+		if len(key) > IDEMPOTENCY_KEY_MAX_LENGTH {
+			writeIdempotencyError(res, PUBERR_INVALID_IDEMPOTENCY_KEY)
+			return
+		}
+
+		// Hash the request, then put the body back for the handler
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			writeIdempotencyError(res, err)
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		hash := sha256.New()
+		hash.Write([]byte(req.Method + " " + req.URL.Path + "\n"))
+		hash.Write(body)
+		requestHash := hex.EncodeToString(hash.Sum(nil))
+
+		// Keys belong to whoever is signed in
+		var userId int64
+		if sesh := c.Get(reflect.TypeOf((*Session)(nil))); sesh.IsValid() {
+			userId = sesh.Interface().(*Session).UserId
+		} else {
+			key = anonymousIdempotencyKey(req.RemoteAddr, key)
+		}
+
+		id, claimed, err := ClaimIdempotencyKey(db, key, userId, requestHash)
+		if err != nil {
+			writeIdempotencyError(res, err)
+			return
+		}
+		if !claimed {
+			replayIdempotentResponse(db, res, userId, key, requestHash)
+			return
+		}
+
+		// Handle the request, recording the response
+		recorder := &idempotentResponseRecorder{ResponseWriter: res}
+		c.MapTo(recorder, (*http.ResponseWriter)(nil))
+		saved := false
+		defer func() {
+			// Let the request be retried if the handler panicked
+			if !saved {
+				if err := DeleteIdempotencyKey(db, id); err != nil {
+					Debug(fmt.Sprintf("Failed to release idempotency key %d: ", id), err)
+				}
+			}
+		}()
+		c.Next()
+		if recorder.status == 0 || recorder.status >= http.StatusInternalServerError {
+			return
+		}
+		err = SaveIdempotentResponse(db, id, recorder.status, res.Header().Get(ContentType), recorder.body.Bytes())
+		if err != nil {
+			Debug(fmt.Sprintf("Failed to save the response to idempotency key %d: ", id), err)
+			return
+		}
+		saved = true
+	}
+}
+
+// Scopes the idempotency key of a request without a session to the address
+// it comes from, so that anonymous clients can't collide with each other's
+// keys. The result is a hash, so it is no longer than the longest key
+func anonymousIdempotencyKey(remoteAddr string, key string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	sum := sha256.Sum256([]byte(host + "\n" + key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Responds to a retry with the response to the original request
+func replayIdempotentResponse(db *sql.DB, res http.ResponseWriter, userId int64, key string, requestHash string) {
+	idempotencyKey, err := GetIdempotencyKey(db, userId, key)
+	if err == PUBERR_ENTITY_NOT_FOUND {
+		// The original request failed in the meantime, so this one may try again
+		writeIdempotencyError(res, PUBERR_IDEMPOTENCY_KEY_IN_USE)
+		return
+	} else if err != nil {
+		writeIdempotencyError(res, err)
+		return
+	}
+	if idempotencyKey.RequestHash != requestHash {
+		writeIdempotencyError(res, PUBERR_IDEMPOTENCY_KEY_REUSED)
+		return
+	}
+	if idempotencyKey.Status == 0 {
+		writeIdempotencyError(res, PUBERR_IDEMPOTENCY_KEY_IN_USE)
+		return
+	}
+	if idempotencyKey.ContentType != "" {
+		res.Header().Set(ContentType, idempotencyKey.ContentType)
+	}
+	res.Header().Set(IDEMPOTENT_REPLAYED_HEADER, "true")
+	res.WriteHeader(idempotencyKey.Status)
+	res.Write(idempotencyKey.Response)
+}
+
+// Writes an error the way the Responder does; the Responder isn't mapped yet
+func writeIdempotencyError(res http.ResponseWriter, err error) {
+	(&Responder{response: res}).Error(err)
+}
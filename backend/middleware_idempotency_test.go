@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAnonymousIdempotencyKey(t *testing.T) {
+	key := anonymousIdempotencyKey("203.0.113.1:4000", "retry-me")
+	if other := anonymousIdempotencyKey("203.0.113.2:4000", "retry-me"); other == key {
+		t.Error("clients at different addresses share a key")
+	}
+	if other := anonymousIdempotencyKey("203.0.113.1:4000", "another"); other == key {
+		t.Error("different keys of the same client collide")
+	}
+	// Retries may come over a new connection
+	if retry := anonymousIdempotencyKey("203.0.113.1:5000", "retry-me"); retry != key {
+		t.Error("a retry from another port got another key")
+	}
+	if long := anonymousIdempotencyKey("[2001:db8::1]:4000", strings.Repeat("k", IDEMPOTENCY_KEY_MAX_LENGTH)); len(long) > IDEMPOTENCY_KEY_MAX_LENGTH {
+		t.Errorf("scoped key is %d long, want at most %d", len(long), IDEMPOTENCY_KEY_MAX_LENGTH)
+	}
+}
+
+func TestIdempotencyExemptsCredentials(t *testing.T) {
+	for _, path := range []string{API_AUTHENTICATE, API_RESET_PASSWORD} {
+		if !idempotencyExemptPaths[path] {
+			t.Errorf("responses of %s would be stored along with their session tokens", path)
+		}
+	}
+}
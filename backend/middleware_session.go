@@ -1,6 +1,7 @@
 package main
 
 import (
+	"database/sql"
 	"errors"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/go-martini/martini"
@@ -157,37 +158,50 @@ func NewSessionToken(
 	return token.SignedString([]byte(env.jwtSecret))
 }
 
-// Martini middleware that provides the session to martini handlers
-func Sessionize(res http.ResponseWriter, req *http.Request, env *Environment, c martini.Context) {
-	// First check if the current path is not blacklisted
-	if strings.Index(req.URL.Path, API_PREFIX) == 0 &&
-		(req.URL.Path != API_AUTHENTICATE) &&
-		!(req.URL.Path == API_REGISTER_USER && req.Method == "POST") {
-		// Get the JWT token
-		token, err := jwt.ParseFromRequest(req, func(token *jwt.Token) (interface{}, error) {
-			return []byte(env.jwtSecret), nil
-		})
-		// Check out whether the token is good
-		if err != nil || !token.Valid {
-			res.Header().Set(ContentType, ContentJSON)
-			res.WriteHeader(http.StatusUnauthorized)
-			res.Write(PUBERR_INVALID_AUTH_TOKEN.Json)
-		} else {
-			// Embed the token data in the context
-			sesh, err := UnmarshalSession(token)
-			if err != nil {
-				// Could not marshal the session, send back the 401
-				http.Error(res, err.Error(), http.StatusUnauthorized)
+// Martini middleware that provides the session to martini handlers. Sessions
+// created before the user last reset their password are turned away
+func Sessionize(db *sql.DB) martini.Handler {
+	return func(res http.ResponseWriter, req *http.Request, env *Environment, c martini.Context) {
+		// First check if the current path is not blacklisted
+		if strings.Index(req.URL.Path, API_PREFIX) == 0 &&
+			(req.URL.Path != API_AUTHENTICATE) &&
+			(req.URL.Path != API_STRIPE_WEBHOOK) &&
+			!(req.URL.Path == API_FORGOT_PASSWORD && req.Method == "POST") &&
+			!(req.URL.Path == API_RESET_PASSWORD && req.Method == "POST") &&
+			!(req.URL.Path == API_REGISTER_USER && req.Method == "POST") {
+			// Get the JWT token
+			token, err := jwt.ParseFromRequest(req, func(token *jwt.Token) (interface{}, error) {
+				return []byte(env.jwtSecret), nil
+			})
+			// Check out whether the token is good
+			if err != nil || !token.Valid {
+				res.Header().Set(ContentType, ContentJSON)
+				res.WriteHeader(http.StatusUnauthorized)
+				res.Write(PUBERR_INVALID_AUTH_TOKEN.Json)
 			} else {
-				// Bind the session to the martini context
-				c.Map(sesh)
-				// Move on
-				c.Next()
+				// Embed the token data in the context
+				sesh, err := UnmarshalSession(token)
+				if err != nil {
+					// Could not marshal the session, send back the 401
+					http.Error(res, err.Error(), http.StatusUnauthorized)
+				} else if revoked, err := IsSessionRevoked(db, sesh); err != nil {
+					Debug("Could not check whether the session was revoked: ", err)
+					res.Header().Set(ContentType, ContentJSON)
+					res.WriteHeader(http.StatusInternalServerError)
+					res.Write(PUBERR_INTERNAL_SERVER_ERROR.Json)
+				} else if revoked {
+					http.Error(res, ERR_JWT_SESSION_REVOKED, http.StatusUnauthorized)
+				} else {
+					// Bind the session to the martini context
+					c.Map(sesh)
+					// Move on
+					c.Next()
+				}
 			}
+		} else {
+			// This path is whitelisted
+			Debug("Request \"" + req.Method + " " + req.URL.Path + "\" was unauthenticated since its path is whitelisted")
+			c.Next()
 		}
-	} else {
-		// This path is whitelisted
-		Debug("Request \"" + req.Method + " " + req.URL.Path + "\" was unauthenticated since its path is whitelisted")
-		c.Next()
 	}
 }
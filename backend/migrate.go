@@ -0,0 +1,247 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"strconv"
+	"time"
+)
+
+// Migration is a numbered change to the database schema
+type Migration struct {
+	Version int64  // Orders the migrations; each version is applied at most once
+	Name    string // What the migration does
+	Up      string // The SQL that applies the migration
+	Down    string // The SQL that rolls the migration back
+}
+
+// MigrationStatus describes whether a Migration has been applied
+type MigrationStatus struct {
+	Migration
+	AppliedAt pq.NullTime // The time when the migration was applied; null if it is pending
+}
+
+const (
+	CMD_MIGRATE        = "migrate" // The subcommand that manages migrations instead of running the server
+	CMD_MIGRATE_UP     = "up"      // Applies pending migrations
+	CMD_MIGRATE_DOWN   = "down"    // Rolls back applied migrations
+	CMD_MIGRATE_STATUS = "status"  // Prints which migrations have been applied
+	MIGRATION_LOCK_KEY = 7335002   // The advisory lock held by whichever process is migrating the database
+
+	TABLE_NAME_SCHEMA_MIGRATION = "schema_migrations"
+
+	SQL_CREATE_TABLE_SCHEMA_MIGRATION = `
+		CREATE TABLE IF NOT EXISTS ` + TABLE_NAME_SCHEMA_MIGRATION + `(
+			version		BIGINT			PRIMARY KEY,
+			name		VARCHAR(255)	NOT NULL,
+			applied_at	TIMESTAMPTZ		NOT NULL
+		);
+	`
+	SQL_LOCK_MIGRATIONS = `
+		SELECT pg_advisory_xact_lock($1);
+	`
+	SQL_SELECT_APPLIED_MIGRATIONS = `
+		SELECT version, applied_at FROM ` + TABLE_NAME_SCHEMA_MIGRATION + `;
+	`
+	SQL_RECORD_MIGRATION = `
+		INSERT INTO ` + TABLE_NAME_SCHEMA_MIGRATION + `
+		(version, name, applied_at) VALUES
+		($1, $2, $3);
+	`
+	SQL_FORGET_MIGRATION = `
+		DELETE FROM ` + TABLE_NAME_SCHEMA_MIGRATION + ` WHERE (version = $1);
+	`
+)
+
+// Returns the version of the newest migration
+func LatestMigrationVersion() int64 {
+	if len(migrations) < 1 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+// Applies every pending migration up to and including the target version;
+// returns the migrations that were applied
+func MigrateUp(db *sql.DB, target int64) ([]Migration, error) {
+	applied := make([]Migration, 0)
+	err := withMigrationLock(db, func(appliedAt map[int64]time.Time) error {
+		for _, migration := range migrations {
+			if migration.Version > target {
+				break
+			}
+			if _, ok := appliedAt[migration.Version]; ok {
+				continue
+			}
+			if err := runMigration(db, migration, true); err != nil {
+				return errors.New(fmt.Sprintf(ERR_MIGRATION_FAILED, migration.Version, migration.Name, err.Error()))
+			}
+			applied = append(applied, migration)
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// Rolls back the specified number of the most recently applied migrations;
+// returns the migrations that were rolled back
+func MigrateDown(db *sql.DB, steps int) ([]Migration, error) {
+	rolledBack := make([]Migration, 0, steps)
+	err := withMigrationLock(db, func(appliedAt map[int64]time.Time) error {
+		for i := len(migrations) - 1; i >= 0 && len(rolledBack) < steps; i-- {
+			migration := migrations[i]
+			if _, ok := appliedAt[migration.Version]; !ok {
+				continue
+			}
+			if err := runMigration(db, migration, false); err != nil {
+				return errors.New(fmt.Sprintf(ERR_MIGRATION_ROLLBACK_FAILED, migration.Version, migration.Name, err.Error()))
+			}
+			rolledBack = append(rolledBack, migration)
+		}
+		return nil
+	})
+	return rolledBack, err
+}
+
+// Gets the status of every migration, oldest first
+func GetMigrationStatus(db *sql.DB) ([]*MigrationStatus, error) {
+	statuses := make([]*MigrationStatus, 0, len(migrations))
+	err := withMigrationLock(db, func(appliedAt map[int64]time.Time) error {
+		for _, migration := range migrations {
+			status := MigrationStatus{Migration: migration}
+			status.AppliedAt.Time, status.AppliedAt.Valid = appliedAt[migration.Version]
+			statuses = append(statuses, &status)
+		}
+		return nil
+	})
+	return statuses, err
+}
+
+// Runs fn with the times when each applied migration was applied. Holds the
+// migration lock meanwhile, so servers that start at the same time wait their
+// turn instead of applying the same migrations twice
+func withMigrationLock(db *sql.DB, fn func(map[int64]time.Time) error) error {
+	// The lock lasts as long as this transaction, so it is released even if we crash
+	leader, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer leader.Rollback()
+	if _, err = leader.Exec(SQL_LOCK_MIGRATIONS, MIGRATION_LOCK_KEY); err != nil {
+		return err
+	}
+	if _, err = db.Exec(SQL_CREATE_TABLE_SCHEMA_MIGRATION); err != nil {
+		return err
+	}
+	// Find out which migrations have been applied
+	rows, err := db.Query(SQL_SELECT_APPLIED_MIGRATIONS)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	appliedAt := make(map[int64]time.Time)
+	for rows.Next() {
+		var (
+			version int64
+			at      time.Time
+		)
+		if err = rows.Scan(&version, &at); err != nil {
+			return err
+		}
+		appliedAt[version] = at
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	return fn(appliedAt)
+}
+
+// Applies or rolls back a single migration along with its record in the
+// schema_migrations table
+func runMigration(db *sql.DB, migration Migration, up bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if up {
+		_, err = tx.Exec(migration.Up)
+		if err == nil {
+			_, err = tx.Exec(SQL_RECORD_MIGRATION, migration.Version, migration.Name, time.Now())
+		}
+	} else {
+		_, err = tx.Exec(migration.Down)
+		if err == nil {
+			_, err = tx.Exec(SQL_FORGET_MIGRATION, migration.Version)
+		}
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Runs the migrate subcommand:
+//
+//	migrate [up [version]]	applies pending migrations up to version (default: all)
+//	migrate down [steps]	rolls back the last steps migrations (default: 1)
+//	migrate status			prints which migrations have been applied
+func RunMigrateCommand(db *sql.DB, args []string) error {
+	command := CMD_MIGRATE_UP
+	if len(args) > 0 {
+		command = args[0]
+	}
+	// Read the optional numeric argument
+	var (
+		arg    int64
+		hasArg = len(args) > 1
+		err    error
+	)
+	if hasArg {
+		if arg, err = strconv.ParseInt(args[1], 10, 64); err != nil || arg < 0 {
+			return errors.New(ERR_MIGRATE_USAGE)
+		}
+	}
+	switch command {
+	case CMD_MIGRATE_UP:
+		target := LatestMigrationVersion()
+		if hasArg {
+			target = arg
+		}
+		applied, err := MigrateUp(db, target)
+		for _, migration := range applied {
+			fmt.Printf("Applied %d %s\n", migration.Version, migration.Name)
+		}
+		if err == nil && len(applied) < 1 {
+			fmt.Println("Already up to date")
+		}
+		return err
+	case CMD_MIGRATE_DOWN:
+		steps := 1
+		if hasArg {
+			steps = int(arg)
+		}
+		rolledBack, err := MigrateDown(db, steps)
+		for _, migration := range rolledBack {
+			fmt.Printf("Rolled back %d %s\n", migration.Version, migration.Name)
+		}
+		return err
+	case CMD_MIGRATE_STATUS:
+		statuses, err := GetMigrationStatus(db)
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if status.AppliedAt.Valid {
+				appliedAt = "applied " + status.AppliedAt.Time.Format(time.RFC3339)
+			}
+			fmt.Printf("%d\t%-40s\t%s\n", status.Version, status.Name, appliedAt)
+		}
+		return nil
+	default:
+		return errors.New(ERR_MIGRATE_USAGE)
+	}
+}
@@ -0,0 +1,569 @@
+package main
+
+// Every change ever made to the database schema, oldest first. Migrations are
+// applied in order of version and recorded in the schema_migrations table, so
+// a migration must never change once it has been released; add a new one
+// instead. The first migrations use IF [NOT] EXISTS so that databases created
+// before migrations existed can adopt them
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create initial tables",
+		Up: `
+			CREATE TABLE IF NOT EXISTS users(
+				id				BIGSERIAL			PRIMARY KEY,
+				first_name		VARCHAR(100)		NOT NULL,
+				last_name		VARCHAR(100)		NOT NULL,
+				email			VARCHAR(255)		UNIQUE NOT NULL,
+				hashed_password	VARCHAR(255)		NOT NULL,
+				stripe_id		VARCHAR(255)		NOT NULL,
+				picture_url		VARCHAR(511),
+
+				active			BOOLEAN				NOT NULL,
+				created_at		TIMESTAMPTZ			NOT NULL,
+				updated_at		TIMESTAMPTZ			NOT NULL,
+				deleted_at		TIMESTAMPTZ
+			);
+			CREATE TABLE IF NOT EXISTS campaigns(
+				id						BIGSERIAL			PRIMARY KEY,
+				title					VARCHAR(255)		NOT NULL,
+				description				TEXT				NOT NULL,
+				cover_picture_url		VARCHAR(511)		NOT NULL,
+				thumbnail_picture_url	VARCHAR(511)		NOT NULL,
+				amount					REAL				NOT NULL,
+				deadline				TIMESTAMPTZ			NOT NULL,
+				finished				BOOLEAN				NOT NULL,
+
+				creator_id	BIGINT REFERENCES users(id)	NOT NULL,
+				claimer_id	BIGINT REFERENCES users(id),
+
+				active			BOOLEAN				NOT NULL,
+				created_at		TIMESTAMPTZ			NOT NULL,
+				updated_at		TIMESTAMPTZ			NOT NULL,
+				deleted_at		TIMESTAMPTZ
+			);
+			CREATE TABLE IF NOT EXISTS contributions(
+				id			BIGSERIAL		PRIMARY KEY,
+				amount		REAL			NOT NULL,
+				stripe_id	VARCHAR(255)	NOT NULL,
+
+				contributor_id	BIGINT REFERENCES users(id)		NOT NULL,
+				campaign_id		BIGINT REFERENCES campaigns(id)	NOT NULL,
+
+				active			BOOLEAN				NOT NULL,
+				created_at		TIMESTAMPTZ			NOT NULL,
+				updated_at		TIMESTAMPTZ			NOT NULL,
+				deleted_at		TIMESTAMPTZ
+			);
+			CREATE TABLE IF NOT EXISTS claims(
+				id						BIGSERIAL			PRIMARY KEY,
+				description				TEXT				NOT NULL,
+
+				claimer_id	BIGINT REFERENCES users(id)		NOT NULL,
+				campaign_id	BIGINT REFERENCES campaigns(id)	NOT NULL,
+
+				active			BOOLEAN				NOT NULL,
+				created_at		TIMESTAMPTZ			NOT NULL,
+				updated_at		TIMESTAMPTZ			NOT NULL,
+				deleted_at		TIMESTAMPTZ
+			);
+			CREATE TABLE IF NOT EXISTS claim_evidence(
+				id			BIGSERIAL		PRIMARY KEY,
+				type		INTEGER			NOT NULL,
+				url			VARCHAR(511)	NOT NULL,
+
+				claim_id	BIGINT REFERENCES claims(id)	NOT NULL,
+
+				active			BOOLEAN				NOT NULL,
+				created_at		TIMESTAMPTZ			NOT NULL,
+				updated_at		TIMESTAMPTZ			NOT NULL,
+				deleted_at		TIMESTAMPTZ
+			);
+			CREATE TABLE IF NOT EXISTS claim_vote(
+				id			BIGSERIAL		PRIMARY KEY,
+				affirmative	BOOLEAN			NOT NULL,
+
+				voter_id	BIGINT REFERENCES users(id)	NOT NULL,
+				claim_id	BIGINT REFERENCES claims(id)	NOT NULL,
+
+				active			BOOLEAN				NOT NULL,
+				created_at		TIMESTAMPTZ			NOT NULL,
+				updated_at		TIMESTAMPTZ			NOT NULL,
+				deleted_at		TIMESTAMPTZ
+			);
+		`,
+		Down: `
+			DROP TABLE claim_vote;
+			DROP TABLE claim_evidence;
+			DROP TABLE claims;
+			DROP TABLE contributions;
+			DROP TABLE campaigns;
+			DROP TABLE users;
+		`,
+	},
+	{
+		Version: 2,
+		Name:    "add campaign search",
+		Up: `
+			ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS search_vector TSVECTOR
+				GENERATED ALWAYS AS (
+					setweight(to_tsvector('english', title), 'A') ||
+					setweight(to_tsvector('english', description), 'B')
+				) STORED;
+			CREATE INDEX IF NOT EXISTS campaigns_search_vector_idx ON campaigns USING GIN (search_vector);
+		`,
+		Down: `
+			DROP INDEX campaigns_search_vector_idx;
+			ALTER TABLE campaigns DROP COLUMN search_vector;
+		`,
+	},
+	{
+		Version: 3,
+		Name:    "add campaign sort indexes",
+		Up: `
+			CREATE INDEX IF NOT EXISTS campaigns_created_at_id_idx ON campaigns (created_at, id);
+			CREATE INDEX IF NOT EXISTS campaigns_deadline_id_idx ON campaigns (deadline, id);
+			CREATE INDEX IF NOT EXISTS campaigns_amount_id_idx ON campaigns (amount, id);
+			CREATE INDEX IF NOT EXISTS campaigns_creator_id_idx ON campaigns (creator_id);
+		`,
+		Down: `
+			DROP INDEX campaigns_creator_id_idx;
+			DROP INDEX campaigns_amount_id_idx;
+			DROP INDEX campaigns_deadline_id_idx;
+			DROP INDEX campaigns_created_at_id_idx;
+		`,
+	},
+	{
+		Version: 4,
+		Name:    "allow one active vote per claim",
+		Up: `
+			CREATE UNIQUE INDEX IF NOT EXISTS claim_vote_claim_id_voter_id_key ON claim_vote (claim_id, voter_id) WHERE active;
+		`,
+		Down: `
+			DROP INDEX claim_vote_claim_id_voter_id_key;
+		`,
+	},
+	{
+		Version: 5,
+		Name:    "add campaign voting rules",
+		Up: `
+			ALTER TABLE campaigns
+				ADD COLUMN IF NOT EXISTS voting_method		VARCHAR(31)		NOT NULL DEFAULT 'one_person_one_vote',
+				ADD COLUMN IF NOT EXISTS voting_quorum		REAL			NOT NULL DEFAULT 50,
+				ADD COLUMN IF NOT EXISTS voting_threshold	REAL			NOT NULL DEFAULT 50;
+		`,
+		Down: `
+			ALTER TABLE campaigns
+				DROP COLUMN voting_threshold,
+				DROP COLUMN voting_quorum,
+				DROP COLUMN voting_method;
+		`,
+	},
+	{
+		Version: 6,
+		Name:    "add claim resolution",
+		Up: `
+			ALTER TABLE claims
+				ADD COLUMN IF NOT EXISTS outcome			VARCHAR(15)		NOT NULL DEFAULT 'pending',
+				ADD COLUMN IF NOT EXISTS resolution_reason	TEXT			NOT NULL DEFAULT '',
+				ADD COLUMN IF NOT EXISTS resolved_at		TIMESTAMPTZ;
+		`,
+		Down: `
+			ALTER TABLE claims
+				DROP COLUMN resolved_at,
+				DROP COLUMN resolution_reason,
+				DROP COLUMN outcome;
+		`,
+	},
+	{
+		Version: 7,
+		Name:    "add campaign lifecycle",
+		Up: `
+			ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS phase VARCHAR(15) NOT NULL DEFAULT 'funding';
+			CREATE TABLE IF NOT EXISTS campaign_events(
+				id			BIGSERIAL		PRIMARY KEY,
+				type		VARCHAR(63)		NOT NULL,
+
+				campaign_id	BIGINT REFERENCES campaigns(id)	NOT NULL,
+
+				active			BOOLEAN				NOT NULL,
+				created_at		TIMESTAMPTZ			NOT NULL,
+				updated_at		TIMESTAMPTZ			NOT NULL,
+				deleted_at		TIMESTAMPTZ
+			);
+		`,
+		Down: `
+			DROP TABLE campaign_events;
+			ALTER TABLE campaigns DROP COLUMN phase;
+		`,
+	},
+	{
+		Version: 8,
+		Name:    "store money in minor units",
+		Up: `
+			ALTER TABLE contributions
+				ALTER COLUMN amount TYPE BIGINT USING round(amount * 100)::BIGINT,
+				ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'USD';
+			ALTER TABLE campaigns
+				ALTER COLUMN amount TYPE BIGINT USING round(amount * 100)::BIGINT,
+				ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'USD';
+			-- The totals drifted while they were floats, so add them up again
+			UPDATE campaigns SET amount = (
+				SELECT COALESCE(SUM(contributions.amount), 0) FROM contributions
+				WHERE (contributions.campaign_id = campaigns.id) AND contributions.active
+			);
+		`,
+		Down: `
+			ALTER TABLE contributions
+				DROP COLUMN currency,
+				ALTER COLUMN amount TYPE REAL USING amount / 100.0;
+			ALTER TABLE campaigns
+				DROP COLUMN currency,
+				ALTER COLUMN amount TYPE REAL USING amount / 100.0;
+		`,
+	},
+	{
+		Version: 9,
+		Name:    "add funding goals",
+		Up: `
+			ALTER TABLE campaigns
+				ADD COLUMN goal				BIGINT			NOT NULL DEFAULT 0,
+				ADD COLUMN funding_mode		VARCHAR(31)		NOT NULL DEFAULT 'keep_what_you_raise',
+				ADD COLUMN funding_outcome	VARCHAR(15)		NOT NULL DEFAULT 'pending';
+			-- Campaigns without a goal met it as soon as they finished
+			UPDATE campaigns SET funding_outcome = 'succeeded' WHERE finished;
+			ALTER TABLE contributions ADD COLUMN status VARCHAR(15) NOT NULL DEFAULT 'captured';
+		`,
+		Down: `
+			ALTER TABLE contributions DROP COLUMN status;
+			ALTER TABLE campaigns
+				DROP COLUMN funding_outcome,
+				DROP COLUMN funding_mode,
+				DROP COLUMN goal;
+		`,
+	},
+	{
+		Version: 10,
+		Name:    "add ledger",
+		Up: `
+			CREATE TABLE ledger_accounts(
+				id			BIGSERIAL		PRIMARY KEY,
+				type		VARCHAR(31)		NOT NULL,
+				owner_id	BIGINT			NOT NULL,
+				currency	CHAR(3)			NOT NULL,
+
+				created_at		TIMESTAMPTZ			NOT NULL,
+
+				UNIQUE (type, owner_id, currency)
+			);
+			CREATE TABLE journal_entries(
+				id			BIGSERIAL		PRIMARY KEY,
+				type		VARCHAR(31)		NOT NULL,
+				description	TEXT			NOT NULL,
+				stripe_id	VARCHAR(255)	NOT NULL,
+
+				contribution_id	BIGINT REFERENCES contributions(id),
+				campaign_id		BIGINT REFERENCES campaigns(id)		NOT NULL,
+
+				created_at		TIMESTAMPTZ			NOT NULL
+			);
+			CREATE INDEX journal_entries_contribution_id_idx ON journal_entries (contribution_id);
+			CREATE TABLE journal_lines(
+				id			BIGSERIAL		PRIMARY KEY,
+				amount		BIGINT			NOT NULL,
+				currency	CHAR(3)			NOT NULL,
+
+				entry_id	BIGINT REFERENCES journal_entries(id)	NOT NULL,
+				account_id	BIGINT REFERENCES ledger_accounts(id)	NOT NULL,
+
+				created_at		TIMESTAMPTZ			NOT NULL
+			);
+			CREATE INDEX journal_lines_entry_id_idx ON journal_lines (entry_id);
+			CREATE INDEX journal_lines_account_id_idx ON journal_lines (account_id);
+
+			-- Post the contributions that were captured before the ledger existed
+			INSERT INTO ledger_accounts (type, owner_id, currency, created_at)
+				SELECT DISTINCT 'contributor', contributor_id, currency, now() FROM contributions WHERE (status = 'captured') AND active
+				UNION
+				SELECT DISTINCT 'campaign_escrow', campaign_id, currency, now() FROM contributions WHERE (status = 'captured') AND active;
+			INSERT INTO journal_entries (type, description, stripe_id, contribution_id, campaign_id, created_at)
+				SELECT 'contribution', format('Contribution %s from user %s to campaign %s', id, contributor_id, campaign_id), stripe_id, id, campaign_id, created_at
+				FROM contributions WHERE (status = 'captured') AND active;
+			INSERT INTO journal_lines (entry_id, account_id, amount, currency, created_at)
+				SELECT entries.id, accounts.id, -contributions.amount, contributions.currency, entries.created_at FROM journal_entries entries
+					INNER JOIN contributions ON entries.contribution_id = contributions.id
+					INNER JOIN ledger_accounts accounts ON (accounts.type = 'contributor') AND (accounts.owner_id = contributions.contributor_id) AND (accounts.currency = contributions.currency)
+				UNION ALL
+				SELECT entries.id, accounts.id, contributions.amount, contributions.currency, entries.created_at FROM journal_entries entries
+					INNER JOIN contributions ON entries.contribution_id = contributions.id
+					INNER JOIN ledger_accounts accounts ON (accounts.type = 'campaign_escrow') AND (accounts.owner_id = contributions.campaign_id) AND (accounts.currency = contributions.currency);
+		`,
+		Down: `
+			DROP TABLE journal_lines;
+			DROP TABLE journal_entries;
+			DROP TABLE ledger_accounts;
+		`,
+	},
+	{
+		Version: 11,
+		Name:    "add stripe event inbox",
+		Up: `
+			CREATE TABLE stripe_events(
+				id			BIGSERIAL		PRIMARY KEY,
+				stripe_id	VARCHAR(255)	NOT NULL UNIQUE,
+				type		VARCHAR(127)	NOT NULL,
+				payload		JSONB			NOT NULL,
+				attempts	INTEGER			NOT NULL DEFAULT 0,
+				last_error	TEXT			NOT NULL DEFAULT '',
+
+				processed_at	TIMESTAMPTZ,
+				created_at		TIMESTAMPTZ			NOT NULL,
+				updated_at		TIMESTAMPTZ			NOT NULL
+			);
+			CREATE INDEX stripe_events_unprocessed_idx ON stripe_events (created_at) WHERE processed_at IS NULL;
+			CREATE INDEX contributions_stripe_id_idx ON contributions (stripe_id);
+		`,
+		Down: `
+			DROP INDEX contributions_stripe_id_idx;
+			DROP TABLE stripe_events;
+		`,
+	},
+	{
+		Version: 12,
+		Name:    "add refunds",
+		Up: `
+			CREATE TABLE refunds(
+				id			BIGSERIAL		PRIMARY KEY,
+				status		VARCHAR(15)		NOT NULL DEFAULT 'pending',
+				stripe_id	VARCHAR(255)	NOT NULL DEFAULT '',
+				attempts	INTEGER			NOT NULL DEFAULT 0,
+				last_error	TEXT			NOT NULL DEFAULT '',
+
+				contribution_id	BIGINT REFERENCES contributions(id)	NOT NULL UNIQUE,
+				campaign_id		BIGINT REFERENCES campaigns(id)		NOT NULL,
+
+				next_attempt_at	TIMESTAMPTZ			NOT NULL,
+				created_at		TIMESTAMPTZ			NOT NULL,
+				updated_at		TIMESTAMPTZ			NOT NULL
+			);
+			CREATE INDEX refunds_due_idx ON refunds (next_attempt_at) WHERE status = 'pending';
+			CREATE INDEX refunds_campaign_id_idx ON refunds (campaign_id);
+
+			-- Settling contributions used to release the authorizations of failed campaigns
+			INSERT INTO refunds (contribution_id, campaign_id, next_attempt_at, created_at, updated_at)
+				SELECT contributions.id, contributions.campaign_id, now(), now(), now() FROM contributions
+					INNER JOIN campaigns ON contributions.campaign_id = campaigns.id
+				WHERE (campaigns.phase = 'failed') AND (contributions.status IN ('authorized', 'captured')) AND contributions.active;
+		`,
+		Down: `
+			DROP TABLE refunds;
+		`,
+	},
+	{
+		Version: 13,
+		Name:    "add payouts",
+		Up: `
+			ALTER TABLE users
+				ADD COLUMN stripe_account_id	VARCHAR(255)	NOT NULL DEFAULT '';
+			CREATE TABLE payouts(
+				id			BIGSERIAL		PRIMARY KEY,
+				status		VARCHAR(15)		NOT NULL DEFAULT 'pending',
+				stripe_id	VARCHAR(255)	NOT NULL DEFAULT '',
+				amount		BIGINT			NOT NULL DEFAULT 0,
+				currency	CHAR(3)			NOT NULL,
+				attempts	INTEGER			NOT NULL DEFAULT 0,
+				last_error	TEXT			NOT NULL DEFAULT '',
+
+				campaign_id	BIGINT REFERENCES campaigns(id)	NOT NULL UNIQUE,
+				claimer_id	BIGINT REFERENCES users(id)		NOT NULL,
+
+				next_attempt_at	TIMESTAMPTZ			NOT NULL,
+				created_at		TIMESTAMPTZ			NOT NULL,
+				updated_at		TIMESTAMPTZ			NOT NULL
+			);
+			CREATE INDEX payouts_due_idx ON payouts (next_attempt_at) WHERE status = 'pending';
+			CREATE INDEX payouts_claimer_id_idx ON payouts (claimer_id);
+			CREATE INDEX payouts_stripe_id_idx ON payouts (stripe_id);
+
+			-- Nothing paid out the campaigns that were claimed before now
+			INSERT INTO payouts (currency, campaign_id, claimer_id, next_attempt_at, created_at, updated_at)
+				SELECT currency, id, claimer_id, now(), now(), now() FROM campaigns
+				WHERE (claimer_id IS NOT NULL) AND active;
+		`,
+		Down: `
+			DROP TABLE payouts;
+			ALTER TABLE users
+				DROP COLUMN stripe_account_id;
+		`,
+	},
+	{
+		Version: 14,
+		Name:    "add idempotency keys",
+		Up: `
+			CREATE TABLE idempotency_keys(
+				id				BIGSERIAL		PRIMARY KEY,
+				key				VARCHAR(255)	NOT NULL,
+				user_id			BIGINT			NOT NULL DEFAULT 0,
+				request_hash	CHAR(64)		NOT NULL,
+				status			INTEGER			NOT NULL DEFAULT 0,
+				content_type	VARCHAR(255)	NOT NULL DEFAULT '',
+				response		BYTEA			NOT NULL DEFAULT '',
+
+				created_at		TIMESTAMPTZ			NOT NULL,
+				expires_at		TIMESTAMPTZ			NOT NULL,
+
+				UNIQUE (user_id, key)
+			);
+			CREATE INDEX idempotency_keys_expires_at_idx ON idempotency_keys (expires_at);
+		`,
+		Down: `
+			DROP TABLE idempotency_keys;
+		`,
+	},
+	{
+		Version: 15,
+		Name:    "add fees",
+		Up: `
+			-- Contributions made before fees were charged keep all of their money
+			ALTER TABLE contributions
+				ADD COLUMN processor_fee	BIGINT	NOT NULL DEFAULT 0,
+				ADD COLUMN platform_fee		BIGINT	NOT NULL DEFAULT 0,
+				ADD COLUMN net				BIGINT	NOT NULL DEFAULT 0;
+			UPDATE contributions SET net = amount;
+
+			-- NULL fee columns mean the campaign pays the fees set in the environment
+			ALTER TABLE campaigns
+				ADD COLUMN net					BIGINT	NOT NULL DEFAULT 0,
+				ADD COLUMN platform_fee_rate	INTEGER,
+				ADD COLUMN platform_fee_fixed	BIGINT;
+			UPDATE campaigns SET net = amount;
+		`,
+		Down: `
+			ALTER TABLE campaigns
+				DROP COLUMN net,
+				DROP COLUMN platform_fee_rate,
+				DROP COLUMN platform_fee_fixed;
+			ALTER TABLE contributions
+				DROP COLUMN processor_fee,
+				DROP COLUMN platform_fee,
+				DROP COLUMN net;
+		`,
+	},
+	{
+		Version: 16,
+		Name:    "add pledges",
+		Up: `
+			CREATE TABLE pledges(
+				id			BIGSERIAL		PRIMARY KEY,
+				amount		BIGINT			NOT NULL,
+				currency	CHAR(3)			NOT NULL,
+				status		VARCHAR(15)		NOT NULL DEFAULT 'active',
+				attempts	INTEGER			NOT NULL DEFAULT 0,
+				last_error	TEXT			NOT NULL DEFAULT '',
+
+				contributor_id	BIGINT REFERENCES users(id)		NOT NULL,
+				campaign_id		BIGINT REFERENCES campaigns(id)	NOT NULL,
+
+				next_charge_at	TIMESTAMPTZ			NOT NULL,
+				next_attempt_at	TIMESTAMPTZ			NOT NULL,
+				created_at		TIMESTAMPTZ			NOT NULL,
+				updated_at		TIMESTAMPTZ			NOT NULL
+			);
+			CREATE INDEX pledges_due_idx ON pledges (next_attempt_at) WHERE status IN ('active', 'past_due');
+			CREATE INDEX pledges_campaign_id_idx ON pledges (campaign_id);
+			CREATE UNIQUE INDEX pledges_contributor_id_campaign_id_key ON pledges (contributor_id, campaign_id) WHERE status <> 'canceled';
+
+			ALTER TABLE contributions
+				ADD COLUMN pledge_id	BIGINT REFERENCES pledges(id);
+			CREATE INDEX contributions_pledge_id_idx ON contributions (pledge_id);
+		`,
+		Down: `
+			ALTER TABLE contributions
+				DROP COLUMN pledge_id;
+			DROP TABLE pledges;
+		`,
+	},
+	{
+		Version: 17,
+		Name:    "add reward tiers",
+		Up: `
+			CREATE TABLE reward_tiers(
+				id					BIGSERIAL		PRIMARY KEY,
+				title				VARCHAR(255)	NOT NULL,
+				description			TEXT			NOT NULL,
+				min_amount			BIGINT			NOT NULL,
+				currency			CHAR(3)			NOT NULL,
+				quantity			INTEGER,
+				claimed				INTEGER			NOT NULL DEFAULT 0 CHECK (quantity IS NULL OR claimed <= quantity),
+				estimated_delivery	TIMESTAMPTZ		NOT NULL,
+
+				campaign_id	BIGINT REFERENCES campaigns(id)	NOT NULL,
+
+				active		BOOLEAN			NOT NULL DEFAULT TRUE,
+				created_at	TIMESTAMPTZ		NOT NULL,
+				updated_at	TIMESTAMPTZ		NOT NULL,
+				deleted_at	TIMESTAMPTZ
+			);
+			CREATE INDEX reward_tiers_campaign_id_idx ON reward_tiers (campaign_id);
+
+			ALTER TABLE contributions
+				ADD COLUMN reward_tier_id	BIGINT REFERENCES reward_tiers(id);
+			CREATE INDEX contributions_reward_tier_id_idx ON contributions (reward_tier_id);
+		`,
+		Down: `
+			ALTER TABLE contributions
+				DROP COLUMN reward_tier_id;
+			DROP TABLE reward_tiers;
+		`,
+	},
+	{
+		Version: 18,
+		Name:    "add admin users",
+		Up: `
+			ALTER TABLE users
+				ADD COLUMN admin	BOOLEAN	NOT NULL DEFAULT FALSE;
+		`,
+		Down: `
+			ALTER TABLE users
+				DROP COLUMN admin;
+		`,
+	},
+	{
+		Version: 19,
+		Name:    "add password resets",
+		Up: `
+			ALTER TABLE users
+				ADD COLUMN password_changed_at	TIMESTAMPTZ;
+
+			CREATE TABLE password_resets(
+				id				BIGSERIAL		PRIMARY KEY,
+				hashed_token	VARCHAR(64)		NOT NULL UNIQUE,
+
+				user_id	BIGINT REFERENCES users(id)	NOT NULL,
+
+				created_at	TIMESTAMPTZ		NOT NULL,
+				expires_at	TIMESTAMPTZ		NOT NULL,
+				used_at		TIMESTAMPTZ
+			);
+			CREATE INDEX password_resets_user_id_idx ON password_resets (user_id);
+		`,
+		Down: `
+			DROP TABLE password_resets;
+			ALTER TABLE users
+				DROP COLUMN password_changed_at;
+		`,
+	},
+	{
+		Version: 20,
+		Name:    "add billing days to pledges",
+		Up: `
+			ALTER TABLE pledges
+				ADD COLUMN billing_day	INTEGER	NOT NULL DEFAULT 1 CHECK (billing_day BETWEEN 1 AND 31);
+			UPDATE pledges SET billing_day = EXTRACT(DAY FROM created_at AT TIME ZONE 'UTC');
+		`,
+		Down: `
+			ALTER TABLE pledges
+				DROP COLUMN billing_day;
+		`,
+	},
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"github.com/lib/pq"
 	"time"
 )
@@ -13,16 +14,29 @@ type Campaign struct {
 	Description         string    `json:"description"`         // The description of the campaign
 	CoverPictureUrl     string    `json:"coverPictureUrl"`     // The URL of this campaign's cover picture
 	ThumbnailPictureUrl string    `json:"thumbnailPictureUrl"` // The URL of this campaign's thumbnail picture
-	Amount              float64   `json:"amount"`              // The current amount that this campaign has raised
+	Amount              Money     `json:"amount"`              // The current amount that this campaign has raised, before fees
+	Net                 int64     `json:"-"`                   // What is left of the amount for the claimer after fees, in minor units of its currency
+	Goal                int64     `json:"-"`                   // The amount this campaign aims to raise, in minor units of its currency
+	FundingMode         string    `json:"fundingMode"`         // Whether the campaign is "all_or_nothing" or "keep_what_you_raise"
+	FundingOutcome      string    `json:"outcome"`             // Whether the goal was met by the deadline; "pending" until then
 	Deadline            time.Time `json:"deadline"`            // When this campaign expires
 	Finished            bool      `json:"finished"`            // True if the campaign is over
+	Phase               string    `json:"phase"`               // Whether the campaign is "funding", "claiming", "claimed", "failed", "unclaimed" or "canceled"
+
+	VotingRules VotingRules `json:"votingRules"` // How the votes concerning this campaign's claims are tallied
+
+	PlatformFeeRate  sql.NullInt64 `json:"-"` // The platform's fee on contributions to this campaign, in basis points; null for the default
+	PlatformFeeFixed sql.NullInt64 `json:"-"` // The platform's fixed fee on contributions to this campaign, in hundredths of a unit; null for the default
 
 	Creator       *User           `json:"creator,omitempty"` // The person who started this campaign; One-To-Many relationship (has one)
 	CreatorId     int64           `json:"-"`                 // The id of the creator; Foreign key for User (belongs to)
 	Claimer       *User           `json:"claimer,omitempty"` // The person who successfully claimed the Campaign; One-To-Many relationship (has one)
 	ClaimerId     sql.NullInt64   `json:"-"`                 // The id of the person who successfully claimed the Campaign; Foreign key for User (belongs to)
+	Payout        *Payout         `json:"payout,omitempty"`  // The transfer of this campaign's proceeds to its claimer; One-To-One relationship (has one)
+	RewardTiers   []*RewardTier   `json:"rewardTiers"`       // The perks this campaign offers its backers; One-To-Many relationship (has many)
 	Contributions []*Contribution `json:"contributions"`     // All the contributions to this campaign; One-To-Many relationship (has many)
 	Claims        []*Claim        `json:"claims"`            // All the claims for this campaign; One-To-Many relationship (has many)
+	Match         *CampaignMatch  `json:"match,omitempty"`   // How this campaign matched a search query; only set for search results
 
 	Active    bool        `json:"active"`    // True if this entity has not been soft deleted
 	CreatedAt time.Time   `json:"createdAt"` // The time when this campaign was created
@@ -30,6 +44,13 @@ type Campaign struct {
 	DeletedAt pq.NullTime `json:"-"`         // The time when this user was soft deleted
 }
 
+// The CampaignMatch model describes how a Campaign matched a full-text search query
+type CampaignMatch struct {
+	Rank                 float64 `json:"rank"`                 // How relevant the campaign is to the query; higher is better
+	TitleHighlight       string  `json:"titleHighlight"`       // The title with matching terms wrapped in <mark> tags
+	DescriptionHighlight string  `json:"descriptionHighlight"` // The most relevant fragments of the description with matching terms wrapped in <mark> tags
+}
+
 const (
 	TABLE_NAME_CAMPAIGN = "campaigns"
 
@@ -38,60 +59,126 @@ const (
 	FIELD_CAMPAIGN_CLAIMER_ID  = "claimer_id"
 	FIELD_CAMPAIGN_TITLE       = "title"
 	FIELD_CAMPAIGN_DESCRIPTION = "description"
+	FIELD_CAMPAIGN_COVER_URL   = "cover_picture_url"
+	FIELD_CAMPAIGN_THUMB_URL   = "thumbnail_picture_url"
+	FIELD_CAMPAIGN_AMOUNT      = "amount"
+	FIELD_CAMPAIGN_DEADLINE    = "deadline"
+	FIELD_CAMPAIGN_GOAL        = "goal"
+	FIELD_CAMPAIGN_FINISHED    = "finished"
+	FIELD_CAMPAIGN_SEARCH      = "search_vector"
+
+	FIELD_CAMPAIGN_PHASE    = "phase"
+	FIELD_CAMPAIGN_CURRENCY = "currency"
+
+	FIELD_CAMPAIGN_FUNDING_OUTCOME = "funding_outcome"
+
+	FIELD_CAMPAIGN_NET                = "net"
+	FIELD_CAMPAIGN_PLATFORM_FEE_RATE  = "platform_fee_rate"
+	FIELD_CAMPAIGN_PLATFORM_FEE_FIXED = "platform_fee_fixed"
+
+	// Phases of a campaign's lifecycle
+	CAMPAIGN_PHASE_FUNDING   = "funding"   // The campaign is accepting contributions
+	CAMPAIGN_PHASE_CLAIMING  = "claiming"  // The campaign reached its deadline and is accepting claims
+	CAMPAIGN_PHASE_CLAIMED   = "claimed"   // A claim to the campaign won
+	CAMPAIGN_PHASE_FAILED    = "failed"    // The campaign was all-or-nothing and missed its goal, so there is nothing to claim
+	CAMPAIGN_PHASE_UNCLAIMED = "unclaimed" // No claim won before claims closed, so the contributions are refunded
+	CAMPAIGN_PHASE_CANCELED  = "canceled"  // The creator canceled the campaign while it was raising money, so the contributions are refunded
+
+	FIELD_CAMPAIGN_VOTING_METHOD    = "voting_method"
+	FIELD_CAMPAIGN_VOTING_QUORUM    = "voting_quorum"
+	FIELD_CAMPAIGN_VOTING_THRESHOLD = "voting_threshold"
 
-	SQL_CREATE_TABLE_CAMPAIGN = `
-		CREATE TABLE IF NOT EXISTS ` + TABLE_NAME_CAMPAIGN + `(
-			id						BIGSERIAL			PRIMARY KEY,
-			title					VARCHAR(255)		NOT NULL,
-			description				TEXT				NOT NULL,
-			cover_picture_url		VARCHAR(511)		NOT NULL,
-			thumbnail_picture_url	VARCHAR(511)		NOT NULL,
-			amount					REAL				NOT NULL,
-			deadline				TIMESTAMPTZ			NOT NULL,
-			finished				BOOLEAN				NOT NULL,
-
-			creator_id	BIGINT REFERENCES ` + TABLE_NAME_USER + `(id)	NOT NULL,
-			claimer_id	BIGINT REFERENCES ` + TABLE_NAME_USER + `(id),
-
-			active			BOOLEAN				NOT NULL,
-			created_at		TIMESTAMPTZ			NOT NULL,
-			updated_at		TIMESTAMPTZ			NOT NULL,
-			deleted_at		TIMESTAMPTZ
-		);
-	`
 	SQL_CREATE_NEW_CAMPAIGN = `
 		INSERT INTO ` + TABLE_NAME_CAMPAIGN + `
-		(title, description, cover_picture_url, thumbnail_picture_url, amount, deadline, finished, creator_id, active, created_at, updated_at) VALUES
-		($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id;
+		(title, description, cover_picture_url, thumbnail_picture_url, amount, deadline, finished, creator_id, active, created_at, updated_at, voting_method, voting_quorum, voting_threshold, currency, goal, funding_mode) VALUES
+		($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17) RETURNING id;
 	`
 	SQL_SELECT_CAMPAIGN_BY_ID = `
-		SELECT * FROM ` + TABLE_NAME_CAMPAIGN + ` WHERE (id = $1);
+		SELECT * FROM ` + TABLE_NAME_CAMPAIGN + ` WHERE (id = $1) AND (active OR $2);
+	`
+	// Locking reads are made by the lifecycle, which has to see soft deleted campaigns too
+	SQL_SELECT_CAMPAIGN_BY_ID_FOR_UPDATE = `
+		SELECT * FROM ` + TABLE_NAME_CAMPAIGN + ` WHERE (id = $1) FOR UPDATE;
+	`
+	SQL_ADD_TO_CAMPAIGN_AMOUNT = `
+		UPDATE ` + TABLE_NAME_CAMPAIGN + ` SET ` + FIELD_CAMPAIGN_AMOUNT + ` = ` + FIELD_CAMPAIGN_AMOUNT + ` + $2, ` + FIELD_CAMPAIGN_NET + ` = ` + FIELD_CAMPAIGN_NET + ` + $3, updated_at = $4 WHERE (id = $1);
+	`
+	SQL_SET_CAMPAIGN_PLATFORM_FEES = `
+		UPDATE ` + TABLE_NAME_CAMPAIGN + ` SET ` + FIELD_CAMPAIGN_PLATFORM_FEE_RATE + ` = $2, ` + FIELD_CAMPAIGN_PLATFORM_FEE_FIXED + ` = $3, updated_at = $4 WHERE (id = $1);
+	`
+	SQL_SET_CAMPAIGN_CLAIMER = `
+		UPDATE ` + TABLE_NAME_CAMPAIGN + ` SET ` + FIELD_CAMPAIGN_CLAIMER_ID + ` = $2, ` + FIELD_CAMPAIGN_FINISHED + ` = TRUE, ` + FIELD_CAMPAIGN_PHASE + ` = '` + CAMPAIGN_PHASE_CLAIMED + `', updated_at = $3
+		WHERE (id = $1) AND (` + FIELD_CAMPAIGN_CLAIMER_ID + ` IS NULL) AND (` + FIELD_CAMPAIGN_PHASE + ` = '` + CAMPAIGN_PHASE_CLAIMING + `');
+	`
+	// Soft deleted campaigns go through the lifecycle too, so that the money
+	// of their backers isn't stranded
+	SQL_SELECT_EXPIRED_CAMPAIGN_IDS = `
+		SELECT id FROM ` + TABLE_NAME_CAMPAIGN + `
+		WHERE (` + FIELD_CAMPAIGN_FINISHED + ` = FALSE) AND (` + FIELD_CAMPAIGN_DEADLINE + ` <= $1);
+	`
+	SQL_SELECT_UNCLAIMED_CAMPAIGN_IDS = `
+		SELECT id FROM ` + TABLE_NAME_CAMPAIGN + ` campaigns
+		WHERE (` + FIELD_CAMPAIGN_PHASE + ` = '` + CAMPAIGN_PHASE_CLAIMING + `') AND (` + FIELD_CAMPAIGN_CLAIMER_ID + ` IS NULL)
+			AND (` + FIELD_CAMPAIGN_DEADLINE + ` <= $1) AND NOT EXISTS (
+				SELECT 1 FROM ` + TABLE_NAME_CLAIM + ` claims
+				WHERE (claims.` + FIELD_CLAIM_CAMPAIGN_ID + ` = campaigns.id) AND (claims.` + FIELD_CLAIM_OUTCOME + ` = '` + CLAIM_OUTCOME_PENDING + `') AND claims.active
+			);
+	`
+	SQL_SET_CAMPAIGN_PHASE = `
+		UPDATE ` + TABLE_NAME_CAMPAIGN + ` SET ` + FIELD_CAMPAIGN_PHASE + ` = $2, updated_at = $3 WHERE (id = $1);
+	`
+	SQL_FINISH_CAMPAIGN = `
+		UPDATE ` + TABLE_NAME_CAMPAIGN + ` SET ` + FIELD_CAMPAIGN_FINISHED + ` = TRUE, ` + FIELD_CAMPAIGN_PHASE + ` = $2, ` + FIELD_CAMPAIGN_FUNDING_OUTCOME + ` = $3, updated_at = $4
+		WHERE (id = $1);
+	`
+	// Backers are those whose contributions weren't given back, and those with pledges that weren't canceled
+	SQL_SELECT_HAS_BACKERS = `
+		SELECT EXISTS(
+			SELECT 1 FROM ` + TABLE_NAME_CONTRIBUTION + `
+			WHERE (` + FIELD_CONTRIBUTION_CAMPAIGN_ID + ` = $1) AND active
+		) OR EXISTS(
+			SELECT 1 FROM ` + TABLE_NAME_PLEDGE + `
+			WHERE (` + FIELD_PLEDGE_CAMPAIGN_ID + ` = $1) AND (` + FIELD_PLEDGE_STATUS + ` <> '` + PLEDGE_STATUS_CANCELED + `')
+		);
 	`
 	SQL_SELECT_FULL_CAMPAIGN_BY_ID = `
 		SELECT * FROM ` + TABLE_NAME_CAMPAIGN + `
 			LEFT JOIN ` + TABLE_NAME_USER + ` as creators ON ` + TABLE_NAME_CAMPAIGN + `.` + FIELD_CAMPAIGN_CREATOR_ID + `=creators.id
-			LEFT JOIN ` + TABLE_NAME_USER + ` as claimers ON ` + TABLE_NAME_CAMPAIGN + `.` + FIELD_CAMPAIGN_CLAIMER_ID + `=claimers.id
-		WHERE (` + TABLE_NAME_CAMPAIGN + `.id = $1);
+		WHERE (` + TABLE_NAME_CAMPAIGN + `.id = $1) AND (` + TABLE_NAME_CAMPAIGN + `.active OR $2);
 	`
 	SQL_SELECT_CAMPAIGNS = `
-		SELECT * FROM ` + TABLE_NAME_CAMPAIGN + `
-			LEFT JOIN ` + TABLE_NAME_USER + ` as creators ON ` + TABLE_NAME_CAMPAIGN + `.` + FIELD_CAMPAIGN_CREATOR_ID + `=creators.id
-		ORDER BY ` + FIELD_CAMPAIGN_CREATED_AT + ` DESC
-		OFFSET $1 LIMIT $2;
-	`
-	SQL_SELECT_AND_FILTER_CAMPAIGNS = `
-		SELECT * FROM ` + TABLE_NAME_CAMPAIGN + `
-			LEFT JOIN ` + TABLE_NAME_USER + ` as creators ON ` + TABLE_NAME_CAMPAIGN + `.` + FIELD_CAMPAIGN_CREATOR_ID + `=creators.id
-		WHERE ((` + TABLE_NAME_CAMPAIGN + `.` + FIELD_CAMPAIGN_CREATED_AT + ` LIKE $1) OR (` + TABLE_NAME_CAMPAIGN + `.` + FIELD_CAMPAIGN_CREATED_AT + ` LIKE $1))
-		ORDER BY ` + TABLE_NAME_CAMPAIGN + `.` + FIELD_CAMPAIGN_CREATED_AT + ` DESC
-		OFFSET $2 LIMIT $3;
+		SELECT ` + TABLE_NAME_CAMPAIGN + `.*, creators.*%s
+		FROM ` + TABLE_NAME_CAMPAIGN + `
+			LEFT JOIN ` + TABLE_NAME_USER + ` as creators ON ` + TABLE_NAME_CAMPAIGN + `.` + FIELD_CAMPAIGN_CREATOR_ID + `=creators.id%s
+		WHERE %s
+		ORDER BY %s
+		LIMIT %s;
 	`
+	SQL_SELECT_CAMPAIGNS_SEARCH_COLUMNS = `,
+			ts_rank(` + TABLE_NAME_CAMPAIGN + `.` + FIELD_CAMPAIGN_SEARCH + `, query)::float8 AS rank,
+			ts_headline('english', ` + TABLE_NAME_CAMPAIGN + `.` + FIELD_CAMPAIGN_TITLE + `, query, 'StartSel=<mark>, StopSel=</mark>, HighlightAll=true'),
+			ts_headline('english', ` + TABLE_NAME_CAMPAIGN + `.` + FIELD_CAMPAIGN_DESCRIPTION + `, query, 'StartSel=<mark>, StopSel=</mark>, MaxFragments=3, MaxWords=35, MinWords=15')`
+	SQL_SELECT_CAMPAIGNS_SEARCH_QUERY = `,
+			websearch_to_tsquery('english', %s) query`
+	SQL_SELECT_CAMPAIGNS_SEARCH_MATCH = `(` + TABLE_NAME_CAMPAIGN + `.` + FIELD_CAMPAIGN_SEARCH + ` @@ query)`
 )
 
-// Creates the Campaign table if it doesn't already exist
-func CreateCampaignTable(db *sql.DB) error {
-	_, err := db.Exec(SQL_CREATE_TABLE_CAMPAIGN)
-	return err
+// The columns of a campaign that UpdateFields may change; every other column
+// has its own way of being changed, if it may be changed at all. The deadline
+// and goal should only change while the campaign has no backers
+var campaignUpdatableFields = map[string]bool{
+	FIELD_CAMPAIGN_TITLE:       true,
+	FIELD_CAMPAIGN_DESCRIPTION: true,
+	FIELD_CAMPAIGN_COVER_URL:   true,
+	FIELD_CAMPAIGN_THUMB_URL:   true,
+	FIELD_CAMPAIGN_DEADLINE:    true,
+	FIELD_CAMPAIGN_GOAL:        true,
+}
+
+// Returns pointers to every column of a campaign row, in table order, for use with Scan
+func (c *Campaign) columns() []interface{} {
+	var searchVector interface{}
+	return []interface{}{&c.Id, &c.Title, &c.Description, &c.CoverPictureUrl, &c.ThumbnailPictureUrl, &c.Amount.Amount, &c.Deadline, &c.Finished, &c.CreatorId, &c.ClaimerId, &c.Active, &c.CreatedAt, &c.UpdatedAt, &c.DeletedAt, &searchVector, &c.VotingRules.Method, &c.VotingRules.Quorum, &c.VotingRules.Threshold, &c.Phase, &c.Amount.Currency, &c.Goal, &c.FundingMode, &c.FundingOutcome, &c.Net, &c.PlatformFeeRate, &c.PlatformFeeFixed}
 }
 
 // Creates a new Campaign in the database; returns the id of the new campaign
@@ -101,15 +188,18 @@ func CreateNewCampaign(
 	Description string, // The last name of the user
 	CoverPictureUrl string, // The email address of the user (indexed)
 	ThumbnailPictureUrl string, // The bcrypted password of the user
-	Amount float64, // The id of the user with Stripe's API
+	Currency string, // The currency the campaign raises money in
+	Goal int64, // The amount the campaign aims to raise, in minor units of its currency
+	FundingMode string, // Whether contributions are captured immediately or only once the goal is met
 	Deadline time.Time, // The URL to user's picture
 	CreatorId int64,
+	VotingRules VotingRules, // How the votes concerning the campaign's claims are tallied
 ) (int64, error) {
 	var (
 		id  int64
 		now = time.Now()
 	)
-	err := db.QueryRow(SQL_CREATE_NEW_CAMPAIGN, Title, Description, CoverPictureUrl, ThumbnailPictureUrl, Amount, Deadline, false, CreatorId, true, now, now).Scan(&id)
+	err := db.QueryRow(SQL_CREATE_NEW_CAMPAIGN, Title, Description, CoverPictureUrl, ThumbnailPictureUrl, 0, Deadline, false, CreatorId, true, now, now, VotingRules.Method, VotingRules.Quorum, VotingRules.Threshold, Currency, Goal, FundingMode).Scan(&id)
 	if err != nil {
 		return -1, err
 	} else {
@@ -117,12 +207,74 @@ func CreateNewCampaign(
 	}
 }
 
-// Gets a Campaign from the database by id
+// Adds the goal in the campaign's currency, the percentage of it that has been
+// raised, and the gross amount raised next to the net amount payable to the claimer
+func (c Campaign) MarshalJSON() ([]byte, error) {
+	type campaign Campaign
+	return json.Marshal(struct {
+		campaign
+		Goal          Money   `json:"goal"`          // The amount this campaign aims to raise
+		PercentFunded float64 `json:"percentFunded"` // The percentage of the goal that has been raised
+		Gross         Money   `json:"gross"`         // The amount raised, before fees
+		Net           Money   `json:"net"`           // The amount payable to the claimer, after fees
+	}{campaign(c), NewMoney(c.Goal, c.Amount.Currency), c.PercentFunded(), c.Amount, NewMoney(c.Net, c.Amount.Currency)})
+}
+
+// Returns the platform's fees on contributions to the campaign; campaigns
+// without fees of their own pay the defaults
+func (c *Campaign) PlatformFees(defaults FeeSchedule) FeeSchedule {
+	fees := defaults
+	if c.PlatformFeeRate.Valid {
+		fees.Rate = c.PlatformFeeRate.Int64
+	}
+	if c.PlatformFeeFixed.Valid {
+		fees.Fixed = c.PlatformFeeFixed.Int64
+	}
+	return fees
+}
+
+// Returns the time when the campaign stops accepting claims
+func (c *Campaign) ClaimsCloseAt(claimPeriod time.Duration) time.Time {
+	return c.Deadline.Add(claimPeriod)
+}
+
+// Returns true if the campaign is still accepting contributions
+func (c *Campaign) IsOpen() bool {
+	return c.Active && !c.Finished && time.Now().Before(c.Deadline)
+}
+
+// Gets a Campaign from the database by id; soft deleted campaigns are left out
 func GetCampaign(
 	db Queryable,
 	id int64,
 ) (*Campaign, error) {
-	rows, err := db.Query(SQL_SELECT_CAMPAIGN_BY_ID, id)
+	return findCampaign(db, SQL_SELECT_CAMPAIGN_BY_ID, id, false)
+}
+
+// Gets a Campaign from the database by id, even if it was soft deleted
+func GetCampaignIncludingDeleted(
+	db Queryable,
+	id int64,
+) (*Campaign, error) {
+	return findCampaign(db, SQL_SELECT_CAMPAIGN_BY_ID, id, true)
+}
+
+// Gets a Campaign from the database by id and locks it until the end of the
+// transaction, even if it was soft deleted; db should be a transaction
+func GetCampaignForUpdate(
+	db Queryable,
+	id int64,
+) (*Campaign, error) {
+	return findCampaign(db, SQL_SELECT_CAMPAIGN_BY_ID_FOR_UPDATE, id)
+}
+
+// Reads a single Campaign using the specified query
+func findCampaign(
+	db Queryable,
+	query string,
+	args ...interface{},
+) (*Campaign, error) {
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		// TODO standardize all database error returns
 		return nil, PUBERR_ENTITY_NOT_FOUND
@@ -131,7 +283,7 @@ func GetCampaign(
 	defer rows.Close()
 	var campaign Campaign
 	for rows.Next() {
-		err = rows.Scan(&campaign.Id, &campaign.Title, &campaign.Description, &campaign.CoverPictureUrl, &campaign.ThumbnailPictureUrl, &campaign.Amount, &campaign.Deadline, &campaign.Finished, &campaign.CreatorId, &campaign.ClaimerId, &campaign.Active, &campaign.CreatedAt, &campaign.UpdatedAt, &campaign.DeletedAt)
+		err = rows.Scan(campaign.columns()...)
 		if err != nil {
 			return nil, err
 		} else {
@@ -142,25 +294,136 @@ func GetCampaign(
 	return nil, PUBERR_ENTITY_NOT_FOUND
 }
 
-// Gets a Campaign from the database by id; has all its relationships fulfilled
+// Adds to the amount a Campaign has raised
+func AddToCampaignAmount(
+	db Queryable, // The database
+	id int64, // The id of the campaign
+	amount Money, // The amount to add in the campaign's currency; may be negative
+	net Money, // What is left of the amount after fees
+) error {
+	_, err := db.Exec(SQL_ADD_TO_CAMPAIGN_AMOUNT, id, amount.Amount, net.Amount, time.Now())
+	return err
+}
+
+// Overrides the platform's fees on future contributions to a Campaign; nil
+// fees make the campaign pay the defaults again
+func SetCampaignPlatformFees(
+	db Queryable, // The database
+	id int64, // The id of the campaign
+	fees *FeeSchedule, // The fees the campaign pays
+) error {
+	var rate, fixed sql.NullInt64
+	if fees != nil {
+		rate = sql.NullInt64{Int64: fees.Rate, Valid: true}
+		fixed = sql.NullInt64{Int64: fees.Fixed, Valid: true}
+	}
+	_, err := db.Exec(SQL_SET_CAMPAIGN_PLATFORM_FEES, id, rate, fixed, time.Now())
+	return err
+}
+
+// Awards a Campaign to its claimer and finishes it. Campaigns that were
+// already claimed, or that aren't in the claiming phase, are left untouched
+// and PUBERR_ENTITY_NOT_FOUND is returned, so that nothing gets paid out
+func SetCampaignClaimer(
+	db Queryable, // The database
+	id int64, // The id of the campaign
+	claimerId int64, // The id of the user whose claim won
+) error {
+	result, err := db.Exec(SQL_SET_CAMPAIGN_CLAIMER, id, claimerId, time.Now())
+	return entityAffected(result, err)
+}
+
+// Finds the ids of unfinished campaigns whose deadline has passed, soft deleted or not
+func FindExpiredCampaignIds(
+	db Queryable,
+	now time.Time,
+) ([]int64, error) {
+	ids := make([]int64, 0)
+	rows, err := db.Query(SQL_SELECT_EXPIRED_CAMPAIGN_IDS, now)
+	if err != nil {
+		return nil, err
+	}
+	// Read the rows
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Finds the ids of campaigns whose deadline passed before the cutoff, that
+// have no claims left to resolve, and were never claimed, soft deleted or not
+func FindUnclaimedCampaignIds(
+	db Queryable,
+	cutoff time.Time,
+) ([]int64, error) {
+	ids := make([]int64, 0)
+	rows, err := db.Query(SQL_SELECT_UNCLAIMED_CAMPAIGN_IDS, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	// Read the rows
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Moves a Campaign on to another phase of its lifecycle
+func SetCampaignPhase(
+	db Queryable, // The database
+	id int64, // The id of the campaign
+	phase string, // One of the CAMPAIGN_PHASE_* constants
+) error {
+	_, err := db.Exec(SQL_SET_CAMPAIGN_PHASE, id, phase, time.Now())
+	return err
+}
+
+// Finishes a Campaign and records the outcome of its funding
+func FinishCampaign(
+	db Queryable, // The database
+	id int64, // The id of the campaign
+	phase string, // The phase the campaign moves on to
+	outcome string, // Whether the campaign met its goal
+) error {
+	_, err := db.Exec(SQL_FINISH_CAMPAIGN, id, phase, outcome, time.Now())
+	return err
+}
+
+// Returns true if anyone has contributed to a Campaign without being given the
+// money back, or has a pledge to it that wasn't canceled
+func HasBackers(
+	db Queryable,
+	id int64,
+) (bool, error) {
+	var exists bool
+	err := db.QueryRow(SQL_SELECT_HAS_BACKERS, id).Scan(&exists)
+	return exists, err
+}
+
+// Gets a Campaign from the database by id; has all its relationships
+// fulfilled. Soft deleted entities are only included if includeDeleted is true
 func GetFullCampaign(
 	db Queryable,
 	id int64,
+	includeDeleted bool,
 ) (*Campaign, error) {
 	var (
 		foundResults = false
 		creator      User
 		campaign     Campaign
-		// Claimer fields are null b/c claimer is optional
-		claimerId         sql.NullInt64
-		claimerFirstName  sql.NullString
-		claimerLastName   sql.NullString
-		claimerEmail      sql.NullString
-		claimerPictureUrl sql.NullString
-		ignoredField      interface{}
 	)
 	// Query the db
-	rows, err := db.Query(SQL_SELECT_FULL_CAMPAIGN_BY_ID, id)
+	rows, err := db.Query(SQL_SELECT_FULL_CAMPAIGN_BY_ID, id, includeDeleted)
 	if err != nil {
 		return nil, err
 	}
@@ -168,11 +431,7 @@ func GetFullCampaign(
 	for rows.Next() {
 		foundResults = true
 		// Scan the results
-		err = rows.Scan(
-			&campaign.Id, &campaign.Title, &campaign.Description, &campaign.CoverPictureUrl, &campaign.ThumbnailPictureUrl, &campaign.Amount, &campaign.Deadline, &campaign.Finished, &campaign.CreatorId, &campaign.ClaimerId, &campaign.Active, &campaign.CreatedAt, &campaign.UpdatedAt, &campaign.DeletedAt, // The campaign fields
-			&creator.Id, &creator.FirstName, &creator.LastName, &creator.Email, &creator.HashedPassword, &creator.StripeId, &creator.PictureUrl, &creator.Active, &creator.CreatedAt, &creator.UpdatedAt, &creator.DeletedAt, // The creator fields
-			&claimerId, &claimerFirstName, &claimerLastName, &claimerEmail, &ignoredField, &ignoredField, &claimerPictureUrl, &ignoredField, &ignoredField, &ignoredField, &ignoredField, // The claimer fields
-		)
+		err = rows.Scan(append(campaign.columns(), creator.columns()...)...)
 		// Exit if there was a problem
 		if err != nil {
 			rows.Close()
@@ -180,14 +439,6 @@ func GetFullCampaign(
 		} else {
 			// Nest the entities
 			campaign.Creator = &creator
-			if campaign.ClaimerId.Valid {
-				campaign.Claimer = &User{}
-				claimerId.Scan(&campaign.Claimer.Id)
-				claimerFirstName.Scan(&campaign.Claimer.FirstName)
-				claimerLastName.Scan(&campaign.Claimer.LastName)
-				claimerEmail.Scan(&campaign.Claimer.Email)
-				claimerPictureUrl.Scan(&campaign.Claimer.PictureUrl)
-			}
 			// Close rows and break
 			rows.Close()
 			break
@@ -197,62 +448,61 @@ func GetFullCampaign(
 	if !foundResults {
 		return nil, PUBERR_ENTITY_NOT_FOUND
 	}
+	// Grab the claimer, if there is one yet; they stay the claimer even if their account is deleted
+	if campaign.ClaimerId.Valid {
+		campaign.Claimer, err = GetUserIncludingDeleted(db, campaign.ClaimerId.Int64)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Grab the payout, if the claimer is being paid
+	campaign.Payout, err = GetPayoutByCampaignId(db, campaign.Id)
+	if err != nil && err != PUBERR_ENTITY_NOT_FOUND {
+		return nil, err
+	}
+	// Grab the reward tiers
+	campaign.RewardTiers, err = FindRewardTiersByCampaignId(db, campaign.Id)
+	if err != nil {
+		return nil, err
+	}
 	// Grab the contributions
-	contributions, err := FindContributionsByCampaignId(db, campaign.Id)
+	contributions, err := FindContributionsByCampaignId(db, campaign.Id, includeDeleted)
 	if err != nil {
 		return nil, err
 	} else {
 		campaign.Contributions = contributions
 	}
 	// Grab the claims
-	claims, err := FindClaimsByCampaignId(db, campaign.Id)
+	claims, err := FindClaimsByCampaignId(db, campaign.Id, includeDeleted)
 	if err != nil {
 		return nil, err
 	} else {
 		campaign.Claims = claims
 	}
+	// Tally the votes concerning each claim
+	for _, claim := range campaign.Claims {
+		claim.Tally, err = GetClaimTally(db, &campaign, claim.Id)
+		if err != nil {
+			return nil, err
+		}
+	}
 	// We didn't find any users
 	return &campaign, nil
 }
 
-// Get all campaigns
+// Gets a page of campaigns matching the filter
 func GetCampaigns(
 	db Queryable,
-	offset int,
-	limit int,
-) ([]*Campaign, error) {
-	rows, err := db.Query(SQL_SELECT_CAMPAIGNS, offset, limit)
-	if err != nil {
-		return nil, err
-	}
-	// Read the rows
-	defer rows.Close()
-	campaigns := make([]*Campaign, 0, limit)
-	for rows.Next() {
-		var (
-			campaign Campaign
-			creator  User
-		)
-		err = rows.Scan(
-			&campaign.Id, &campaign.Title, &campaign.Description, &campaign.CoverPictureUrl, &campaign.ThumbnailPictureUrl, &campaign.Amount, &campaign.Deadline, &campaign.Deadline, &campaign.CreatorId, &campaign.ClaimerId, &campaign.Active, &campaign.CreatedAt, &campaign.UpdatedAt, &campaign.DeletedAt, // The campaign fields
-			&creator.Id, &creator.FirstName, &creator.LastName, &creator.Email, &creator.HashedPassword, &creator.StripeId, &creator.PictureUrl, &creator.Active, &creator.CreatedAt, &creator.UpdatedAt, &creator.DeletedAt, // The creator fields
-		)
-		if err != nil {
-			return nil, err
-		} else {
-			campaign.Creator = &creator
-			campaigns = append(campaigns, &campaign)
-		}
-	}
-	// We didn't find any users
-	return campaigns, nil
+	filter *CampaignFilter,
+) (*CampaignPage, error) {
+	return findCampaigns(db, "", filter)
 }
 
-// Filter all campaigns
+// Searches the titles and descriptions of the campaigns matching the filter
 func FilterCampaigns(
 	db Queryable,
-	offset int,
-	limit int,
-) ([]*Campaign, error) {
-	return nil, nil
+	query string, // The search query; supports quoted phrases, "or" and "-" exclusions
+	filter *CampaignFilter,
+) (*CampaignPage, error) {
+	return findCampaigns(db, query, filter)
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"github.com/lib/pq"
+	"time"
+)
+
+// The CampaignEvent model represents a step in the lifecycle of a Campaign
+type CampaignEvent struct {
+	Id   int64  `json:"id"`   // The identifier of the event
+	Type string `json:"type"` // What happened; one of the EVENT_CAMPAIGN_* constants
+
+	CampaignId int64 `json:"campaignId"` // The id of the campaign; Foreign key for the Campaign (belongs to)
+
+	Active    bool        `json:"active"`    // True if this entity has not been soft deleted
+	CreatedAt time.Time   `json:"createdAt"` // The time when this event happened
+	UpdatedAt time.Time   `json:"updatedAt"` // The time when this event was last updated
+	DeletedAt pq.NullTime `json:"-"`         // The time when this event was soft deleted
+}
+
+const (
+	// Lifecycle events of campaigns
+	EVENT_CAMPAIGN_FINISHED       = "campaign.finished"       // The campaign reached its deadline
+	EVENT_CAMPAIGN_FUNDED         = "campaign.funded"         // The campaign met its goal by the deadline
+	EVENT_CAMPAIGN_FUNDING_FAILED = "campaign.funding_failed" // The campaign missed its goal
+	EVENT_CAMPAIGN_CLAIMS_OPENED  = "campaign.claims_opened"  // The campaign started accepting claims
+	EVENT_CAMPAIGN_CLAIMED        = "campaign.claimed"        // A claim to the campaign won
+	EVENT_CAMPAIGN_UNCLAIMED      = "campaign.unclaimed"      // Claims closed without any claim winning
+	EVENT_CAMPAIGN_CANCELED       = "campaign.canceled"       // The creator canceled the campaign before its deadline
+
+	TABLE_NAME_CAMPAIGN_EVENT = "campaign_events"
+
+	SQL_CREATE_NEW_CAMPAIGN_EVENT = `
+		INSERT INTO ` + TABLE_NAME_CAMPAIGN_EVENT + `
+		(type, campaign_id, active, created_at, updated_at) VALUES
+		($1, $2, $3, $4, $5) RETURNING id;
+	`
+)
+
+// Functions that are called with every lifecycle event once it has been committed
+var campaignEventListeners = make([]func(*CampaignEvent), 0)
+
+// Records a lifecycle event in the database; it should be recorded in the same
+// transaction as the change it describes, and emitted once that commits
+func RecordCampaignEvent(
+	db Queryable, // The database
+	Type string, // What happened
+	CampaignId int64, // The id of the campaign it happened to
+) (*CampaignEvent, error) {
+	event := CampaignEvent{
+		Type:       Type,
+		CampaignId: CampaignId,
+		Active:     true,
+		CreatedAt:  time.Now(),
+	}
+	event.UpdatedAt = event.CreatedAt
+	err := db.QueryRow(SQL_CREATE_NEW_CAMPAIGN_EVENT, event.Type, event.CampaignId, event.Active, event.CreatedAt, event.UpdatedAt).Scan(&event.Id)
+	if err != nil {
+		return nil, err
+	} else {
+		return &event, nil
+	}
+}
+
+// Registers a function to be called with every lifecycle event
+func OnCampaignEvent(listener func(*CampaignEvent)) {
+	campaignEventListeners = append(campaignEventListeners, listener)
+}
+
+// Passes committed lifecycle events along to the listeners
+func EmitCampaignEvents(events ...*CampaignEvent) {
+	for _, event := range events {
+		Debug("Campaign ", event.CampaignId, " lifecycle event: ", event.Type)
+		for _, listener := range campaignEventListeners {
+			listener(event)
+		}
+	}
+}
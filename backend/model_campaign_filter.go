@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Ways that lists of campaigns can be ordered
+	CAMPAIGN_SORT_NEWEST      = "newest"      // Most recently created first
+	CAMPAIGN_SORT_ENDING_SOON = "ending_soon" // Closest deadline first
+	CAMPAIGN_SORT_MOST_FUNDED = "most_funded" // Largest amount raised first
+	CAMPAIGN_SORT_RELEVANCE   = "relevance"   // Best search match first; only valid when searching
+
+	// States that lists of campaigns can be narrowed down to
+	CAMPAIGN_STATE_ACTIVE   = "active"   // Campaigns that are still raising money
+	CAMPAIGN_STATE_FINISHED = "finished" // Campaigns that are over
+
+	CAMPAIGN_PAGE_DEFAULT_LIMIT = 20  // The number of campaigns in a page when no limit is given
+	CAMPAIGN_PAGE_MAX_LIMIT     = 100 // The largest number of campaigns a single page may hold
+)
+
+// CampaignFilter narrows down and orders a list of campaigns
+type CampaignFilter struct {
+	CreatorId      int64     // Only include campaigns started by this user; ignored if 0
+	State          string    // Only include campaigns in this state; ignored if empty
+	DeadlineAfter  time.Time // Only include campaigns with a deadline after this time; ignored if zero
+	DeadlineBefore time.Time // Only include campaigns with a deadline before this time; ignored if zero
+	Sort           string    // How the campaigns are ordered; one of the CAMPAIGN_SORT_* constants
+	Cursor         string    // The cursor of the previous page; empty for the first page
+	Limit          int       // The maximum number of campaigns in the page
+	IncludeDeleted bool      // Include soft deleted campaigns too
+}
+
+// CampaignPage is one page of a list of campaigns
+type CampaignPage struct {
+	Campaigns  []*Campaign `json:"campaigns"`            // The campaigns in this page
+	NextCursor string      `json:"nextCursor,omitempty"` // The cursor of the next page; omitted on the last page
+}
+
+// campaignSort describes the column a list of campaigns is ordered by
+type campaignSort struct {
+	key        string // The SQL expression campaigns are ordered by; ties are broken by id
+	cast       string // The SQL cast applied to cursor values so that they compare exactly with key
+	descending bool   // True if the largest values come first
+	timed      bool   // True if key is a time rather than a number
+}
+
+// campaignCursor is the decoded form of an opaque page cursor; it holds the
+// sort key of the last campaign in the previous page
+type campaignCursor struct {
+	Sort   string    `json:"s"` // The sort the cursor was made for
+	Time   time.Time `json:"t"` // The last time value; used by time-based sorts
+	Number float64   `json:"n"` // The last numeric value; used by number-based sorts
+	Id     int64     `json:"i"` // The id of the last campaign
+}
+
+var campaignSorts = map[string]campaignSort{
+	CAMPAIGN_SORT_NEWEST:      {key: TABLE_NAME_CAMPAIGN + "." + FIELD_CAMPAIGN_CREATED_AT, cast: "::timestamptz", descending: true, timed: true},
+	CAMPAIGN_SORT_ENDING_SOON: {key: TABLE_NAME_CAMPAIGN + "." + FIELD_CAMPAIGN_DEADLINE, cast: "::timestamptz", descending: false, timed: true},
+	CAMPAIGN_SORT_MOST_FUNDED: {key: TABLE_NAME_CAMPAIGN + "." + FIELD_CAMPAIGN_AMOUNT, cast: "::bigint", descending: true},
+	CAMPAIGN_SORT_RELEVANCE:   {key: "ts_rank(" + TABLE_NAME_CAMPAIGN + "." + FIELD_CAMPAIGN_SEARCH + ", query)::float8", cast: "::float8", descending: true},
+}
+
+// Returns true if state is one of the CAMPAIGN_STATE_* constants
+func IsValidCampaignState(state string) bool {
+	return state == CAMPAIGN_STATE_ACTIVE || state == CAMPAIGN_STATE_FINISHED
+}
+
+// Builds the cursor that points just past campaign in a list ordered by sort
+func encodeCampaignCursor(sort string, campaign *Campaign) (string, error) {
+	cursor := campaignCursor{Sort: sort, Id: campaign.Id}
+	switch sort {
+	case CAMPAIGN_SORT_NEWEST:
+		cursor.Time = campaign.CreatedAt
+	case CAMPAIGN_SORT_ENDING_SOON:
+		cursor.Time = campaign.Deadline
+	case CAMPAIGN_SORT_MOST_FUNDED:
+		cursor.Number = float64(campaign.Amount.Amount)
+	case CAMPAIGN_SORT_RELEVANCE:
+		cursor.Number = campaign.Match.Rank
+	}
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// Parses a cursor made by encodeCampaignCursor; fails if it was made for a different sort
+func decodeCampaignCursor(sort string, str string) (*campaignCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(str)
+	if err != nil {
+		return nil, PUBERR_INVALID_CURSOR
+	}
+	var cursor campaignCursor
+	if err = json.Unmarshal(data, &cursor); err != nil || cursor.Sort != sort {
+		return nil, PUBERR_INVALID_CURSOR
+	}
+	return &cursor, nil
+}
+
+// Gets a page of campaigns matching the filter; only campaigns matching query are included if it isn't empty
+func findCampaigns(
+	db Queryable,
+	query string,
+	filter *CampaignFilter,
+) (*CampaignPage, error) {
+	sort, ok := campaignSorts[filter.Sort]
+	if !ok || (filter.Sort == CAMPAIGN_SORT_RELEVANCE && query == "") {
+		return nil, PUBERR_INVALID_SORT
+	}
+	limit := filter.Limit
+	if limit < 1 {
+		limit = CAMPAIGN_PAGE_DEFAULT_LIMIT
+	} else if limit > CAMPAIGN_PAGE_MAX_LIMIT {
+		limit = CAMPAIGN_PAGE_MAX_LIMIT
+	}
+
+	var (
+		args       = make([]interface{}, 0, 8)
+		conditions = make([]string, 0, 6)
+		columns    = ""
+		from       = ""
+		direction  = "ASC"
+		comparison = ">"
+	)
+	// Adds a query argument; returns its placeholder
+	param := func(value interface{}) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+	// Build the WHERE section of the query
+	if query != "" {
+		columns = SQL_SELECT_CAMPAIGNS_SEARCH_COLUMNS
+		from = fmt.Sprintf(SQL_SELECT_CAMPAIGNS_SEARCH_QUERY, param(query))
+		conditions = append(conditions, SQL_SELECT_CAMPAIGNS_SEARCH_MATCH)
+	}
+	if !filter.IncludeDeleted {
+		conditions = append(conditions, "("+TABLE_NAME_CAMPAIGN+".active)")
+	}
+	if filter.CreatorId != 0 {
+		conditions = append(conditions, "("+TABLE_NAME_CAMPAIGN+"."+FIELD_CAMPAIGN_CREATOR_ID+" = "+param(filter.CreatorId)+")")
+	}
+	if filter.State != "" {
+		conditions = append(conditions, "("+TABLE_NAME_CAMPAIGN+"."+FIELD_CAMPAIGN_FINISHED+" = "+param(filter.State == CAMPAIGN_STATE_FINISHED)+")")
+	}
+	if !filter.DeadlineAfter.IsZero() {
+		conditions = append(conditions, "("+TABLE_NAME_CAMPAIGN+"."+FIELD_CAMPAIGN_DEADLINE+" > "+param(filter.DeadlineAfter)+")")
+	}
+	if !filter.DeadlineBefore.IsZero() {
+		conditions = append(conditions, "("+TABLE_NAME_CAMPAIGN+"."+FIELD_CAMPAIGN_DEADLINE+" < "+param(filter.DeadlineBefore)+")")
+	}
+	if sort.descending {
+		direction = "DESC"
+		comparison = "<"
+	}
+	// Skip past everything up to and including the end of the previous page
+	if filter.Cursor != "" {
+		cursor, err := decodeCampaignCursor(filter.Sort, filter.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		var value interface{} = cursor.Number
+		if sort.timed {
+			value = cursor.Time
+		}
+		conditions = append(conditions, fmt.Sprintf("((%s, %s.id) %s (%s%s, %s))", sort.key, TABLE_NAME_CAMPAIGN, comparison, param(value), sort.cast, param(cursor.Id)))
+	}
+	if len(conditions) < 1 {
+		conditions = append(conditions, "TRUE")
+	}
+	order := fmt.Sprintf("%s %s, %s.id %s", sort.key, direction, TABLE_NAME_CAMPAIGN, direction)
+
+	// Fetch one extra campaign to find out whether there is another page
+	rows, err := db.Query(fmt.Sprintf(SQL_SELECT_CAMPAIGNS, columns, from, strings.Join(conditions, " AND "), order, param(limit+1)), args...)
+	if err != nil {
+		return nil, err
+	}
+	// Read the rows
+	defer rows.Close()
+	page := &CampaignPage{Campaigns: make([]*Campaign, 0, limit+1)}
+	for rows.Next() {
+		var (
+			campaign Campaign
+			creator  User
+		)
+		fields := append(campaign.columns(), creator.columns()...)
+		if query != "" {
+			campaign.Match = &CampaignMatch{}
+			fields = append(fields, &campaign.Match.Rank, &campaign.Match.TitleHighlight, &campaign.Match.DescriptionHighlight)
+		}
+		err = rows.Scan(fields...)
+		if err != nil {
+			return nil, err
+		} else {
+			campaign.Creator = &creator
+			page.Campaigns = append(page.Campaigns, &campaign)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	// Trim the extra campaign and point the cursor at the last one we keep
+	if len(page.Campaigns) > limit {
+		page.Campaigns = page.Campaigns[:limit]
+		page.NextCursor, err = encodeCampaignCursor(filter.Sort, page.Campaigns[limit-1])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return page, nil
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"database/sql"
 	"github.com/lib/pq"
 	"time"
 )
@@ -11,12 +10,17 @@ type Claim struct {
 	Id          int64  `json:"id"`          // The identifier of the contribution
 	Description string `json:"description"` // The description of the claim
 
+	Outcome          string      `json:"outcome"`                    // Whether the claim is "pending", "won" or "lost"
+	ResolutionReason string      `json:"resolutionReason,omitempty"` // Why the claim won or lost
+	ResolvedAt       pq.NullTime `json:"-"`                          // The time when voting on the claim was closed
+
 	Claimer    *User            `json:"claimer,omitempty"`  // The person who made this claim
 	ClaimerId  int64            `json:"-"`                  // The id of the claimer; Foreign key for User (belongs to)
 	Campaign   *Campaign        `json:"campaign,omitempty"` // The campaign this claim was made for
 	CampaignId int64            `json:"-"`                  // The id of the campaign; Foreign key for the Campaign (belongs to)
 	Evidence   []*ClaimEvidence `json:"evidence"`           // The evidence of the claim; One-To-Many relationship (has many)
-	Votes      []*ClaimVote     `json:"votes"`              // The votes concerning this claim; One-To-Many relationship (has many)
+	Votes      []*ClaimVote     `json:"votes,omitempty"`    // The votes concerning this claim; One-To-Many relationship (has many)
+	Tally      *ClaimTally      `json:"tally,omitempty"`    // The outcome of the votes concerning this claim
 
 	Active    bool        `json:"active"`    // True if this entity has not been soft deleted
 	CreatedAt time.Time   `json:"createdAt"` // The time when this contribution was created
@@ -27,44 +31,167 @@ type Claim struct {
 const (
 	TABLE_NAME_CLAIM = "claims"
 
+	FIELD_CLAIM_DESCRIPTION = "description"
 	FIELD_CLAIM_CLAIMER_ID  = "claimer_id"
 	FIELD_CLAIM_CAMPAIGN_ID = "campaign_id"
+	FIELD_CLAIM_OUTCOME     = "outcome"
+	FIELD_CLAIM_CREATED_AT  = "created_at"
 
-	SQL_CREATE_TABLE_CLAIM = `
-		CREATE TABLE IF NOT EXISTS ` + TABLE_NAME_CLAIM + `(
-			id						BIGSERIAL			PRIMARY KEY,
-			description				TEXT				NOT NULL,
-
-			claimer_id	BIGINT REFERENCES ` + TABLE_NAME_USER + `(id)		NOT NULL,
-			campaign_id	BIGINT REFERENCES ` + TABLE_NAME_CAMPAIGN + `(id)	NOT NULL,
-
-			active			BOOLEAN				NOT NULL,
-			created_at		TIMESTAMPTZ			NOT NULL,
-			updated_at		TIMESTAMPTZ			NOT NULL,
-			deleted_at		TIMESTAMPTZ
-		);
+	SQL_CREATE_NEW_CLAIM = `
+		INSERT INTO ` + TABLE_NAME_CLAIM + `
+		(description, claimer_id, campaign_id, active, created_at, updated_at) VALUES
+		($1, $2, $3, $4, $5, $6) RETURNING id;
+	`
+	SQL_SELECT_CLAIM_BY_ID = `
+		SELECT * FROM ` + TABLE_NAME_CLAIM + ` WHERE (id = $1) AND active;
+	`
+	SQL_SELECT_FULL_CLAIM_BY_ID = `
+		SELECT * FROM ` + TABLE_NAME_CLAIM + `
+			LEFT JOIN ` + TABLE_NAME_USER + ` as claimers ON ` + TABLE_NAME_CLAIM + `.` + FIELD_CLAIM_CLAIMER_ID + `=claimers.id
+		WHERE (` + TABLE_NAME_CLAIM + `.id = $1) AND (` + TABLE_NAME_CLAIM + `.active OR $2);
 	`
 	SQL_SELECT_CLAIM_BY_CAMPAIGN_ID = `
 		SELECT * FROM ` + TABLE_NAME_CLAIM + `
 			LEFT JOIN ` + TABLE_NAME_USER + ` as claimers ON ` + TABLE_NAME_CLAIM + `.` + FIELD_CLAIM_CLAIMER_ID + `=claimers.id
-		WHERE (` + FIELD_CONTRIBUTION_CAMPAIGN_ID + ` = $1);
+		WHERE (` + TABLE_NAME_CLAIM + `.` + FIELD_CLAIM_CAMPAIGN_ID + ` = $1) AND (` + TABLE_NAME_CLAIM + `.active OR $2);
+	`
+	SQL_SELECT_CAMPAIGN_IDS_WITH_DUE_CLAIMS = `
+		SELECT DISTINCT ` + FIELD_CLAIM_CAMPAIGN_ID + ` FROM ` + TABLE_NAME_CLAIM + `
+		WHERE (` + FIELD_CLAIM_OUTCOME + ` = 'pending') AND (` + FIELD_CLAIM_CREATED_AT + ` <= $1) AND active;
+	`
+	SQL_SELECT_DUE_CLAIMS_FOR_UPDATE = `
+		SELECT * FROM ` + TABLE_NAME_CLAIM + `
+		WHERE (` + FIELD_CLAIM_CAMPAIGN_ID + ` = $1) AND (` + FIELD_CLAIM_OUTCOME + ` = 'pending') AND (` + FIELD_CLAIM_CREATED_AT + ` <= $2) AND active
+		ORDER BY ` + FIELD_CLAIM_CREATED_AT + `, id
+		FOR UPDATE;
+	`
+	SQL_RESOLVE_CLAIM = `
+		UPDATE ` + TABLE_NAME_CLAIM + ` SET ` + FIELD_CLAIM_OUTCOME + ` = $2, resolution_reason = $3, resolved_at = $4, updated_at = $4
+		WHERE (id = $1) AND (` + FIELD_CLAIM_OUTCOME + ` = 'pending');
 	`
 )
 
-// Creates the Claim table if it doesn't already exist
-func CreateClaimTable(db *sql.DB) error {
-	_, err := db.Exec(SQL_CREATE_TABLE_CLAIM)
-	return err
+// The columns of a claim that UpdateFields may change; every other column
+// has its own way of being changed, if it may be changed at all
+var claimUpdatableFields = map[string]bool{
+	FIELD_CLAIM_DESCRIPTION: true,
+}
+
+// Returns pointers to every column of a claim row, in table order, for use with Scan
+func (c *Claim) columns() []interface{} {
+	return []interface{}{&c.Id, &c.Description, &c.ClaimerId, &c.CampaignId, &c.Active, &c.CreatedAt, &c.UpdatedAt, &c.DeletedAt, &c.Outcome, &c.ResolutionReason, &c.ResolvedAt}
+}
+
+// Returns the time when voting on the claim closes
+func (c *Claim) VotingClosesAt(window time.Duration) time.Time {
+	return c.CreatedAt.Add(window)
+}
+
+// Creates a new Claim in the database; returns the id of the new claim
+func CreateNewClaim(
+	db Queryable, // The database
+	Description string, // The description of the claim
+	ClaimerId int64, // The id of the claimer
+	CampaignId int64, // The id of the campaign being claimed
+) (int64, error) {
+	var (
+		id  int64
+		now = time.Now()
+	)
+	err := db.QueryRow(SQL_CREATE_NEW_CLAIM, Description, ClaimerId, CampaignId, true, now, now).Scan(&id)
+	if err != nil {
+		return -1, err
+	} else {
+		return id, nil
+	}
+}
+
+// Gets a Claim from the database by id; soft deleted claims are left out
+func GetClaim(
+	db Queryable,
+	id int64,
+) (*Claim, error) {
+	rows, err := db.Query(SQL_SELECT_CLAIM_BY_ID, id)
+	if err != nil {
+		return nil, err
+	}
+	// Read the rows
+	defer rows.Close()
+	var claim Claim
+	for rows.Next() {
+		err = rows.Scan(claim.columns()...)
+		if err != nil {
+			return nil, err
+		} else {
+			return &claim, nil
+		}
+	}
+	// We didn't find any claims
+	return nil, PUBERR_ENTITY_NOT_FOUND
 }
 
-// Finds Claims for a specific campaign
+// Gets a Claim from the database by id; has its claimer, evidence and vote
+// tally fulfilled. Soft deleted entities are only included if includeDeleted is true
+func GetFullClaim(
+	db Queryable,
+	id int64,
+	includeDeleted bool,
+) (*Claim, error) {
+	var (
+		foundResults = false
+		claim        Claim
+		claimer      User
+	)
+	// Query the db
+	rows, err := db.Query(SQL_SELECT_FULL_CLAIM_BY_ID, id, includeDeleted)
+	if err != nil {
+		return nil, err
+	}
+	// Read the rows
+	for rows.Next() {
+		foundResults = true
+		err = rows.Scan(append(claim.columns(), claimer.columns()...)...)
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+		claim.Claimer = &claimer
+		break
+	}
+	// Exit if there were no results
+	if !foundResults {
+		return nil, PUBERR_ENTITY_NOT_FOUND
+	}
+	// Grab the evidence
+	evidence, err := FindClaimEvidenceByClaimId(db, claim.Id, includeDeleted)
+	if err != nil {
+		return nil, err
+	} else {
+		claim.Evidence = evidence
+	}
+	// Tally the votes according to the campaign's rules
+	campaign, err := findCampaign(db, SQL_SELECT_CAMPAIGN_BY_ID, claim.CampaignId, includeDeleted)
+	if err != nil {
+		return nil, err
+	}
+	tally, err := GetClaimTally(db, campaign, claim.Id)
+	if err != nil {
+		return nil, err
+	} else {
+		claim.Tally = tally
+	}
+	return &claim, nil
+}
+
+// Finds Claims for a specific campaign; soft deleted claims are only included if includeDeleted is true
 func FindClaimsByCampaignId(
 	db Queryable,
 	campaignId int64,
+	includeDeleted bool,
 ) ([]*Claim, error) {
 	claims := make([]*Claim, 0)
 	// Submit the query
-	rows, err := db.Query(SQL_SELECT_CLAIM_BY_CAMPAIGN_ID, campaignId)
+	rows, err := db.Query(SQL_SELECT_CLAIM_BY_CAMPAIGN_ID, campaignId, includeDeleted)
 	if err != nil {
 		return nil, err
 	}
@@ -74,10 +201,7 @@ func FindClaimsByCampaignId(
 		var currentClaim Claim
 		var currentClaimer User
 		// Read row data
-		err = rows.Scan(
-			&currentClaim.Id, &currentClaim.Description, &currentClaim.ClaimerId, &currentClaim.CampaignId, &currentClaim.Active, &currentClaim.CreatedAt, &currentClaim.UpdatedAt, &currentClaim.DeletedAt, // The contribution fields
-			&currentClaimer.Id, &currentClaimer.FirstName, &currentClaimer.LastName, &currentClaimer.Email, &currentClaimer.HashedPassword, &currentClaimer.StripeId, &currentClaimer.PictureUrl, &currentClaimer.Active, &currentClaimer.CreatedAt, &currentClaimer.UpdatedAt, &currentClaimer.DeletedAt, // The contributor fields
-		)
+		err = rows.Scan(append(currentClaim.columns(), currentClaimer.columns()...)...)
 		// Exit if there was a problem
 		if err != nil {
 			rows.Close()
@@ -90,3 +214,61 @@ func FindClaimsByCampaignId(
 	// Return the results
 	return claims, nil
 }
+
+// Finds the ids of campaigns that have pending claims made before the cutoff
+func FindCampaignIdsWithDueClaims(
+	db Queryable,
+	cutoff time.Time,
+) ([]int64, error) {
+	ids := make([]int64, 0)
+	rows, err := db.Query(SQL_SELECT_CAMPAIGN_IDS_WITH_DUE_CLAIMS, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	// Read the rows
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Finds the pending claims of a campaign made before the cutoff and locks
+// them until the end of the transaction; db should be a transaction
+func FindDueClaimsForUpdate(
+	db Queryable,
+	campaignId int64,
+	cutoff time.Time,
+) ([]*Claim, error) {
+	claims := make([]*Claim, 0)
+	rows, err := db.Query(SQL_SELECT_DUE_CLAIMS_FOR_UPDATE, campaignId, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	// Read the rows
+	defer rows.Close()
+	for rows.Next() {
+		var currentClaim Claim
+		if err = rows.Scan(currentClaim.columns()...); err != nil {
+			return nil, err
+		}
+		claims = append(claims, &currentClaim)
+	}
+	return claims, rows.Err()
+}
+
+// Closes voting on a pending claim and records its outcome; claims that were
+// already resolved are left untouched
+func ResolveClaim(
+	db Queryable, // The database
+	id int64, // The id of the claim
+	outcome string, // Either "won" or "lost"
+	reason string, // Why the claim won or lost
+) error {
+	_, err := db.Exec(SQL_RESOLVE_CLAIM, id, outcome, reason, time.Now())
+	return err
+}
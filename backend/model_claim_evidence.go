@@ -2,45 +2,125 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"github.com/lib/pq"
 	"time"
 )
 
+// ClaimEvidenceType is the kind of proof a piece of ClaimEvidence is
+type ClaimEvidenceType int
+
+const (
+	CLAIM_EVIDENCE_TYPE_LINK     ClaimEvidenceType = iota // A link to a web page
+	CLAIM_EVIDENCE_TYPE_IMAGE                             // A link to an image
+	CLAIM_EVIDENCE_TYPE_DOCUMENT                          // A link to a document
+	CLAIM_EVIDENCE_TYPE_COMMIT                            // A link to a source control commit
+)
+
+var claimEvidenceTypeNames = map[ClaimEvidenceType]string{
+	CLAIM_EVIDENCE_TYPE_LINK:     "link",
+	CLAIM_EVIDENCE_TYPE_IMAGE:    "image",
+	CLAIM_EVIDENCE_TYPE_DOCUMENT: "document",
+	CLAIM_EVIDENCE_TYPE_COMMIT:   "commit",
+}
+
+// Returns the name of the evidence type
+func (t ClaimEvidenceType) String() string {
+	return claimEvidenceTypeNames[t]
+}
+
+// Marshals the evidence type as its name
+func (t ClaimEvidenceType) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.String())
+}
+
+// Parses an evidence type from its name
+func ParseClaimEvidenceType(name string) (ClaimEvidenceType, bool) {
+	for t, typeName := range claimEvidenceTypeNames {
+		if typeName == name {
+			return t, true
+		}
+	}
+	return -1, false
+}
+
 // The ClaimEvidence model represents proof that supports a Claim
 type ClaimEvidence struct {
-	Id   int64  // The identifier of the contribution
-	Type int    // The type of the claim
-	Url  string // The url of the evidence
+	Id   int64             `json:"id"`   // The identifier of the contribution
+	Type ClaimEvidenceType `json:"type"` // The type of the claim
+	Url  string            `json:"url"`  // The url of the evidence
 
-	ClaimId sql.NullInt64 // The id of the claim; Foreign key for Claim (belongs to)
+	ClaimId sql.NullInt64 `json:"-"` // The id of the claim; Foreign key for Claim (belongs to)
 
-	Active    bool        // True if this entity has not been soft deleted
-	CreatedAt time.Time   // The time when this claim evidence was created
-	UpdatedAt time.Time   // The time when this claim evidence was last updated
-	DeletedAt pq.NullTime // The time when this user was soft deleted
+	Active    bool        `json:"active"`    // True if this entity has not been soft deleted
+	CreatedAt time.Time   `json:"createdAt"` // The time when this claim evidence was created
+	UpdatedAt time.Time   `json:"updatedAt"` // The time when this claim evidence was last updated
+	DeletedAt pq.NullTime `json:"-"`         // The time when this user was soft deleted
 }
 
 const (
 	TABLE_NAME_CLAIM_EVIDENCE = "claim_evidence"
 
-	SQL_CREATE_TABLE_CLAIM_EVIDENCE = `
-		CREATE TABLE IF NOT EXISTS ` + TABLE_NAME_CLAIM_EVIDENCE + `(
-			id			BIGSERIAL		PRIMARY KEY,
-			type		INTEGER			NOT NULL,
-			url			VARCHAR(511)	NOT NULL,
+	FIELD_CLAIM_EVIDENCE_CLAIM_ID = "claim_id"
 
-			claim_id	BIGINT REFERENCES ` + TABLE_NAME_CLAIM + `(id)	NOT NULL,
-
-			active			BOOLEAN				NOT NULL,
-			created_at		TIMESTAMPTZ			NOT NULL,
-			updated_at		TIMESTAMPTZ			NOT NULL,
-			deleted_at		TIMESTAMPTZ
-		);
+	SQL_CREATE_NEW_CLAIM_EVIDENCE = `
+		INSERT INTO ` + TABLE_NAME_CLAIM_EVIDENCE + `
+		(type, url, claim_id, active, created_at, updated_at) VALUES
+		($1, $2, $3, $4, $5, $6) RETURNING id;
+	`
+	SQL_SELECT_CLAIM_EVIDENCE_BY_CLAIM_ID = `
+		SELECT * FROM ` + TABLE_NAME_CLAIM_EVIDENCE + ` WHERE (` + FIELD_CLAIM_EVIDENCE_CLAIM_ID + ` = $1) AND (active OR $2) ORDER BY id;
 	`
 )
 
-// Creates the ClaimEvidence table if it doesn't already exist
-func CreateClaimEvidenceTable(db *sql.DB) error {
-	_, err := db.Exec(SQL_CREATE_TABLE_CLAIM_EVIDENCE)
-	return err
+// Returns pointers to every column of a claim evidence row, in table order, for use with Scan
+func (e *ClaimEvidence) columns() []interface{} {
+	return []interface{}{&e.Id, &e.Type, &e.Url, &e.ClaimId, &e.Active, &e.CreatedAt, &e.UpdatedAt, &e.DeletedAt}
+}
+
+// Creates a new ClaimEvidence in the database; returns the id of the new evidence
+func CreateNewClaimEvidence(
+	db Queryable, // The database
+	Type ClaimEvidenceType, // The type of the evidence
+	Url string, // The url of the evidence
+	ClaimId int64, // The id of the claim the evidence supports
+) (int64, error) {
+	var (
+		id  int64
+		now = time.Now()
+	)
+	err := db.QueryRow(SQL_CREATE_NEW_CLAIM_EVIDENCE, Type, Url, ClaimId, true, now, now).Scan(&id)
+	if err != nil {
+		return -1, err
+	} else {
+		return id, nil
+	}
+}
+
+// Finds the ClaimEvidence supporting a specific claim; soft deleted evidence
+// is only included if includeDeleted is true
+func FindClaimEvidenceByClaimId(
+	db Queryable,
+	claimId int64,
+	includeDeleted bool,
+) ([]*ClaimEvidence, error) {
+	evidence := make([]*ClaimEvidence, 0)
+	// Submit the query
+	rows, err := db.Query(SQL_SELECT_CLAIM_EVIDENCE_BY_CLAIM_ID, claimId, includeDeleted)
+	if err != nil {
+		return nil, err
+	}
+	// Read the rows
+	defer rows.Close()
+	for rows.Next() {
+		var currentEvidence ClaimEvidence
+		err = rows.Scan(currentEvidence.columns()...)
+		if err != nil {
+			return nil, err
+		} else {
+			evidence = append(evidence, &currentEvidence)
+		}
+	}
+	// Return the results
+	return evidence, nil
 }
@@ -8,39 +8,114 @@ import (
 
 // The ClaimVote model represents a vote in favor of, or against a Claim
 type ClaimVote struct {
-	Id          int64 // The identifier of the contribution
-	Affirmative bool  // True if in favor of the Claim
+	Id          int64 `json:"id"`          // The identifier of the contribution
+	Affirmative bool  `json:"affirmative"` // True if in favor of the Claim
 
-	VoterId sql.NullInt64 // The id of the voter; Foreign key for User (belongs to)
-	ClaimId sql.NullInt64 // The id of the claim; Foreign key for Claim (belongs to)
+	VoterId sql.NullInt64 `json:"-"` // The id of the voter; Foreign key for User (belongs to)
+	ClaimId sql.NullInt64 `json:"-"` // The id of the claim; Foreign key for Claim (belongs to)
 
-	Active    bool        // True if this entity has not been soft deleted
-	CreatedAt time.Time   // The time when this claim evidence was created
-	UpdatedAt time.Time   // The time when this claim evidence was last updated
-	DeletedAt pq.NullTime // The time when this user was soft deleted
+	Active    bool        `json:"active"`    // True if this entity has not been soft deleted
+	CreatedAt time.Time   `json:"createdAt"` // The time when this claim evidence was created
+	UpdatedAt time.Time   `json:"updatedAt"` // The time when this claim evidence was last updated
+	DeletedAt pq.NullTime `json:"-"`         // The time when this user was soft deleted
 }
 
 const (
 	TABLE_NAME_CLAIM_VOTE = "claim_vote"
 
-	SQL_CREATE_TABLE_CLAIM_VOTE = `
-		CREATE TABLE IF NOT EXISTS ` + TABLE_NAME_CLAIM_VOTE + `(
-			id			BIGSERIAL		PRIMARY KEY,
-			affirmative	BOOLEAN			NOT NULL,
+	FIELD_CLAIM_VOTE_CLAIM_ID    = "claim_id"
+	FIELD_CLAIM_VOTE_VOTER_ID    = "voter_id"
+	FIELD_CLAIM_VOTE_AFFIRMATIVE = "affirmative"
 
-			voter_id	BIGINT REFERENCES ` + TABLE_NAME_USER + `(id)	NOT NULL,
-			claim_id	BIGINT REFERENCES ` + TABLE_NAME_CLAIM + `(id)	NOT NULL,
-
-			active			BOOLEAN				NOT NULL,
-			created_at		TIMESTAMPTZ			NOT NULL,
-			updated_at		TIMESTAMPTZ			NOT NULL,
-			deleted_at		TIMESTAMPTZ
-		);
+	SQL_UPSERT_CLAIM_VOTE = `
+		INSERT INTO ` + TABLE_NAME_CLAIM_VOTE + `
+		(affirmative, voter_id, claim_id, active, created_at, updated_at) VALUES
+		($1, $2, $3, TRUE, $4, $4)
+		ON CONFLICT (` + FIELD_CLAIM_VOTE_CLAIM_ID + `, ` + FIELD_CLAIM_VOTE_VOTER_ID + `) WHERE active
+		DO UPDATE SET affirmative = EXCLUDED.affirmative, updated_at = EXCLUDED.updated_at
+		RETURNING id;
+	`
+	SQL_RETRACT_CLAIM_VOTE = `
+		UPDATE ` + TABLE_NAME_CLAIM_VOTE + ` SET active = FALSE, updated_at = $3, deleted_at = $3
+		WHERE (` + FIELD_CLAIM_VOTE_CLAIM_ID + ` = $1) AND (` + FIELD_CLAIM_VOTE_VOTER_ID + ` = $2) AND active;
+	`
+	SQL_SELECT_CLAIM_BALLOTS = `
+		SELECT ` + TABLE_NAME_CLAIM_VOTE + `.` + FIELD_CLAIM_VOTE_AFFIRMATIVE + `, COALESCE(SUM(` + TABLE_NAME_CONTRIBUTION + `.amount), 0)
+		FROM ` + TABLE_NAME_CLAIM_VOTE + `
+			LEFT JOIN ` + TABLE_NAME_CONTRIBUTION + ` ON (
+				` + TABLE_NAME_CONTRIBUTION + `.` + FIELD_CONTRIBUTION_CONTRIBUTOR_ID + ` = ` + TABLE_NAME_CLAIM_VOTE + `.` + FIELD_CLAIM_VOTE_VOTER_ID + ` AND
+				` + TABLE_NAME_CONTRIBUTION + `.` + FIELD_CONTRIBUTION_CAMPAIGN_ID + ` = $1 AND
+				` + TABLE_NAME_CONTRIBUTION + `.active
+			)
+		WHERE (` + TABLE_NAME_CLAIM_VOTE + `.` + FIELD_CLAIM_VOTE_CLAIM_ID + ` = $2) AND ` + TABLE_NAME_CLAIM_VOTE + `.active
+		GROUP BY ` + TABLE_NAME_CLAIM_VOTE + `.id;
 	`
 )
 
-// Creates the ClaimVote table if it doesn't already exist
-func CreateClaimVoteTable(db *sql.DB) error {
-	_, err := db.Exec(SQL_CREATE_TABLE_CLAIM_VOTE)
-	return err
+// Casts a vote concerning a claim; changes the voter's existing vote if they already have one.
+// Returns the id of the vote
+func CastClaimVote(
+	db Queryable, // The database
+	claimId int64, // The id of the claim being voted on
+	voterId int64, // The id of the voter
+	affirmative bool, // True if in favor of the claim
+) (int64, error) {
+	var id int64
+	err := db.QueryRow(SQL_UPSERT_CLAIM_VOTE, affirmative, voterId, claimId, time.Now()).Scan(&id)
+	if err != nil {
+		return -1, err
+	} else {
+		return id, nil
+	}
+}
+
+// Retracts a voter's vote concerning a claim
+func RetractClaimVote(
+	db Queryable, // The database
+	claimId int64, // The id of the claim that was voted on
+	voterId int64, // The id of the voter
+) error {
+	result, err := db.Exec(SQL_RETRACT_CLAIM_VOTE, claimId, voterId, time.Now())
+	if err != nil {
+		return err
+	}
+	// Make sure there was a vote to retract
+	if affected, err := result.RowsAffected(); err != nil {
+		return err
+	} else if affected < 1 {
+		return PUBERR_ENTITY_NOT_FOUND
+	}
+	return nil
+}
+
+// Tallies the votes concerning a specific claim according to the voting rules of its campaign
+func GetClaimTally(
+	db Queryable,
+	campaign *Campaign, // The campaign the claim was made for
+	claimId int64,
+) (*ClaimTally, error) {
+	funds, err := SumCampaignContributions(db, campaign.Id)
+	if err != nil {
+		return nil, err
+	}
+	// Read each vote along with how much its voter contributed
+	rows, err := db.Query(SQL_SELECT_CLAIM_BALLOTS, campaign.Id, claimId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ballots := make([]Ballot, 0)
+	for rows.Next() {
+		var ballot Ballot
+		err = rows.Scan(&ballot.Affirmative, &ballot.Contributed)
+		if err != nil {
+			return nil, err
+		} else {
+			ballots = append(ballots, ballot)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return TallyBallots(campaign.VotingRules, funds, ballots), nil
 }
@@ -2,20 +2,27 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"github.com/lib/pq"
 	"time"
 )
 
 // The Contribution model represents an amount paid by a user to a Campaign
 type Contribution struct {
-	Id       int64   `json:"id"`       // The identifier of the contribution
-	Amount   float64 `json:"amount"`   // The amount of the contribution
-	StripeId string  `json:"stripeId"` // The stripe id of this transaction
+	Id           int64  `json:"id"`       // The identifier of the contribution
+	Amount       Money  `json:"amount"`   // The gross amount of the contribution, i.e. what the contributor paid
+	ProcessorFee int64  `json:"-"`        // What the payment processor keeps of the amount, in minor units of its currency
+	PlatformFee  int64  `json:"-"`        // What the platform keeps of the amount, in minor units of its currency
+	Net          int64  `json:"-"`        // What is left of the amount for the claimer, in minor units of its currency
+	StripeId     string `json:"stripeId"` // The stripe id of this transaction
+	Status       string `json:"status"`   // Whether the payment is "authorized", "captured", "released", "failed", "refunded" or "disputed"
 
-	Contributor   *User     `json:"contributor,omitempty"` // The person who made this contribution
-	ContributorId int64     `json:"-"`                     // The id of the contributor; Foreign key for User (belongs to)
-	Campaign      *Campaign `json:"campaign,omitempty"`    // The campaign this contribution was made to
-	CampaignId    int64     `json:"-"`                     // The id of the campaign; Foreign key for the Campaign (belongs to)
+	Contributor   *User         `json:"contributor,omitempty"` // The person who made this contribution
+	ContributorId int64         `json:"-"`                     // The id of the contributor; Foreign key for User (belongs to)
+	Campaign      *Campaign     `json:"campaign,omitempty"`    // The campaign this contribution was made to
+	CampaignId    int64         `json:"-"`                     // The id of the campaign; Foreign key for the Campaign (belongs to)
+	PledgeId      sql.NullInt64 `json:"-"`                     // The id of the recurring pledge that made this contribution, if any; Foreign key for Pledge (belongs to)
+	RewardTierId  sql.NullInt64 `json:"-"`                     // The id of the reward tier the contributor selected, if any; Foreign key for RewardTier (belongs to)
 
 	Active    bool        `json:"active"`    // True if this entity has not been soft deleted
 	CreatedAt time.Time   `json:"createdAt"` // The time when this contribution was created
@@ -28,43 +35,262 @@ const (
 
 	FIELD_CONTRIBUTION_CAMPAIGN_ID    = "campaign_id"
 	FIELD_CONTRIBUTION_CONTRIBUTOR_ID = "contributor_id"
+	FIELD_CONTRIBUTION_STATUS         = "status"
+	FIELD_CONTRIBUTION_STRIPE_ID      = "stripe_id"
 
-	SQL_CREATE_TABLE_CONTRIBUTION = `
-		CREATE TABLE IF NOT EXISTS ` + TABLE_NAME_CONTRIBUTION + `(
-			id			BIGSERIAL		PRIMARY KEY,
-			amount		REAL			NOT NULL,
-			stripe_id	VARCHAR(255)	NOT NULL,
+	// Statuses of the payments behind contributions
+	CONTRIBUTION_STATUS_AUTHORIZED = "authorized" // The money is held until the campaign's funding outcome is decided
+	CONTRIBUTION_STATUS_CAPTURED   = "captured"   // The money was collected
+	CONTRIBUTION_STATUS_RELEASED   = "released"   // The hold was released because the campaign missed its goal
+	CONTRIBUTION_STATUS_FAILED     = "failed"     // The money could not be collected
+	CONTRIBUTION_STATUS_REFUNDED   = "refunded"   // The money was collected and then given back
+	CONTRIBUTION_STATUS_DISPUTED   = "disputed"   // The contributor disputed the charge with their bank
 
-			contributor_id	BIGINT REFERENCES ` + TABLE_NAME_USER + `(id)		NOT NULL,
-			campaign_id		BIGINT REFERENCES ` + TABLE_NAME_CAMPAIGN + `(id)	NOT NULL,
-
-			active			BOOLEAN				NOT NULL,
-			created_at		TIMESTAMPTZ			NOT NULL,
-			updated_at		TIMESTAMPTZ			NOT NULL,
-			deleted_at		TIMESTAMPTZ
+	SQL_CREATE_NEW_CONTRIBUTION = `
+		INSERT INTO ` + TABLE_NAME_CONTRIBUTION + `
+		(amount, stripe_id, contributor_id, campaign_id, active, created_at, updated_at, currency, status, processor_fee, platform_fee, net, pledge_id, reward_tier_id) VALUES
+		($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14) RETURNING id;
+	`
+	SQL_SELECT_CONTRIBUTION_BY_ID = `
+		SELECT * FROM ` + TABLE_NAME_CONTRIBUTION + ` WHERE (id = $1) AND (active OR $2);
+	`
+	SQL_SELECT_CONTRIBUTION_BY_ID_FOR_UPDATE = `
+		SELECT * FROM ` + TABLE_NAME_CONTRIBUTION + ` WHERE (id = $1) FOR UPDATE;
+	`
+	SQL_SELECT_CONTRIBUTION_BY_STRIPE_ID_FOR_UPDATE = `
+		SELECT * FROM ` + TABLE_NAME_CONTRIBUTION + ` WHERE (` + FIELD_CONTRIBUTION_STRIPE_ID + ` = $1) FOR UPDATE;
+	`
+	SQL_SELECT_HAS_CONTRIBUTED = `
+		SELECT EXISTS(
+			SELECT 1 FROM ` + TABLE_NAME_CONTRIBUTION + `
+			WHERE (` + FIELD_CONTRIBUTION_CAMPAIGN_ID + ` = $1) AND (` + FIELD_CONTRIBUTION_CONTRIBUTOR_ID + ` = $2) AND active
 		);
 	`
+	SQL_SUM_CAMPAIGN_CONTRIBUTIONS = `
+		SELECT COALESCE(SUM(amount), 0) FROM ` + TABLE_NAME_CONTRIBUTION + `
+		WHERE (` + FIELD_CONTRIBUTION_CAMPAIGN_ID + ` = $1) AND active;
+	`
+	SQL_SUM_CAMPAIGN_FEES = `
+		SELECT COALESCE(SUM(processor_fee), 0), COALESCE(SUM(platform_fee), 0) FROM ` + TABLE_NAME_CONTRIBUTION + `
+		WHERE (` + FIELD_CONTRIBUTION_CAMPAIGN_ID + ` = $1) AND (` + FIELD_CONTRIBUTION_STATUS + ` = '` + CONTRIBUTION_STATUS_CAPTURED + `') AND active;
+	`
+	SQL_SELECT_UNSETTLED_CONTRIBUTIONS = `
+		SELECT ` + TABLE_NAME_CONTRIBUTION + `.* FROM ` + TABLE_NAME_CONTRIBUTION + `
+			INNER JOIN ` + TABLE_NAME_CAMPAIGN + ` ON ` + TABLE_NAME_CONTRIBUTION + `.` + FIELD_CONTRIBUTION_CAMPAIGN_ID + ` = ` + TABLE_NAME_CAMPAIGN + `.id
+		WHERE (` + TABLE_NAME_CONTRIBUTION + `.` + FIELD_CONTRIBUTION_STATUS + ` = '` + CONTRIBUTION_STATUS_AUTHORIZED + `')
+			AND (` + TABLE_NAME_CAMPAIGN + `.` + FIELD_CAMPAIGN_FUNDING_OUTCOME + ` = '` + FUNDING_OUTCOME_SUCCEEDED + `')
+			AND ` + TABLE_NAME_CONTRIBUTION + `.active;
+	`
+	SQL_SET_CONTRIBUTION_STATUS = `
+		UPDATE ` + TABLE_NAME_CONTRIBUTION + ` SET ` + FIELD_CONTRIBUTION_STATUS + ` = $2, updated_at = $3
+		WHERE (id = $1);
+	`
+	SQL_SET_CONTRIBUTION_FEES = `
+		UPDATE ` + TABLE_NAME_CONTRIBUTION + ` SET processor_fee = $2, platform_fee = $3, net = $4, updated_at = $5
+		WHERE (id = $1);
+	`
+	SQL_WITHDRAW_CONTRIBUTION = `
+		UPDATE ` + TABLE_NAME_CONTRIBUTION + ` SET ` + FIELD_CONTRIBUTION_STATUS + ` = $2, active = FALSE, updated_at = $3, deleted_at = $3
+		WHERE (id = $1);
+	`
+	SQL_REINSTATE_CONTRIBUTION = `
+		UPDATE ` + TABLE_NAME_CONTRIBUTION + ` SET ` + FIELD_CONTRIBUTION_STATUS + ` = $2, active = TRUE, updated_at = $3, deleted_at = NULL
+		WHERE (id = $1);
+	`
 	SQL_SELECT_CONTRIBUTION_BY_CAMPAIGN_ID = `
 		SELECT * FROM ` + TABLE_NAME_CONTRIBUTION + `
 			LEFT JOIN ` + TABLE_NAME_USER + ` as contributors ON ` + TABLE_NAME_CONTRIBUTION + `.` + FIELD_CONTRIBUTION_CONTRIBUTOR_ID + `=contributors.id
-		WHERE (` + FIELD_CONTRIBUTION_CAMPAIGN_ID + ` = $1);
+		WHERE (` + TABLE_NAME_CONTRIBUTION + `.` + FIELD_CONTRIBUTION_CAMPAIGN_ID + ` = $1) AND (` + TABLE_NAME_CONTRIBUTION + `.active OR $2);
 	`
 )
 
-// Creates the Contribution table if it doesn't already exist
-func CreateContributionTable(db *sql.DB) error {
-	_, err := db.Exec(SQL_CREATE_TABLE_CONTRIBUTION)
+// Returns pointers to every column of a contribution row, in table order, for use with Scan
+func (c *Contribution) columns() []interface{} {
+	return []interface{}{&c.Id, &c.Amount.Amount, &c.StripeId, &c.ContributorId, &c.CampaignId, &c.Active, &c.CreatedAt, &c.UpdatedAt, &c.DeletedAt, &c.Amount.Currency, &c.Status, &c.ProcessorFee, &c.PlatformFee, &c.Net, &c.PledgeId, &c.RewardTierId}
+}
+
+// Adds the fees and the net amount in the contribution's currency, and the
+// selected reward tier if there is one
+func (c Contribution) MarshalJSON() ([]byte, error) {
+	type contribution Contribution
+	var rewardTierId *int64
+	if c.RewardTierId.Valid {
+		rewardTierId = &c.RewardTierId.Int64
+	}
+	return json.Marshal(struct {
+		contribution
+		ProcessorFee Money  `json:"processorFee"`           // What the payment processor keeps of the amount
+		PlatformFee  Money  `json:"platformFee"`            // What the platform keeps of the amount
+		Net          Money  `json:"net"`                    // What is left of the amount for the claimer
+		RewardTierId *int64 `json:"rewardTierId,omitempty"` // The id of the reward tier the contributor selected
+	}{contribution(c), NewMoney(c.ProcessorFee, c.Amount.Currency), NewMoney(c.PlatformFee, c.Amount.Currency), NewMoney(c.Net, c.Amount.Currency), rewardTierId})
+}
+
+// Creates a new Contribution in the database; returns the id of the new contribution
+func CreateNewContribution(
+	db Queryable, // The database
+	Amount Money, // The gross amount of the contribution
+	ProcessorFee Money, // What the payment processor keeps of the amount
+	PlatformFee Money, // What the platform keeps of the amount
+	Net Money, // What is left of the amount for the claimer
+	StripeId string, // The stripe id of this transaction
+	Status string, // Whether the payment was authorized or captured
+	ContributorId int64, // The id of the contributor
+	CampaignId int64, // The id of the campaign
+	PledgeId sql.NullInt64, // The id of the recurring pledge making the contribution, if any
+	RewardTierId sql.NullInt64, // The id of the reward tier the contributor selected, if any
+) (int64, error) {
+	var (
+		id  int64
+		now = time.Now()
+	)
+	err := db.QueryRow(SQL_CREATE_NEW_CONTRIBUTION, Amount.Amount, StripeId, ContributorId, CampaignId, true, now, now, Amount.Currency, Status, ProcessorFee.Amount, PlatformFee.Amount, Net.Amount, PledgeId, RewardTierId).Scan(&id)
+	if err != nil {
+		return -1, err
+	} else {
+		return id, nil
+	}
+}
+
+// Gets a Contribution from the database by id; withdrawn contributions are left out
+func GetContribution(
+	db Queryable,
+	id int64,
+) (*Contribution, error) {
+	return findContribution(db, SQL_SELECT_CONTRIBUTION_BY_ID, id, false)
+}
+
+// Gets a Contribution from the database by id, even if it was withdrawn
+func GetContributionIncludingDeleted(
+	db Queryable,
+	id int64,
+) (*Contribution, error) {
+	return findContribution(db, SQL_SELECT_CONTRIBUTION_BY_ID, id, true)
+}
+
+// Gets a Contribution from the database by id and locks it until the end of
+// the transaction; db should be a transaction
+func GetContributionForUpdate(
+	db Queryable,
+	id int64,
+) (*Contribution, error) {
+	return findContribution(db, SQL_SELECT_CONTRIBUTION_BY_ID_FOR_UPDATE, id)
+}
+
+// Gets the Contribution made with a Stripe charge and locks it until the end
+// of the transaction; db should be a transaction
+func GetContributionByStripeIdForUpdate(
+	db Queryable,
+	stripeId string,
+) (*Contribution, error) {
+	return findContribution(db, SQL_SELECT_CONTRIBUTION_BY_STRIPE_ID_FOR_UPDATE, stripeId)
+}
+
+// Reads a single Contribution using the specified query
+func findContribution(
+	db Queryable,
+	query string,
+	args ...interface{},
+) (*Contribution, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	// Read the rows
+	defer rows.Close()
+	var contribution Contribution
+	for rows.Next() {
+		err = rows.Scan(contribution.columns()...)
+		if err != nil {
+			return nil, err
+		} else {
+			return &contribution, nil
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	// We didn't find any contributions
+	return nil, PUBERR_ENTITY_NOT_FOUND
+}
+
+// Finds authorized contributions to campaigns that met their goal, which should now be captured
+func FindUnsettledContributions(
+	db Queryable,
+) ([]*Contribution, error) {
+	contributions := make([]*Contribution, 0)
+	rows, err := db.Query(SQL_SELECT_UNSETTLED_CONTRIBUTIONS)
+	if err != nil {
+		return nil, err
+	}
+	// Read the rows
+	defer rows.Close()
+	for rows.Next() {
+		var currentContribution Contribution
+		err = rows.Scan(currentContribution.columns()...)
+		if err != nil {
+			return nil, err
+		}
+		contributions = append(contributions, &currentContribution)
+	}
+	return contributions, rows.Err()
+}
+
+// Records what became of the payment behind a Contribution
+func SetContributionStatus(
+	db Queryable, // The database
+	id int64, // The id of the contribution
+	status string, // One of the CONTRIBUTION_STATUS_* constants
+) error {
+	_, err := db.Exec(SQL_SET_CONTRIBUTION_STATUS, id, status, time.Now())
 	return err
 }
 
-// Finds Contributions to a specific campaign
+// Records the fees on a Contribution once the payment processor has said what
+// it kept; the campaign's net amount should be changed to match
+func SetContributionFees(
+	db Queryable, // The database
+	id int64, // The id of the contribution
+	processorFee Money, // What the payment processor kept of the amount
+	platformFee Money, // What the platform keeps of the amount
+	net Money, // What is left of the amount for the claimer
+) error {
+	_, err := db.Exec(SQL_SET_CONTRIBUTION_FEES, id, processorFee.Amount, platformFee.Amount, net.Amount, time.Now())
+	return err
+}
+
+// Soft deletes a Contribution whose money was given back, so that it no longer
+// counts towards its campaign; the campaign total should be reduced to match
+func WithdrawContribution(
+	db Queryable, // The database
+	id int64, // The id of the contribution
+	status string, // Why the money was given back; one of the CONTRIBUTION_STATUS_* constants
+) error {
+	_, err := db.Exec(SQL_WITHDRAW_CONTRIBUTION, id, status, time.Now())
+	return err
+}
+
+// Restores a withdrawn Contribution whose money turned out to be collected
+// after all; the campaign total should be increased to match
+func ReinstateContribution(
+	db Queryable, // The database
+	id int64, // The id of the contribution
+	status string, // What became of the money; one of the CONTRIBUTION_STATUS_* constants
+) error {
+	_, err := db.Exec(SQL_REINSTATE_CONTRIBUTION, id, status, time.Now())
+	return err
+}
+
+// Finds Contributions to a specific campaign; withdrawn contributions are
+// only included if includeDeleted is true
 func FindContributionsByCampaignId(
 	db Queryable,
 	campaignId int64,
+	includeDeleted bool,
 ) ([]*Contribution, error) {
 	contributions := make([]*Contribution, 0)
 	// Submit the query
-	rows, err := db.Query(SQL_SELECT_CONTRIBUTION_BY_CAMPAIGN_ID, campaignId)
+	rows, err := db.Query(SQL_SELECT_CONTRIBUTION_BY_CAMPAIGN_ID, campaignId, includeDeleted)
 	if err != nil {
 		return nil, err
 	}
@@ -74,10 +300,7 @@ func FindContributionsByCampaignId(
 		var currentContribution Contribution
 		var currentContributor User
 		// Read row data
-		err = rows.Scan(
-			&currentContribution.Id, &currentContribution.Amount, &currentContribution.StripeId, &currentContribution.ContributorId, &currentContribution.CampaignId, &currentContribution.Active, &currentContribution.CreatedAt, &currentContribution.UpdatedAt, &currentContribution.DeletedAt, // The contribution fields
-			&currentContributor.Id, &currentContributor.FirstName, &currentContributor.LastName, &currentContributor.Email, &currentContributor.HashedPassword, &currentContributor.StripeId, &currentContributor.PictureUrl, &currentContributor.Active, &currentContributor.CreatedAt, &currentContributor.UpdatedAt, &currentContributor.DeletedAt, // The contributor fields
-		)
+		err = rows.Scan(append(currentContribution.columns(), currentContributor.columns()...)...)
 		// Exit if there was a problem
 		if err != nil {
 			rows.Close()
@@ -90,3 +313,35 @@ func FindContributionsByCampaignId(
 	// Return the results
 	return contributions, nil
 }
+
+// Returns true if a user has contributed to a specific campaign
+func HasContributedToCampaign(
+	db Queryable,
+	campaignId int64,
+	contributorId int64,
+) (bool, error) {
+	var contributed bool
+	err := db.QueryRow(SQL_SELECT_HAS_CONTRIBUTED, campaignId, contributorId).Scan(&contributed)
+	return contributed, err
+}
+
+// Adds up every contribution made to a specific campaign; the total is in the campaign's currency
+func SumCampaignContributions(
+	db Queryable,
+	campaignId int64,
+) (int64, error) {
+	var sum int64
+	err := db.QueryRow(SQL_SUM_CAMPAIGN_CONTRIBUTIONS, campaignId).Scan(&sum)
+	return sum, err
+}
+
+// Adds up the fees of the captured contributions to a campaign
+func SumCampaignFees(
+	db Queryable,
+	campaignId int64,
+	currency string,
+) (processorFee Money, platformFee Money, err error) {
+	var processorFees, platformFees int64
+	err = db.QueryRow(SQL_SUM_CAMPAIGN_FEES, campaignId).Scan(&processorFees, &platformFees)
+	return NewMoney(processorFees, currency), NewMoney(platformFees, currency), err
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	FIELD_ACTIVE     = "active"
+	FIELD_UPDATED_AT = "updated_at"
+	FIELD_DELETED_AT = "deleted_at"
+
+	SQL_UPDATE_FIELDS = `
+		UPDATE %s SET %s WHERE (id = $1);
+	`
+	SQL_SOFT_DELETE = `
+		UPDATE %s SET ` + FIELD_ACTIVE + ` = FALSE, ` + FIELD_UPDATED_AT + ` = $2, ` + FIELD_DELETED_AT + ` = COALESCE(` + FIELD_DELETED_AT + `, $2)
+		WHERE (id = $1);
+	`
+	SQL_RESTORE = `
+		UPDATE %s SET ` + FIELD_ACTIVE + ` = TRUE, ` + FIELD_UPDATED_AT + ` = $2, ` + FIELD_DELETED_AT + ` = NULL
+		WHERE (id = $1);
+	`
+)
+
+// The tables whose rows can be soft deleted, along with the columns of each
+// that UpdateFields may change. Table and column names end up in queries, so
+// nothing else gets through. Contributions are left out on purpose: they are
+// only ever soft deleted by WithdrawContribution, since that gives money back
+var softDeletableTables = map[string]map[string]bool{
+	TABLE_NAME_USER:           userUpdatableFields,
+	TABLE_NAME_CAMPAIGN:       campaignUpdatableFields,
+	TABLE_NAME_CAMPAIGN_EVENT: {},
+	TABLE_NAME_CLAIM:          claimUpdatableFields,
+	TABLE_NAME_CLAIM_EVIDENCE: {},
+	TABLE_NAME_CLAIM_VOTE:     {},
+	TABLE_NAME_REWARD_TIER:    rewardTierUpdatableFields,
+}
+
+// Updates a specific set of fields of a row; the keys are column names and
+// have to be among the updatable columns of the table. Soft deleted rows may
+// be updated too. Returns PUBERR_ENTITY_NOT_FOUND if there is no such row
+func UpdateFields(
+	db Queryable, // The database
+	table string, // One of the TABLE_NAME_* constants
+	id int64, // The id of the row being updated
+	keyVals map[string]interface{}, // Field deltas
+) error {
+	updatable, ok := softDeletableTables[table]
+	if !ok {
+		return errors.New(fmt.Sprintf(ERR_TABLE_NOT_SOFT_DELETABLE, table))
+	}
+	if len(keyVals) < 1 {
+		return nil
+	}
+	// The keys end up in the query, so only known columns get through
+	for fieldName := range keyVals {
+		if !updatable[fieldName] {
+			return errors.New(fmt.Sprintf(ERR_FIELD_NOT_UPDATABLE, fieldName, table))
+		}
+	}
+
+	var (
+		updates bytes.Buffer
+		values  = make([]interface{}, 1, (len(keyVals) + 2))
+		i       = 0
+	)
+	// Add the id as the first query param
+	values[0] = id
+	// Build the SET section of the query
+	for fieldName, fieldVal := range keyVals {
+		updates.WriteString(fieldName)
+		updates.WriteString(" = $")
+		updates.WriteString(strconv.Itoa(i + 2))
+		updates.WriteString(", ")
+		values = append(values, fieldVal)
+		i = i + 1
+	}
+	// Ensure "updated_at" is accurate
+	updates.WriteString(FIELD_UPDATED_AT)
+	updates.WriteString(" = $")
+	updates.WriteString(strconv.Itoa(i + 2))
+	values = append(values, time.Now())
+	// Execute the query
+	result, err := db.Exec(fmt.Sprintf(SQL_UPDATE_FIELDS, table, updates.String()), values...)
+	return entityAffected(result, err)
+}
+
+// Soft deletes a row, so that reads leave it out unless they ask for soft
+// deleted rows too; deleting a row twice keeps the time it was first deleted
+func SoftDelete(
+	db Queryable, // The database
+	table string, // One of the TABLE_NAME_* constants
+	id int64, // The id of the row being deleted
+) error {
+	if _, ok := softDeletableTables[table]; !ok {
+		return errors.New(fmt.Sprintf(ERR_TABLE_NOT_SOFT_DELETABLE, table))
+	}
+	result, err := db.Exec(fmt.Sprintf(SQL_SOFT_DELETE, table), id, time.Now())
+	return entityAffected(result, err)
+}
+
+// Restores a soft deleted row
+func Restore(
+	db Queryable, // The database
+	table string, // One of the TABLE_NAME_* constants
+	id int64, // The id of the row being restored
+) error {
+	if _, ok := softDeletableTables[table]; !ok {
+		return errors.New(fmt.Sprintf(ERR_TABLE_NOT_SOFT_DELETABLE, table))
+	}
+	result, err := db.Exec(fmt.Sprintf(SQL_RESTORE, table), id, time.Now())
+	return entityAffected(result, err)
+}
+
+// Turns the result of an update of a single row into PUBERR_ENTITY_NOT_FOUND if it changed nothing
+func entityAffected(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected < 1 {
+		return PUBERR_ENTITY_NOT_FOUND
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+// The IdempotencyKey model represents the first response to a request made
+// with an Idempotency-Key header, so that retries of the request get the same
+// response instead of doing the same thing twice. Keys belong to the user who
+// made the request; keys of requests made without a session have user id 0,
+// and are scoped to the address the request came from
+type IdempotencyKey struct {
+	Id          int64  // The identifier of the key
+	Key         string // The value of the Idempotency-Key header; hashed along with the client's address if there was no session
+	UserId      int64  // The id of the user who made the request; 0 if there was no session
+	RequestHash string // A hash of the method, path and body of the request
+	Status      int    // The status of the response; 0 while the request is still being handled
+	ContentType string // The content type of the response
+	Response    []byte // The body of the response
+
+	CreatedAt time.Time // The time when the request was first made
+	ExpiresAt time.Time // The time after which the key may be used again
+}
+
+const (
+	IDEMPOTENCY_KEY_LIFETIME = time.Hour * 24 // How long responses are replayed for
+
+	TABLE_NAME_IDEMPOTENCY_KEY = "idempotency_keys"
+
+	FIELD_IDEMPOTENCY_KEY_KEY        = "key"
+	FIELD_IDEMPOTENCY_KEY_USER_ID    = "user_id"
+	FIELD_IDEMPOTENCY_KEY_EXPIRES_AT = "expires_at"
+
+	// Claims the key, unless it was claimed by a request that hasn't expired
+	SQL_CLAIM_IDEMPOTENCY_KEY = `
+		INSERT INTO ` + TABLE_NAME_IDEMPOTENCY_KEY + `
+		(key, user_id, request_hash, created_at, expires_at) VALUES
+		($1, $2, $3, $4, $5)
+		ON CONFLICT (` + FIELD_IDEMPOTENCY_KEY_USER_ID + `, ` + FIELD_IDEMPOTENCY_KEY_KEY + `) DO UPDATE
+			SET request_hash = EXCLUDED.request_hash, status = 0, content_type = '', response = '', created_at = EXCLUDED.created_at, expires_at = EXCLUDED.expires_at
+			WHERE ` + TABLE_NAME_IDEMPOTENCY_KEY + `.` + FIELD_IDEMPOTENCY_KEY_EXPIRES_AT + ` <= $4
+		RETURNING id;
+	`
+	SQL_SELECT_IDEMPOTENCY_KEY = `
+		SELECT * FROM ` + TABLE_NAME_IDEMPOTENCY_KEY + `
+		WHERE (` + FIELD_IDEMPOTENCY_KEY_USER_ID + ` = $1) AND (` + FIELD_IDEMPOTENCY_KEY_KEY + ` = $2);
+	`
+	SQL_SAVE_IDEMPOTENT_RESPONSE = `
+		UPDATE ` + TABLE_NAME_IDEMPOTENCY_KEY + ` SET status = $2, content_type = $3, response = $4
+		WHERE (id = $1);
+	`
+	SQL_DELETE_IDEMPOTENCY_KEY = `
+		DELETE FROM ` + TABLE_NAME_IDEMPOTENCY_KEY + ` WHERE (id = $1);
+	`
+	SQL_DELETE_EXPIRED_IDEMPOTENCY_KEYS = `
+		DELETE FROM ` + TABLE_NAME_IDEMPOTENCY_KEY + ` WHERE (` + FIELD_IDEMPOTENCY_KEY_EXPIRES_AT + ` <= $1);
+	`
+)
+
+// Returns pointers to every column of an idempotency key row, in table order, for use with Scan
+func (k *IdempotencyKey) columns() []interface{} {
+	return []interface{}{&k.Id, &k.Key, &k.UserId, &k.RequestHash, &k.Status, &k.ContentType, &k.Response, &k.CreatedAt, &k.ExpiresAt}
+}
+
+// Claims an idempotency key for a request that is about to be handled. Returns
+// the id of the key, and false if the key was already claimed by a request
+// that hasn't expired
+func ClaimIdempotencyKey(
+	db Queryable, // The database
+	key string, // The value of the Idempotency-Key header
+	userId int64, // The id of the user making the request; 0 if there is no session
+	requestHash string, // A hash of the method, path and body of the request
+) (int64, bool, error) {
+	var (
+		id  int64
+		now = time.Now()
+	)
+	err := db.QueryRow(SQL_CLAIM_IDEMPOTENCY_KEY, key, userId, requestHash, now, now.Add(IDEMPOTENCY_KEY_LIFETIME)).Scan(&id)
+	if err == sql.ErrNoRows {
+		return -1, false, nil
+	} else if err != nil {
+		return -1, false, err
+	} else {
+		return id, true, nil
+	}
+}
+
+// Gets the IdempotencyKey a user made a request with
+func GetIdempotencyKey(
+	db Queryable,
+	userId int64,
+	key string,
+) (*IdempotencyKey, error) {
+	var idempotencyKey IdempotencyKey
+	err := db.QueryRow(SQL_SELECT_IDEMPOTENCY_KEY, userId, key).Scan(idempotencyKey.columns()...)
+	if err == sql.ErrNoRows {
+		return nil, PUBERR_ENTITY_NOT_FOUND
+	} else if err != nil {
+		return nil, err
+	} else {
+		return &idempotencyKey, nil
+	}
+}
+
+// Saves the response to the request an idempotency key was claimed for
+func SaveIdempotentResponse(
+	db Queryable, // The database
+	id int64, // The id of the key
+	status int, // The status of the response
+	contentType string, // The content type of the response
+	response []byte, // The body of the response
+) error {
+	_, err := db.Exec(SQL_SAVE_IDEMPOTENT_RESPONSE, id, status, contentType, response)
+	return err
+}
+
+// Releases an idempotency key, so that the request can be retried
+func DeleteIdempotencyKey(
+	db Queryable,
+	id int64,
+) error {
+	_, err := db.Exec(SQL_DELETE_IDEMPOTENCY_KEY, id)
+	return err
+}
+
+// Deletes the idempotency keys whose responses are no longer replayed
+func DeleteExpiredIdempotencyKeys(db *sql.DB) error {
+	_, err := db.Exec(SQL_DELETE_EXPIRED_IDEMPOTENCY_KEYS, time.Now())
+	return err
+}
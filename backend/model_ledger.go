@@ -0,0 +1,178 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The LedgerAccount model represents a place that money can be; its balance is
+// the sum of the journal lines posted to it
+type LedgerAccount struct {
+	Id       int64  `json:"id"`       // The identifier of the account
+	Type     string `json:"type"`     // What the account holds; one of the LEDGER_ACCOUNT_* constants
+	OwnerId  int64  `json:"ownerId"`  // The id of the user or campaign the account belongs to; 0 for platform accounts
+	Currency string `json:"currency"` // The currency of every line posted to the account
+
+	CreatedAt time.Time `json:"createdAt"` // The time when this account was opened
+}
+
+// The JournalEntry model represents a single movement of money between ledger
+// accounts. Entries and their lines are never updated or deleted; mistakes are
+// corrected by posting an opposite entry
+type JournalEntry struct {
+	Id          int64          `json:"id"`          // The identifier of the entry
+	Type        string         `json:"type"`        // Why the money moved; one of the JOURNAL_ENTRY_* constants
+	Description string         `json:"description"` // A human readable description of the movement
+	StripeId    string         `json:"stripeId"`    // The id of the Stripe object that moved the money
+	Lines       []*JournalLine `json:"lines"`       // The changes to the balances of the accounts involved; they add up to zero
+
+	ContributionId sql.NullInt64 `json:"-"` // The id of the contribution the entry concerns, if any; Foreign key for Contribution (belongs to)
+	CampaignId     int64         `json:"-"` // The id of the campaign the entry concerns; Foreign key for Campaign (belongs to)
+
+	CreatedAt time.Time `json:"createdAt"` // The time when this entry was posted
+}
+
+// The JournalLine model represents the change a JournalEntry makes to the balance of one account
+type JournalLine struct {
+	Id        int64 `json:"id"`        // The identifier of the line
+	EntryId   int64 `json:"-"`         // The id of the entry; Foreign key for JournalEntry (belongs to)
+	AccountId int64 `json:"accountId"` // The id of the account; Foreign key for LedgerAccount (belongs to)
+	Amount    Money `json:"amount"`    // The change to the balance; positive amounts flow into the account
+
+	CreatedAt time.Time `json:"createdAt"` // The time when this line was posted
+}
+
+const (
+	// Types of ledger accounts
+	LEDGER_ACCOUNT_CONTRIBUTOR     = "contributor"     // Money a user paid in; owned by the user
+	LEDGER_ACCOUNT_CAMPAIGN_ESCROW = "campaign_escrow" // Money held for a campaign until it is paid out; owned by the campaign
+	LEDGER_ACCOUNT_PLATFORM_FEES   = "platform_fees"   // Money the platform kept as fees; owned by no one
+	LEDGER_ACCOUNT_PROCESSOR_FEES  = "processor_fees"  // Money the payment processor kept as fees; owned by no one
+	LEDGER_ACCOUNT_CLAIMER_PAYOUT  = "claimer_payout"  // Money paid out to a user whose claim won; owned by the user
+
+	// Types of journal entries
+	JOURNAL_ENTRY_CONTRIBUTION = "contribution" // A contribution was captured into escrow
+	JOURNAL_ENTRY_REFUND       = "refund"       // A contribution was returned from escrow
+	JOURNAL_ENTRY_PAYOUT       = "payout"       // Escrow was paid out to a claimer
+	JOURNAL_ENTRY_FEE          = "fee"          // Escrow was kept by the platform and the payment processor
+
+	TABLE_NAME_LEDGER_ACCOUNT = "ledger_accounts"
+	TABLE_NAME_JOURNAL_ENTRY  = "journal_entries"
+	TABLE_NAME_JOURNAL_LINE   = "journal_lines"
+
+	FIELD_JOURNAL_ENTRY_TYPE            = "type"
+	FIELD_JOURNAL_ENTRY_STRIPE_ID       = "stripe_id"
+	FIELD_JOURNAL_ENTRY_CONTRIBUTION_ID = "contribution_id"
+	FIELD_JOURNAL_ENTRY_CAMPAIGN_ID     = "campaign_id"
+	FIELD_JOURNAL_LINE_ENTRY_ID         = "entry_id"
+	FIELD_JOURNAL_LINE_ACCOUNT_ID       = "account_id"
+
+	SQL_UPSERT_LEDGER_ACCOUNT = `
+		INSERT INTO ` + TABLE_NAME_LEDGER_ACCOUNT + `
+		(type, owner_id, currency, created_at) VALUES
+		($1, $2, $3, $4)
+		ON CONFLICT (type, owner_id, currency) DO UPDATE SET type = EXCLUDED.type
+		RETURNING id;
+	`
+	SQL_CREATE_NEW_JOURNAL_ENTRY = `
+		INSERT INTO ` + TABLE_NAME_JOURNAL_ENTRY + `
+		(type, description, stripe_id, contribution_id, campaign_id, created_at) VALUES
+		($1, $2, $3, $4, $5, $6) RETURNING id;
+	`
+	SQL_CREATE_NEW_JOURNAL_LINE = `
+		INSERT INTO ` + TABLE_NAME_JOURNAL_LINE + `
+		(entry_id, account_id, amount, currency, created_at) VALUES
+		($1, $2, $3, $4, $5) RETURNING id;
+	`
+	SQL_SELECT_LEDGER_ACCOUNT_BALANCE = `
+		SELECT COALESCE(SUM(` + TABLE_NAME_JOURNAL_LINE + `.amount), 0) FROM ` + TABLE_NAME_JOURNAL_LINE + `
+			INNER JOIN ` + TABLE_NAME_LEDGER_ACCOUNT + ` ON ` + TABLE_NAME_JOURNAL_LINE + `.` + FIELD_JOURNAL_LINE_ACCOUNT_ID + ` = ` + TABLE_NAME_LEDGER_ACCOUNT + `.id
+		WHERE (` + TABLE_NAME_LEDGER_ACCOUNT + `.type = $1) AND (` + TABLE_NAME_LEDGER_ACCOUNT + `.owner_id = $2) AND (` + TABLE_NAME_LEDGER_ACCOUNT + `.currency = $3);
+	`
+)
+
+// Opens a ledger account if it doesn't already exist; returns the id of the account
+func GetOrCreateLedgerAccount(
+	db Queryable, // The database
+	Type string, // What the account holds
+	OwnerId int64, // The id of the user or campaign the account belongs to
+	Currency string, // The currency of the account
+) (int64, error) {
+	var id int64
+	err := db.QueryRow(SQL_UPSERT_LEDGER_ACCOUNT, Type, OwnerId, Currency, time.Now()).Scan(&id)
+	if err != nil {
+		return -1, err
+	} else {
+		return id, nil
+	}
+}
+
+// Gets the balance of a ledger account; accounts that were never opened have a balance of zero
+func GetLedgerBalance(
+	db Queryable,
+	Type string,
+	OwnerId int64,
+	Currency string,
+) (Money, error) {
+	var amount int64
+	err := db.QueryRow(SQL_SELECT_LEDGER_ACCOUNT_BALANCE, Type, OwnerId, Currency).Scan(&amount)
+	return NewMoney(amount, Currency), err
+}
+
+// LedgerPosting is the change a journal entry makes to the balance of one account
+type LedgerPosting struct {
+	Type    string // The type of the account
+	OwnerId int64  // The owner of the account
+	Amount  Money  // The change to the balance; positive amounts flow into the account
+}
+
+// Posts a journal entry; fails unless there are at least two postings, all in
+// the same currency, that add up to zero. db should be a transaction so that
+// the entry is posted along with the change it records. Returns the id of the entry
+func PostJournalEntry(
+	db Queryable, // The database
+	Type string, // Why the money moved
+	Description string, // A human readable description of the movement
+	StripeId string, // The id of the Stripe object that moved the money
+	ContributionId sql.NullInt64, // The id of the contribution the entry concerns, if any
+	CampaignId int64, // The id of the campaign the entry concerns
+	postings ...LedgerPosting,
+) (int64, error) {
+	// Make sure the entry balances
+	if len(postings) < 2 {
+		return -1, errors.New(fmt.Sprintf(ERR_JOURNAL_ENTRY_UNBALANCED, Description))
+	}
+	total := NewMoney(0, postings[0].Amount.Currency)
+	for _, posting := range postings {
+		var err error
+		if total, err = total.Add(posting.Amount); err != nil {
+			return -1, err
+		}
+	}
+	if total.Amount != 0 {
+		return -1, errors.New(fmt.Sprintf(ERR_JOURNAL_ENTRY_UNBALANCED, Description))
+	}
+	// Record the entry and its lines
+	var (
+		entryId int64
+		now     = time.Now()
+	)
+	err := db.QueryRow(SQL_CREATE_NEW_JOURNAL_ENTRY, Type, Description, StripeId, ContributionId, CampaignId, now).Scan(&entryId)
+	if err != nil {
+		return -1, err
+	}
+	for _, posting := range postings {
+		accountId, err := GetOrCreateLedgerAccount(db, posting.Type, posting.OwnerId, posting.Amount.Currency)
+		if err != nil {
+			return -1, err
+		}
+		var lineId int64
+		err = db.QueryRow(SQL_CREATE_NEW_JOURNAL_LINE, entryId, accountId, posting.Amount.Amount, posting.Amount.Currency, now).Scan(&lineId)
+		if err != nil {
+			return -1, err
+		}
+	}
+	return entryId, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"github.com/lib/pq"
+	"time"
+)
+
+// The PasswordReset model represents a request to reset the password of a
+// user who forgot it. The token is emailed to the user and only its hash is
+// kept, so that reading the table doesn't let anyone take over accounts.
+// Each token can be used once, and only until it expires
+type PasswordReset struct {
+	Id          int64  // The identifier of the reset
+	UserId      int64  // The id of the user whose password may be reset
+	HashedToken string // The hex encoded SHA-256 hash of the token
+
+	CreatedAt time.Time   // The time when the reset was requested
+	ExpiresAt time.Time   // The time after which the token no longer works
+	UsedAt    pq.NullTime // The time when the token was used; null until then
+}
+
+const (
+	PASSWORD_RESET_LIFETIME     = time.Hour // How long reset tokens work for
+	PASSWORD_RESET_TOKEN_LENGTH = 32        // How many random bytes go into a reset token
+
+	TABLE_NAME_PASSWORD_RESET = "password_resets"
+
+	// Only creates the reset if the user has no other token that still works,
+	// so that nobody can flood a user's inbox with reset emails
+	SQL_CREATE_PASSWORD_RESET = `
+		INSERT INTO ` + TABLE_NAME_PASSWORD_RESET + `
+		(user_id, hashed_token, created_at, expires_at)
+		SELECT $1::BIGINT, $2, $3::TIMESTAMPTZ, $4::TIMESTAMPTZ
+		WHERE NOT EXISTS (
+			SELECT 1 FROM ` + TABLE_NAME_PASSWORD_RESET + `
+			WHERE (user_id = $1) AND (used_at IS NULL) AND (expires_at > $3)
+		)
+		RETURNING id;
+	`
+	// Uses up the token, unless it was already used or has expired
+	SQL_USE_PASSWORD_RESET = `
+		UPDATE ` + TABLE_NAME_PASSWORD_RESET + ` SET used_at = $2
+		WHERE (hashed_token = $1) AND (used_at IS NULL) AND (expires_at > $2)
+		RETURNING user_id;
+	`
+	SQL_USE_PASSWORD_RESETS_BY_USER_ID = `
+		UPDATE ` + TABLE_NAME_PASSWORD_RESET + ` SET used_at = $2
+		WHERE (user_id = $1) AND (used_at IS NULL);
+	`
+)
+
+// Creates a new PasswordReset for a user; returns the token to email to them,
+// which is never stored. Returns false, creating nothing, if the user has
+// another token that hasn't been used and hasn't expired
+func CreatePasswordReset(
+	db Queryable, // The database
+	userId int64, // The id of the user whose password may be reset
+) (string, bool, error) {
+	secret := make([]byte, PASSWORD_RESET_TOKEN_LENGTH)
+	if _, err := rand.Read(secret); err != nil {
+		return "", false, err
+	}
+	var (
+		id    int64
+		token = hex.EncodeToString(secret)
+		now   = time.Now()
+	)
+	err := db.QueryRow(SQL_CREATE_PASSWORD_RESET, userId, hashPasswordResetToken(token), now, now.Add(PASSWORD_RESET_LIFETIME)).Scan(&id)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	return token, true, nil
+}
+
+// Uses up a reset token, along with every other unused token of its user, so
+// that none of them can be used again; returns the id of the user whose
+// password may be reset. Returns PUBERR_INVALID_RESET_TOKEN if the token is
+// unknown, expired or already used
+func UsePasswordReset(
+	db Queryable, // The database
+	token string, // The token that was emailed to the user
+) (int64, error) {
+	var (
+		userId int64
+		now    = time.Now()
+	)
+	err := db.QueryRow(SQL_USE_PASSWORD_RESET, hashPasswordResetToken(token), now).Scan(&userId)
+	if err == sql.ErrNoRows {
+		return -1, PUBERR_INVALID_RESET_TOKEN
+	} else if err != nil {
+		return -1, err
+	}
+	if _, err = db.Exec(SQL_USE_PASSWORD_RESETS_BY_USER_ID, userId, now); err != nil {
+		return -1, err
+	}
+	return userId, nil
+}
+
+// Hashes a reset token the way it is stored; tokens are long and random, so a
+// fast hash is enough
+func hashPasswordResetToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+// The Payout model represents the transfer of a claimed campaign's escrow to
+// the Stripe Connect account of its claimer. Payouts are made in the
+// background and retried until they go through, so each one records how far it got
+type Payout struct {
+	Id        int64  `json:"id"`        // The identifier of the payout
+	Status    string `json:"status"`    // Whether the payout is "pending", "awaiting_account", "transferred", "paid", "failed" or "skipped"
+	StripeId  string `json:"stripeId"`  // The id of the Stripe transfer; empty until it is made
+	Amount    Money  `json:"amount"`    // The amount transferred; zero until the transfer is made
+	Attempts  int64  `json:"attempts"`  // How many times making the transfer has failed
+	LastError string `json:"lastError"` // Why the payout last failed
+
+	CampaignId int64 `json:"-"` // The id of the campaign being paid out; Foreign key for Campaign (belongs to)
+	ClaimerId  int64 `json:"-"` // The id of the user being paid; Foreign key for User (belongs to)
+
+	NextAttemptAt time.Time `json:"-"`         // The time when making the transfer is next attempted
+	CreatedAt     time.Time `json:"createdAt"` // The time when the payout was scheduled
+	UpdatedAt     time.Time `json:"updatedAt"` // The time when the payout was last updated
+}
+
+const (
+	TABLE_NAME_PAYOUT = "payouts"
+
+	FIELD_PAYOUT_STATUS          = "status"
+	FIELD_PAYOUT_STRIPE_ID       = "stripe_id"
+	FIELD_PAYOUT_CAMPAIGN_ID     = "campaign_id"
+	FIELD_PAYOUT_CLAIMER_ID      = "claimer_id"
+	FIELD_PAYOUT_NEXT_ATTEMPT_AT = "next_attempt_at"
+
+	// Statuses of payouts
+	PAYOUT_STATUS_PENDING          = "pending"          // The transfer hasn't been made yet
+	PAYOUT_STATUS_AWAITING_ACCOUNT = "awaiting_account" // The claimer has to link a Stripe Connect account first
+	PAYOUT_STATUS_TRANSFERRED      = "transferred"      // The transfer was made, and is on its way to the claimer's account
+	PAYOUT_STATUS_PAID             = "paid"             // The transfer arrived in the claimer's account
+	PAYOUT_STATUS_FAILED           = "failed"           // Stripe turned the transfer down, or it failed; someone has to look into it
+	PAYOUT_STATUS_SKIPPED          = "skipped"          // There was nothing left in escrow to transfer
+
+	SQL_SCHEDULE_PAYOUT = `
+		INSERT INTO ` + TABLE_NAME_PAYOUT + `
+		(currency, campaign_id, claimer_id, next_attempt_at, created_at, updated_at) VALUES
+		($1, $2, $3, $4, $4, $4)
+		ON CONFLICT (` + FIELD_PAYOUT_CAMPAIGN_ID + `) DO NOTHING;
+	`
+	SQL_SELECT_DUE_PAYOUTS = `
+		SELECT * FROM ` + TABLE_NAME_PAYOUT + `
+		WHERE (` + FIELD_PAYOUT_STATUS + ` = '` + PAYOUT_STATUS_PENDING + `') AND (` + FIELD_PAYOUT_NEXT_ATTEMPT_AT + ` <= $1)
+		ORDER BY ` + FIELD_PAYOUT_NEXT_ATTEMPT_AT + `, id
+		LIMIT $2;
+	`
+	SQL_SELECT_PAYOUT_BY_ID_FOR_UPDATE = `
+		SELECT * FROM ` + TABLE_NAME_PAYOUT + ` WHERE (id = $1) FOR UPDATE;
+	`
+	SQL_SELECT_PAYOUT_BY_STRIPE_ID_FOR_UPDATE = `
+		SELECT * FROM ` + TABLE_NAME_PAYOUT + ` WHERE (` + FIELD_PAYOUT_STRIPE_ID + ` = $1) FOR UPDATE;
+	`
+	SQL_SELECT_PAYOUT_BY_CAMPAIGN_ID = `
+		SELECT * FROM ` + TABLE_NAME_PAYOUT + ` WHERE (` + FIELD_PAYOUT_CAMPAIGN_ID + ` = $1);
+	`
+	SQL_COMPLETE_PAYOUT = `
+		UPDATE ` + TABLE_NAME_PAYOUT + ` SET ` + FIELD_PAYOUT_STATUS + ` = $2, amount = $3, ` + FIELD_PAYOUT_STRIPE_ID + ` = $4, last_error = '', updated_at = $5
+		WHERE (id = $1);
+	`
+	SQL_SET_PAYOUT_STATUS = `
+		UPDATE ` + TABLE_NAME_PAYOUT + ` SET ` + FIELD_PAYOUT_STATUS + ` = $2, last_error = $3, updated_at = $4
+		WHERE (id = $1);
+	`
+	SQL_RECORD_PAYOUT_FAILURE = `
+		UPDATE ` + TABLE_NAME_PAYOUT + ` SET ` + FIELD_PAYOUT_STATUS + ` = $2, attempts = attempts + 1, last_error = $3, ` + FIELD_PAYOUT_NEXT_ATTEMPT_AT + ` = $4, updated_at = $5
+		WHERE (id = $1);
+	`
+	SQL_RESUME_CLAIMER_PAYOUTS = `
+		UPDATE ` + TABLE_NAME_PAYOUT + ` SET ` + FIELD_PAYOUT_STATUS + ` = '` + PAYOUT_STATUS_PENDING + `', ` + FIELD_PAYOUT_NEXT_ATTEMPT_AT + ` = $2, updated_at = $2
+		WHERE (` + FIELD_PAYOUT_CLAIMER_ID + ` = $1) AND (` + FIELD_PAYOUT_STATUS + ` = '` + PAYOUT_STATUS_AWAITING_ACCOUNT + `');
+	`
+)
+
+// Returns pointers to every column of a payout row, in table order, for use with Scan
+func (p *Payout) columns() []interface{} {
+	return []interface{}{&p.Id, &p.Status, &p.StripeId, &p.Amount.Amount, &p.Amount.Currency, &p.Attempts, &p.LastError, &p.CampaignId, &p.ClaimerId, &p.NextAttemptAt, &p.CreatedAt, &p.UpdatedAt}
+}
+
+// Schedules the Payout of a claimed campaign; does nothing if it was already scheduled
+func SchedulePayout(
+	db Queryable, // The database
+	campaignId int64, // The id of the campaign being paid out
+	claimerId int64, // The id of the user whose claim won
+	currency string, // The currency of the campaign
+) error {
+	_, err := db.Exec(SQL_SCHEDULE_PAYOUT, currency, campaignId, claimerId, time.Now())
+	return err
+}
+
+// Finds up to limit pending payouts that are due to be attempted, most overdue first
+func FindDuePayouts(
+	db Queryable,
+	now time.Time,
+	limit int,
+) ([]*Payout, error) {
+	payouts := make([]*Payout, 0, limit)
+	rows, err := db.Query(SQL_SELECT_DUE_PAYOUTS, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	// Read the rows
+	defer rows.Close()
+	for rows.Next() {
+		var currentPayout Payout
+		if err = rows.Scan(currentPayout.columns()...); err != nil {
+			return nil, err
+		}
+		payouts = append(payouts, &currentPayout)
+	}
+	return payouts, rows.Err()
+}
+
+// Gets a Payout from the database by id and locks it until the end of the
+// transaction; db should be a transaction
+func GetPayoutForUpdate(
+	db Queryable,
+	id int64,
+) (*Payout, error) {
+	return findPayout(db, SQL_SELECT_PAYOUT_BY_ID_FOR_UPDATE, id)
+}
+
+// Gets the Payout made with a Stripe transfer and locks it until the end of
+// the transaction; db should be a transaction
+func GetPayoutByStripeIdForUpdate(
+	db Queryable,
+	stripeId string,
+) (*Payout, error) {
+	return findPayout(db, SQL_SELECT_PAYOUT_BY_STRIPE_ID_FOR_UPDATE, stripeId)
+}
+
+// Gets the Payout of a campaign
+func GetPayoutByCampaignId(
+	db Queryable,
+	campaignId int64,
+) (*Payout, error) {
+	return findPayout(db, SQL_SELECT_PAYOUT_BY_CAMPAIGN_ID, campaignId)
+}
+
+// Reads a single Payout using the specified query
+func findPayout(
+	db Queryable,
+	query string,
+	arg interface{},
+) (*Payout, error) {
+	var payout Payout
+	err := db.QueryRow(query, arg).Scan(payout.columns()...)
+	if err == sql.ErrNoRows {
+		return nil, PUBERR_ENTITY_NOT_FOUND
+	} else if err != nil {
+		return nil, err
+	} else {
+		return &payout, nil
+	}
+}
+
+// Records that the transfer of a Payout was made, or that there was nothing to transfer
+func CompletePayout(
+	db Queryable, // The database
+	id int64, // The id of the payout
+	status string, // Either PAYOUT_STATUS_TRANSFERRED or PAYOUT_STATUS_SKIPPED
+	amount Money, // The amount transferred
+	stripeId string, // The id of the Stripe transfer, if one was made
+) error {
+	_, err := db.Exec(SQL_COMPLETE_PAYOUT, id, status, amount.Amount, stripeId, time.Now())
+	return err
+}
+
+// Moves a Payout on to another status
+func SetPayoutStatus(
+	db Queryable, // The database
+	id int64, // The id of the payout
+	status string, // One of the PAYOUT_STATUS_* constants
+	reason string, // Why, if the payout didn't go through
+) error {
+	_, err := db.Exec(SQL_SET_PAYOUT_STATUS, id, status, reason, time.Now())
+	return err
+}
+
+// Records that making the transfer of a Payout failed, and when to try again
+func RecordPayoutFailure(
+	db Queryable, // The database
+	id int64, // The id of the payout
+	status string, // PAYOUT_STATUS_PENDING to try again, or PAYOUT_STATUS_FAILED to give up
+	reason string, // Why the transfer failed
+	nextAttemptAt time.Time, // When to try again
+) error {
+	_, err := db.Exec(SQL_RECORD_PAYOUT_FAILURE, id, status, reason, nextAttemptAt, time.Now())
+	return err
+}
+
+// Makes the payouts that were waiting for a claimer to link a Stripe Connect account due right away
+func ResumeClaimerPayouts(
+	db Queryable,
+	claimerId int64,
+) error {
+	_, err := db.Exec(SQL_RESUME_CLAIMER_PAYOUTS, claimerId, time.Now())
+	return err
+}
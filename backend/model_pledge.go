@@ -0,0 +1,288 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+// The Pledge model represents a user's commitment to contribute an amount to
+// a Campaign every month. Each billing cycle charges the contributor and makes
+// a Contribution; declined charges are retried on a dunning schedule
+type Pledge struct {
+	Id        int64  `json:"id"`        // The identifier of the pledge
+	Amount    Money  `json:"amount"`    // The amount contributed every month
+	Status    string `json:"status"`    // Whether the pledge is "active", "past_due", "paused" or "canceled"
+	Attempts  int64  `json:"attempts"`  // How many times the charge of the current billing cycle was declined
+	LastError string `json:"lastError"` // Why the last charge was declined, or why the pledge was canceled
+
+	ContributorId int64 `json:"contributorId"` // The id of the contributor; Foreign key for User (belongs to)
+	CampaignId    int64 `json:"campaignId"`    // The id of the campaign; Foreign key for Campaign (belongs to)
+
+	BillingDay    int64     `json:"billingDay"`   // The day of the month billing cycles start on, in UTC; they start on the last day of shorter months
+	NextChargeAt  time.Time `json:"nextChargeAt"` // The start of the next billing cycle
+	NextAttemptAt time.Time `json:"-"`            // The time when the contributor is next charged; later than NextChargeAt while past due
+	CreatedAt     time.Time `json:"createdAt"`    // The time when the pledge was made
+	UpdatedAt     time.Time `json:"updatedAt"`    // The time when the pledge was last updated
+}
+
+const (
+	TABLE_NAME_PLEDGE = "pledges"
+
+	FIELD_PLEDGE_STATUS          = "status"
+	FIELD_PLEDGE_CONTRIBUTOR_ID  = "contributor_id"
+	FIELD_PLEDGE_CAMPAIGN_ID     = "campaign_id"
+	FIELD_PLEDGE_NEXT_ATTEMPT_AT = "next_attempt_at"
+
+	// Statuses of pledges
+	PLEDGE_STATUS_ACTIVE   = "active"   // The contributor is charged every billing cycle
+	PLEDGE_STATUS_PAST_DUE = "past_due" // The charge of the current billing cycle was declined, and is being retried
+	PLEDGE_STATUS_PAUSED   = "paused"   // The contributor stopped the charges for now
+	PLEDGE_STATUS_CANCELED = "canceled" // The charges stopped for good
+
+	SQL_CREATE_NEW_PLEDGE = `
+		INSERT INTO ` + TABLE_NAME_PLEDGE + `
+		(amount, currency, contributor_id, campaign_id, billing_day, next_charge_at, next_attempt_at, created_at, updated_at) VALUES
+		($1, $2, $3, $4, $5, $6, $6, $6, $6) RETURNING id;
+	`
+	SQL_SELECT_PLEDGE_BY_ID = `
+		SELECT * FROM ` + TABLE_NAME_PLEDGE + ` WHERE (id = $1);
+	`
+	SQL_SELECT_PLEDGE_BY_ID_FOR_UPDATE = `
+		SELECT * FROM ` + TABLE_NAME_PLEDGE + ` WHERE (id = $1) FOR UPDATE;
+	`
+	SQL_SELECT_PLEDGES_BY_CONTRIBUTOR_ID = `
+		SELECT * FROM ` + TABLE_NAME_PLEDGE + `
+		WHERE (` + FIELD_PLEDGE_CONTRIBUTOR_ID + ` = $1)
+		ORDER BY id DESC;
+	`
+	SQL_SELECT_DUE_PLEDGE_IDS = `
+		SELECT id FROM ` + TABLE_NAME_PLEDGE + `
+		WHERE (` + FIELD_PLEDGE_STATUS + ` IN ('` + PLEDGE_STATUS_ACTIVE + `', '` + PLEDGE_STATUS_PAST_DUE + `')) AND (` + FIELD_PLEDGE_NEXT_ATTEMPT_AT + ` <= $1)
+		ORDER BY ` + FIELD_PLEDGE_NEXT_ATTEMPT_AT + `, id
+		LIMIT $2;
+	`
+	SQL_SELECT_HAS_OPEN_PLEDGE = `
+		SELECT EXISTS(
+			SELECT 1 FROM ` + TABLE_NAME_PLEDGE + `
+			WHERE (` + FIELD_PLEDGE_CONTRIBUTOR_ID + ` = $1) AND (` + FIELD_PLEDGE_CAMPAIGN_ID + ` = $2) AND (` + FIELD_PLEDGE_STATUS + ` <> '` + PLEDGE_STATUS_CANCELED + `')
+		);
+	`
+	SQL_ADVANCE_PLEDGE = `
+		UPDATE ` + TABLE_NAME_PLEDGE + ` SET ` + FIELD_PLEDGE_STATUS + ` = '` + PLEDGE_STATUS_ACTIVE + `', attempts = 0, last_error = '', next_charge_at = $2, ` + FIELD_PLEDGE_NEXT_ATTEMPT_AT + ` = $2, updated_at = $3
+		WHERE (id = $1);
+	`
+	SQL_RECORD_PLEDGE_FAILURE = `
+		UPDATE ` + TABLE_NAME_PLEDGE + ` SET ` + FIELD_PLEDGE_STATUS + ` = $2, attempts = attempts + 1, last_error = $3, ` + FIELD_PLEDGE_NEXT_ATTEMPT_AT + ` = $4, updated_at = $5
+		WHERE (id = $1);
+	`
+	SQL_DELAY_PLEDGE = `
+		UPDATE ` + TABLE_NAME_PLEDGE + ` SET ` + FIELD_PLEDGE_NEXT_ATTEMPT_AT + ` = $2, updated_at = $3
+		WHERE (id = $1);
+	`
+	SQL_SET_PLEDGE_STATUS = `
+		UPDATE ` + TABLE_NAME_PLEDGE + ` SET ` + FIELD_PLEDGE_STATUS + ` = $2, last_error = $3, updated_at = $4
+		WHERE (id = $1);
+	`
+	SQL_CANCEL_CAMPAIGN_PLEDGES = `
+		UPDATE ` + TABLE_NAME_PLEDGE + ` SET ` + FIELD_PLEDGE_STATUS + ` = '` + PLEDGE_STATUS_CANCELED + `', last_error = $2, updated_at = $3
+		WHERE (` + FIELD_PLEDGE_CAMPAIGN_ID + ` = $1) AND (` + FIELD_PLEDGE_STATUS + ` <> '` + PLEDGE_STATUS_CANCELED + `');
+	`
+	SQL_RESUME_PLEDGE = `
+		UPDATE ` + TABLE_NAME_PLEDGE + ` SET ` + FIELD_PLEDGE_STATUS + ` = '` + PLEDGE_STATUS_ACTIVE + `', attempts = 0, last_error = '',
+			next_charge_at = GREATEST(next_charge_at, $2), ` + FIELD_PLEDGE_NEXT_ATTEMPT_AT + ` = GREATEST(next_charge_at, $2), updated_at = $2
+		WHERE (id = $1);
+	`
+)
+
+// Returns the start of the billing cycle after the one that starts at from:
+// the same time of day, on the billing day of the next month or on its last
+// day if the month is shorter. Dates are in UTC, as billing days are
+func (p *Pledge) NextBillingDate(from time.Time) time.Time {
+	from = from.UTC()
+	year, month, _ := from.Date()
+	// Day 0 of the month after next is the last day of the next month
+	lastDay := int64(time.Date(year, month+2, 0, 0, 0, 0, 0, time.UTC).Day())
+	day := p.BillingDay
+	if day > lastDay {
+		day = lastDay
+	}
+	return time.Date(year, month+1, int(day), from.Hour(), from.Minute(), from.Second(), from.Nanosecond(), time.UTC)
+}
+
+// Returns pointers to every column of a pledge row, in table order, for use with Scan
+func (p *Pledge) columns() []interface{} {
+	return []interface{}{&p.Id, &p.Amount.Amount, &p.Amount.Currency, &p.Status, &p.Attempts, &p.LastError, &p.ContributorId, &p.CampaignId, &p.NextChargeAt, &p.NextAttemptAt, &p.CreatedAt, &p.UpdatedAt, &p.BillingDay}
+}
+
+// Creates a new Pledge in the database; the first billing cycle starts right
+// away, and later ones on the same day of the month. Returns the id of the new pledge
+func CreateNewPledge(
+	db Queryable, // The database
+	Amount Money, // The amount contributed every month
+	ContributorId int64, // The id of the contributor
+	CampaignId int64, // The id of the campaign
+) (int64, error) {
+	var (
+		id  int64
+		now = time.Now()
+	)
+	err := db.QueryRow(SQL_CREATE_NEW_PLEDGE, Amount.Amount, Amount.Currency, ContributorId, CampaignId, now.UTC().Day(), now).Scan(&id)
+	if err != nil {
+		return -1, err
+	} else {
+		return id, nil
+	}
+}
+
+// Gets a Pledge from the database by id
+func GetPledge(
+	db Queryable,
+	id int64,
+) (*Pledge, error) {
+	return findPledge(db, SQL_SELECT_PLEDGE_BY_ID, id)
+}
+
+// Gets a Pledge from the database by id and locks it until the end of the
+// transaction; db should be a transaction
+func GetPledgeForUpdate(
+	db Queryable,
+	id int64,
+) (*Pledge, error) {
+	return findPledge(db, SQL_SELECT_PLEDGE_BY_ID_FOR_UPDATE, id)
+}
+
+// Reads a single Pledge using the specified query
+func findPledge(
+	db Queryable,
+	query string,
+	arg interface{},
+) (*Pledge, error) {
+	var pledge Pledge
+	err := db.QueryRow(query, arg).Scan(pledge.columns()...)
+	if err == sql.ErrNoRows {
+		return nil, PUBERR_ENTITY_NOT_FOUND
+	} else if err != nil {
+		return nil, err
+	} else {
+		return &pledge, nil
+	}
+}
+
+// Finds every Pledge a user made, newest first
+func FindPledgesByContributorId(
+	db Queryable,
+	contributorId int64,
+) ([]*Pledge, error) {
+	pledges := []*Pledge{}
+	rows, err := db.Query(SQL_SELECT_PLEDGES_BY_CONTRIBUTOR_ID, contributorId)
+	if err != nil {
+		return nil, err
+	}
+	// Read the rows
+	defer rows.Close()
+	for rows.Next() {
+		var currentPledge Pledge
+		if err = rows.Scan(currentPledge.columns()...); err != nil {
+			return nil, err
+		}
+		pledges = append(pledges, &currentPledge)
+	}
+	return pledges, rows.Err()
+}
+
+// Finds the ids of up to limit pledges whose contributors are due to be charged, most overdue first
+func FindDuePledgeIds(
+	db Queryable,
+	now time.Time,
+	limit int,
+) ([]int64, error) {
+	ids := make([]int64, 0, limit)
+	rows, err := db.Query(SQL_SELECT_DUE_PLEDGE_IDS, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	// Read the rows
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Returns true if a user has a pledge to a campaign that wasn't canceled
+func HasOpenPledge(
+	db Queryable,
+	contributorId int64,
+	campaignId int64,
+) (bool, error) {
+	var exists bool
+	err := db.QueryRow(SQL_SELECT_HAS_OPEN_PLEDGE, contributorId, campaignId).Scan(&exists)
+	return exists, err
+}
+
+// Records that the contributor of a Pledge was charged, and starts the next billing cycle
+func AdvancePledge(
+	db Queryable, // The database
+	id int64, // The id of the pledge
+	nextChargeAt time.Time, // The start of the next billing cycle
+) error {
+	_, err := db.Exec(SQL_ADVANCE_PLEDGE, id, nextChargeAt, time.Now())
+	return err
+}
+
+// Records that charging the contributor of a Pledge was declined, and when to try again
+func RecordPledgeFailure(
+	db Queryable, // The database
+	id int64, // The id of the pledge
+	status string, // PLEDGE_STATUS_PAST_DUE to try again, or PLEDGE_STATUS_CANCELED to give up
+	reason string, // Why the charge was declined
+	nextAttemptAt time.Time, // When to try again
+) error {
+	_, err := db.Exec(SQL_RECORD_PLEDGE_FAILURE, id, status, reason, nextAttemptAt, time.Now())
+	return err
+}
+
+// Puts off the next attempt at charging a Pledge without counting it as declined
+func DelayPledge(
+	db Queryable, // The database
+	id int64, // The id of the pledge
+	nextAttemptAt time.Time, // When to try again
+) error {
+	_, err := db.Exec(SQL_DELAY_PLEDGE, id, nextAttemptAt, time.Now())
+	return err
+}
+
+// Moves a Pledge on to another status
+func SetPledgeStatus(
+	db Queryable, // The database
+	id int64, // The id of the pledge
+	status string, // One of the PLEDGE_STATUS_* constants
+	reason string, // Why, if the pledge was canceled for the contributor
+) error {
+	_, err := db.Exec(SQL_SET_PLEDGE_STATUS, id, status, reason, time.Now())
+	return err
+}
+
+// Restarts the charges of a paused Pledge; billing cycles that were missed while
+// paused are skipped, so the next one starts right away if it is overdue
+func ResumePledge(
+	db Queryable,
+	id int64,
+) error {
+	_, err := db.Exec(SQL_RESUME_PLEDGE, id, time.Now())
+	return err
+}
+
+// Cancels every Pledge to a campaign that wasn't canceled already
+func CancelCampaignPledges(
+	db Queryable, // The database
+	campaignId int64, // The id of the campaign
+	reason string, // Why the pledges were canceled
+) error {
+	_, err := db.Exec(SQL_CANCEL_CAMPAIGN_PLEDGES, campaignId, reason, time.Now())
+	return err
+}
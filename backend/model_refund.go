@@ -0,0 +1,125 @@
+package main
+
+import (
+	"time"
+)
+
+// The Refund model represents the return of a Contribution to its contributor.
+// Refunds are issued in the background and retried until they go through, so
+// each one records how far it got
+type Refund struct {
+	Id        int64  `json:"id"`       // The identifier of the refund
+	Status    string `json:"status"`   // Whether the refund is "pending", "succeeded", "failed" or "skipped"
+	StripeId  string `json:"stripeId"` // The id of the Stripe refund; empty until it succeeds
+	Attempts  int64  `json:"attempts"` // How many times issuing the refund has failed
+	LastError string `json:"-"`        // Why issuing the refund last failed
+
+	ContributionId int64 `json:"-"` // The id of the contribution being refunded; Foreign key for Contribution (belongs to)
+	CampaignId     int64 `json:"-"` // The id of the campaign the contribution was made to; Foreign key for Campaign (belongs to)
+
+	NextAttemptAt time.Time `json:"-"`         // The time when issuing the refund is next attempted
+	CreatedAt     time.Time `json:"createdAt"` // The time when the refund was scheduled
+	UpdatedAt     time.Time `json:"updatedAt"` // The time when the refund was last updated
+}
+
+const (
+	TABLE_NAME_REFUND = "refunds"
+
+	FIELD_REFUND_STATUS          = "status"
+	FIELD_REFUND_CONTRIBUTION_ID = "contribution_id"
+	FIELD_REFUND_NEXT_ATTEMPT_AT = "next_attempt_at"
+
+	// Statuses of refunds
+	REFUND_STATUS_PENDING   = "pending"   // The refund hasn't gone through yet
+	REFUND_STATUS_SUCCEEDED = "succeeded" // The money was refunded, or the authorization released
+	REFUND_STATUS_FAILED    = "failed"    // Stripe turned the refund down, or it failed too many times; someone has to look into it
+	REFUND_STATUS_SKIPPED   = "skipped"   // The contribution had already been refunded or released some other way
+
+	SQL_SCHEDULE_CAMPAIGN_REFUNDS = `
+		INSERT INTO ` + TABLE_NAME_REFUND + `
+		(contribution_id, campaign_id, next_attempt_at, created_at, updated_at)
+			SELECT id, campaign_id, $2, $2, $2 FROM ` + TABLE_NAME_CONTRIBUTION + `
+			WHERE (` + FIELD_CONTRIBUTION_CAMPAIGN_ID + ` = $1) AND active
+				AND (` + FIELD_CONTRIBUTION_STATUS + ` IN ('` + CONTRIBUTION_STATUS_AUTHORIZED + `', '` + CONTRIBUTION_STATUS_CAPTURED + `'))
+		ON CONFLICT (` + FIELD_REFUND_CONTRIBUTION_ID + `) DO NOTHING;
+	`
+	SQL_SELECT_DUE_REFUNDS = `
+		SELECT * FROM ` + TABLE_NAME_REFUND + `
+		WHERE (` + FIELD_REFUND_STATUS + ` = '` + REFUND_STATUS_PENDING + `') AND (` + FIELD_REFUND_NEXT_ATTEMPT_AT + ` <= $1)
+		ORDER BY ` + FIELD_REFUND_NEXT_ATTEMPT_AT + `, id
+		LIMIT $2;
+	`
+	SQL_COMPLETE_REFUND = `
+		UPDATE ` + TABLE_NAME_REFUND + ` SET ` + FIELD_REFUND_STATUS + ` = $2, stripe_id = $3, updated_at = $4
+		WHERE (id = $1) AND (` + FIELD_REFUND_STATUS + ` = '` + REFUND_STATUS_PENDING + `');
+	`
+	SQL_RECORD_REFUND_FAILURE = `
+		UPDATE ` + TABLE_NAME_REFUND + ` SET ` + FIELD_REFUND_STATUS + ` = $2, attempts = attempts + 1, last_error = $3, ` + FIELD_REFUND_NEXT_ATTEMPT_AT + ` = $4, updated_at = $5
+		WHERE (id = $1) AND (` + FIELD_REFUND_STATUS + ` = '` + REFUND_STATUS_PENDING + `');
+	`
+)
+
+// Returns pointers to every column of a refund row, in table order, for use with Scan
+func (r *Refund) columns() []interface{} {
+	return []interface{}{&r.Id, &r.Status, &r.StripeId, &r.Attempts, &r.LastError, &r.ContributionId, &r.CampaignId, &r.NextAttemptAt, &r.CreatedAt, &r.UpdatedAt}
+}
+
+// Schedules a Refund for every contribution to a campaign that was authorized
+// or captured; contributions that already have one are left alone. Returns how
+// many refunds were scheduled
+func ScheduleCampaignRefunds(
+	db Queryable,
+	campaignId int64,
+) (int64, error) {
+	result, err := db.Exec(SQL_SCHEDULE_CAMPAIGN_REFUNDS, campaignId, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Finds up to limit pending refunds that are due to be attempted, most overdue first
+func FindDueRefunds(
+	db Queryable,
+	now time.Time,
+	limit int,
+) ([]*Refund, error) {
+	refunds := make([]*Refund, 0, limit)
+	rows, err := db.Query(SQL_SELECT_DUE_REFUNDS, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	// Read the rows
+	defer rows.Close()
+	for rows.Next() {
+		var currentRefund Refund
+		if err = rows.Scan(currentRefund.columns()...); err != nil {
+			return nil, err
+		}
+		refunds = append(refunds, &currentRefund)
+	}
+	return refunds, rows.Err()
+}
+
+// Records that a pending Refund went through, or was skipped
+func CompleteRefund(
+	db Queryable, // The database
+	id int64, // The id of the refund
+	status string, // Either REFUND_STATUS_SUCCEEDED or REFUND_STATUS_SKIPPED
+	stripeId string, // The id of the Stripe refund, if one was issued
+) error {
+	_, err := db.Exec(SQL_COMPLETE_REFUND, id, status, stripeId, time.Now())
+	return err
+}
+
+// Records that issuing a pending Refund failed, and when to try again
+func RecordRefundFailure(
+	db Queryable, // The database
+	id int64, // The id of the refund
+	status string, // REFUND_STATUS_PENDING to try again, or REFUND_STATUS_FAILED to give up
+	reason string, // Why the refund failed
+	nextAttemptAt time.Time, // When to try again
+) error {
+	_, err := db.Exec(SQL_RECORD_REFUND_FAILURE, id, status, reason, nextAttemptAt, time.Now())
+	return err
+}
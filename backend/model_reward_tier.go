@@ -0,0 +1,180 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"github.com/lib/pq"
+	"time"
+)
+
+// The RewardTier model represents a perk that a Campaign offers to those who
+// contribute at least a minimum amount, optionally in limited quantity
+type RewardTier struct {
+	Id                int64         `json:"id"`                // The identifier of the reward tier
+	Title             string        `json:"title"`             // The title of the reward tier
+	Description       string        `json:"description"`       // What backers of the tier get
+	MinAmount         Money         `json:"minAmount"`         // The least a contribution has to be to select the tier
+	Quantity          sql.NullInt64 `json:"-"`                 // How many backers may select the tier; null if unlimited
+	Claimed           int64         `json:"claimed"`           // How many backers have selected the tier
+	EstimatedDelivery time.Time     `json:"estimatedDelivery"` // When the reward is expected to reach backers
+
+	CampaignId int64 `json:"-"` // The id of the campaign; Foreign key for Campaign (belongs to)
+
+	Active    bool        `json:"active"`    // True if this entity has not been soft deleted
+	CreatedAt time.Time   `json:"createdAt"` // The time when this reward tier was created
+	UpdatedAt time.Time   `json:"updatedAt"` // The time when this reward tier was last updated
+	DeletedAt pq.NullTime `json:"-"`         // The time when this reward tier was soft deleted
+}
+
+const (
+	TABLE_NAME_REWARD_TIER = "reward_tiers"
+
+	FIELD_REWARD_TIER_TITLE              = "title"
+	FIELD_REWARD_TIER_DESCRIPTION        = "description"
+	FIELD_REWARD_TIER_ESTIMATED_DELIVERY = "estimated_delivery"
+	FIELD_REWARD_TIER_CAMPAIGN_ID        = "campaign_id"
+	FIELD_REWARD_TIER_QUANTITY           = "quantity"
+	FIELD_REWARD_TIER_CLAIMED            = "claimed"
+
+	SQL_CREATE_NEW_REWARD_TIER = `
+		INSERT INTO ` + TABLE_NAME_REWARD_TIER + `
+		(title, description, min_amount, currency, quantity, estimated_delivery, campaign_id, active, created_at, updated_at) VALUES
+		($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id;
+	`
+	SQL_SELECT_REWARD_TIER_BY_ID = `
+		SELECT * FROM ` + TABLE_NAME_REWARD_TIER + ` WHERE (id = $1) AND active;
+	`
+	SQL_SELECT_REWARD_TIERS_BY_CAMPAIGN_ID = `
+		SELECT * FROM ` + TABLE_NAME_REWARD_TIER + `
+		WHERE (` + FIELD_REWARD_TIER_CAMPAIGN_ID + ` = $1) AND active
+		ORDER BY min_amount, id;
+	`
+	// Only claims the tier while there is some left, so that concurrent contributions can't oversell it
+	SQL_CLAIM_REWARD_TIER = `
+		UPDATE ` + TABLE_NAME_REWARD_TIER + ` SET ` + FIELD_REWARD_TIER_CLAIMED + ` = ` + FIELD_REWARD_TIER_CLAIMED + ` + 1, updated_at = $2
+		WHERE (id = $1) AND ((` + FIELD_REWARD_TIER_QUANTITY + ` IS NULL) OR (` + FIELD_REWARD_TIER_CLAIMED + ` < ` + FIELD_REWARD_TIER_QUANTITY + `));
+	`
+	SQL_RELEASE_REWARD_TIER = `
+		UPDATE ` + TABLE_NAME_REWARD_TIER + ` SET ` + FIELD_REWARD_TIER_CLAIMED + ` = ` + FIELD_REWARD_TIER_CLAIMED + ` - 1, updated_at = $2
+		WHERE (id = $1) AND (` + FIELD_REWARD_TIER_CLAIMED + ` > 0);
+	`
+)
+
+// The columns of a reward tier that UpdateFields may change; the minimum and
+// quantity are left alone since backers already chose the tier by them
+var rewardTierUpdatableFields = map[string]bool{
+	FIELD_REWARD_TIER_TITLE:              true,
+	FIELD_REWARD_TIER_DESCRIPTION:        true,
+	FIELD_REWARD_TIER_ESTIMATED_DELIVERY: true,
+}
+
+// Returns pointers to every column of a reward tier row, in table order, for use with Scan
+func (t *RewardTier) columns() []interface{} {
+	return []interface{}{&t.Id, &t.Title, &t.Description, &t.MinAmount.Amount, &t.MinAmount.Currency, &t.Quantity, &t.Claimed, &t.EstimatedDelivery, &t.CampaignId, &t.Active, &t.CreatedAt, &t.UpdatedAt, &t.DeletedAt}
+}
+
+// Adds the quantity and how many are left; both are null if the tier is unlimited
+func (t RewardTier) MarshalJSON() ([]byte, error) {
+	type rewardTier RewardTier
+	var quantity, remaining *int64
+	if t.Quantity.Valid {
+		left := t.Remaining()
+		quantity, remaining = &t.Quantity.Int64, &left
+	}
+	return json.Marshal(struct {
+		rewardTier
+		Quantity  *int64 `json:"quantity"`  // How many backers may select the tier
+		Remaining *int64 `json:"remaining"` // How many more backers may select the tier
+	}{rewardTier(t), quantity, remaining})
+}
+
+// Returns how many more backers may select the tier; only meaningful if it is limited
+func (t *RewardTier) Remaining() int64 {
+	if remaining := t.Quantity.Int64 - t.Claimed; remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// Creates a new RewardTier in the database; returns the id of the new reward tier
+func CreateNewRewardTier(
+	db Queryable, // The database
+	Title string, // The title of the reward tier
+	Description string, // What backers of the tier get
+	MinAmount Money, // The least a contribution has to be to select the tier; in the campaign's currency
+	Quantity sql.NullInt64, // How many backers may select the tier; null if unlimited
+	EstimatedDelivery time.Time, // When the reward is expected to reach backers
+	CampaignId int64, // The id of the campaign offering the tier
+) (int64, error) {
+	var (
+		id  int64
+		now = time.Now()
+	)
+	err := db.QueryRow(SQL_CREATE_NEW_REWARD_TIER, Title, Description, MinAmount.Amount, MinAmount.Currency, Quantity, EstimatedDelivery, CampaignId, true, now, now).Scan(&id)
+	if err != nil {
+		return -1, err
+	} else {
+		return id, nil
+	}
+}
+
+// Gets a RewardTier from the database by id; soft deleted tiers are left out
+func GetRewardTier(
+	db Queryable,
+	id int64,
+) (*RewardTier, error) {
+	var tier RewardTier
+	err := db.QueryRow(SQL_SELECT_REWARD_TIER_BY_ID, id).Scan(tier.columns()...)
+	if err == sql.ErrNoRows {
+		return nil, PUBERR_ENTITY_NOT_FOUND
+	} else if err != nil {
+		return nil, err
+	} else {
+		return &tier, nil
+	}
+}
+
+// Finds the RewardTiers a specific campaign offers, cheapest first
+func FindRewardTiersByCampaignId(
+	db Queryable,
+	campaignId int64,
+) ([]*RewardTier, error) {
+	tiers := make([]*RewardTier, 0)
+	rows, err := db.Query(SQL_SELECT_REWARD_TIERS_BY_CAMPAIGN_ID, campaignId)
+	if err != nil {
+		return nil, err
+	}
+	// Read the rows
+	defer rows.Close()
+	for rows.Next() {
+		var currentTier RewardTier
+		if err = rows.Scan(currentTier.columns()...); err != nil {
+			return nil, err
+		}
+		tiers = append(tiers, &currentTier)
+	}
+	return tiers, rows.Err()
+}
+
+// Claims one of a RewardTier for a backer. Returns false, leaving the tier
+// untouched, if none are left
+func ClaimRewardTier(
+	db Queryable,
+	id int64,
+) (bool, error) {
+	result, err := db.Exec(SQL_CLAIM_REWARD_TIER, id, time.Now())
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// Gives back one of a RewardTier, e.g. because the contribution that claimed it was refunded
+func ReleaseRewardTier(
+	db Queryable,
+	id int64,
+) error {
+	_, err := db.Exec(SQL_RELEASE_REWARD_TIER, id, time.Now())
+	return err
+}
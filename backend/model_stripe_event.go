@@ -0,0 +1,158 @@
+package main
+
+import (
+	"database/sql"
+	"github.com/lib/pq"
+	"time"
+)
+
+// The StripeEvent model represents a webhook event received from Stripe. Every
+// event is stored before it is processed, so that failures can be retried and
+// events can be replayed
+type StripeEvent struct {
+	Id        int64  `json:"id"`        // The identifier of the event
+	StripeId  string `json:"stripeId"`  // The id Stripe gave the event; events are only stored once
+	Type      string `json:"type"`      // The type of the event, e.g. "charge.refunded"
+	Payload   []byte `json:"-"`         // The body of the webhook request
+	Attempts  int64  `json:"attempts"`  // How many times processing the event has failed
+	LastError string `json:"lastError"` // Why processing the event last failed
+
+	ProcessedAt pq.NullTime `json:"processedAt"` // The time when the event was processed; null until then
+	CreatedAt   time.Time   `json:"createdAt"`   // The time when the event was received
+	UpdatedAt   time.Time   `json:"updatedAt"`   // The time when the event was last updated
+}
+
+const (
+	STRIPE_EVENT_MAX_ATTEMPTS = 10 // How many times processing an event may fail before it is only processed on replay
+
+	TABLE_NAME_STRIPE_EVENT = "stripe_events"
+
+	FIELD_STRIPE_EVENT_STRIPE_ID    = "stripe_id"
+	FIELD_STRIPE_EVENT_PROCESSED_AT = "processed_at"
+
+	SQL_CREATE_NEW_STRIPE_EVENT = `
+		INSERT INTO ` + TABLE_NAME_STRIPE_EVENT + `
+		(stripe_id, type, payload, created_at, updated_at) VALUES
+		($1, $2, $3, $4, $5)
+		ON CONFLICT (` + FIELD_STRIPE_EVENT_STRIPE_ID + `) DO NOTHING
+		RETURNING id;
+	`
+	SQL_SELECT_STRIPE_EVENT_BY_ID_FOR_UPDATE = `
+		SELECT * FROM ` + TABLE_NAME_STRIPE_EVENT + ` WHERE (id = $1) FOR UPDATE;
+	`
+	SQL_SELECT_STRIPE_EVENT_IDS_BY_STRIPE_ID = `
+		SELECT id FROM ` + TABLE_NAME_STRIPE_EVENT + ` WHERE (` + FIELD_STRIPE_EVENT_STRIPE_ID + ` = ANY($1)) ORDER BY created_at;
+	`
+	SQL_SELECT_UNPROCESSED_STRIPE_EVENT_IDS = `
+		SELECT id FROM ` + TABLE_NAME_STRIPE_EVENT + `
+		WHERE (` + FIELD_STRIPE_EVENT_PROCESSED_AT + ` IS NULL) AND (attempts < $1)
+		ORDER BY created_at;
+	`
+	SQL_MARK_STRIPE_EVENT_PROCESSED = `
+		UPDATE ` + TABLE_NAME_STRIPE_EVENT + ` SET ` + FIELD_STRIPE_EVENT_PROCESSED_AT + ` = $2, last_error = '', updated_at = $2
+		WHERE (id = $1);
+	`
+	SQL_RECORD_STRIPE_EVENT_FAILURE = `
+		UPDATE ` + TABLE_NAME_STRIPE_EVENT + ` SET attempts = attempts + 1, last_error = $2, updated_at = $3
+		WHERE (id = $1);
+	`
+)
+
+// Returns pointers to every column of a stripe event row, in table order, for use with Scan
+func (e *StripeEvent) columns() []interface{} {
+	return []interface{}{&e.Id, &e.StripeId, &e.Type, &e.Payload, &e.Attempts, &e.LastError, &e.ProcessedAt, &e.CreatedAt, &e.UpdatedAt}
+}
+
+// Stores a StripeEvent in the database unless an event with the same Stripe id
+// was already stored; returns the id of the new event, and false if it was a duplicate
+func CreateNewStripeEvent(
+	db Queryable, // The database
+	StripeId string, // The id Stripe gave the event
+	Type string, // The type of the event
+	Payload []byte, // The body of the webhook request
+) (int64, bool, error) {
+	var (
+		id  int64
+		now = time.Now()
+	)
+	// JSONB columns take text, not bytea
+	err := db.QueryRow(SQL_CREATE_NEW_STRIPE_EVENT, StripeId, Type, string(Payload), now, now).Scan(&id)
+	if err == sql.ErrNoRows {
+		return -1, false, nil
+	} else if err != nil {
+		return -1, false, err
+	} else {
+		return id, true, nil
+	}
+}
+
+// Gets a StripeEvent from the database by id, and locks it until the end of the transaction
+func GetStripeEventForUpdate(
+	db Queryable,
+	id int64,
+) (*StripeEvent, error) {
+	var event StripeEvent
+	err := db.QueryRow(SQL_SELECT_STRIPE_EVENT_BY_ID_FOR_UPDATE, id).Scan(event.columns()...)
+	if err == sql.ErrNoRows {
+		return nil, PUBERR_ENTITY_NOT_FOUND
+	} else if err != nil {
+		return nil, err
+	} else {
+		return &event, nil
+	}
+}
+
+// Finds the ids of the events with the given Stripe ids, oldest first
+func FindStripeEventIdsByStripeId(
+	db Queryable,
+	stripeIds []string,
+) ([]int64, error) {
+	return findStripeEventIds(db, SQL_SELECT_STRIPE_EVENT_IDS_BY_STRIPE_ID, pq.Array(stripeIds))
+}
+
+// Finds the ids of the events that haven't been processed yet and haven't
+// failed too many times, oldest first
+func FindUnprocessedStripeEventIds(
+	db Queryable,
+	maxAttempts int64,
+) ([]int64, error) {
+	return findStripeEventIds(db, SQL_SELECT_UNPROCESSED_STRIPE_EVENT_IDS, maxAttempts)
+}
+
+// Reads the ids of stripe events returned by a query
+func findStripeEventIds(db Queryable, query string, args ...interface{}) ([]int64, error) {
+	ids := make([]int64, 0)
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	// Read the rows
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// Records that a StripeEvent was processed
+func MarkStripeEventProcessed(
+	db Queryable,
+	id int64,
+) error {
+	_, err := db.Exec(SQL_MARK_STRIPE_EVENT_PROCESSED, id, time.Now())
+	return err
+}
+
+// Records that processing a StripeEvent failed, and why
+func RecordStripeEventFailure(
+	db Queryable,
+	id int64,
+	reason string,
+) error {
+	_, err := db.Exec(SQL_RECORD_STRIPE_EVENT_FAILURE, id, reason, time.Now())
+	return err
+}
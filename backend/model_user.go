@@ -1,24 +1,25 @@
 package main
 
 import (
-	"bytes"
 	"database/sql"
-	"fmt"
 	"github.com/lib/pq"
-	"strconv"
 	"strings"
 	"time"
 )
 
 // The User model represents people who have accounts
 type User struct {
-	Id             int64  `json:"id"`         // The identifier of the user
-	FirstName      string `json:"firstName"`  // The first name of the user
-	LastName       string `json:"lastName"`   // The last name of the user
-	Email          string `json:"email"`      // The email address of the user (indexed)
-	HashedPassword string `json:"-"`          // The bcrypted password of the user
-	StripeId       string `json:"-"`          // The id of the user with Stripe's API
-	PictureUrl     string `json:"pictureUrl"` // The URL to user's picture
+	Id              int64  `json:"id"`              // The identifier of the user
+	FirstName       string `json:"firstName"`       // The first name of the user
+	LastName        string `json:"lastName"`        // The last name of the user
+	Email           string `json:"email,omitempty"` // The email address of the user (indexed); left out where it is redacted
+	HashedPassword  string `json:"-"`               // The bcrypted password of the user
+	StripeId        string `json:"-"`               // The id of the user with Stripe's API
+	StripeAccountId string `json:"-"`               // The id of the Stripe Connect account the user is paid out to; empty until they link one
+	PictureUrl      string `json:"pictureUrl"`      // The URL to user's picture
+	Admin           bool   `json:"-"`               // True if the user may see soft deleted entities
+
+	PasswordChangedAt pq.NullTime `json:"-"` // The time when the password was last reset; sessions created before then no longer work
 
 	Active    bool        `json:"active"`    // True if this entity has not been soft deleted
 	CreatedAt time.Time   `json:"createdAt"` // The time when this user was created
@@ -29,70 +30,89 @@ type User struct {
 const (
 	TABLE_NAME_USER = "users"
 
-	FIELD_USER_STRIPE_ID = "stripe_id"
-
-	SQL_CREATE_TABLE_USER = `
-		CREATE TABLE IF NOT EXISTS ` + TABLE_NAME_USER + `(
-			id				BIGSERIAL			PRIMARY KEY,
-			first_name		VARCHAR(100)		NOT NULL,
-			last_name		VARCHAR(100)		NOT NULL,
-			email			VARCHAR(255)		UNIQUE NOT NULL,
-			hashed_password	VARCHAR(255)		NOT NULL,
-			stripe_id		VARCHAR(255)		NOT NULL,
-			picture_url		VARCHAR(511),
-
-			active			BOOLEAN				NOT NULL,
-			created_at		TIMESTAMPTZ			NOT NULL,
-			updated_at		TIMESTAMPTZ			NOT NULL,
-			deleted_at		TIMESTAMPTZ
-		);
-	`
+	FIELD_USER_FIRST_NAME        = "first_name"
+	FIELD_USER_LAST_NAME         = "last_name"
+	FIELD_USER_EMAIL             = "email"
+	FIELD_USER_PICTURE_URL       = "picture_url"
+	FIELD_USER_STRIPE_ID         = "stripe_id"
+	FIELD_USER_STRIPE_ACCOUNT_ID = "stripe_account_id"
+	FIELD_USER_ADMIN             = "admin"
+
 	SQL_CREATE_NEW_USER = `
 		INSERT INTO ` + TABLE_NAME_USER + `
 		(first_name, last_name, email, hashed_password, stripe_id, picture_url, active, created_at, updated_at) VALUES
 		($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id;
 	`
 	SQL_SELECT_USER_BY_ID = `
-		SELECT * FROM ` + TABLE_NAME_USER + ` WHERE (id = $1);
+		SELECT * FROM ` + TABLE_NAME_USER + ` WHERE (id = $1) AND (active OR $2);
 	`
 	SQL_SELECT_USER_BY_EMAIL = `
-		SELECT * FROM ` + TABLE_NAME_USER + ` WHERE (email = $1);
+		SELECT * FROM ` + TABLE_NAME_USER + ` WHERE (email = $1) AND active;
 	`
-	SQL_SELECT_USERS = `
-		SELECT * FROM ` + TABLE_NAME_USER + ` OFFSET $1 LIMIT $2;
+	SQL_UPDATE_USER_PASSWORD = `
+		UPDATE ` + TABLE_NAME_USER + ` SET hashed_password = $2, password_changed_at = $3, updated_at = $3
+		WHERE (id = $1) AND active;
 	`
-	SQL_UPDATE_USER = `
-		UPDATE ` + TABLE_NAME_USER + ` SET %s WHERE (id = $1);;
+	SQL_SELECT_USERS = `
+		SELECT * FROM ` + TABLE_NAME_USER + ` WHERE (active OR $3) ORDER BY id OFFSET $1 LIMIT $2;
 	`
 )
 
+// The columns of a user that UpdateUserFields may change; every other column
+// has its own way of being changed, if it may be changed at all
+var userUpdatableFields = map[string]bool{
+	FIELD_USER_FIRST_NAME:        true,
+	FIELD_USER_LAST_NAME:         true,
+	FIELD_USER_EMAIL:             true,
+	FIELD_USER_PICTURE_URL:       true,
+	FIELD_USER_STRIPE_ID:         true,
+	FIELD_USER_STRIPE_ACCOUNT_ID: true,
+	FIELD_USER_ADMIN:             true,
+}
+
 // Fills user with data from a db row
 func (u User) populateFromRow(row *sql.Row) error {
 	// Scan for member fields
 	Debug("Populate from row ", *row)
-	return row.Scan(&u.Id, &u.FirstName, &u.LastName, &u.Email, &u.HashedPassword, &u.StripeId, &u.PictureUrl, &u.Active, &u.CreatedAt, &u.UpdatedAt, &u.DeletedAt)
+	return row.Scan(u.columns()...)
 }
 
-// Creates the User table if it doesn't already exist
-func CreateUserTable(db *sql.DB) error {
-	_, err := db.Exec(SQL_CREATE_TABLE_USER)
-	return err
+// Returns pointers to every column of a user row, in table order, for use with Scan
+func (u *User) columns() []interface{} {
+	return []interface{}{&u.Id, &u.FirstName, &u.LastName, &u.Email, &u.HashedPassword, &u.StripeId, &u.PictureUrl, &u.Active, &u.CreatedAt, &u.UpdatedAt, &u.DeletedAt, &u.StripeAccountId, &u.Admin, &u.PasswordChangedAt}
 }
 
-// Gets a User from the database by id
+// Gets a User from the database by id; soft deleted users are left out
 func GetUser(
 	db Queryable,
 	id int64,
 ) (*User, error) {
-	rows, err := db.Query(SQL_SELECT_USER_BY_ID, id)
+	return findUser(db, id, false)
+}
+
+// Gets a User from the database by id, even if they were soft deleted
+func GetUserIncludingDeleted(
+	db Queryable,
+	id int64,
+) (*User, error) {
+	return findUser(db, id, true)
+}
+
+// Reads a single User by id; soft deleted users are only found if includeDeleted is true
+func findUser(
+	db Queryable,
+	id int64,
+	includeDeleted bool,
+) (*User, error) {
+	rows, err := db.Query(SQL_SELECT_USER_BY_ID, id, includeDeleted)
 	if err != nil {
-		return nil, PUBERR_ENTITY_NOT_FOUND
+		return nil, err
 	}
 	// Read the rows
 	defer rows.Close()
 	var user User
 	for rows.Next() {
-		err = rows.Scan(&user.Id, &user.FirstName, &user.LastName, &user.Email, &user.HashedPassword, &user.StripeId, &user.PictureUrl, &user.Active, &user.CreatedAt, &user.UpdatedAt, &user.DeletedAt)
+		err = rows.Scan(user.columns()...)
 		if err != nil {
 			return nil, err
 		} else {
@@ -103,13 +123,15 @@ func GetUser(
 	return nil, PUBERR_ENTITY_NOT_FOUND
 }
 
-// Gets a User from the database by id
+// Gets a page of Users from the database; soft deleted users are only
+// included if includeDeleted is true
 func GetUsers(
 	db Queryable,
 	offset int,
 	limit int,
+	includeDeleted bool,
 ) ([]*User, error) {
-	rows, err := db.Query(SQL_SELECT_USERS, offset, limit)
+	rows, err := db.Query(SQL_SELECT_USERS, offset, limit, includeDeleted)
 	if err != nil {
 		return nil, PUBERR_ENTITY_NOT_FOUND
 	}
@@ -118,7 +140,7 @@ func GetUsers(
 	users := make([]*User, 0, limit)
 	for rows.Next() {
 		var newUser User
-		err = rows.Scan(&newUser.Id, &newUser.FirstName, &newUser.LastName, &newUser.Email, &newUser.HashedPassword, &newUser.StripeId, &newUser.PictureUrl, &newUser.Active, &newUser.CreatedAt, &newUser.UpdatedAt, &newUser.DeletedAt)
+		err = rows.Scan(newUser.columns()...)
 		if err != nil {
 			return nil, err
 		} else {
@@ -129,7 +151,7 @@ func GetUsers(
 	return users, nil
 }
 
-// Finds a User by email
+// Finds a User by email; soft deleted users are left out
 func FindUserByEmail(
 	db Queryable,
 	email string,
@@ -142,7 +164,7 @@ func FindUserByEmail(
 	defer rows.Close()
 	var newUser User
 	for rows.Next() {
-		err = rows.Scan(&newUser.Id, &newUser.FirstName, &newUser.LastName, &newUser.Email, &newUser.HashedPassword, &newUser.StripeId, &newUser.PictureUrl, &newUser.Active, &newUser.CreatedAt, &newUser.UpdatedAt, &newUser.DeletedAt)
+		err = rows.Scan(newUser.columns()...)
 		if err != nil {
 			return nil, err
 		} else {
@@ -180,37 +202,45 @@ func CreateNewUser(
 	}
 }
 
-// Updates a specific set of fields of a user
+// Updates a specific set of fields of a user; the keys are column names and
+// have to be among the FIELD_USER_* constants that may be updated
 func UpdateUserFields(
 	db Queryable, // The database
 	id int64, // The id of the user being updated
 	keyVals map[string]interface{}, // Field deltas
 ) error {
-	if len(keyVals) < 1 {
-		return nil
+	err := UpdateFields(db, TABLE_NAME_USER, id, keyVals)
+	if err != nil && strings.Contains(err.Error(), "violates unique constraint \"users_email_key\"") {
+		return PUBERR_EMAIL_TAKEN
 	}
-	// Ensure "updated_at" is accurate
-	keyVals["updated_at"] = time.Now()
+	return err
+}
 
-	var (
-		updates bytes.Buffer
-		values  = make([]interface{}, 1, (len(keyVals) + 1))
-		i       = 0
-	)
-	// Add the id as the first query param
-	values[0] = id
-	// Built the SET section of the quuery
-	for fieldName, fieldVal := range keyVals {
-		if i > 0 {
-			updates.WriteString(", ")
-		}
-		updates.WriteString(fieldName)
-		updates.WriteString(" = $")
-		updates.WriteString(strconv.Itoa(i + 2))
-		values = append(values, fieldVal)
-		i = i + 1
+// Replaces the password of a user, which ends every session they had before
+// now; soft deleted users are left alone
+func SetUserPassword(
+	db Queryable, // The database
+	id int64, // The id of the user
+	hashedPassword string, // The bcrypted new password
+) error {
+	result, err := db.Exec(SQL_UPDATE_USER_PASSWORD, id, hashedPassword, time.Now())
+	return entityAffected(result, err)
+}
+
+// Returns true if the session was created before the user last reset their
+// password, or if the user was deleted or soft deleted
+func IsSessionRevoked(
+	db Queryable, // The database
+	sesh *Session, // The session of the user
+) (bool, error) {
+	user, err := GetUserIncludingDeleted(db, sesh.UserId)
+	if err == PUBERR_ENTITY_NOT_FOUND {
+		return true, nil
+	} else if err != nil {
+		return false, err
 	}
-	// Execute the query
-	_, err := db.Exec(fmt.Sprintf(SQL_UPDATE_USER, updates.String()), values...)
-	return err
+	if !user.Active {
+		return true, nil
+	}
+	return user.PasswordChangedAt.Valid && sesh.TimeCreated < user.PasswordChangedAt.Time.Unix(), nil
 }
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"time"
+)
+
+// The UserProfile model is what anyone may see of a User, along with how
+// they have taken part in campaigns. The email address is only shown to the
+// user themselves
+type UserProfile struct {
+	Id         int64  `json:"id"`              // The identifier of the user
+	FirstName  string `json:"firstName"`       // The first name of the user
+	LastName   string `json:"lastName"`        // The last name of the user
+	Email      string `json:"email,omitempty"` // The email address of the user; only shown to the user themselves
+	PictureUrl string `json:"pictureUrl"`      // The URL to user's picture
+
+	CampaignsCreated int64   `json:"campaignsCreated"` // How many campaigns the user started
+	CampaignsBacked  int64   `json:"campaignsBacked"`  // How many campaigns the user contributed to
+	ClaimsWon        int64   `json:"claimsWon"`        // How many of the user's claims were awarded their campaign
+	TotalContributed []Money `json:"totalContributed"` // How much the user has contributed, one amount per currency
+
+	CreatedAt time.Time `json:"createdAt"` // The time when the user signed up
+}
+
+const (
+	SQL_SELECT_USER_STATS = `
+		SELECT
+			(SELECT COUNT(*) FROM ` + TABLE_NAME_CAMPAIGN + `
+				WHERE (` + FIELD_CAMPAIGN_CREATOR_ID + ` = $1) AND active),
+			(SELECT COUNT(DISTINCT ` + FIELD_CONTRIBUTION_CAMPAIGN_ID + `) FROM ` + TABLE_NAME_CONTRIBUTION + `
+				WHERE (` + FIELD_CONTRIBUTION_CONTRIBUTOR_ID + ` = $1) AND active),
+			(SELECT COUNT(*) FROM ` + TABLE_NAME_CLAIM + `
+				WHERE (` + FIELD_CLAIM_CLAIMER_ID + ` = $1) AND (` + FIELD_CLAIM_OUTCOME + ` = '` + CLAIM_OUTCOME_WON + `') AND active);
+	`
+	// Contributions that were given back or never collected don't count
+	SQL_SUM_USER_CONTRIBUTIONS = `
+		SELECT currency, SUM(amount) FROM ` + TABLE_NAME_CONTRIBUTION + `
+		WHERE (` + FIELD_CONTRIBUTION_CONTRIBUTOR_ID + ` = $1)
+			AND (` + FIELD_CONTRIBUTION_STATUS + ` IN ('` + CONTRIBUTION_STATUS_AUTHORIZED + `', '` + CONTRIBUTION_STATUS_CAPTURED + `')) AND active
+		GROUP BY currency
+		ORDER BY currency;
+	`
+)
+
+// Returns a copy of the user that is safe to show to the user with viewerId;
+// the email address is left out unless they are the same user
+func (u *User) Redacted(viewerId int64) *User {
+	redacted := *u
+	if u.Id != viewerId {
+		redacted.Email = ""
+	}
+	return &redacted
+}
+
+// Redacts every user nested in the campaign, its contributions and its claims
+// for the user with viewerId
+func (c *Campaign) RedactUsers(viewerId int64) {
+	c.Creator = redactUser(c.Creator, viewerId)
+	c.Claimer = redactUser(c.Claimer, viewerId)
+	for _, contribution := range c.Contributions {
+		contribution.Contributor = redactUser(contribution.Contributor, viewerId)
+	}
+	for _, claim := range c.Claims {
+		claim.RedactUsers(viewerId)
+	}
+}
+
+// Redacts the claimer of the claim for the user with viewerId
+func (c *Claim) RedactUsers(viewerId int64) {
+	c.Claimer = redactUser(c.Claimer, viewerId)
+}
+
+// Redacts a user that may not have been loaded
+func redactUser(u *User, viewerId int64) *User {
+	if u == nil {
+		return nil
+	}
+	return u.Redacted(viewerId)
+}
+
+// Gets the UserProfile of a User as seen by the user with viewerId; soft
+// deleted users only have a profile if includeDeleted is true
+func GetUserProfile(
+	db Queryable,
+	id int64,
+	viewerId int64,
+	includeDeleted bool,
+) (*UserProfile, error) {
+	user, err := findUser(db, id, includeDeleted)
+	if err != nil {
+		return nil, err
+	}
+	user = user.Redacted(viewerId)
+	profile := UserProfile{
+		Id:               user.Id,
+		FirstName:        user.FirstName,
+		LastName:         user.LastName,
+		Email:            user.Email,
+		PictureUrl:       user.PictureUrl,
+		TotalContributed: make([]Money, 0),
+		CreatedAt:        user.CreatedAt,
+	}
+	err = db.QueryRow(SQL_SELECT_USER_STATS, id).Scan(&profile.CampaignsCreated, &profile.CampaignsBacked, &profile.ClaimsWon)
+	if err != nil {
+		return nil, err
+	}
+	// Add up the contributions in each currency
+	rows, err := db.Query(SQL_SUM_USER_CONTRIBUTIONS, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var total Money
+		if err = rows.Scan(&total.Currency, &total.Amount); err != nil {
+			return nil, err
+		}
+		profile.TotalContributed = append(profile.TotalContributed, total)
+	}
+	return &profile, rows.Err()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	DEFAULT_CURRENCY = "USD" // The currency of campaigns that don't specify one
+)
+
+// Money is an exact amount of a currency; it is never a fraction of the
+// currency's smallest unit, so amounts can be added up without drifting
+type Money struct {
+	Amount   int64  `json:"amount"`   // The amount in minor units of the currency (e.g. cents)
+	Currency string `json:"currency"` // The ISO-4217 code of the currency (e.g. "USD")
+}
+
+// The currencies we accept along with the number of digits after their decimal point
+var currencyExponents = map[string]int{
+	"AUD": 2,
+	"CAD": 2,
+	"CHF": 2,
+	"EUR": 2,
+	"GBP": 2,
+	"JPY": 0,
+	"USD": 2,
+}
+
+// Creates a new amount of money
+func NewMoney(amount int64, currency string) Money {
+	return Money{Amount: amount, Currency: currency}
+}
+
+// Normalizes an ISO-4217 currency code; returns false if the currency isn't supported
+func ParseCurrency(code string) (string, bool) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	_, ok := currencyExponents[code]
+	return code, ok
+}
+
+// Returns true if both amounts are of the same currency
+func (m Money) SameCurrency(other Money) bool {
+	return m.Currency == other.Currency
+}
+
+// Returns how many minor units make up a unit of a currency, e.g. 100 for USD and 1 for JPY
+func minorUnitScale(currency string) int64 {
+	scale := int64(1)
+	for i := 0; i < currencyExponents[currency]; i++ {
+		scale *= 10
+	}
+	return scale
+}
+
+// Adds two amounts of the same currency
+func (m Money) Add(other Money) (Money, error) {
+	if !m.SameCurrency(other) {
+		return Money{}, errors.New(fmt.Sprintf(ERR_CURRENCY_MISMATCH, m.Currency, other.Currency))
+	}
+	return NewMoney(m.Amount+other.Amount, m.Currency), nil
+}
+
+// Formats the amount in major units, e.g. "12.50 USD"
+func (m Money) String() string {
+	exponent := currencyExponents[m.Currency]
+	if exponent == 0 {
+		return fmt.Sprintf("%d %s", m.Amount, m.Currency)
+	}
+	var (
+		sign  = ""
+		units = m.Amount
+		scale = minorUnitScale(m.Currency)
+	)
+	if units < 0 {
+		sign = "-"
+		units = -units
+	}
+	return fmt.Sprintf("%s%d.%0*d %s", sign, units/scale, exponent, units%scale, m.Currency)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	PAYMENT_PROVIDER_STRIPE = "stripe" // Payments go through the Stripe API
+	PAYMENT_PROVIDER_FAKE   = "fake"   // Payments are kept in memory and never leave the server; for development and tests
+)
+
+// PaymentProvider moves the money behind users, contributions and payouts.
+// It is mapped into every request, so route handlers take it as an argument
+type PaymentProvider interface {
+	// Creates a new customer to charge; returns the customer id
+	NewCustomer(email string, id int64, firstName string, lastName string) (string, error)
+	// Updates the contact details of a customer to match the user's
+	UpdateCustomer(customerId string, email string, id int64, firstName string, lastName string) error
+	// Charges a customer's default payment source; the charge is only
+	// authorized if capture is false. Returns the charge id and what the
+	// provider kept of it, which is nothing until it is captured. Requests with
+	// the same non-empty idempotency key only charge the customer once
+	NewCharge(customerId string, amount Money, capture bool, desc string, idempotencyKey string) (string, Money, error)
+	// Captures the entirety of an authorized charge; returns what the provider kept of it
+	CaptureCharge(chargeId string) (Money, error)
+	// Refunds the entirety of a charge, or releases it if it was only
+	// authorized; returns the refund id. Requests with the same non-empty
+	// idempotency key only refund the charge once
+	RefundCharge(chargeId string, idempotencyKey string) (string, error)
+	// Creates an account that users can be paid out to; returns the account id
+	NewAccount(email string, country string) (string, error)
+	// Transfers money from the platform's balance to an account; returns the
+	// transfer id. Requests with the same idempotency key only transfer the money once
+	NewTransfer(accountId string, amount Money, desc string, idempotencyKey string) (string, error)
+}
+
+// PaymentDeclinedError is returned when the payment provider turns a request
+// down, so trying it again won't help; any other error may go away on its own
+type PaymentDeclinedError struct {
+	Code    string // Why the request was turned down, as the provider puts it
+	Message string // A human readable description of why
+}
+
+func (err *PaymentDeclinedError) Error() string {
+	return err.Message
+}
+
+// Returns true if err means the payment provider turned a request down
+func IsPaymentDeclined(err error) bool {
+	_, ok := err.(*PaymentDeclinedError)
+	return ok
+}
+
+// Creates the payment provider chosen by the environment
+func NewPaymentProvider(env *Environment) (PaymentProvider, error) {
+	switch env.paymentProvider {
+	case PAYMENT_PROVIDER_STRIPE:
+		return NewStripePaymentProvider(env.stripeAPIKey, env.stripeAPIURL), nil
+	case PAYMENT_PROVIDER_FAKE:
+		Debug("Payments are faked; no money will change hands")
+		return NewFakePaymentProvider(env.processorFees), nil
+	default:
+		return nil, errors.New(fmt.Sprintf(ERR_ENV_VAR_MISSING, ENV_VAR_PAYMENT_PROVIDER))
+	}
+}
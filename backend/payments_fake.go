@@ -0,0 +1,250 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+const (
+	// Charges and transfers of these amounts, in minor units, fail the way
+	// real ones sometimes do, so that failures can be tried out by hand
+	FAKE_PAYMENT_DECLINED_AMOUNT    = 402 // The request is declined
+	FAKE_PAYMENT_UNAVAILABLE_AMOUNT = 503 // The provider can't be reached
+
+	// Why the fake payment provider declines requests
+	FAKE_PAYMENT_CODE_DECLINED         = "card_declined"
+	FAKE_PAYMENT_CODE_NO_SUCH_CUSTOMER = "no_such_customer"
+	FAKE_PAYMENT_CODE_NO_SUCH_CHARGE   = "no_such_charge"
+	FAKE_PAYMENT_CODE_NO_SUCH_ACCOUNT  = "no_such_account"
+	FAKE_PAYMENT_CODE_ALREADY_CAPTURED = "charge_already_captured"
+	FAKE_PAYMENT_CODE_ALREADY_REFUNDED = "charge_already_refunded"
+
+	// Operations of the fake payment provider that can be made to fail
+	FAKE_PAYMENT_OP_NEW_CUSTOMER    = "NewCustomer"
+	FAKE_PAYMENT_OP_UPDATE_CUSTOMER = "UpdateCustomer"
+	FAKE_PAYMENT_OP_NEW_CHARGE      = "NewCharge"
+	FAKE_PAYMENT_OP_CAPTURE_CHARGE  = "CaptureCharge"
+	FAKE_PAYMENT_OP_REFUND_CHARGE   = "RefundCharge"
+	FAKE_PAYMENT_OP_NEW_ACCOUNT     = "NewAccount"
+	FAKE_PAYMENT_OP_NEW_TRANSFER    = "NewTransfer"
+)
+
+// A charge made with the fake payment provider
+type fakeCharge struct {
+	amount   Money
+	fee      Money // What the provider kept of the charge; nothing until it is captured
+	captured bool
+	refundId string // Empty unless the charge was refunded
+}
+
+// FakePaymentProvider keeps payments in memory instead of making them. Ids are
+// handed out in sequence, so the same requests always get the same results.
+// Requests fail with PaymentDeclinedErrors wherever Stripe would decline them,
+// and can be made to fail on purpose with FailNext or with the
+// FAKE_PAYMENT_*_AMOUNT amounts
+type FakePaymentProvider struct {
+	mutex     sync.Mutex
+	lastId    int64
+	customers map[string]bool
+	accounts  map[string]bool
+	charges   map[string]*fakeCharge
+	transfers map[string]Money
+	keys      map[string]string  // The ids of the results of idempotent requests, by idempotency key
+	failures  map[string][]error // Errors to fail operations with, in order, by operation
+	fees      FeeSchedule        // What the provider keeps of each charge it captures
+}
+
+// Creates a FakePaymentProvider with no payments in it, that keeps fees of
+// charges it captures as Stripe does
+func NewFakePaymentProvider(fees FeeSchedule) *FakePaymentProvider {
+	return &FakePaymentProvider{
+		fees:      fees,
+		customers: make(map[string]bool),
+		accounts:  make(map[string]bool),
+		charges:   make(map[string]*fakeCharge),
+		transfers: make(map[string]Money),
+		keys:      make(map[string]string),
+		failures:  make(map[string][]error),
+	}
+}
+
+// Makes the next call to an operation, one of the FAKE_PAYMENT_OP_* constants,
+// fail with err; failures queue up if this is called more than once
+func (p *FakePaymentProvider) FailNext(operation string, err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.failures[operation] = append(p.failures[operation], err)
+}
+
+// Pretends to create a customer; returns the customer id
+func (p *FakePaymentProvider) NewCustomer(email string, id int64, firstName string, lastName string) (string, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if err := p.failure(FAKE_PAYMENT_OP_NEW_CUSTOMER); err != nil {
+		return "", err
+	}
+	customerId := p.nextId("cus")
+	p.customers[customerId] = true
+	return customerId, nil
+}
+
+// Pretends to update a customer
+func (p *FakePaymentProvider) UpdateCustomer(customerId string, email string, id int64, firstName string, lastName string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if err := p.failure(FAKE_PAYMENT_OP_UPDATE_CUSTOMER); err != nil {
+		return err
+	}
+	if !p.customers[customerId] {
+		return fakeDecline(FAKE_PAYMENT_CODE_NO_SUCH_CUSTOMER)
+	}
+	return nil
+}
+
+// Pretends to charge a customer; returns the charge id and the fee kept
+func (p *FakePaymentProvider) NewCharge(customerId string, amount Money, capture bool, desc string, idempotencyKey string) (string, Money, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if err := p.failure(FAKE_PAYMENT_OP_NEW_CHARGE); err != nil {
+		return "", Money{}, err
+	}
+	if chargeId, ok := p.keys[idempotencyKey]; ok && idempotencyKey != "" {
+		return chargeId, p.charges[chargeId].fee, nil
+	}
+	if err := failAmount(amount); err != nil {
+		return "", Money{}, err
+	}
+	if !p.customers[customerId] {
+		return "", Money{}, fakeDecline(FAKE_PAYMENT_CODE_NO_SUCH_CUSTOMER)
+	}
+	chargeId := p.nextId("ch")
+	charge := &fakeCharge{amount: amount, fee: NewMoney(0, amount.Currency)}
+	if capture {
+		p.capture(charge)
+	}
+	p.charges[chargeId] = charge
+	if idempotencyKey != "" {
+		p.keys[idempotencyKey] = chargeId
+	}
+	return chargeId, charge.fee, nil
+}
+
+// Pretends to capture an authorized charge; returns the fee kept
+func (p *FakePaymentProvider) CaptureCharge(chargeId string) (Money, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if err := p.failure(FAKE_PAYMENT_OP_CAPTURE_CHARGE); err != nil {
+		return Money{}, err
+	}
+	charge, ok := p.charges[chargeId]
+	switch {
+	case !ok:
+		return Money{}, fakeDecline(FAKE_PAYMENT_CODE_NO_SUCH_CHARGE)
+	case charge.refundId != "":
+		return Money{}, fakeDecline(FAKE_PAYMENT_CODE_ALREADY_REFUNDED)
+	case charge.captured:
+		return Money{}, fakeDecline(FAKE_PAYMENT_CODE_ALREADY_CAPTURED)
+	}
+	p.capture(charge)
+	return charge.fee, nil
+}
+
+// Captures a charge, keeping the provider's fee; the mutex has to be held
+func (p *FakePaymentProvider) capture(charge *fakeCharge) {
+	charge.captured = true
+	charge.fee = p.fees.FeeOn(charge.amount)
+}
+
+// Pretends to refund a charge; returns the refund id
+func (p *FakePaymentProvider) RefundCharge(chargeId string, idempotencyKey string) (string, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if err := p.failure(FAKE_PAYMENT_OP_REFUND_CHARGE); err != nil {
+		return "", err
+	}
+	if refundId, ok := p.keys[idempotencyKey]; ok && idempotencyKey != "" {
+		return refundId, nil
+	}
+	charge, ok := p.charges[chargeId]
+	if !ok {
+		return "", fakeDecline(FAKE_PAYMENT_CODE_NO_SUCH_CHARGE)
+	}
+	if charge.refundId != "" {
+		return "", fakeDecline(FAKE_PAYMENT_CODE_ALREADY_REFUNDED)
+	}
+	charge.refundId = p.nextId("re")
+	if idempotencyKey != "" {
+		p.keys[idempotencyKey] = charge.refundId
+	}
+	return charge.refundId, nil
+}
+
+// Pretends to create an account to pay a user out to; returns the account id
+func (p *FakePaymentProvider) NewAccount(email string, country string) (string, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if err := p.failure(FAKE_PAYMENT_OP_NEW_ACCOUNT); err != nil {
+		return "", err
+	}
+	accountId := p.nextId("acct")
+	p.accounts[accountId] = true
+	return accountId, nil
+}
+
+// Pretends to transfer money to an account; returns the transfer id
+func (p *FakePaymentProvider) NewTransfer(accountId string, amount Money, desc string, idempotencyKey string) (string, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if err := p.failure(FAKE_PAYMENT_OP_NEW_TRANSFER); err != nil {
+		return "", err
+	}
+	if transferId, ok := p.keys[idempotencyKey]; ok && idempotencyKey != "" {
+		return transferId, nil
+	}
+	if err := failAmount(amount); err != nil {
+		return "", err
+	}
+	if !p.accounts[accountId] {
+		return "", fakeDecline(FAKE_PAYMENT_CODE_NO_SUCH_ACCOUNT)
+	}
+	transferId := p.nextId("tr")
+	p.transfers[transferId] = amount
+	if idempotencyKey != "" {
+		p.keys[idempotencyKey] = transferId
+	}
+	return transferId, nil
+}
+
+// Hands out the next id, e.g. "ch_fake_3"; the mutex has to be held
+func (p *FakePaymentProvider) nextId(prefix string) string {
+	p.lastId++
+	return fmt.Sprintf("%s_fake_%d", prefix, p.lastId)
+}
+
+// Returns the next error an operation was made to fail with, if any; the mutex has to be held
+func (p *FakePaymentProvider) failure(operation string) error {
+	queue := p.failures[operation]
+	if len(queue) == 0 {
+		return nil
+	}
+	p.failures[operation] = queue[1:]
+	return queue[0]
+}
+
+// Returns the error that charges and transfers of an amount fail with, if any
+func failAmount(amount Money) error {
+	switch amount.Amount {
+	case FAKE_PAYMENT_DECLINED_AMOUNT:
+		return fakeDecline(FAKE_PAYMENT_CODE_DECLINED)
+	case FAKE_PAYMENT_UNAVAILABLE_AMOUNT:
+		return errors.New(ERR_FAKE_PAYMENT_UNAVAILABLE)
+	default:
+		return nil
+	}
+}
+
+// Returns the PaymentDeclinedError the fake payment provider declines requests with
+func fakeDecline(code string) error {
+	return &PaymentDeclinedError{Code: code, Message: fmt.Sprintf(ERR_FAKE_PAYMENT_DECLINED, code)}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const (
+	PAYOUT_BATCH_SIZE      = 20            // How many payouts are made each time the job runs
+	PAYOUT_MAX_ATTEMPTS    = 8             // How many times making a transfer may fail before someone has to look into it
+	PAYOUT_RETRY_DELAY     = time.Minute   // How long to wait after the first failure; the wait doubles with every failure after that
+	PAYOUT_MAX_RETRY_DELAY = time.Hour * 6 // The longest wait between attempts
+	PAYOUT_IDEMPOTENCY_KEY = "payout-%d"   // Makes Stripe make each transfer only once, however many times it is attempted
+)
+
+// Transfers the net proceeds of claimed campaigns to their claimers. Payouts
+// are stored when the claim wins, so the work picks up where it left off
+// after a restart; each payout is made on its own, so a failure is simply
+// retried later
+func PayOutCampaigns(db *sql.DB, payments PaymentProvider) error {
+	payouts, err := FindDuePayouts(db, time.Now(), PAYOUT_BATCH_SIZE)
+	if err != nil {
+		return err
+	}
+	var firstErr error
+	for _, payout := range payouts {
+		if err = issuePayout(db, payments, payout); err != nil {
+			Debug(fmt.Sprintf("Failed to pay out campaign %d: ", payout.CampaignId), err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// Transfers whatever is left in a campaign's escrow to its claimer's Stripe
+// Connect account, then records the transfer along with the change to the ledger
+func issuePayout(db *sql.DB, payments PaymentProvider, payout *Payout) error {
+	// Claimers are still owed the proceeds if their account was deleted since
+	claimer, err := GetUserIncludingDeleted(db, payout.ClaimerId)
+	if err != nil {
+		return err
+	}
+	// The claimer is paid once they link an account
+	if claimer.StripeAccountId == "" {
+		return SetPayoutStatus(db, payout.Id, PAYOUT_STATUS_AWAITING_ACCOUNT, "")
+	}
+	// The net proceeds are the contributions, less refunds, disputes and fees
+	balance, err := GetLedgerBalance(db, LEDGER_ACCOUNT_CAMPAIGN_ESCROW, payout.CampaignId, payout.Amount.Currency)
+	if err != nil {
+		return err
+	}
+	processorFee, platformFee, err := SumCampaignFees(db, payout.CampaignId, payout.Amount.Currency)
+	if err != nil {
+		return err
+	}
+	proceeds := NewMoney(balance.Amount-processorFee.Amount-platformFee.Amount, balance.Currency)
+	if proceeds.Amount < 0 {
+		proceeds.Amount = 0
+	}
+	var transferId string
+	if proceeds.Amount > 0 {
+		transferId, err = payments.NewTransfer(
+			claimer.StripeAccountId,
+			proceeds,
+			fmt.Sprintf(STRIPE_TRANSFER_DESC, payout.CampaignId, claimer.Id),
+			fmt.Sprintf(PAYOUT_IDEMPOTENCY_KEY, payout.Id),
+		)
+		if err != nil {
+			return failPayout(db, payout, err)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	current, err := GetPayoutForUpdate(tx, payout.Id)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if current.Status != PAYOUT_STATUS_PENDING {
+		return tx.Rollback()
+	}
+	// The fees leave escrow along with the payout
+	err = PostFees(tx, payout.CampaignId, processorFee, platformFee)
+	if err == nil && transferId == "" {
+		err = CompletePayout(tx, payout.Id, PAYOUT_STATUS_SKIPPED, proceeds, "")
+	} else if err == nil {
+		if err = PostPayout(tx, payout.CampaignId, claimer.Id, proceeds, transferId); err == nil {
+			err = CompletePayout(tx, payout.Id, PAYOUT_STATUS_TRANSFERRED, proceeds, transferId)
+		}
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Records a failed attempt at a payout; it is retried with exponential backoff
+// unless the payment provider turned it down or it has failed too many times. Returns cause
+func failPayout(db *sql.DB, payout *Payout, cause error) error {
+	var (
+		attempts = payout.Attempts + 1
+		status   = PAYOUT_STATUS_PENDING
+	)
+	// The payment provider turned the request down, so trying again won't help
+	if IsPaymentDeclined(cause) || attempts >= PAYOUT_MAX_ATTEMPTS {
+		status = PAYOUT_STATUS_FAILED
+	}
+	if err := RecordPayoutFailure(db, payout.Id, status, cause.Error(), time.Now().Add(RetryDelay(attempts, PAYOUT_RETRY_DELAY, PAYOUT_MAX_RETRY_DELAY))); err != nil {
+		return err
+	}
+	return cause
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// A claimed campaign with one captured contribution, ready to be paid out
+type testPayout struct {
+	*testFixture
+	claimer      *User
+	contribution *Contribution
+	payout       *Payout
+}
+
+// Sets up a claimed campaign with a scheduled payout; the claimer only has a
+// Stripe Connect account if withAccount is true
+func newTestPayout(t *testing.T, withAccount bool) *testPayout {
+	p := &testPayout{testFixture: newTestFixture(t, FUNDING_MODE_KEEP_WHAT_YOU_RAISE)}
+	p.claimer = newTestUser(t, p.db, p.payments, "claimer@example.com")
+	if withAccount {
+		accountId, err := p.payments.NewAccount(p.claimer.Email, "US")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = UpdateUserFields(p.db, p.claimer.Id, map[string]interface{}{FIELD_USER_STRIPE_ACCOUNT_ID: accountId}); err != nil {
+			t.Fatal(err)
+		}
+		p.claimer.StripeAccountId = accountId
+	}
+	p.contribution = newTestContribution(t, p.db, p.payments, p.campaign, p.contributor, 5000)
+	if err := SchedulePayout(p.db, p.campaign.Id, p.claimer.Id, TEST_CURRENCY); err != nil {
+		t.Fatal(err)
+	}
+	p.payout = p.get(t)
+	return p
+}
+
+// Reads the payout as it is now
+func (p *testPayout) get(t *testing.T) *Payout {
+	payout, err := GetPayoutByCampaignId(p.db, p.campaign.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payout
+}
+
+func TestIssuePayoutAwaitsAccount(t *testing.T) {
+	p := newTestPayout(t, false)
+	defer p.db.Close()
+
+	if err := issuePayout(p.db, p.payments, p.payout); err != nil {
+		t.Fatal(err)
+	}
+	payout := p.get(t)
+	if payout.Status != PAYOUT_STATUS_AWAITING_ACCOUNT {
+		t.Errorf("status is %q, want %q", payout.Status, PAYOUT_STATUS_AWAITING_ACCOUNT)
+	}
+	if len(p.payments.transfers) != 0 {
+		t.Errorf("made %d transfers, want none", len(p.payments.transfers))
+	}
+	// Nothing leaves escrow until the claimer can be paid
+	if balance := getTestBalance(t, p.db, LEDGER_ACCOUNT_CAMPAIGN_ESCROW, p.campaign.Id); balance != p.contribution.Amount.Amount {
+		t.Errorf("escrow holds %d, want %d", balance, p.contribution.Amount.Amount)
+	}
+	checkTestLedger(t, p.db)
+}
+
+func TestIssuePayoutRetriesFailure(t *testing.T) {
+	p := newTestPayout(t, true)
+	defer p.db.Close()
+
+	p.payments.FailNext(FAKE_PAYMENT_OP_NEW_TRANSFER, errors.New(ERR_FAKE_PAYMENT_UNAVAILABLE))
+	if err := issuePayout(p.db, p.payments, p.payout); err == nil {
+		t.Fatal("issuePayout succeeded, want the transfer's error")
+	}
+	payout := p.get(t)
+	if payout.Status != PAYOUT_STATUS_PENDING {
+		t.Errorf("status is %q after a failure, want %q", payout.Status, PAYOUT_STATUS_PENDING)
+	}
+	if payout.Attempts != 1 {
+		t.Errorf("attempts are %d, want 1", payout.Attempts)
+	}
+	if payout.LastError == "" {
+		t.Error("the failure wasn't recorded")
+	}
+	if !payout.NextAttemptAt.After(time.Now()) {
+		t.Errorf("next attempt is at %v, want it put off", payout.NextAttemptAt)
+	}
+	// No money moved, so the ledger is as it was
+	if balance := getTestBalance(t, p.db, LEDGER_ACCOUNT_CAMPAIGN_ESCROW, p.campaign.Id); balance != p.contribution.Amount.Amount {
+		t.Errorf("escrow holds %d, want %d", balance, p.contribution.Amount.Amount)
+	}
+
+	// The retry goes through
+	if err := issuePayout(p.db, p.payments, payout); err != nil {
+		t.Fatal(err)
+	}
+	payout = p.get(t)
+	if payout.Status != PAYOUT_STATUS_TRANSFERRED {
+		t.Errorf("status is %q after the retry, want %q", payout.Status, PAYOUT_STATUS_TRANSFERRED)
+	}
+	if payout.LastError != "" {
+		t.Errorf("last error is %q after the retry, want none", payout.LastError)
+	}
+	checkTestLedger(t, p.db)
+}
+
+func TestIssuePayoutGivesUpOnDecline(t *testing.T) {
+	p := newTestPayout(t, true)
+	defer p.db.Close()
+
+	p.payments.FailNext(FAKE_PAYMENT_OP_NEW_TRANSFER, fakeDecline(FAKE_PAYMENT_CODE_DECLINED))
+	if err := issuePayout(p.db, p.payments, p.payout); !IsPaymentDeclined(err) {
+		t.Fatalf("issuePayout returned %v, want the decline", err)
+	}
+	if payout := p.get(t); payout.Status != PAYOUT_STATUS_FAILED {
+		t.Errorf("status is %q, want %q", payout.Status, PAYOUT_STATUS_FAILED)
+	}
+}
+
+func TestIssuePayoutIsIdempotent(t *testing.T) {
+	p := newTestPayout(t, true)
+	defer p.db.Close()
+
+	// The transfer was made, but the payout was never recorded, e.g. because the server went down
+	key := fmt.Sprintf(PAYOUT_IDEMPOTENCY_KEY, p.payout.Id)
+	transferId, err := p.payments.NewTransfer(p.claimer.StripeAccountId, NewMoney(p.contribution.Net, TEST_CURRENCY), "Test transfer", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = issuePayout(p.db, p.payments, p.payout); err != nil {
+		t.Fatal(err)
+	}
+	payout := p.get(t)
+	if payout.StripeId != transferId {
+		t.Errorf("recorded transfer %q, want %q", payout.StripeId, transferId)
+	}
+	if len(p.payments.transfers) != 1 {
+		t.Errorf("made %d transfers, want 1", len(p.payments.transfers))
+	}
+
+	// Issuing the payout again, e.g. from a stale batch, changes nothing
+	if err = issuePayout(p.db, p.payments, p.payout); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.payments.transfers) != 1 {
+		t.Errorf("made %d transfers after issuing again, want 1", len(p.payments.transfers))
+	}
+	if balance := getTestBalance(t, p.db, LEDGER_ACCOUNT_CLAIMER_PAYOUT, p.claimer.Id); balance != p.contribution.Net {
+		t.Errorf("claimer was paid %d, want %d", balance, p.contribution.Net)
+	}
+	checkTestLedger(t, p.db)
+}
+
+func TestIssuePayoutPostsToLedger(t *testing.T) {
+	p := newTestPayout(t, true)
+	defer p.db.Close()
+
+	if err := issuePayout(p.db, p.payments, p.payout); err != nil {
+		t.Fatal(err)
+	}
+	payout := p.get(t)
+	if payout.Status != PAYOUT_STATUS_TRANSFERRED {
+		t.Errorf("status is %q, want %q", payout.Status, PAYOUT_STATUS_TRANSFERRED)
+	}
+	if payout.Amount.Amount != p.contribution.Net {
+		t.Errorf("paid out %d, want the net proceeds of %d", payout.Amount.Amount, p.contribution.Net)
+	}
+	if amount := p.payments.transfers[payout.StripeId]; amount.Amount != p.contribution.Net {
+		t.Errorf("transferred %d, want %d", amount.Amount, p.contribution.Net)
+	}
+	balances := []struct {
+		accountType string
+		ownerId     int64
+		want        int64
+	}{
+		{LEDGER_ACCOUNT_CAMPAIGN_ESCROW, p.campaign.Id, 0},
+		{LEDGER_ACCOUNT_CLAIMER_PAYOUT, p.claimer.Id, p.contribution.Net},
+		{LEDGER_ACCOUNT_PROCESSOR_FEES, 0, p.contribution.ProcessorFee},
+		{LEDGER_ACCOUNT_PLATFORM_FEES, 0, p.contribution.PlatformFee},
+		{LEDGER_ACCOUNT_CONTRIBUTOR, p.contribution.ContributorId, -p.contribution.Amount.Amount},
+	}
+	for _, b := range balances {
+		if balance := getTestBalance(t, p.db, b.accountType, b.ownerId); balance != b.want {
+			t.Errorf("%s account %d holds %d, want %d", b.accountType, b.ownerId, balance, b.want)
+		}
+	}
+	checkTestLedger(t, p.db)
+}
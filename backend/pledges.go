@@ -0,0 +1,170 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const (
+	PLEDGE_BATCH_SIZE      = 50                 // How many pledges are charged before pausing
+	PLEDGE_BATCH_PAUSE     = time.Second        // How long to pause between batches, so as to stay well under Stripe's rate limits
+	PLEDGE_MAX_ATTEMPTS    = 4                  // How many times the charge of a billing cycle may be declined before the pledge is canceled
+	PLEDGE_RETRY_DELAY     = time.Hour * 24     // How long to wait after the first decline; the wait doubles with every decline after that
+	PLEDGE_MAX_RETRY_DELAY = time.Hour * 24 * 7 // The longest wait between attempts
+	PLEDGE_ABORT_DELAY     = time.Minute        // How long to wait before charging again when a charge couldn't be recorded
+	PLEDGE_CHARGE_DESC     = "Monthly pledge %d to campaign %d by user %d"
+	PLEDGE_IDEMPOTENCY_KEY = "pledge-%d-%d" // Makes Stripe make each attempt at a charge only once, however many times it is made
+)
+
+// Charges the contributors of the pledges that are due, in batches, until
+// there are none left or one fails for a reason other than a decline. Each
+// charge makes a Contribution; declined charges are retried on a dunning
+// schedule, and pledges to campaigns that have closed are canceled
+func ChargePledges(db *sql.DB, payments PaymentProvider, env *Environment) error {
+	for {
+		ids, err := FindDuePledgeIds(db, time.Now(), PLEDGE_BATCH_SIZE)
+		if err != nil {
+			return err
+		}
+		var firstErr error
+		for _, id := range ids {
+			if err = chargePledge(db, payments, env, id); err != nil {
+				Debug(fmt.Sprintf("Failed to charge pledge %d: ", id), err)
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+		// Leave the rest for next time if Stripe is having trouble
+		if firstErr != nil || len(ids) < PLEDGE_BATCH_SIZE {
+			return firstErr
+		}
+		time.Sleep(PLEDGE_BATCH_PAUSE)
+	}
+}
+
+// Charges the contributor of a pledge for the current billing cycle, records
+// the Contribution and starts the next billing cycle
+func chargePledge(db *sql.DB, payments PaymentProvider, env *Environment, id int64) error {
+	pledge, err := GetPledge(db, id)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	// Lock the campaign so that its total can't change underneath us. It is
+	// locked before the pledge, as CancelCampaign does, so that canceling the
+	// campaign during a charge can't deadlock
+	campaign, err := GetCampaignForUpdate(tx, pledge.CampaignId)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	// The contributor may have paused or canceled the pledge in the meantime
+	pledge, err = GetPledgeForUpdate(tx, id)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	now := time.Now()
+	if (pledge.Status != PLEDGE_STATUS_ACTIVE && pledge.Status != PLEDGE_STATUS_PAST_DUE) || pledge.NextAttemptAt.After(now) {
+		return tx.Rollback()
+	}
+	if !campaign.IsOpen() {
+		if err = SetPledgeStatus(tx, pledge.Id, PLEDGE_STATUS_CANCELED, ERR_CAMPAIGN_CLOSED); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	}
+	// Deleted accounts aren't charged any more
+	contributor, err := GetUser(tx, pledge.ContributorId)
+	if err == PUBERR_ENTITY_NOT_FOUND {
+		if err = SetPledgeStatus(tx, pledge.Id, PLEDGE_STATUS_CANCELED, ERR_ACCOUNT_DELETED); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	} else if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	// The key changes with every attempt, since Stripe would answer a retry
+	// of a declined charge with the same decline. If the charge goes through
+	// but this process dies before recording it, the pledge is still due at
+	// the same time, so the next run gets the same charge back
+	chargeId, processorFee, err := payments.NewCharge(
+		contributor.StripeId,
+		pledge.Amount,
+		true,
+		fmt.Sprintf(PLEDGE_CHARGE_DESC, pledge.Id, campaign.Id, contributor.Id),
+		fmt.Sprintf(PLEDGE_IDEMPOTENCY_KEY, pledge.Id, pledge.NextAttemptAt.Unix()),
+	)
+	if err != nil {
+		// Only declines are dunned; anything else is retried the next time around
+		if !IsPaymentDeclined(err) {
+			_ = tx.Rollback()
+			return err
+		}
+		if err = failPledge(tx, pledge, err); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	}
+	// Undoes the charge if it can't be recorded, and puts off the next attempt
+	// so that it isn't answered with the refunded charge. Returns cause
+	abort := func(cause error) error {
+		_ = tx.Rollback()
+		if _, refundErr := payments.RefundCharge(chargeId, ""); refundErr != nil {
+			Debug("Could not refund unrecorded charge \""+chargeId+"\": ", refundErr)
+		}
+		if delayErr := DelayPledge(db, pledge.Id, time.Now().Add(PLEDGE_ABORT_DELAY)); delayErr != nil {
+			Debug(fmt.Sprintf("Could not put off pledge %d: ", pledge.Id), delayErr)
+		}
+		return cause
+	}
+	// Record the contribution; pledges are only made to campaigns that capture immediately
+	platformFee, net := SplitContribution(pledge.Amount, processorFee, campaign.PlatformFees(env.platformFees))
+	newId, err := CreateNewContribution(tx, pledge.Amount, processorFee, platformFee, net, chargeId, CONTRIBUTION_STATUS_CAPTURED, contributor.Id, campaign.Id, sql.NullInt64{Int64: pledge.Id, Valid: true}, sql.NullInt64{})
+	if err != nil {
+		return abort(err)
+	}
+	err = PostContribution(tx, &Contribution{Id: newId, Amount: pledge.Amount, ProcessorFee: processorFee.Amount, PlatformFee: platformFee.Amount, Net: net.Amount, StripeId: chargeId, ContributorId: contributor.Id, CampaignId: campaign.Id})
+	if err != nil {
+		return abort(err)
+	}
+	if err = AddToCampaignAmount(tx, campaign.Id, pledge.Amount, net); err != nil {
+		return abort(err)
+	}
+	// Billing cycles missed while the scheduler wasn't running are skipped rather than charged all at once
+	nextChargeAt := pledge.NextBillingDate(pledge.NextChargeAt)
+	for !nextChargeAt.After(now) {
+		nextChargeAt = pledge.NextBillingDate(nextChargeAt)
+	}
+	if err = AdvancePledge(tx, pledge.Id, nextChargeAt); err != nil {
+		return abort(err)
+	}
+	if err = tx.Commit(); err != nil {
+		return abort(err)
+	}
+	return nil
+}
+
+// Records a declined charge of a pledge; it is retried with exponential backoff
+// until it has been declined too many times, then the pledge is canceled
+func failPledge(db Queryable, pledge *Pledge, cause error) error {
+	var (
+		attempts = pledge.Attempts + 1
+		status   = PLEDGE_STATUS_PAST_DUE
+	)
+	if attempts >= PLEDGE_MAX_ATTEMPTS {
+		status = PLEDGE_STATUS_CANCELED
+	}
+	Debug(fmt.Sprintf("Charge of pledge %d was declined: ", pledge.Id), cause)
+	return RecordPledgeFailure(db, pledge.Id, status, cause.Error(), time.Now().Add(RetryDelay(attempts, PLEDGE_RETRY_DELAY, PLEDGE_MAX_RETRY_DELAY)))
+}
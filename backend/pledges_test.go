@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Sets up a pledge to a campaign that is due to be charged
+func newTestPledge(t *testing.T) (*testFixture, *Pledge) {
+	f := newTestFixture(t, FUNDING_MODE_KEEP_WHAT_YOU_RAISE)
+	id, err := CreateNewPledge(f.db, NewMoney(1000, TEST_CURRENCY), f.contributor.Id, f.campaign.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pledge, err := GetPledge(f.db, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, pledge
+}
+
+func TestChargePledgeIsIdempotent(t *testing.T) {
+	f, pledge := newTestPledge(t)
+	defer f.db.Close()
+
+	// The charge was made, but never recorded, e.g. because the server went down
+	key := fmt.Sprintf(PLEDGE_IDEMPOTENCY_KEY, pledge.Id, pledge.NextAttemptAt.Unix())
+	chargeId, _, err := f.payments.NewCharge(f.contributor.StripeId, pledge.Amount, true, "Test pledge", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = chargePledge(f.db, f.payments, testEnvironment, pledge.Id); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.payments.charges) != 1 {
+		t.Errorf("made %d charges, want 1", len(f.payments.charges))
+	}
+	contributions, err := FindContributionsByCampaignId(f.db, f.campaign.Id, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contributions) != 1 || contributions[0].StripeId != chargeId {
+		t.Errorf("recorded %d contributions, want one for charge %q", len(contributions), chargeId)
+	}
+	// The next billing cycle has started, so charging again does nothing
+	if err = chargePledge(f.db, f.payments, testEnvironment, pledge.Id); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.payments.charges) != 1 {
+		t.Errorf("made %d charges after charging again, want 1", len(f.payments.charges))
+	}
+	checkTestLedger(t, f.db)
+}
+
+func TestChargePledgeRetriesDeclineWithNewKey(t *testing.T) {
+	f, pledge := newTestPledge(t)
+	defer f.db.Close()
+
+	f.payments.FailNext(FAKE_PAYMENT_OP_NEW_CHARGE, fakeDecline(FAKE_PAYMENT_CODE_DECLINED))
+	if err := chargePledge(f.db, f.payments, testEnvironment, pledge.Id); err != nil {
+		t.Fatal(err)
+	}
+	declined, err := GetPledge(f.db, pledge.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if declined.Status != PLEDGE_STATUS_PAST_DUE {
+		t.Errorf("status is %q, want %q", declined.Status, PLEDGE_STATUS_PAST_DUE)
+	}
+	// The retry must not be answered with the decline
+	if declined.NextAttemptAt.Unix() == pledge.NextAttemptAt.Unix() {
+		t.Error("the retry would use the idempotency key of the declined charge")
+	}
+}
+
+func TestNextBillingDate(t *testing.T) {
+	at := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 9, 30, 0, 0, time.UTC)
+	}
+	cases := []struct {
+		billingDay int64
+		from       time.Time
+		want       time.Time
+	}{
+		{15, at(2026, time.January, 15), at(2026, time.February, 15)},
+		{31, at(2026, time.January, 31), at(2026, time.February, 28)},
+		{31, at(2028, time.January, 31), at(2028, time.February, 29)},
+		// Short months don't move the billing day for good
+		{31, at(2026, time.February, 28), at(2026, time.March, 31)},
+		{30, at(2026, time.March, 30), at(2026, time.April, 30)},
+		{31, at(2026, time.April, 30), at(2026, time.May, 31)},
+		{31, at(2026, time.December, 31), at(2027, time.January, 31)},
+		// A pledge resumed mid-cycle goes back to its billing day
+		{5, at(2026, time.June, 20), at(2026, time.July, 5)},
+	}
+	for _, c := range cases {
+		pledge := &Pledge{BillingDay: c.billingDay}
+		if got := pledge.NextBillingDate(c.from); !got.Equal(c.want) {
+			t.Errorf("billing day %d after %v is %v, want %v", c.billingDay, c.from, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const (
+	REFUND_BATCH_SIZE      = 50            // How many refunds are issued before pausing
+	REFUND_BATCH_PAUSE     = time.Second   // How long to pause between batches, so as to stay well under Stripe's rate limits
+	REFUND_MAX_ATTEMPTS    = 8             // How many times issuing a refund may fail before someone has to look into it
+	REFUND_RETRY_DELAY     = time.Minute   // How long to wait after the first failure; the wait doubles with every failure after that
+	REFUND_MAX_RETRY_DELAY = time.Hour * 6 // The longest wait between attempts
+	REFUND_IDEMPOTENCY_KEY = "refund-%d"   // Makes Stripe issue each refund only once, however many times it is attempted
+)
+
+// Issues the refunds that are due, in batches, until there are none left or
+// one fails. Refunds are stored before they are issued, so the work picks up
+// where it left off after a restart
+func RefundContributions(db *sql.DB, payments PaymentProvider) error {
+	for {
+		refunds, err := FindDueRefunds(db, time.Now(), REFUND_BATCH_SIZE)
+		if err != nil {
+			return err
+		}
+		var firstErr error
+		for _, refund := range refunds {
+			if err = issueRefund(db, payments, refund); err != nil {
+				Debug(fmt.Sprintf("Failed to refund contribution %d: ", refund.ContributionId), err)
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+		// Leave the rest for next time if Stripe is having trouble
+		if firstErr != nil || len(refunds) < REFUND_BATCH_SIZE {
+			return firstErr
+		}
+		time.Sleep(REFUND_BATCH_PAUSE)
+	}
+}
+
+// Refunds a captured contribution or releases an authorized one, then records
+// the outcome along with the change to the ledger
+func issueRefund(db *sql.DB, payments PaymentProvider, refund *Refund) error {
+	contribution, err := GetContributionIncludingDeleted(db, refund.ContributionId)
+	if err != nil {
+		return err
+	}
+	// The money may have been given back some other way, e.g. from the Stripe dashboard
+	if contribution.Status != CONTRIBUTION_STATUS_CAPTURED && contribution.Status != CONTRIBUTION_STATUS_AUTHORIZED {
+		return CompleteRefund(db, refund.Id, REFUND_STATUS_SKIPPED, "")
+	}
+	stripeId, err := payments.RefundCharge(contribution.StripeId, fmt.Sprintf(REFUND_IDEMPOTENCY_KEY, refund.Id))
+	if err != nil {
+		return failRefund(db, refund, err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	// A Stripe webhook may have recorded the refund in the meantime
+	contribution, err = GetContributionForUpdate(tx, refund.ContributionId)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	switch contribution.Status {
+	case CONTRIBUTION_STATUS_CAPTURED:
+		if err = withdrawContribution(tx, contribution, CONTRIBUTION_STATUS_REFUNDED); err == nil {
+			err = PostRefund(tx, contribution, stripeId)
+		}
+	case CONTRIBUTION_STATUS_AUTHORIZED:
+		err = withdrawContribution(tx, contribution, CONTRIBUTION_STATUS_RELEASED)
+	}
+	if err == nil {
+		err = CompleteRefund(tx, refund.Id, REFUND_STATUS_SUCCEEDED, stripeId)
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Records a failed attempt at a refund; it is retried with exponential backoff
+// unless the payment provider turned it down or it has failed too many times. Returns cause
+func failRefund(db *sql.DB, refund *Refund, cause error) error {
+	var (
+		attempts = refund.Attempts + 1
+		status   = REFUND_STATUS_PENDING
+	)
+	// The payment provider turned the request down, so trying again won't help
+	if IsPaymentDeclined(cause) || attempts >= REFUND_MAX_ATTEMPTS {
+		status = REFUND_STATUS_FAILED
+	}
+	if err := RecordRefundFailure(db, refund.Id, status, cause.Error(), time.Now().Add(RetryDelay(attempts, REFUND_RETRY_DELAY, REFUND_MAX_RETRY_DELAY))); err != nil {
+		return err
+	}
+	return cause
+}
+
+// Stops a contribution from counting towards its campaign, and gives back the
+// reward tier it claimed
+func withdrawContribution(tx *sql.Tx, contribution *Contribution, status string) error {
+	if err := WithdrawContribution(tx, contribution.Id, status); err != nil {
+		return err
+	}
+	if contribution.RewardTierId.Valid {
+		if err := ReleaseRewardTier(tx, contribution.RewardTierId.Int64); err != nil {
+			return err
+		}
+	}
+	return AddToCampaignAmount(tx, contribution.CampaignId, NewMoney(-contribution.Amount.Amount, contribution.Amount.Currency), NewMoney(-contribution.Net, contribution.Amount.Currency))
+}
+
+// Undoes withdrawContribution for a contribution whose money was collected
+// after all. The reward tier may have been claimed by someone else since, in
+// which case the backer goes without
+func reinstateContribution(tx *sql.Tx, contribution *Contribution, status string) error {
+	if err := ReinstateContribution(tx, contribution.Id, status); err != nil {
+		return err
+	}
+	if contribution.RewardTierId.Valid {
+		claimed, err := ClaimRewardTier(tx, contribution.RewardTierId.Int64)
+		if err != nil {
+			return err
+		} else if !claimed {
+			Debug(fmt.Sprintf("Reward tier %d ran out before contribution %d was reinstated", contribution.RewardTierId.Int64, contribution.Id))
+		}
+	}
+	return AddToCampaignAmount(tx, contribution.CampaignId, contribution.Amount, NewMoney(contribution.Net, contribution.Amount.Currency))
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const (
+	// Outcomes of claims
+	CLAIM_OUTCOME_PENDING = "pending" // Voting on the claim is still open
+	CLAIM_OUTCOME_WON     = "won"     // The claim was awarded the campaign
+	CLAIM_OUTCOME_LOST    = "lost"    // The claim was not awarded the campaign
+
+	// Reasons that claims win or lose
+	REASON_CLAIM_WON             = "Approved by %.1f%% of the weighted votes with %.1f%% of contributed funds voting"
+	REASON_CLAIM_QUORUM_NOT_MET  = "Only %.1f%% of contributed funds voted; a quorum of %.1f%% was needed"
+	REASON_CLAIM_NOT_APPROVED    = "Approved by %.1f%% of the weighted votes; more than %.1f%% was needed"
+	REASON_CLAIM_OUTRANKED       = "Approved by %.1f%% of the weighted votes, but claim %d was approved by %.1f%%"
+	REASON_CAMPAIGN_ALREADY_WON  = "The campaign was already awarded to another claim"
+	REASON_CAMPAIGN_NOT_CLAIMING = "The campaign stopped accepting claims before this one was resolved"
+)
+
+// Resolves every pending claim whose voting window has closed
+func ResolveClaims(db *sql.DB, window time.Duration) error {
+	cutoff := time.Now().Add(-window)
+	campaignIds, err := FindCampaignIdsWithDueClaims(db, cutoff)
+	if err != nil {
+		return err
+	}
+	// Resolve each campaign on its own so that one failure doesn't hold up the rest
+	var firstErr error
+	for _, campaignId := range campaignIds {
+		if err = ResolveCampaignClaims(db, campaignId, cutoff); err != nil {
+			Debug(fmt.Sprintf("Failed to resolve the claims of campaign %d: ", campaignId), err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// Resolves the pending claims of a campaign that were made before the cutoff.
+// The winner is the approved claim with the highest approval; ties go to the
+// higher participation, and then to the earlier claim. Everything happens in
+// one transaction that locks the campaign and its claims, so resolution is
+// safe to re-run after a crash and never resolves a claim twice. Claims on a
+// campaign that has left the claiming phase all lose
+func ResolveCampaignClaims(db *sql.DB, campaignId int64, cutoff time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	campaign, err := GetCampaignForUpdate(tx, campaignId)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	claims, err := FindDueClaimsForUpdate(tx, campaignId, cutoff)
+	if err != nil || len(claims) < 1 {
+		_ = tx.Rollback()
+		return err
+	}
+	// The campaign may have been awarded, or closed and refunded, in the meantime
+	if campaign.Phase != CAMPAIGN_PHASE_CLAIMING {
+		reason := REASON_CAMPAIGN_NOT_CLAIMING
+		if campaign.ClaimerId.Valid {
+			reason = REASON_CAMPAIGN_ALREADY_WON
+		}
+		for _, claim := range claims {
+			if err = ResolveClaim(tx, claim.Id, CLAIM_OUTCOME_LOST, reason); err != nil {
+				_ = tx.Rollback()
+				return err
+			}
+		}
+		return tx.Commit()
+	}
+
+	// Tally every claim and pick the winner
+	var (
+		tallies = make([]*ClaimTally, len(claims))
+		winner  = -1
+	)
+	for i, claim := range claims {
+		tallies[i], err = GetClaimTally(tx, campaign, claim.Id)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		if campaign.ClaimerId.Valid || !tallies[i].Approved {
+			continue
+		}
+		if winner < 0 || outranks(tallies[i], tallies[winner]) {
+			winner = i
+		}
+	}
+
+	// Record the outcome of every claim
+	for i, claim := range claims {
+		var (
+			tally   = tallies[i]
+			outcome = CLAIM_OUTCOME_LOST
+			reason  string
+		)
+		switch {
+		case i == winner:
+			outcome = CLAIM_OUTCOME_WON
+			reason = fmt.Sprintf(REASON_CLAIM_WON, tally.Approval, tally.Participation)
+		case campaign.ClaimerId.Valid:
+			reason = REASON_CAMPAIGN_ALREADY_WON
+		case !tally.QuorumMet:
+			reason = fmt.Sprintf(REASON_CLAIM_QUORUM_NOT_MET, tally.Participation, campaign.VotingRules.Quorum)
+		case !tally.Approved:
+			reason = fmt.Sprintf(REASON_CLAIM_NOT_APPROVED, tally.Approval, campaign.VotingRules.Threshold)
+		default:
+			reason = fmt.Sprintf(REASON_CLAIM_OUTRANKED, tally.Approval, claims[winner].Id, tallies[winner].Approval)
+		}
+		if err = ResolveClaim(tx, claim.Id, outcome, reason); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	// Award the campaign
+	if winner < 0 {
+		return tx.Commit()
+	}
+	if err = SetCampaignClaimer(tx, campaign.Id, claims[winner].ClaimerId); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	// Pay the claimer once the claim has been awarded
+	if err = SchedulePayout(tx, campaign.Id, claims[winner].ClaimerId, campaign.Amount.Currency); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	event, err := RecordCampaignEvent(tx, EVENT_CAMPAIGN_CLAIMED, campaign.Id)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	EmitCampaignEvents(event)
+	return nil
+}
+
+// Returns true if the challenger tally beats the incumbent tally
+func outranks(challenger *ClaimTally, incumbent *ClaimTally) bool {
+	if challenger.Approval != incumbent.Approval {
+		return challenger.Approval > incumbent.Approval
+	}
+	return challenger.Participation > incumbent.Participation
+}
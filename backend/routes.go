@@ -8,16 +8,37 @@ import (
 const (
 	API_PREFIX = "/api"
 	// Auth routes
-	API_SESSION      = API_PREFIX + "/session"
-	API_AUTHENTICATE = API_PREFIX + "/authenticate"
+	API_SESSION         = API_PREFIX + "/session"
+	API_AUTHENTICATE    = API_PREFIX + "/authenticate"
+	API_FORGOT_PASSWORD = API_PREFIX + "/forgot-password"
+	API_RESET_PASSWORD  = API_PREFIX + "/reset-password"
 	// User routes
-	API_REGISTER_USER = API_PREFIX + "/users"
-	API_GET_USERS     = API_PREFIX + "/users"
-	API_GET_USER      = API_PREFIX + "/users/:id"
+	API_REGISTER_USER         = API_PREFIX + "/users"
+	API_GET_USERS             = API_PREFIX + "/users"
+	API_GET_USER              = API_PREFIX + "/users/:id"
+	API_UPDATE_USER           = API_PREFIX + "/users/:id"
+	API_CREATE_STRIPE_ACCOUNT = API_PREFIX + "/users/:id/stripe-account"
 	// Campaign routes
 	API_GET_CAMPAIGN    = API_PREFIX + "/campaigns/:id"
 	API_GET_CAMPAIGNS   = API_PREFIX + "/campaigns"
 	API_CREATE_CAMPAIGN = API_PREFIX + "/campaigns"
+	API_UPDATE_CAMPAIGN = API_PREFIX + "/campaigns/:id"
+	API_CANCEL_CAMPAIGN = API_PREFIX + "/campaigns/:id/cancel"
+	// Contribution routes
+	API_CREATE_CONTRIBUTION = API_PREFIX + "/campaigns/:id/contributions"
+	// Pledge routes
+	API_CREATE_PLEDGE = API_PREFIX + "/campaigns/:id/pledges"
+	API_GET_PLEDGES   = API_PREFIX + "/pledges"
+	API_PAUSE_PLEDGE  = API_PREFIX + "/pledges/:id/pause"
+	API_RESUME_PLEDGE = API_PREFIX + "/pledges/:id/resume"
+	API_CANCEL_PLEDGE = API_PREFIX + "/pledges/:id"
+	// Claim routes
+	API_CREATE_CLAIM = API_PREFIX + "/campaigns/:id/claims"
+	API_GET_CLAIM    = API_PREFIX + "/claims/:id"
+	API_CAST_VOTE    = API_PREFIX + "/claims/:id/vote"
+	API_RETRACT_VOTE = API_PREFIX + "/claims/:id/vote"
+	// Webhook routes
+	API_STRIPE_WEBHOOK = API_PREFIX + "/stripe/webhook"
 )
 
 func SetupRoutes(m *martini.ClassicMartini, db *sql.DB, env *Environment) {
@@ -29,4 +50,12 @@ func SetupRoutes(m *martini.ClassicMartini, db *sql.DB, env *Environment) {
 	SetupUserRoutes(m, db, env)
 	// Routes to do with campaigns
 	SetupCampaignRoutes(m, db, env)
+	// Routes to do with contributions
+	SetupContributionRoutes(m, db, env)
+	// Routes to do with pledges
+	SetupPledgeRoutes(m, db, env)
+	// Routes to do with claims
+	SetupClaimRoutes(m, db, env)
+	// Routes that receive events from other services
+	SetupWebhookRoutes(m, db, env)
 }
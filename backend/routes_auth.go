@@ -7,6 +7,22 @@ import (
 	"github.com/go-martini/martini"
 	"golang.org/x/crypto/bcrypt"
 	"net/http"
+	"net/url"
+)
+
+const (
+	AUTH_FIELD_TOKEN = "token" // The body field password reset tokens are sent back in
+
+	PASSWORD_RESET_EMAIL_SUBJECT = "Reset your Equitize password"
+	PASSWORD_RESET_EMAIL_BODY    = `Hi %s,
+
+Somebody asked to reset the password of your Equitize account. If it was you,
+follow the link below within the next hour to choose a new one:
+
+%s
+
+If it wasn't you, you can ignore this email; your password stays the same.
+`
 )
 
 func SetupAuthRoutes(m *martini.ClassicMartini, db *sql.DB, env *Environment) {
@@ -67,4 +83,145 @@ func SetupAuthRoutes(m *martini.ClassicMartini, db *sql.DB, env *Environment) {
 	m.Get(API_SESSION, func(session *Session, responder *Responder) {
 		responder.Json(session)
 	})
+	// Emails a password reset link to a user who forgot their password. The
+	// response is the same whether or not anybody has the email address, so
+	// that it can't be used to find out who has an account. Users get no more
+	// emails while the token they were sent still works. Expects a JSON
+	// encoded body with the following properties:
+	// - email (string)
+	m.Post(API_FORGOT_PASSWORD, func(req *http.Request, mailer Mailer, responder *Responder) {
+		// Perform json unmarshalling
+		var body map[string]interface{}
+
+		decoder := json.NewDecoder(req.Body)
+		if err := decoder.Decode(&body); err != nil {
+			responder.Error(PUBERR_INVALID_JSON)
+			return
+		}
+
+		// Basic validation and field extractions
+		email, ok := String(body[USER_FIELD_EMAIL])
+		if !ok {
+			responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_FIELD, fmt.Sprintf(ERR_BODY_FIELD_INVALID, USER_FIELD_EMAIL)))
+			return
+		}
+
+		// The email is sent in the background, so that the time it takes to
+		// respond doesn't tell whether anybody has the address either
+		go requestPasswordReset(db, mailer, env.passwordResetURL, email)
+		responder.Json(map[string]bool{"requested": true})
+	})
+	// Resets the password of a user with a token from a password reset email;
+	// every session they had before now ends, and a new one is created. Expects
+	// a JSON encoded body with the following properties:
+	// - token (string)
+	// - password (string; validated like when registering)
+	m.Post(API_RESET_PASSWORD, func(req *http.Request, responder *Responder) {
+		// Perform json unmarshalling
+		var (
+			body     map[string]interface{}
+			token    string
+			password string
+			ok       bool
+		)
+
+		decoder := json.NewDecoder(req.Body)
+		if err := decoder.Decode(&body); err != nil {
+			responder.Error(PUBERR_INVALID_JSON)
+			return
+		}
+
+		// Basic validation and field extractions
+		token, ok = String(body[AUTH_FIELD_TOKEN])
+		if !ok {
+			responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_FIELD, fmt.Sprintf(ERR_BODY_FIELD_INVALID, AUTH_FIELD_TOKEN)))
+			return
+		}
+		password, ok = String(body[USER_FIELD_PASSWORD])
+		if !ok || !IsValidPassword(password) {
+			responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_FIELD, fmt.Sprintf(ERR_BODY_FIELD_INVALID, USER_FIELD_PASSWORD)))
+			return
+		}
+
+		// Build hashed password
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 7)
+		if err != nil {
+			responder.Error(err)
+			return
+		}
+
+		// Start the transaction
+		tx, err := db.Begin()
+		if err != nil {
+			responder.Error(err)
+			return
+		}
+		// Use up the token so that it can't be used again
+		userId, err := UsePasswordReset(tx, token)
+		if err != nil {
+			_ = tx.Rollback()
+			responder.Error(err)
+			return
+		}
+		// Replace the password
+		if err = SetUserPassword(tx, userId, string(hashedPassword[:])); err != nil {
+			_ = tx.Rollback()
+			responder.Error(err)
+			return
+		}
+		// Commit the tx
+		if err = tx.Commit(); err != nil {
+			responder.Error(err)
+			return
+		}
+
+		// Log the user back in
+		user, err := GetUser(db, userId)
+		if err != nil {
+			responder.Error(err)
+			return
+		}
+		sessionToken, err := NewSessionToken(
+			env,
+			user.Id,
+			user.FirstName,
+			user.LastName,
+			user.Email,
+			user.PictureUrl,
+		)
+		if err != nil {
+			responder.Error(err)
+		} else {
+			responder.Text(sessionToken)
+		}
+	})
+}
+
+// Emails a password reset link to the user with an email address, if there is
+// one and they have no other token that still works. Runs in the background,
+// so failures are only logged
+func requestPasswordReset(db *sql.DB, mailer Mailer, resetURL string, email string) {
+	user, err := FindUserByEmail(db, email)
+	if err == PUBERR_ENTITY_NOT_FOUND {
+		return
+	} else if err != nil {
+		Debug("Failed to find the user to reset the password of: ", err)
+		return
+	}
+	token, created, err := CreatePasswordReset(db, user.Id)
+	if err != nil {
+		Debug(fmt.Sprintf("Failed to create a password reset for user %d: ", user.Id), err)
+		return
+	} else if !created {
+		Debug(fmt.Sprintf("User %d already has a password reset that hasn't expired", user.Id))
+		return
+	}
+	link := resetURL + url.QueryEscape(token)
+	if err = mailer.Send(user.Email, PASSWORD_RESET_EMAIL_SUBJECT, fmt.Sprintf(PASSWORD_RESET_EMAIL_BODY, user.FirstName, link)); err != nil {
+		Debug(fmt.Sprintf("Failed to email user %d their password reset: ", user.Id), err)
+		// Nobody got the token, so use it up to let the user ask again
+		if _, err = UsePasswordReset(db, token); err != nil {
+			Debug(fmt.Sprintf("Failed to withdraw the password reset of user %d: ", user.Id), err)
+		}
+	}
 }
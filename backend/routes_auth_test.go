@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// A mailer that keeps the emails it is asked to send, or fails to send them
+type testMailer struct {
+	sent []string // The addresses emails were sent to
+	err  error    // What sending fails with, if anything
+}
+
+func (m *testMailer) Send(to string, subject string, body string) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.sent = append(m.sent, to)
+	return nil
+}
+
+func TestRequestPasswordReset(t *testing.T) {
+	f := newTestFixture(t, FUNDING_MODE_KEEP_WHAT_YOU_RAISE)
+	defer f.db.Close()
+	mailer := &testMailer{}
+
+	// Nobody has the address, so nobody is emailed
+	requestPasswordReset(f.db, mailer, "", "nobody@example.com")
+	if len(mailer.sent) != 0 {
+		t.Errorf("sent %d emails to an unknown address, want none", len(mailer.sent))
+	}
+	requestPasswordReset(f.db, mailer, "", f.contributor.Email)
+	if len(mailer.sent) != 1 || mailer.sent[0] != f.contributor.Email {
+		t.Fatalf("sent emails to %v, want one to %s", mailer.sent, f.contributor.Email)
+	}
+	// The token that was sent still works, so asking again sends nothing
+	requestPasswordReset(f.db, mailer, "", f.contributor.Email)
+	if len(mailer.sent) != 1 {
+		t.Errorf("sent %d emails, want no more than 1 while the token works", len(mailer.sent))
+	}
+}
+
+func TestRequestPasswordResetAfterMailFailure(t *testing.T) {
+	f := newTestFixture(t, FUNDING_MODE_KEEP_WHAT_YOU_RAISE)
+	defer f.db.Close()
+	mailer := &testMailer{err: errors.New("The mail server is down")}
+
+	requestPasswordReset(f.db, mailer, "", f.contributor.Email)
+	// Nobody got the token, so the user may ask again right away
+	mailer.err = nil
+	requestPasswordReset(f.db, mailer, "", f.contributor.Email)
+	if len(mailer.sent) != 1 {
+		t.Errorf("sent %d emails after the failure, want 1", len(mailer.sent))
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/go-martini/martini"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -17,16 +18,53 @@ const (
 	CAMPAIGN_FIELD_COVER_PICTURE_URL     = "coverPictureUrl"
 	CAMPAIGN_FIELD_THUMBNAIL_PICTURE_URL = "thumbnailPictureUrl"
 	CAMPAIGN_FIELD_AMOUNT                = "amount"
+	CAMPAIGN_FIELD_CURRENCY              = "currency"
+	CAMPAIGN_FIELD_GOAL                  = "goal"
+	CAMPAIGN_FIELD_FUNDING_MODE          = "fundingMode"
 	CAMPAIGN_FIELD_DEADLINE              = "deadline"
+	CAMPAIGN_FIELD_VOTING_METHOD         = "votingMethod"
+	CAMPAIGN_FIELD_VOTING_QUORUM         = "votingQuorum"
+	CAMPAIGN_FIELD_VOTING_THRESHOLD      = "votingThreshold"
+	CAMPAIGN_FIELD_REWARD_TIERS          = "rewardTiers"
+
+	REWARD_TIER_FIELD_TITLE              = "title"
+	REWARD_TIER_FIELD_DESCRIPTION        = "description"
+	REWARD_TIER_FIELD_MIN_AMOUNT         = "minAmount"
+	REWARD_TIER_FIELD_QUANTITY           = "quantity"
+	REWARD_TIER_FIELD_ESTIMATED_DELIVERY = "estimatedDelivery"
+
+	CAMPAIGN_MAX_REWARD_TIERS = 20 // The most reward tiers a single campaign may offer
+
+	CAMPAIGN_PARAM_QUERY           = "q"
+	CAMPAIGN_PARAM_CREATOR_ID      = "creatorId"
+	CAMPAIGN_PARAM_STATE           = "state"
+	CAMPAIGN_PARAM_DEADLINE_AFTER  = "deadlineAfter"
+	CAMPAIGN_PARAM_DEADLINE_BEFORE = "deadlineBefore"
+	CAMPAIGN_PARAM_SORT            = "sort"
+	CAMPAIGN_PARAM_CURSOR          = "cursor"
+	CAMPAIGN_PARAM_LIMIT           = "limit"
 )
 
 func SetupCampaignRoutes(m *martini.ClassicMartini, db *sql.DB, env *Environment) {
 	// Registers a new campaign
 	// Expects a JSON encoded body with the following properties:
-	// - firstName (string; no longer than 100 characters)
-	// - lastName (string; no longer than 100 characters)
-	// - email (string; must be email formatted; no longer than 100 characters)
-	// - pictureUrl (string; must be URL formatted; no longer than 500 characters)
+	// - title (string; no longer than 255 characters)
+	// - description (string)
+	// - coverPictureUrl (string; must be URL formatted; no longer than 500 characters)
+	// - thumbnailPictureUrl (string; must be URL formatted; no longer than 500 characters)
+	// - deadline (string; seconds since epoch; within 6 days for all-or-nothing campaigns)
+	// - currency (string; optional; ISO-4217 code; defaults to "USD")
+	// - goal (int; in minor units of the currency, e.g. cents; greater than 0)
+	// - fundingMode (string; optional; "all_or_nothing" or "keep_what_you_raise"; defaults to "keep_what_you_raise")
+	// - votingMethod (string; optional; "one_person_one_vote", "weighted" or "quadratic")
+	// - votingQuorum (number; optional; percentage of contributed funds that must vote on a claim)
+	// - votingThreshold (number; optional; percentage of weighted votes a claim must beat to be approved)
+	// - rewardTiers (array; optional; no more than 20 objects with the following properties)
+	//   - title (string; no longer than 255 characters)
+	//   - description (string)
+	//   - minAmount (int; in minor units of the currency; no less than 50)
+	//   - quantity (int; optional; how many backers may select the tier; unlimited if left out)
+	//   - estimatedDelivery (string; seconds since epoch)
 	m.Post(API_CREATE_CAMPAIGN, func(req *http.Request, session *Session, responder *Responder) {
 		// Perform json unmarshalling
 		var (
@@ -35,9 +73,12 @@ func SetupCampaignRoutes(m *martini.ClassicMartini, db *sql.DB, env *Environment
 			description         string
 			coverPictureUrl     string
 			thumbnailPictureUrl string
-			deadlineStr         string
-			deadlineLong        int64
 			deadline            time.Time
+			currency            = DEFAULT_CURRENCY
+			goal                int64
+			fundingMode         = DEFAULT_FUNDING_MODE
+			votingRules         = DefaultVotingRules()
+			rewardTiers         []*RewardTier
 			ok                  bool
 			err                 error
 		)
@@ -69,48 +110,415 @@ func SetupCampaignRoutes(m *martini.ClassicMartini, db *sql.DB, env *Environment
 			responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_FIELD, fmt.Sprintf(ERR_BODY_FIELD_INVALID, CAMPAIGN_FIELD_THUMBNAIL_PICTURE_URL)))
 			return
 		}
-		deadlineStr, ok = String(body[CAMPAIGN_FIELD_DEADLINE])
+		deadline, ok = parseCampaignDeadline(body[CAMPAIGN_FIELD_DEADLINE])
 		if !ok {
 			responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_FIELD, fmt.Sprintf(ERR_BODY_FIELD_INVALID, CAMPAIGN_FIELD_DEADLINE)))
 			return
 		}
-		deadlineLong, err = strconv.ParseInt(deadlineStr, 10, 64)
-		if err != nil {
-			responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_FIELD, fmt.Sprintf(ERR_BODY_FIELD_INVALID, CAMPAIGN_FIELD_DEADLINE)))
+		if body[CAMPAIGN_FIELD_CURRENCY] != nil {
+			currency, ok = String(body[CAMPAIGN_FIELD_CURRENCY])
+			if currency, ok = ParseCurrency(currency); !ok {
+				responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_FIELD, fmt.Sprintf(ERR_BODY_FIELD_INVALID, CAMPAIGN_FIELD_CURRENCY)))
+				return
+			}
+		}
+		goal, ok = Int(body[CAMPAIGN_FIELD_GOAL])
+		if !ok || goal < 1 {
+			responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_FIELD, fmt.Sprintf(ERR_BODY_FIELD_INVALID, CAMPAIGN_FIELD_GOAL)))
+			return
+		}
+		if body[CAMPAIGN_FIELD_FUNDING_MODE] != nil {
+			fundingMode, ok = String(body[CAMPAIGN_FIELD_FUNDING_MODE])
+			if !ok || !IsValidFundingMode(fundingMode) {
+				responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_FIELD, fmt.Sprintf(ERR_BODY_FIELD_INVALID, CAMPAIGN_FIELD_FUNDING_MODE)))
+				return
+			}
+		}
+		if !IsAllowedDeadline(fundingMode, deadline) {
+			responder.Error(PUBERR_DEADLINE_TOO_FAR)
 			return
 		}
-		deadline = time.Unix(deadlineLong, 0)
+		// The voting rules are optional
+		if body[CAMPAIGN_FIELD_VOTING_METHOD] != nil {
+			votingRules.Method, ok = String(body[CAMPAIGN_FIELD_VOTING_METHOD])
+			if !ok || !IsValidVotingMethod(votingRules.Method) {
+				responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_FIELD, fmt.Sprintf(ERR_BODY_FIELD_INVALID, CAMPAIGN_FIELD_VOTING_METHOD)))
+				return
+			}
+		}
+		if body[CAMPAIGN_FIELD_VOTING_QUORUM] != nil {
+			votingRules.Quorum, ok = Float(body[CAMPAIGN_FIELD_VOTING_QUORUM])
+			if !ok || !IsValidVotingQuorum(votingRules.Quorum) {
+				responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_FIELD, fmt.Sprintf(ERR_BODY_FIELD_INVALID, CAMPAIGN_FIELD_VOTING_QUORUM)))
+				return
+			}
+		}
+		if body[CAMPAIGN_FIELD_VOTING_THRESHOLD] != nil {
+			votingRules.Threshold, ok = Float(body[CAMPAIGN_FIELD_VOTING_THRESHOLD])
+			if !ok || !IsValidVotingThreshold(votingRules.Threshold) {
+				responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_FIELD, fmt.Sprintf(ERR_BODY_FIELD_INVALID, CAMPAIGN_FIELD_VOTING_THRESHOLD)))
+				return
+			}
+		}
+
+		// The reward tiers are optional
+		if body[CAMPAIGN_FIELD_REWARD_TIERS] != nil {
+			rewardTiers, err = parseRewardTiers(body[CAMPAIGN_FIELD_REWARD_TIERS], currency)
+			if err != nil {
+				responder.Error(err)
+				return
+			}
+		}
 
-		// Put the campaign in the database
-		newId, err := CreateNewCampaign(db, title, description, coverPictureUrl, thumbnailPictureUrl, 0, deadline, session.UserId)
+		// Start the transaction
+		tx, err := db.Begin()
 		if err != nil {
 			responder.Error(err)
 			return
-		} else {
-			// Return the new campaign
-			newCampaign, err := GetCampaign(db, newId)
+		}
+		// Put the campaign and its reward tiers in the database
+		newId, err := CreateNewCampaign(tx, title, description, coverPictureUrl, thumbnailPictureUrl, currency, goal, fundingMode, deadline, session.UserId, votingRules)
+		if err != nil {
+			_ = tx.Rollback()
+			responder.Error(err)
+			return
+		}
+		for _, tier := range rewardTiers {
+			_, err = CreateNewRewardTier(tx, tier.Title, tier.Description, tier.MinAmount, tier.Quantity, tier.EstimatedDelivery, newId)
 			if err != nil {
+				_ = tx.Rollback()
 				responder.Error(err)
 				return
-			} else {
-				responder.Json(newCampaign)
+			}
+		}
+		// Commit the tx
+		err = tx.Commit()
+		if err != nil {
+			responder.Error(err)
+			return
+		}
+		// Return the new campaign along with its reward tiers
+		respondWithCampaign(db, newId, responder)
+	})
+
+	// Gets a page of campaigns
+	// Accepts the following query parameters:
+	// - q (string; optional; full-text search over titles and descriptions)
+	// - creatorId (int; optional; only campaigns started by this user)
+	// - state (string; optional; either "active" or "finished")
+	// - deadlineAfter (int; optional; seconds since epoch)
+	// - deadlineBefore (int; optional; seconds since epoch)
+	// - sort (string; optional; "newest", "ending_soon", "most_funded" or "relevance"; defaults to "relevance" when searching and "newest" otherwise)
+	// - cursor (string; optional; the "nextCursor" of the previous page)
+	// - limit (int; optional; defaults to 20; no more than 100)
+	// - includeDeleted (bool; optional; admins only; includes soft deleted campaigns)
+	m.Get(API_GET_CAMPAIGNS, func(session *Session, responder *Responder, req *http.Request) {
+		var (
+			values = req.URL.Query()
+			query  = strings.TrimSpace(values.Get(CAMPAIGN_PARAM_QUERY))
+			filter = CampaignFilter{
+				State:  values.Get(CAMPAIGN_PARAM_STATE),
+				Sort:   values.Get(CAMPAIGN_PARAM_SORT),
+				Cursor: values.Get(CAMPAIGN_PARAM_CURSOR),
+			}
+			err error
+		)
+
+		if str := values.Get(CAMPAIGN_PARAM_CREATOR_ID); str != "" {
+			filter.CreatorId, err = strconv.ParseInt(str, 10, 64)
+			if err != nil {
+				responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_PARAM, fmt.Sprintf(ERR_URL_PARAM_INVALID, CAMPAIGN_PARAM_CREATOR_ID)))
+				return
+			}
+		}
+		if filter.State != "" && !IsValidCampaignState(filter.State) {
+			responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_PARAM, fmt.Sprintf(ERR_URL_PARAM_INVALID, CAMPAIGN_PARAM_STATE)))
+			return
+		}
+		if str := values.Get(CAMPAIGN_PARAM_DEADLINE_AFTER); str != "" {
+			secs, err := strconv.ParseInt(str, 10, 64)
+			if err != nil {
+				responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_PARAM, fmt.Sprintf(ERR_URL_PARAM_INVALID, CAMPAIGN_PARAM_DEADLINE_AFTER)))
+				return
+			}
+			filter.DeadlineAfter = time.Unix(secs, 0)
+		}
+		if str := values.Get(CAMPAIGN_PARAM_DEADLINE_BEFORE); str != "" {
+			secs, err := strconv.ParseInt(str, 10, 64)
+			if err != nil {
+				responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_PARAM, fmt.Sprintf(ERR_URL_PARAM_INVALID, CAMPAIGN_PARAM_DEADLINE_BEFORE)))
 				return
 			}
+			filter.DeadlineBefore = time.Unix(secs, 0)
+		}
+		if filter.Sort == "" {
+			if query != "" {
+				filter.Sort = CAMPAIGN_SORT_RELEVANCE
+			} else {
+				filter.Sort = CAMPAIGN_SORT_NEWEST
+			}
+		}
+		filter.Limit, err = strconv.Atoi(values.Get(CAMPAIGN_PARAM_LIMIT))
+		if err != nil {
+			filter.Limit = CAMPAIGN_PAGE_DEFAULT_LIMIT
+		}
+		filter.IncludeDeleted, err = IncludeDeleted(db, req, session)
+		if err != nil {
+			responder.Error(err)
+			return
+		}
+
+		var page *CampaignPage
+		if query != "" {
+			page, err = FilterCampaigns(db, query, &filter)
+		} else {
+			page, err = GetCampaigns(db, &filter)
+		}
+		if err != nil {
+			responder.Error(err)
+		} else {
+			for _, campaign := range page.Campaigns {
+				campaign.RedactUsers(session.UserId)
+			}
+			responder.Json(page)
 		}
 	})
 
 	// Gets a info about a specific campaign
-	m.Get(API_GET_CAMPAIGN, func(params martini.Params, responder *Responder) {
+	// Accepts the following query parameters:
+	// - includeDeleted (bool; optional; admins only; includes the campaign and its contributions and claims even if soft deleted)
+	m.Get(API_GET_CAMPAIGN, func(params martini.Params, req *http.Request, session *Session, responder *Responder) {
 		id, err := strconv.ParseInt(params[CAMPAIGN_FIELD_ID], 10, 64)
 		if err != nil {
 			responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_PARAM, fmt.Sprintf(ERR_URL_PARAM_INVALID, CAMPAIGN_FIELD_ID)))
 		} else {
-			campaign, err := GetFullCampaign(db, id)
+			includeDeleted, err := IncludeDeleted(db, req, session)
+			if err != nil {
+				responder.Error(err)
+				return
+			}
+			campaign, err := GetFullCampaign(db, id, includeDeleted)
 			if err != nil {
 				responder.Error(err)
 			} else {
+				campaign.RedactUsers(session.UserId)
 				responder.Json(campaign)
 			}
 		}
 	})
+
+	// Changes a campaign of the current user; fields that are left out stay the
+	// same. The deadline and goal can only be changed while the campaign is
+	// raising money and nobody has backed it yet, since backers chose to
+	// contribute by them. Expects a JSON encoded body with any of the following
+	// properties, validated as they are when creating a campaign:
+	// - title (string)
+	// - description (string)
+	// - coverPictureUrl (string)
+	// - thumbnailPictureUrl (string)
+	// - deadline (string; seconds since epoch; must be in the future; within 6 days for all-or-nothing campaigns)
+	// - goal (int; in minor units of the campaign's currency; greater than 0)
+	m.Patch(API_UPDATE_CAMPAIGN, func(params martini.Params, req *http.Request, session *Session, responder *Responder) {
+		campaignId, err := strconv.ParseInt(params[CAMPAIGN_FIELD_ID], 10, 64)
+		if err != nil {
+			responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_PARAM, fmt.Sprintf(ERR_URL_PARAM_INVALID, CAMPAIGN_FIELD_ID)))
+			return
+		}
+
+		// Perform json unmarshalling
+		var (
+			body         map[string]interface{}
+			updateArgs   = make(map[string]interface{})
+			deadline     time.Time
+			changesTerms = false
+		)
+
+		decoder := json.NewDecoder(req.Body)
+		if err := decoder.Decode(&body); err != nil {
+			responder.Error(PUBERR_INVALID_JSON)
+			return
+		}
+
+		// Only known fields may be changed, and each is checked on its own
+		for name, value := range body {
+			var ok bool
+			switch name {
+			case CAMPAIGN_FIELD_TITLE, CAMPAIGN_FIELD_DESCRIPTION, CAMPAIGN_FIELD_COVER_PICTURE_URL, CAMPAIGN_FIELD_THUMBNAIL_PICTURE_URL:
+				updateArgs[campaignEditableFields[name]], ok = String(value)
+			case CAMPAIGN_FIELD_DEADLINE:
+				deadline, ok = parseCampaignDeadline(value)
+				ok = ok && deadline.After(time.Now())
+				updateArgs[FIELD_CAMPAIGN_DEADLINE] = deadline
+				changesTerms = true
+			case CAMPAIGN_FIELD_GOAL:
+				var goal int64
+				goal, ok = Int(value)
+				ok = ok && goal > 0
+				updateArgs[FIELD_CAMPAIGN_GOAL] = goal
+				changesTerms = true
+			}
+			if !ok {
+				responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_FIELD, fmt.Sprintf(ERR_BODY_FIELD_INVALID, name)))
+				return
+			}
+		}
+
+		// Start the transaction
+		tx, err := db.Begin()
+		if err != nil {
+			responder.Error(err)
+			return
+		}
+		// Lock the campaign so that nobody can contribute while its terms change
+		campaign, err := GetCampaignForUpdate(tx, campaignId)
+		if err == nil && !campaign.Active {
+			err = PUBERR_ENTITY_NOT_FOUND
+		}
+		if err != nil {
+			_ = tx.Rollback()
+			responder.Error(err)
+			return
+		}
+		if campaign.CreatorId != session.UserId {
+			_ = tx.Rollback()
+			responder.Error(PUBERR_NOT_CAMPAIGN_CREATOR)
+			return
+		}
+		if changesTerms {
+			if !campaign.IsOpen() {
+				_ = tx.Rollback()
+				responder.Error(PUBERR_CAMPAIGN_CLOSED)
+				return
+			}
+			hasBackers, err := HasBackers(tx, campaign.Id)
+			if err != nil {
+				_ = tx.Rollback()
+				responder.Error(err)
+				return
+			}
+			if hasBackers {
+				_ = tx.Rollback()
+				responder.Error(PUBERR_CAMPAIGN_HAS_BACKERS)
+				return
+			}
+		}
+		if _, ok := updateArgs[FIELD_CAMPAIGN_DEADLINE]; ok && !IsAllowedDeadline(campaign.FundingMode, deadline) {
+			_ = tx.Rollback()
+			responder.Error(PUBERR_DEADLINE_TOO_FAR)
+			return
+		}
+		// Submit the update
+		if err = UpdateFields(tx, TABLE_NAME_CAMPAIGN, campaign.Id, updateArgs); err != nil {
+			_ = tx.Rollback()
+			responder.Error(err)
+			return
+		}
+		// Commit the tx
+		if err = tx.Commit(); err != nil {
+			responder.Error(err)
+			return
+		}
+		respondWithCampaign(db, campaign.Id, responder)
+	})
+
+	// Cancels a campaign of the current user while it is raising money; its
+	// backers are refunded in the background and their pledges canceled
+	m.Post(API_CANCEL_CAMPAIGN, func(params martini.Params, session *Session, responder *Responder) {
+		campaignId, err := strconv.ParseInt(params[CAMPAIGN_FIELD_ID], 10, 64)
+		if err != nil {
+			responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_PARAM, fmt.Sprintf(ERR_URL_PARAM_INVALID, CAMPAIGN_FIELD_ID)))
+			return
+		}
+		if err = CancelCampaign(db, campaignId, session.UserId); err != nil {
+			responder.Error(err)
+			return
+		}
+		respondWithCampaign(db, campaignId, responder)
+	})
+}
+
+// The fields of a campaign that its creator may change at any time, and the columns they are stored in
+var campaignEditableFields = map[string]string{
+	CAMPAIGN_FIELD_TITLE:                 FIELD_CAMPAIGN_TITLE,
+	CAMPAIGN_FIELD_DESCRIPTION:           FIELD_CAMPAIGN_DESCRIPTION,
+	CAMPAIGN_FIELD_COVER_PICTURE_URL:     FIELD_CAMPAIGN_COVER_URL,
+	CAMPAIGN_FIELD_THUMBNAIL_PICTURE_URL: FIELD_CAMPAIGN_THUMB_URL,
+}
+
+// Reads the deadline of a campaign from a request body, where it is a string
+// of seconds since epoch; returns false if it is missing or invalid
+func parseCampaignDeadline(field interface{}) (time.Time, bool) {
+	str, ok := String(field)
+	if !ok {
+		return time.Time{}, false
+	}
+	secs, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(secs, 0), true
+}
+
+// Responds with a campaign along with its reward tiers
+func respondWithCampaign(db *sql.DB, campaignId int64, responder *Responder) {
+	campaign, err := GetCampaign(db, campaignId)
+	if err == nil {
+		campaign.RewardTiers, err = FindRewardTiersByCampaignId(db, campaignId)
+	}
+	if err != nil {
+		responder.Error(err)
+	} else {
+		responder.Json(campaign)
+	}
+}
+
+// Reads the reward tiers of a new campaign from a request body; their minimum
+// amounts are in the campaign's currency
+func parseRewardTiers(field interface{}, currency string) ([]*RewardTier, error) {
+	items, ok := field.([]interface{})
+	if !ok || len(items) > CAMPAIGN_MAX_REWARD_TIERS {
+		return nil, NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_FIELD, fmt.Sprintf(ERR_BODY_FIELD_INVALID, CAMPAIGN_FIELD_REWARD_TIERS))
+	}
+	tiers := make([]*RewardTier, 0, len(items))
+	for i, item := range items {
+		fields, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_FIELD, fmt.Sprintf(ERR_BODY_FIELD_INVALID, CAMPAIGN_FIELD_REWARD_TIERS))
+		}
+		invalid := func(name string) error {
+			return NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_FIELD, fmt.Sprintf(ERR_BODY_ITEM_FIELD_INVALID, name, i, CAMPAIGN_FIELD_REWARD_TIERS))
+		}
+		var tier RewardTier
+		tier.Title, ok = String(fields[REWARD_TIER_FIELD_TITLE])
+		if !ok || tier.Title == "" || len(tier.Title) > 255 {
+			return nil, invalid(REWARD_TIER_FIELD_TITLE)
+		}
+		tier.Description, ok = String(fields[REWARD_TIER_FIELD_DESCRIPTION])
+		if !ok {
+			return nil, invalid(REWARD_TIER_FIELD_DESCRIPTION)
+		}
+		minAmount, ok := Int(fields[REWARD_TIER_FIELD_MIN_AMOUNT])
+		if !ok || minAmount < CONTRIBUTION_MIN_AMOUNT {
+			return nil, invalid(REWARD_TIER_FIELD_MIN_AMOUNT)
+		}
+		tier.MinAmount = NewMoney(minAmount, currency)
+		if fields[REWARD_TIER_FIELD_QUANTITY] != nil {
+			tier.Quantity.Int64, ok = Int(fields[REWARD_TIER_FIELD_QUANTITY])
+			if !ok || tier.Quantity.Int64 < 1 {
+				return nil, invalid(REWARD_TIER_FIELD_QUANTITY)
+			}
+			tier.Quantity.Valid = true
+		}
+		deliveryStr, ok := String(fields[REWARD_TIER_FIELD_ESTIMATED_DELIVERY])
+		if !ok {
+			return nil, invalid(REWARD_TIER_FIELD_ESTIMATED_DELIVERY)
+		}
+		delivery, err := strconv.ParseInt(deliveryStr, 10, 64)
+		if err != nil {
+			return nil, invalid(REWARD_TIER_FIELD_ESTIMATED_DELIVERY)
+		}
+		tier.EstimatedDelivery = time.Unix(delivery, 0)
+		tiers = append(tiers, &tier)
+	}
+	return tiers, nil
 }
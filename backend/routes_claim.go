@@ -0,0 +1,265 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	validator "github.com/asaskevich/govalidator"
+	"github.com/go-martini/martini"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	CLAIM_FIELD_ID            = "id"
+	CLAIM_FIELD_DESCRIPTION   = "description"
+	CLAIM_FIELD_EVIDENCE      = "evidence"
+	CLAIM_FIELD_EVIDENCE_TYPE = "type"
+	CLAIM_FIELD_EVIDENCE_URL  = "url"
+	CLAIM_FIELD_AFFIRMATIVE   = "affirmative"
+
+	CLAIM_MAX_EVIDENCE = 20 // The most pieces of evidence a single claim may have
+)
+
+func SetupClaimRoutes(m *martini.ClassicMartini, db *sql.DB, env *Environment) {
+	// Claims the proceeds of a campaign for the current user
+	// Expects a JSON encoded body with the following properties:
+	// - description (string; explains why the claim should be approved)
+	// - evidence (array; between 1 and 20 objects with the following properties)
+	//   - type (string; "link", "image", "document" or "commit")
+	//   - url (string; must be URL formatted; no longer than 500 characters)
+	m.Post(API_CREATE_CLAIM, func(params martini.Params, req *http.Request, session *Session, responder *Responder) {
+		campaignId, err := strconv.ParseInt(params[CLAIM_FIELD_ID], 10, 64)
+		if err != nil {
+			responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_PARAM, fmt.Sprintf(ERR_URL_PARAM_INVALID, CLAIM_FIELD_ID)))
+			return
+		}
+
+		// Perform json unmarshalling
+		var (
+			body          map[string]interface{}
+			description   string
+			evidence      []interface{}
+			evidenceUrls  []string
+			evidenceTypes []ClaimEvidenceType
+			ok            bool
+		)
+
+		decoder := json.NewDecoder(req.Body)
+		if err := decoder.Decode(&body); err != nil {
+			responder.Error(PUBERR_INVALID_JSON)
+			return
+		}
+
+		// Basic validation and field extractions
+		description, ok = String(body[CLAIM_FIELD_DESCRIPTION])
+		if !ok || description == "" {
+			responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_FIELD, fmt.Sprintf(ERR_BODY_FIELD_INVALID, CLAIM_FIELD_DESCRIPTION)))
+			return
+		}
+		evidence, ok = body[CLAIM_FIELD_EVIDENCE].([]interface{})
+		if !ok || len(evidence) < 1 || len(evidence) > CLAIM_MAX_EVIDENCE {
+			responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_FIELD, fmt.Sprintf(ERR_BODY_FIELD_INVALID, CLAIM_FIELD_EVIDENCE)))
+			return
+		}
+		for i, item := range evidence {
+			fields, ok := item.(map[string]interface{})
+			if !ok {
+				responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_FIELD, fmt.Sprintf(ERR_BODY_FIELD_INVALID, CLAIM_FIELD_EVIDENCE)))
+				return
+			}
+			typeName, _ := String(fields[CLAIM_FIELD_EVIDENCE_TYPE])
+			itemType, ok := ParseClaimEvidenceType(typeName)
+			if !ok {
+				responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_FIELD, fmt.Sprintf(ERR_BODY_ITEM_FIELD_INVALID, CLAIM_FIELD_EVIDENCE_TYPE, i, CLAIM_FIELD_EVIDENCE)))
+				return
+			}
+			url, ok := String(fields[CLAIM_FIELD_EVIDENCE_URL])
+			if !ok || len(url) > 500 || !validator.IsURL(url) {
+				responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_FIELD, fmt.Sprintf(ERR_BODY_ITEM_FIELD_INVALID, CLAIM_FIELD_EVIDENCE_URL, i, CLAIM_FIELD_EVIDENCE)))
+				return
+			}
+			evidenceTypes = append(evidenceTypes, itemType)
+			evidenceUrls = append(evidenceUrls, url)
+		}
+
+		// Make sure the campaign is still up for grabs
+		campaign, err := GetCampaign(db, campaignId)
+		if err != nil {
+			responder.Error(err)
+			return
+		}
+		if campaign.ClaimerId.Valid {
+			responder.Error(PUBERR_CAMPAIGN_CLAIMED)
+			return
+		}
+		if campaign.Phase != CAMPAIGN_PHASE_CLAIMING {
+			responder.Error(PUBERR_CLAIMS_NOT_OPEN)
+			return
+		}
+		if time.Now().After(campaign.ClaimsCloseAt(env.claimPeriod)) {
+			responder.Error(PUBERR_CLAIMS_CLOSED)
+			return
+		}
+
+		// Start the transaction
+		tx, err := db.Begin()
+		if err != nil {
+			responder.Error(err)
+			return
+		}
+		// Put the claim and its evidence in the database
+		newId, err := CreateNewClaim(tx, description, session.UserId, campaign.Id)
+		if err != nil {
+			_ = tx.Rollback()
+			responder.Error(err)
+			return
+		}
+		for i := range evidenceUrls {
+			_, err = CreateNewClaimEvidence(tx, evidenceTypes[i], evidenceUrls[i], newId)
+			if err != nil {
+				_ = tx.Rollback()
+				responder.Error(err)
+				return
+			}
+		}
+		// Commit the tx
+		err = tx.Commit()
+		if err != nil {
+			_ = tx.Rollback()
+			responder.Error(err)
+			return
+		}
+		// Return the new claim
+		newClaim, err := GetFullClaim(db, newId, false)
+		if err != nil {
+			responder.Error(err)
+		} else {
+			newClaim.RedactUsers(session.UserId)
+			responder.Json(newClaim)
+		}
+	})
+
+	// Gets a specific claim along with its evidence and vote tally
+	// Accepts the following query parameters:
+	// - includeDeleted (bool; optional; admins only; includes the claim and its evidence even if soft deleted)
+	m.Get(API_GET_CLAIM, func(params martini.Params, req *http.Request, session *Session, responder *Responder) {
+		id, err := strconv.ParseInt(params[CLAIM_FIELD_ID], 10, 64)
+		if err != nil {
+			responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_PARAM, fmt.Sprintf(ERR_URL_PARAM_INVALID, CLAIM_FIELD_ID)))
+		} else {
+			includeDeleted, err := IncludeDeleted(db, req, session)
+			if err != nil {
+				responder.Error(err)
+				return
+			}
+			claim, err := GetFullClaim(db, id, includeDeleted)
+			if err != nil {
+				responder.Error(err)
+			} else {
+				claim.RedactUsers(session.UserId)
+				responder.Json(claim)
+			}
+		}
+	})
+
+	// Casts the current user's vote concerning a claim; changes their vote if they already voted
+	// Expects a JSON encoded body with the following properties:
+	// - affirmative (boolean; true if in favor of the claim)
+	m.Put(API_CAST_VOTE, func(params martini.Params, req *http.Request, session *Session, responder *Responder) {
+		claimId, err := strconv.ParseInt(params[CLAIM_FIELD_ID], 10, 64)
+		if err != nil {
+			responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_PARAM, fmt.Sprintf(ERR_URL_PARAM_INVALID, CLAIM_FIELD_ID)))
+			return
+		}
+
+		// Perform json unmarshalling
+		var body map[string]interface{}
+		decoder := json.NewDecoder(req.Body)
+		if err := decoder.Decode(&body); err != nil {
+			responder.Error(PUBERR_INVALID_JSON)
+			return
+		}
+		affirmative, ok := body[CLAIM_FIELD_AFFIRMATIVE].(bool)
+		if !ok {
+			responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_FIELD, fmt.Sprintf(ERR_BODY_FIELD_INVALID, CLAIM_FIELD_AFFIRMATIVE)))
+			return
+		}
+
+		// Make sure the current user is allowed to vote
+		err = checkCanVote(db, env, claimId, session.UserId)
+		if err != nil {
+			responder.Error(err)
+			return
+		}
+		_, err = CastClaimVote(db, claimId, session.UserId, affirmative)
+		if err != nil {
+			responder.Error(err)
+			return
+		}
+		// Return the claim with its updated tally
+		claim, err := GetFullClaim(db, claimId, false)
+		if err != nil {
+			responder.Error(err)
+		} else {
+			claim.RedactUsers(session.UserId)
+			responder.Json(claim)
+		}
+	})
+
+	// Retracts the current user's vote concerning a claim
+	m.Delete(API_RETRACT_VOTE, func(params martini.Params, session *Session, responder *Responder) {
+		claimId, err := strconv.ParseInt(params[CLAIM_FIELD_ID], 10, 64)
+		if err != nil {
+			responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_PARAM, fmt.Sprintf(ERR_URL_PARAM_INVALID, CLAIM_FIELD_ID)))
+			return
+		}
+
+		// Make sure the current user is allowed to vote
+		err = checkCanVote(db, env, claimId, session.UserId)
+		if err != nil {
+			responder.Error(err)
+			return
+		}
+		err = RetractClaimVote(db, claimId, session.UserId)
+		if err != nil {
+			responder.Error(err)
+			return
+		}
+		// Return the claim with its updated tally
+		claim, err := GetFullClaim(db, claimId, false)
+		if err != nil {
+			responder.Error(err)
+		} else {
+			claim.RedactUsers(session.UserId)
+			responder.Json(claim)
+		}
+	})
+}
+
+// Returns an error if a user may not vote concerning a claim; only backers of
+// a campaign that hasn't been claimed yet may vote, and only while voting is open
+func checkCanVote(db Queryable, env *Environment, claimId int64, voterId int64) error {
+	claim, err := GetClaim(db, claimId)
+	if err != nil {
+		return err
+	}
+	if claim.Outcome != CLAIM_OUTCOME_PENDING || time.Now().After(claim.VotingClosesAt(env.claimVotingWindow)) {
+		return PUBERR_VOTING_CLOSED
+	}
+	campaign, err := GetCampaign(db, claim.CampaignId)
+	if err != nil {
+		return err
+	}
+	if campaign.ClaimerId.Valid {
+		return PUBERR_CAMPAIGN_CLAIMED
+	}
+	backer, err := HasContributedToCampaign(db, campaign.Id, voterId)
+	if err != nil {
+		return err
+	} else if !backer {
+		return PUBERR_NOT_A_BACKER
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/go-martini/martini"
+	"net/http"
+	"strconv"
+)
+
+const (
+	CONTRIBUTION_FIELD_CAMPAIGN_ID = "id"
+	CONTRIBUTION_FIELD_AMOUNT      = "amount"
+	CONTRIBUTION_FIELD_CURRENCY    = "currency"
+	CONTRIBUTION_FIELD_REWARD_TIER = "rewardTierId"
+
+	CONTRIBUTION_MIN_AMOUNT = 50 // The smallest contribution Stripe is able to charge for, in minor units
+)
+
+func SetupContributionRoutes(m *martini.ClassicMartini, db *sql.DB, env *Environment) {
+	// Contributes to a campaign by charging the current user's Stripe customer
+	// Expects a JSON encoded body with the following properties:
+	// - amount (int; in minor units of the campaign's currency, e.g. cents; no less than 50)
+	// - currency (string; optional; must be the campaign's currency)
+	// - rewardTierId (int; optional; one of the campaign's reward tiers; amount must be at least its minimum)
+	m.Post(API_CREATE_CONTRIBUTION, func(params martini.Params, req *http.Request, session *Session, payments PaymentProvider, responder *Responder) {
+		campaignId, err := strconv.ParseInt(params[CONTRIBUTION_FIELD_CAMPAIGN_ID], 10, 64)
+		if err != nil {
+			responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_PARAM, fmt.Sprintf(ERR_URL_PARAM_INVALID, CONTRIBUTION_FIELD_CAMPAIGN_ID)))
+			return
+		}
+
+		// Perform json unmarshalling
+		var (
+			body         map[string]interface{}
+			units        int64
+			currency     string
+			rewardTierId sql.NullInt64
+			ok           bool
+		)
+
+		decoder := json.NewDecoder(req.Body)
+		if err := decoder.Decode(&body); err != nil {
+			responder.Error(PUBERR_INVALID_JSON)
+			return
+		}
+
+		// Basic validation and field extractions
+		units, ok = Int(body[CONTRIBUTION_FIELD_AMOUNT])
+		if !ok || units < CONTRIBUTION_MIN_AMOUNT {
+			responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_FIELD, fmt.Sprintf(ERR_BODY_FIELD_INVALID, CONTRIBUTION_FIELD_AMOUNT)))
+			return
+		}
+		if body[CONTRIBUTION_FIELD_CURRENCY] != nil {
+			currency, ok = String(body[CONTRIBUTION_FIELD_CURRENCY])
+			if currency, ok = ParseCurrency(currency); !ok {
+				responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_FIELD, fmt.Sprintf(ERR_BODY_FIELD_INVALID, CONTRIBUTION_FIELD_CURRENCY)))
+				return
+			}
+		}
+		if body[CONTRIBUTION_FIELD_REWARD_TIER] != nil {
+			rewardTierId.Int64, rewardTierId.Valid = Int(body[CONTRIBUTION_FIELD_REWARD_TIER])
+			if !rewardTierId.Valid {
+				responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_FIELD, fmt.Sprintf(ERR_BODY_FIELD_INVALID, CONTRIBUTION_FIELD_REWARD_TIER)))
+				return
+			}
+		}
+
+		// Find the Stripe customer of the contributor
+		contributor, err := GetUser(db, session.UserId)
+		if err != nil {
+			responder.Error(err)
+			return
+		}
+		// Charge them and record the contribution
+		newId, err := contribute(db, env, payments, contributor, campaignId, units, currency, rewardTierId)
+		if err != nil {
+			responder.Error(err)
+			return
+		}
+		// Return the new contribution
+		newContribution, err := GetContribution(db, newId)
+		if err != nil {
+			responder.Error(err)
+		} else {
+			responder.Json(newContribution)
+		}
+	})
+}
+
+// Charges a contributor for a contribution to a campaign and records it; the
+// charge is refunded if it can't be recorded. Returns the id of the new contribution
+func contribute(
+	db *sql.DB, // The database
+	env *Environment, // The environment, for the default fees
+	payments PaymentProvider, // The payment provider that charges the contributor
+	contributor *User, // The user contributing
+	campaignId int64, // The id of the campaign contributed to
+	units int64, // The amount in minor units of the campaign's currency
+	currency string, // The currency the contributor asked for; empty for the campaign's
+	rewardTierId sql.NullInt64, // The reward tier the contributor selected, if any
+) (int64, error) {
+	// Check the campaign and claim the reward tier in a short transaction, so
+	// that the campaign isn't locked while the contributor is charged
+	tx, err := db.Begin()
+	if err != nil {
+		return -1, err
+	}
+	campaign, err := GetCampaignForUpdate(tx, campaignId)
+	if err != nil {
+		_ = tx.Rollback()
+		return -1, err
+	}
+	if !campaign.IsOpen() {
+		_ = tx.Rollback()
+		return -1, PUBERR_CAMPAIGN_CLOSED
+	}
+	// Contributions are always in the currency of the campaign
+	if currency != "" && currency != campaign.Amount.Currency {
+		_ = tx.Rollback()
+		return -1, NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_FIELD, fmt.Sprintf(ERR_BODY_FIELD_INVALID, CONTRIBUTION_FIELD_CURRENCY))
+	}
+	amount := NewMoney(units, campaign.Amount.Currency)
+	// Claim the reward tier before charging; the campaign lock keeps claims of it in order
+	if rewardTierId.Valid {
+		if err = claimRewardTier(tx, campaign.Id, rewardTierId.Int64, amount); err != nil {
+			_ = tx.Rollback()
+			return -1, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return -1, err
+	}
+	// Gives the reward tier back if the contribution doesn't go through
+	releaseTier := func() {
+		if !rewardTierId.Valid {
+			return
+		}
+		if err := ReleaseRewardTier(db, rewardTierId.Int64); err != nil {
+			Debug(fmt.Sprintf("Could not release reward tier %d: ", rewardTierId.Int64), err)
+		}
+	}
+
+	// Charge the contributor; all-or-nothing campaigns only hold the money until their deadline
+	capture := campaign.CapturesImmediately()
+	chargeId, processorFee, err := payments.NewCharge(contributor.StripeId, amount, capture, fmt.Sprintf(STRIPE_CHARGE_DESC, campaign.Id, contributor.Id), "")
+	if err != nil {
+		releaseTier()
+		Debug("Charge failed: ", err)
+		return -1, PUBERR_PAYMENT_FAILED
+	}
+
+	// Record the contribution and update the campaign total
+	tx, err = db.Begin()
+	if err != nil {
+		return -1, err
+	}
+	// Undoes the charge if it can't be recorded
+	abort := func(err error) (int64, error) {
+		_ = tx.Rollback()
+		if _, refundErr := payments.RefundCharge(chargeId, ""); refundErr != nil {
+			Debug("Could not refund unrecorded charge \""+chargeId+"\": ", refundErr)
+		}
+		releaseTier()
+		return -1, err
+	}
+	// Lock the campaign so that its total can't change underneath us. It may
+	// have closed, or changed how it is funded, while the contributor was charged
+	campaign, err = GetCampaignForUpdate(tx, campaignId)
+	if err != nil {
+		return abort(err)
+	}
+	if !campaign.IsOpen() || campaign.CapturesImmediately() != capture {
+		return abort(PUBERR_CAMPAIGN_CLOSED)
+	}
+	status := CONTRIBUTION_STATUS_CAPTURED
+	if !capture {
+		status = CONTRIBUTION_STATUS_AUTHORIZED
+	}
+	platformFee, net := SplitContribution(amount, processorFee, campaign.PlatformFees(env.platformFees))
+	newId, err := CreateNewContribution(tx, amount, processorFee, platformFee, net, chargeId, status, contributor.Id, campaign.Id, sql.NullInt64{}, rewardTierId)
+	if err != nil {
+		return abort(err)
+	}
+	// Captured money goes straight into the campaign's escrow
+	if status == CONTRIBUTION_STATUS_CAPTURED {
+		err = PostContribution(tx, &Contribution{Id: newId, Amount: amount, ProcessorFee: processorFee.Amount, PlatformFee: platformFee.Amount, Net: net.Amount, StripeId: chargeId, ContributorId: contributor.Id, CampaignId: campaign.Id})
+		if err != nil {
+			return abort(err)
+		}
+	}
+	if err = AddToCampaignAmount(tx, campaign.Id, amount, net); err != nil {
+		return abort(err)
+	}
+	if err = tx.Commit(); err != nil {
+		return abort(err)
+	}
+	return newId, nil
+}
+
+// Claims one of a campaign's reward tiers for a contribution of amount; returns
+// an error if the tier isn't the campaign's, the amount is below its minimum or
+// none are left
+func claimRewardTier(db Queryable, campaignId int64, rewardTierId int64, amount Money) error {
+	tier, err := GetRewardTier(db, rewardTierId)
+	if err == PUBERR_ENTITY_NOT_FOUND || (err == nil && tier.CampaignId != campaignId) {
+		return NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_FIELD, fmt.Sprintf(ERR_BODY_FIELD_INVALID, CONTRIBUTION_FIELD_REWARD_TIER))
+	} else if err != nil {
+		return err
+	}
+	if amount.Amount < tier.MinAmount.Amount {
+		return PUBERR_BELOW_REWARD_TIER_MINIMUM
+	}
+	claimed, err := ClaimRewardTier(db, tier.Id)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		return PUBERR_REWARD_TIER_SOLD_OUT
+	}
+	return nil
+}
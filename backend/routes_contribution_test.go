@@ -0,0 +1,130 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+// The environment contributions are made in during tests
+var testEnvironment = &Environment{processorFees: testProcessorFees, platformFees: testPlatformFees}
+
+// Fails the test unless a campaign has no contributions, withdrawn or not, and has raised nothing
+func checkNoContributions(t *testing.T, db *sql.DB, campaignId int64) {
+	contributions, err := FindContributionsByCampaignId(db, campaignId, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contributions) != 0 {
+		t.Errorf("recorded %d contributions, want none", len(contributions))
+	}
+	if campaign := getTestCampaign(t, db, campaignId); campaign.Amount.Amount != 0 || campaign.Net != 0 {
+		t.Errorf("campaign raised %d (%d net), want nothing", campaign.Amount.Amount, campaign.Net)
+	}
+	if balance := getTestBalance(t, db, LEDGER_ACCOUNT_CAMPAIGN_ESCROW, campaignId); balance != 0 {
+		t.Errorf("escrow holds %d, want nothing", balance)
+	}
+}
+
+func TestContributeCapturesCharge(t *testing.T) {
+	f := newTestFixture(t, FUNDING_MODE_KEEP_WHAT_YOU_RAISE)
+	defer f.db.Close()
+
+	id, err := contribute(f.db, testEnvironment, f.payments, f.contributor, f.campaign.Id, 5000, "", sql.NullInt64{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	contribution := getTestContribution(t, f.db, id)
+	if contribution.Status != CONTRIBUTION_STATUS_CAPTURED {
+		t.Errorf("status is %q, want %q", contribution.Status, CONTRIBUTION_STATUS_CAPTURED)
+	}
+	if charge := f.payments.charges[contribution.StripeId]; charge == nil || !charge.captured {
+		t.Errorf("charge %q wasn't captured", contribution.StripeId)
+	}
+	if campaign := getTestCampaign(t, f.db, f.campaign.Id); campaign.Amount.Amount != 5000 || campaign.Net != contribution.Net {
+		t.Errorf("campaign raised %d (%d net), want 5000 (%d net)", campaign.Amount.Amount, campaign.Net, contribution.Net)
+	}
+	if balance := getTestBalance(t, f.db, LEDGER_ACCOUNT_CAMPAIGN_ESCROW, f.campaign.Id); balance != 5000 {
+		t.Errorf("escrow holds %d, want 5000", balance)
+	}
+	checkTestLedger(t, f.db)
+}
+
+func TestContributeDeclined(t *testing.T) {
+	cases := []struct {
+		name        string
+		fundingMode string
+		units       int64
+		failure     error // What the charge is made to fail with, if anything
+	}{
+		{"declined amount", FUNDING_MODE_KEEP_WHAT_YOU_RAISE, FAKE_PAYMENT_DECLINED_AMOUNT, nil},
+		{"declined charge", FUNDING_MODE_KEEP_WHAT_YOU_RAISE, 5000, fakeDecline(FAKE_PAYMENT_CODE_DECLINED)},
+		{"declined authorization", FUNDING_MODE_ALL_OR_NOTHING, 5000, fakeDecline(FAKE_PAYMENT_CODE_DECLINED)},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			f := newTestFixture(t, c.fundingMode)
+			defer f.db.Close()
+			tierId, err := CreateNewRewardTier(f.db, "Test tier", "", NewMoney(100, TEST_CURRENCY), sql.NullInt64{Int64: 1, Valid: true}, time.Now(), f.campaign.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if c.failure != nil {
+				f.payments.FailNext(FAKE_PAYMENT_OP_NEW_CHARGE, c.failure)
+			}
+			_, err = contribute(f.db, testEnvironment, f.payments, f.contributor, f.campaign.Id, c.units, "", sql.NullInt64{Int64: tierId, Valid: true})
+			if err != PUBERR_PAYMENT_FAILED {
+				t.Fatalf("contribute returned %v, want %v", err, PUBERR_PAYMENT_FAILED)
+			}
+			checkNoContributions(t, f.db, f.campaign.Id)
+			// The reward tier is still there for someone else
+			tier, err := GetRewardTier(f.db, tierId)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tier.Claimed != 0 {
+				t.Errorf("reward tier was claimed %d times, want none", tier.Claimed)
+			}
+			if len(f.payments.charges) != 0 {
+				t.Errorf("made %d charges, want none", len(f.payments.charges))
+			}
+			checkTestLedger(t, f.db)
+		})
+	}
+}
+
+func TestContributeRefundsUnrecordedCharge(t *testing.T) {
+	f := newTestFixture(t, FUNDING_MODE_KEEP_WHAT_YOU_RAISE)
+	defer f.db.Close()
+
+	// The customer can be charged, but the contribution can't be recorded
+	// since there is no such user
+	stranger := *f.contributor
+	stranger.Id += 1000
+	tierId, err := CreateNewRewardTier(f.db, "Test tier", "", NewMoney(100, TEST_CURRENCY), sql.NullInt64{Int64: 1, Valid: true}, time.Now(), f.campaign.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = contribute(f.db, testEnvironment, f.payments, &stranger, f.campaign.Id, 5000, "", sql.NullInt64{Int64: tierId, Valid: true}); err == nil {
+		t.Fatal("contribute succeeded, want the error recording the contribution")
+	}
+	if len(f.payments.charges) != 1 {
+		t.Fatalf("made %d charges, want 1", len(f.payments.charges))
+	}
+	for chargeId, charge := range f.payments.charges {
+		if charge.refundId == "" {
+			t.Errorf("charge %q wasn't refunded", chargeId)
+		}
+	}
+	// The reward tier was claimed before the charge, and is given back
+	tier, err := GetRewardTier(f.db, tierId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tier.Claimed != 0 {
+		t.Errorf("reward tier was claimed %d times, want none", tier.Claimed)
+	}
+	checkNoContributions(t, f.db, f.campaign.Id)
+	checkTestLedger(t, f.db)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/go-martini/martini"
+	"net/http"
+	"strconv"
+)
+
+const (
+	PLEDGE_FIELD_ID       = "id"
+	PLEDGE_FIELD_AMOUNT   = "amount"
+	PLEDGE_FIELD_CURRENCY = "currency"
+)
+
+func SetupPledgeRoutes(m *martini.ClassicMartini, db *sql.DB, env *Environment) {
+	// Pledges to contribute to a campaign every month by charging the current
+	// user's Stripe customer; the first charge is made shortly afterwards.
+	// Only campaigns that keep what they raise accept pledges
+	// Expects a JSON encoded body with the following properties:
+	// - amount (int; in minor units of the campaign's currency, e.g. cents; no less than 50)
+	// - currency (string; optional; must be the campaign's currency)
+	m.Post(API_CREATE_PLEDGE, func(params martini.Params, req *http.Request, session *Session, responder *Responder) {
+		campaignId, err := strconv.ParseInt(params[PLEDGE_FIELD_ID], 10, 64)
+		if err != nil {
+			responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_PARAM, fmt.Sprintf(ERR_URL_PARAM_INVALID, PLEDGE_FIELD_ID)))
+			return
+		}
+
+		// Perform json unmarshalling
+		var (
+			body     map[string]interface{}
+			units    int64
+			currency string
+			ok       bool
+		)
+
+		decoder := json.NewDecoder(req.Body)
+		if err := decoder.Decode(&body); err != nil {
+			responder.Error(PUBERR_INVALID_JSON)
+			return
+		}
+
+		// Basic validation and field extractions
+		units, ok = Int(body[PLEDGE_FIELD_AMOUNT])
+		if !ok || units < CONTRIBUTION_MIN_AMOUNT {
+			responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_FIELD, fmt.Sprintf(ERR_BODY_FIELD_INVALID, PLEDGE_FIELD_AMOUNT)))
+			return
+		}
+		if body[PLEDGE_FIELD_CURRENCY] != nil {
+			currency, ok = String(body[PLEDGE_FIELD_CURRENCY])
+			if currency, ok = ParseCurrency(currency); !ok {
+				responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_FIELD, fmt.Sprintf(ERR_BODY_FIELD_INVALID, PLEDGE_FIELD_CURRENCY)))
+				return
+			}
+		}
+
+		campaign, err := GetCampaign(db, campaignId)
+		if err != nil {
+			responder.Error(err)
+			return
+		}
+		if !campaign.IsOpen() {
+			responder.Error(PUBERR_CAMPAIGN_CLOSED)
+			return
+		}
+		// All-or-nothing campaigns can only hold money until their deadline
+		if !campaign.CapturesImmediately() {
+			responder.Error(PUBERR_PLEDGES_NOT_ACCEPTED)
+			return
+		}
+		// Pledges are always in the currency of the campaign
+		if currency != "" && currency != campaign.Amount.Currency {
+			responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_FIELD, fmt.Sprintf(ERR_BODY_FIELD_INVALID, PLEDGE_FIELD_CURRENCY)))
+			return
+		}
+		// Each user only gets one pledge to each campaign; they may change it by canceling and pledging again
+		exists, err := HasOpenPledge(db, session.UserId, campaign.Id)
+		if err != nil {
+			responder.Error(err)
+			return
+		}
+		if exists {
+			responder.Error(PUBERR_PLEDGE_EXISTS)
+			return
+		}
+		newId, err := CreateNewPledge(db, NewMoney(units, campaign.Amount.Currency), session.UserId, campaign.Id)
+		if err != nil {
+			responder.Error(err)
+			return
+		}
+		// Return the new pledge
+		newPledge, err := GetPledge(db, newId)
+		if err != nil {
+			responder.Error(err)
+		} else {
+			responder.Json(newPledge)
+		}
+	})
+
+	// Gets the current user's pledges, newest first
+	m.Get(API_GET_PLEDGES, func(session *Session, responder *Responder) {
+		pledges, err := FindPledgesByContributorId(db, session.UserId)
+		if err != nil {
+			responder.Error(err)
+		} else {
+			responder.Json(pledges)
+		}
+	})
+
+	// Stops charging the current user for a pledge until it is resumed
+	m.Put(API_PAUSE_PLEDGE, func(params martini.Params, session *Session, responder *Responder) {
+		changePledge(db, params, session, responder, func(tx *sql.Tx, pledge *Pledge) error {
+			if pledge.Status == PLEDGE_STATUS_PAUSED {
+				return nil
+			}
+			return SetPledgeStatus(tx, pledge.Id, PLEDGE_STATUS_PAUSED, "")
+		})
+	})
+
+	// Starts charging the current user for a paused pledge again; a billing
+	// cycle that started while it was paused is charged right away
+	m.Put(API_RESUME_PLEDGE, func(params martini.Params, session *Session, responder *Responder) {
+		changePledge(db, params, session, responder, func(tx *sql.Tx, pledge *Pledge) error {
+			if pledge.Status != PLEDGE_STATUS_PAUSED {
+				return nil
+			}
+			return ResumePledge(tx, pledge.Id)
+		})
+	})
+
+	// Cancels a pledge of the current user for good
+	m.Delete(API_CANCEL_PLEDGE, func(params martini.Params, session *Session, responder *Responder) {
+		changePledge(db, params, session, responder, func(tx *sql.Tx, pledge *Pledge) error {
+			return SetPledgeStatus(tx, pledge.Id, PLEDGE_STATUS_CANCELED, "")
+		})
+	})
+}
+
+// Applies a change to a pledge of the current user and responds with the
+// updated pledge. The pledge is locked while it changes, so that it can't be
+// charged at the same time; canceled pledges can't be changed
+func changePledge(db *sql.DB, params martini.Params, session *Session, responder *Responder, change func(*sql.Tx, *Pledge) error) {
+	pledgeId, err := strconv.ParseInt(params[PLEDGE_FIELD_ID], 10, 64)
+	if err != nil {
+		responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_PARAM, fmt.Sprintf(ERR_URL_PARAM_INVALID, PLEDGE_FIELD_ID)))
+		return
+	}
+
+	// Start the transaction
+	tx, err := db.Begin()
+	if err != nil {
+		responder.Error(err)
+		return
+	}
+	pledge, err := GetPledgeForUpdate(tx, pledgeId)
+	if err != nil {
+		_ = tx.Rollback()
+		responder.Error(err)
+		return
+	}
+	if pledge.ContributorId != session.UserId {
+		_ = tx.Rollback()
+		responder.Error(PUBERR_FORBIDDEN)
+		return
+	}
+	if pledge.Status == PLEDGE_STATUS_CANCELED {
+		_ = tx.Rollback()
+		responder.Error(PUBERR_PLEDGE_CANCELED)
+		return
+	}
+	if err = change(tx, pledge); err != nil {
+		_ = tx.Rollback()
+		responder.Error(err)
+		return
+	}
+	// Commit the tx
+	if err = tx.Commit(); err != nil {
+		responder.Error(err)
+		return
+	}
+	// Return the updated pledge
+	pledge, err = GetPledge(db, pledgeId)
+	if err != nil {
+		responder.Error(err)
+	} else {
+		responder.Json(pledge)
+	}
+}
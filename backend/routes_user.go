@@ -8,6 +8,7 @@ import (
 	"github.com/go-martini/martini"
 	// "github.com/stripe/stripe-go"
 	"golang.org/x/crypto/bcrypt"
+	"io"
 	"net/http"
 	"strconv"
 )
@@ -18,6 +19,10 @@ const (
 	USER_FIELD_EMAIL       = "email"
 	USER_FIELD_PASSWORD    = "password"
 	USER_FIELD_PICTURE_URL = "pictureUrl"
+	USER_FIELD_ID          = "id"
+	USER_FIELD_COUNTRY     = "country"
+
+	DEFAULT_STRIPE_ACCOUNT_COUNTRY = "US" // The country of Stripe Connect accounts when none is specified
 )
 
 func SetupUserRoutes(m *martini.ClassicMartini, db *sql.DB, env *Environment) {
@@ -27,7 +32,7 @@ func SetupUserRoutes(m *martini.ClassicMartini, db *sql.DB, env *Environment) {
 	// - lastName (string; no longer than 100 characters)
 	// - email (string; must be email formatted; no longer than 100 characters)
 	// - pictureUrl (string; must be URL formatted; no longer than 500 characters)
-	m.Post(API_REGISTER_USER, func(req *http.Request, responder *Responder) {
+	m.Post(API_REGISTER_USER, func(req *http.Request, payments PaymentProvider, responder *Responder) {
 		// Perform json unmarshalling
 		var (
 			body       map[string]interface{}
@@ -46,18 +51,15 @@ func SetupUserRoutes(m *martini.ClassicMartini, db *sql.DB, env *Environment) {
 		}
 
 		// Basic validation and field extractions
-		firstName, ok = String(body[USER_FIELD_FIRST_NAME])
-		if !ok {
+		if firstName, ok = parseUserField(body, USER_FIELD_FIRST_NAME); !ok {
 			responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_FIELD, fmt.Sprintf(ERR_BODY_FIELD_INVALID, USER_FIELD_FIRST_NAME)))
 			return
 		}
-		lastName, ok = String(body[USER_FIELD_LAST_NAME])
-		if !ok {
+		if lastName, ok = parseUserField(body, USER_FIELD_LAST_NAME); !ok {
 			responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_FIELD, fmt.Sprintf(ERR_BODY_FIELD_INVALID, USER_FIELD_LAST_NAME)))
 			return
 		}
-		email, ok = String(body[USER_FIELD_EMAIL])
-		if !ok || !validator.IsEmail(email) {
+		if email, ok = parseUserField(body, USER_FIELD_EMAIL); !ok {
 			responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_FIELD, fmt.Sprintf(ERR_BODY_FIELD_INVALID, USER_FIELD_EMAIL)))
 			return
 		}
@@ -66,8 +68,7 @@ func SetupUserRoutes(m *martini.ClassicMartini, db *sql.DB, env *Environment) {
 			responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_FIELD, fmt.Sprintf(ERR_BODY_FIELD_INVALID, USER_FIELD_PASSWORD)))
 			return
 		}
-		pictureUrl, ok = String(body[USER_FIELD_PICTURE_URL])
-		if !ok {
+		if pictureUrl, ok = parseUserField(body, USER_FIELD_PICTURE_URL); !ok {
 			responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_FIELD, fmt.Sprintf(ERR_BODY_FIELD_INVALID, USER_FIELD_PICTURE_URL)))
 			return
 		}
@@ -93,7 +94,7 @@ func SetupUserRoutes(m *martini.ClassicMartini, db *sql.DB, env *Environment) {
 			return
 		} else {
 			// Create a new Stripe customer
-			stripeId, err := NewStripeCustomerId(email, newId, firstName, lastName)
+			stripeId, err := payments.NewCustomer(email, newId, firstName, lastName)
 			if err != nil {
 				_ = tx.Rollback()
 				responder.Error(err)
@@ -128,8 +129,12 @@ func SetupUserRoutes(m *martini.ClassicMartini, db *sql.DB, env *Environment) {
 		}
 	})
 
-	// Gets a list of users
-	m.Get(API_GET_USERS, func(responder *Responder, req *http.Request) {
+	// Gets a list of users; only the current user's email address is shown
+	// Accepts the following query parameters:
+	// - offset (int; optional; defaults to 0)
+	// - limit (int; optional; defaults to 20)
+	// - includeDeleted (bool; optional; admins only; includes soft deleted users)
+	m.Get(API_GET_USERS, func(session *Session, responder *Responder, req *http.Request) {
 		values := req.URL.Query()
 
 		offset, err := strconv.Atoi(values.Get("offset"))
@@ -141,11 +146,214 @@ func SetupUserRoutes(m *martini.ClassicMartini, db *sql.DB, env *Environment) {
 			limit = 20
 		}
 
-		users, err := GetUsers(db, offset, limit)
+		includeDeleted, err := IncludeDeleted(db, req, session)
+		if err != nil {
+			responder.Error(err)
+			return
+		}
+
+		users, err := GetUsers(db, offset, limit, includeDeleted)
+		if err != nil {
+			responder.Error(err)
+			return
+		}
+		for i, user := range users {
+			users[i] = user.Redacted(session.UserId)
+		}
+		responder.Json(users)
+	})
+
+	// Gets the public profile of a user along with how they have taken part
+	// in campaigns; the email address is only shown to the user themselves
+	// Accepts the following query parameters:
+	// - includeDeleted (bool; optional; admins only; finds the user even if soft deleted)
+	m.Get(API_GET_USER, func(params martini.Params, req *http.Request, session *Session, responder *Responder) {
+		userId, err := strconv.ParseInt(params[USER_FIELD_ID], 10, 64)
+		if err != nil {
+			responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_PARAM, fmt.Sprintf(ERR_URL_PARAM_INVALID, USER_FIELD_ID)))
+			return
+		}
+		includeDeleted, err := IncludeDeleted(db, req, session)
+		if err != nil {
+			responder.Error(err)
+			return
+		}
+		profile, err := GetUserProfile(db, userId, session.UserId, includeDeleted)
 		if err != nil {
 			responder.Error(err)
 		} else {
-			responder.Json(users)
+			responder.Json(profile)
 		}
 	})
+
+	// Changes the profile of the user in the session; fields that are left out
+	// stay the same. Changes to the email address or name are passed on to
+	// the user's Stripe customer. Expects a JSON encoded body with any of the
+	// following properties, validated as they are when registering:
+	// - firstName (string)
+	// - lastName (string)
+	// - email (string; must be email formatted)
+	// - pictureUrl (string)
+	m.Patch(API_UPDATE_USER, func(params martini.Params, req *http.Request, session *Session, payments PaymentProvider, responder *Responder) {
+		userId, err := strconv.ParseInt(params[USER_FIELD_ID], 10, 64)
+		if err != nil {
+			responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_PARAM, fmt.Sprintf(ERR_URL_PARAM_INVALID, USER_FIELD_ID)))
+			return
+		}
+		if userId != session.UserId {
+			responder.Error(PUBERR_FORBIDDEN)
+			return
+		}
+
+		// Perform json unmarshalling
+		var body map[string]interface{}
+		decoder := json.NewDecoder(req.Body)
+		if err := decoder.Decode(&body); err != nil {
+			responder.Error(PUBERR_INVALID_JSON)
+			return
+		}
+
+		// Only whitelisted fields may be changed, and each is checked on its own
+		updateArgs := make(map[string]interface{})
+		for name := range body {
+			column, ok := userEditableFields[name]
+			if !ok {
+				responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_FIELD, fmt.Sprintf(ERR_BODY_FIELD_INVALID, name)))
+				return
+			}
+			value, ok := parseUserField(body, name)
+			if !ok {
+				responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_FIELD, fmt.Sprintf(ERR_BODY_FIELD_INVALID, name)))
+				return
+			}
+			updateArgs[column] = value
+		}
+
+		user, err := GetUser(db, userId)
+		if err != nil {
+			responder.Error(err)
+			return
+		}
+		// Start the transaction
+		tx, err := db.Begin()
+		if err != nil {
+			responder.Error(err)
+			return
+		}
+		// Submit the update
+		err = UpdateUserFields(tx, user.Id, updateArgs)
+		if err != nil {
+			_ = tx.Rollback()
+			responder.Error(err)
+			return
+		}
+		updated, err := GetUser(tx, user.Id)
+		if err != nil {
+			_ = tx.Rollback()
+			responder.Error(err)
+			return
+		}
+		// Commit the tx
+		err = tx.Commit()
+		if err != nil {
+			responder.Error(err)
+			return
+		}
+		// Keep the Stripe customer in step once the change is saved; Stripe only
+		// uses these details for receipts, so a failure doesn't undo the update
+		if user.StripeId != "" && (updated.Email != user.Email || updated.FirstName != user.FirstName || updated.LastName != user.LastName) {
+			err = payments.UpdateCustomer(user.StripeId, updated.Email, updated.Id, updated.FirstName, updated.LastName)
+			if err != nil {
+				Debug(fmt.Sprintf("Failed to update the Stripe customer of user %d: ", updated.Id), err)
+			}
+		}
+		// Return the updated user
+		responder.Json(updated)
+	})
+
+	// Links a Stripe Connect account to the user in the session, so that the
+	// campaigns they claim can be paid out to them. Payouts that were waiting
+	// for an account are made right away. Users who already have an account
+	// get the one they have. Expects an optional JSON encoded body with the
+	// following properties:
+	// - country (string; ISO 3166-1 alpha-2 country code; defaults to "US")
+	m.Post(API_CREATE_STRIPE_ACCOUNT, func(params martini.Params, req *http.Request, session *Session, payments PaymentProvider, responder *Responder) {
+		userId, err := strconv.ParseInt(params[USER_FIELD_ID], 10, 64)
+		if err != nil {
+			responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_PARAM, fmt.Sprintf(ERR_URL_PARAM_INVALID, USER_FIELD_ID)))
+			return
+		}
+		if userId != session.UserId {
+			responder.Error(PUBERR_FORBIDDEN)
+			return
+		}
+
+		// Perform json unmarshalling; the body may be left out entirely
+		var (
+			body    map[string]interface{}
+			country = DEFAULT_STRIPE_ACCOUNT_COUNTRY
+			ok      bool
+		)
+
+		decoder := json.NewDecoder(req.Body)
+		if err := decoder.Decode(&body); err != nil && err != io.EOF {
+			responder.Error(PUBERR_INVALID_JSON)
+			return
+		}
+		if body[USER_FIELD_COUNTRY] != nil {
+			country, ok = String(body[USER_FIELD_COUNTRY])
+			if !ok || !validator.IsISO3166Alpha2(country) {
+				responder.Error(NewPublicError(http.StatusBadRequest, ERRCODE_INVALID_FIELD, fmt.Sprintf(ERR_BODY_FIELD_INVALID, USER_FIELD_COUNTRY)))
+				return
+			}
+		}
+
+		user, err := GetUser(db, userId)
+		if err != nil {
+			responder.Error(err)
+			return
+		}
+		if user.StripeAccountId == "" {
+			// Create a new Stripe Connect account
+			user.StripeAccountId, err = payments.NewAccount(user.Email, country)
+			if err != nil {
+				responder.Error(err)
+				return
+			}
+			// Setup update arguments
+			updateArgs := make(map[string]interface{})
+			updateArgs[FIELD_USER_STRIPE_ACCOUNT_ID] = user.StripeAccountId
+			// Submit the update
+			err = UpdateUserFields(db, user.Id, updateArgs)
+			if err != nil {
+				responder.Error(err)
+				return
+			}
+		}
+		// Pay out whatever was waiting on the account
+		if err = ResumeClaimerPayouts(db, user.Id); err != nil {
+			responder.Error(err)
+			return
+		}
+		responder.Json(map[string]string{"stripeAccountId": user.StripeAccountId})
+	})
+}
+
+// The fields of a user that they may change themselves, and the columns they are stored in
+var userEditableFields = map[string]string{
+	USER_FIELD_FIRST_NAME:  FIELD_USER_FIRST_NAME,
+	USER_FIELD_LAST_NAME:   FIELD_USER_LAST_NAME,
+	USER_FIELD_EMAIL:       FIELD_USER_EMAIL,
+	USER_FIELD_PICTURE_URL: FIELD_USER_PICTURE_URL,
+}
+
+// Extracts a profile field of a user from a request body; returns false if it
+// is missing or invalid. The same rules apply when registering and when
+// changing the profile later
+func parseUserField(body map[string]interface{}, name string) (string, bool) {
+	value, ok := String(body[name])
+	if ok && name == USER_FIELD_EMAIL {
+		ok = validator.IsEmail(value)
+	}
+	return value, ok
 }
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"database/sql"
+	"github.com/go-martini/martini"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+func SetupWebhookRoutes(m *martini.ClassicMartini, db *sql.DB, env *Environment) {
+	// Without the signing secret there is no telling real events from forged ones
+	if env.stripeWebhookSecret == "" {
+		Debug("Stripe webhooks are disabled since " + ENV_VAR_STRIPE_WEBHOOK_SECRET + " is not set")
+		return
+	}
+
+	// Receives an event from Stripe; the body has to be signed in the Stripe-Signature header.
+	// Every event is stored exactly once, then processed; events that fail to process are
+	// retried in the background, so Stripe is told the event was received either way
+	m.Post(API_STRIPE_WEBHOOK, func(req *http.Request, responder *Responder) {
+		payload, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			responder.Error(err)
+			return
+		}
+		if err = receiveStripeEvent(db, env.stripeWebhookSecret, payload, req.Header.Get(STRIPE_SIGNATURE_HEADER)); err != nil {
+			responder.Error(err)
+			return
+		}
+		responder.Json(map[string]bool{"received": true})
+	})
+}
+
+// Verifies the signature of a Stripe webhook request, then stores and
+// processes its event unless Stripe already sent it. Returns an error only if
+// the request was rejected; events that fail to process are retried later
+func receiveStripeEvent(db *sql.DB, secret string, payload []byte, signature string) error {
+	err := VerifyStripeSignature(payload, signature, secret, time.Now())
+	if err != nil {
+		Debug("Rejected Stripe webhook: ", err)
+		return PUBERR_INVALID_SIGNATURE
+	}
+	event, err := parseStripeEvent(payload)
+	if err != nil {
+		return PUBERR_INVALID_JSON
+	}
+
+	// Store the event, unless Stripe already sent it
+	id, created, err := CreateNewStripeEvent(db, event.Id, event.Type, payload)
+	if err != nil {
+		return err
+	}
+	if created {
+		if err = ProcessStripeEvent(db, id, false); err != nil {
+			Debug("Failed to process Stripe event \""+event.Id+"\": ", err)
+		}
+	} else {
+		Debug("Ignored duplicate Stripe event \"" + event.Id + "\"")
+	}
+	return nil
+}
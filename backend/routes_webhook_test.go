@@ -0,0 +1,102 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// Starts a server that receives Stripe webhooks the way the webhook route does
+func newTestWebhookServer(t *testing.T, db *sql.DB) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		payload, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = receiveStripeEvent(db, TEST_STRIPE_WEBHOOK_SECRET, payload, req.Header.Get(STRIPE_SIGNATURE_HEADER))
+		if pubErr, ok := err.(*PublicError); ok {
+			w.WriteHeader(pubErr.Status)
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+}
+
+func TestWebhookReceivesFixtures(t *testing.T) {
+	f := newTestFixture(t, FUNDING_MODE_KEEP_WHAT_YOU_RAISE)
+	defer f.db.Close()
+	server := newTestWebhookServer(t, f.db)
+	defer server.Close()
+
+	// Every fixture is acknowledged, even if it concerns no contribution or payout
+	paths, err := filepath.Glob(TEST_STRIPE_FIXTURES)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		res, body, err := SendStripeFixture(path, "", TEST_STRIPE_WEBHOOK_SECRET, server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("%s: status is %d (%s), want %d", path, res.StatusCode, body, http.StatusOK)
+		}
+	}
+
+	// Forged events are turned away
+	res, _, err := SendStripeFixture(paths[0], "", "whsec_forged", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != PUBERR_INVALID_SIGNATURE.Status {
+		t.Errorf("forged event got status %d, want %d", res.StatusCode, PUBERR_INVALID_SIGNATURE.Status)
+	}
+}
+
+func TestWebhookRefundsContribution(t *testing.T) {
+	f := newTestFixture(t, FUNDING_MODE_KEEP_WHAT_YOU_RAISE)
+	defer f.db.Close()
+	server := newTestWebhookServer(t, f.db)
+	defer server.Close()
+	contribution := newTestContribution(t, f.db, f.payments, f.campaign, f.contributor, 5000)
+
+	// Stripe may send an event more than once, but it is only processed once
+	path := filepath.Join(filepath.Dir(TEST_STRIPE_FIXTURES), "charge_refunded.json")
+	for i := 0; i < 2; i++ {
+		res, body, err := SendStripeFixture(path, contribution.StripeId, TEST_STRIPE_WEBHOOK_SECRET, server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("status is %d (%s), want %d", res.StatusCode, body, http.StatusOK)
+		}
+	}
+	ids, err := FindStripeEventIdsByStripeId(f.db, []string{"evt_charge_refunded_" + contribution.StripeId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 {
+		t.Errorf("stored the event %d times, want once", len(ids))
+	}
+	contribution = getTestContribution(t, f.db, contribution.Id)
+	if contribution.Status != CONTRIBUTION_STATUS_REFUNDED || contribution.Active {
+		t.Errorf("status is %q (active %v), want a withdrawn %q contribution", contribution.Status, contribution.Active, CONTRIBUTION_STATUS_REFUNDED)
+	}
+	if balance := getTestBalance(t, f.db, LEDGER_ACCOUNT_CAMPAIGN_ESCROW, f.campaign.Id); balance != 0 {
+		t.Errorf("escrow holds %d, want nothing", balance)
+	}
+	// Stripe keeps its fee on refunded charges, at the platform's expense
+	if contribution.ProcessorFee == 0 {
+		t.Error("the refunded charge had no processor fee")
+	}
+	if balance := getTestBalance(t, f.db, LEDGER_ACCOUNT_PROCESSOR_FEES, 0); balance != contribution.ProcessorFee {
+		t.Errorf("processor fees hold %d, want the %d kept on the refunded charge", balance, contribution.ProcessorFee)
+	}
+	if balance := getTestBalance(t, f.db, LEDGER_ACCOUNT_PLATFORM_FEES, 0); balance != -contribution.ProcessorFee {
+		t.Errorf("platform fees hold %d, want %d", balance, -contribution.ProcessorFee)
+	}
+	checkTestLedger(t, f.db)
+}
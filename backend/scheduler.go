@@ -0,0 +1,91 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+const (
+	SCHEDULER_INTERVAL = time.Minute // How often scheduled jobs run
+	SCHEDULER_LOCK_KEY = 7335001     // The advisory lock held by whichever server is running the jobs
+
+	SQL_TRY_SCHEDULER_LOCK = `
+		SELECT pg_try_advisory_xact_lock($1);
+	`
+)
+
+// ScheduledJob is work that the Scheduler runs periodically
+type ScheduledJob struct {
+	Name string              // What the job does; used in logs
+	Run  func(*sql.DB) error // Does the work
+}
+
+// Scheduler periodically runs jobs in the background. When several servers
+// share a database, only the one holding the scheduler lock runs them
+type Scheduler struct {
+	db       *sql.DB
+	interval time.Duration
+	jobs     []ScheduledJob
+}
+
+// Creates a new scheduler that runs its jobs every interval
+func NewScheduler(db *sql.DB, interval time.Duration) *Scheduler {
+	return &Scheduler{
+		db:       db,
+		interval: interval,
+		jobs:     make([]ScheduledJob, 0),
+	}
+}
+
+// Adds a job to the scheduler
+func (s *Scheduler) Add(name string, run func(*sql.DB) error) {
+	s.jobs = append(s.jobs, ScheduledJob{Name: name, Run: run})
+}
+
+// Starts running the jobs in the background
+func (s *Scheduler) Start() {
+	go func() {
+		for {
+			if err := s.Tick(); err != nil {
+				Debug("Scheduler could not run: ", err)
+			}
+			time.Sleep(s.interval)
+		}
+	}()
+}
+
+// Runs every job once if no other server is already doing so
+func (s *Scheduler) Tick() error {
+	// The lock lasts as long as this transaction, so it is released even if we crash
+	leader, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer leader.Rollback()
+	var locked bool
+	err = leader.QueryRow(SQL_TRY_SCHEDULER_LOCK, SCHEDULER_LOCK_KEY).Scan(&locked)
+	if err != nil || !locked {
+		return err
+	}
+	// Run the jobs; one failing doesn't stop the rest
+	for _, job := range s.jobs {
+		if err = job.Run(s.db); err != nil {
+			Debug("Scheduled job \""+job.Name+"\" failed: ", err)
+		}
+	}
+	return nil
+}
+
+// Returns how long a job should wait before retrying work that has failed the
+// specified number of times; the wait starts at base and doubles with every
+// failure, up to max
+func RetryDelay(attempts int64, base time.Duration, max time.Duration) time.Duration {
+	delay := base
+	for i := int64(1); i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
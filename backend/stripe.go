@@ -3,28 +3,182 @@ package main
 import (
 	"fmt"
 	"github.com/stripe/stripe-go"
+	"github.com/stripe/stripe-go/account"
+	"github.com/stripe/stripe-go/charge"
 	"github.com/stripe/stripe-go/customer"
+	"github.com/stripe/stripe-go/refund"
+	"github.com/stripe/stripe-go/transfer"
+	"net/http"
+	"strings"
 )
 
 const (
 	STRIPE_CUSTOMER_DESC = "%s %s (id: %d)"
+	STRIPE_CHARGE_DESC   = "Contribution to campaign %d by user %d"
+	STRIPE_TRANSFER_DESC = "Payout of campaign %d to user %d"
+
+	STRIPE_EXPAND_BALANCE_TRANSACTION = "balance_transaction" // Expands the balance transaction of a charge, which says what Stripe kept of it
 )
 
-// Initializes the Stripe API client
-func SetupStripe(env *Environment) {
-	stripe.Key = env.stripeAPIKey
+// StripePaymentProvider makes payments through the Stripe API. It keeps its
+// own clients rather than using the package level key, so that it can be
+// pointed at a local fake of the Stripe API
+type StripePaymentProvider struct {
+	accounts  account.Client
+	charges   charge.Client
+	customers customer.Client
+	refunds   refund.Client
+	transfers transfer.Client
+}
+
+// Creates a StripePaymentProvider that authenticates with the specified key;
+// talks to the Stripe API at apiURL instead, if it isn't empty
+func NewStripePaymentProvider(key string, apiURL string) *StripePaymentProvider {
+	backend := stripe.GetBackend(stripe.APIBackend)
+	if apiURL != "" {
+		backend = &stripe.BackendConfiguration{
+			Type:       stripe.APIBackend,
+			URL:        apiURL,
+			HTTPClient: &http.Client{},
+		}
+	}
+	return &StripePaymentProvider{
+		accounts:  account.Client{B: backend, Key: key},
+		charges:   charge.Client{B: backend, Key: key},
+		customers: customer.Client{B: backend, Key: key},
+		refunds:   refund.Client{B: backend, Key: key},
+		transfers: transfer.Client{B: backend, Key: key},
+	}
 }
 
 // Creates a new Stripe customer; returns the customer id
-func NewStripeCustomerId(email string, id int64, firstName string, lastName string) (string, error) {
+func (p *StripePaymentProvider) NewCustomer(email string, id int64, firstName string, lastName string) (string, error) {
 	params := &stripe.CustomerParams{
 		Email: email,
 		Desc:  fmt.Sprintf(STRIPE_CUSTOMER_DESC, firstName, lastName, id),
 	}
-	newCust, err := customer.New(params)
+	newCust, err := p.customers.New(params)
 	if err != nil {
-		return "", err
+		return "", stripeError(err)
 	} else {
 		return newCust.ID, nil
 	}
 }
+
+// Updates the email address and description of a Stripe customer
+func (p *StripePaymentProvider) UpdateCustomer(customerId string, email string, id int64, firstName string, lastName string) error {
+	params := &stripe.CustomerParams{
+		Email: email,
+		Desc:  fmt.Sprintf(STRIPE_CUSTOMER_DESC, firstName, lastName, id),
+	}
+	_, err := p.customers.Update(customerId, params)
+	return stripeError(err)
+}
+
+// Charges a Stripe customer's default payment source; the charge is only
+// authorized if capture is false. Returns the charge id and Stripe's fee on
+// it, which is nothing until it is captured. Requests with the same non-empty
+// idempotency key only charge the customer once
+func (p *StripePaymentProvider) NewCharge(customerId string, amount Money, capture bool, desc string, idempotencyKey string) (string, Money, error) {
+	params := &stripe.ChargeParams{
+		Amount:    uint64(amount.Amount),
+		Currency:  stripe.Currency(strings.ToLower(amount.Currency)),
+		Customer:  customerId,
+		Desc:      desc,
+		NoCapture: !capture,
+	}
+	params.IdempotencyKey = idempotencyKey
+	params.Expand(STRIPE_EXPAND_BALANCE_TRANSACTION)
+	newCharge, err := p.charges.New(params)
+	if err != nil {
+		return "", Money{}, stripeError(err)
+	} else {
+		return newCharge.ID, stripeChargeFee(newCharge, amount.Currency), nil
+	}
+}
+
+// Captures the entirety of an authorized Stripe charge; returns Stripe's fee on it
+func (p *StripePaymentProvider) CaptureCharge(chargeId string) (Money, error) {
+	params := &stripe.CaptureParams{}
+	params.Expand(STRIPE_EXPAND_BALANCE_TRANSACTION)
+	captured, err := p.charges.Capture(chargeId, params)
+	if err != nil {
+		return Money{}, stripeError(err)
+	}
+	return stripeChargeFee(captured, strings.ToUpper(string(captured.Currency))), nil
+}
+
+// Returns what Stripe kept of a charge in the charge's currency; nothing if
+// the charge has no balance transaction yet because it was only authorized.
+// Stripe takes its fee in the currency the platform is paid out in, so the
+// fee is converted at the rate the charge itself was converted at
+func stripeChargeFee(charge *stripe.Charge, currency string) Money {
+	tx := charge.Tx
+	if tx == nil || tx.Fee == 0 {
+		return NewMoney(0, currency)
+	}
+	if strings.EqualFold(string(tx.Currency), currency) || tx.Amount == 0 {
+		return NewMoney(tx.Fee, currency)
+	}
+	return NewMoney((tx.Fee*int64(charge.Amount)+tx.Amount/2)/tx.Amount, currency)
+}
+
+// Refunds the entirety of a Stripe charge, or releases it if it was only
+// authorized; returns the refund id. Requests with the same non-empty
+// idempotency key only refund the charge once
+func (p *StripePaymentProvider) RefundCharge(chargeId string, idempotencyKey string) (string, error) {
+	params := &stripe.RefundParams{
+		Charge: chargeId,
+	}
+	params.IdempotencyKey = idempotencyKey
+	newRefund, err := p.refunds.New(params)
+	if err != nil {
+		return "", stripeError(err)
+	} else {
+		return newRefund.ID, nil
+	}
+}
+
+// Creates a Stripe Connect account that Stripe manages on the platform's
+// behalf, so that a user can be paid out; returns the account id
+func (p *StripePaymentProvider) NewAccount(email string, country string) (string, error) {
+	params := &stripe.AccountParams{
+		Country: country,
+		Email:   email,
+		Managed: true,
+	}
+	newAccount, err := p.accounts.New(params)
+	if err != nil {
+		return "", stripeError(err)
+	} else {
+		return newAccount.ID, nil
+	}
+}
+
+// Transfers money from the platform's balance to a Stripe Connect account;
+// returns the transfer id. Requests with the same idempotency key only
+// transfer the money once
+func (p *StripePaymentProvider) NewTransfer(accountId string, amount Money, desc string, idempotencyKey string) (string, error) {
+	params := &stripe.TransferParams{
+		Amount:   amount.Amount,
+		Currency: stripe.Currency(strings.ToLower(amount.Currency)),
+		Dest:     accountId,
+		Desc:     desc,
+	}
+	params.IdempotencyKey = idempotencyKey
+	newTransfer, err := p.transfers.New(params)
+	if err != nil {
+		return "", stripeError(err)
+	} else {
+		return newTransfer.ID, nil
+	}
+}
+
+// Turns errors Stripe responded with into PaymentDeclinedErrors; other
+// errors, e.g. network failures, are returned as they are
+func stripeError(err error) error {
+	if stripeErr, ok := err.(*stripe.Error); ok {
+		return &PaymentDeclinedError{Code: string(stripeErr.Code), Message: stripeErr.Msg}
+	}
+	return err
+}
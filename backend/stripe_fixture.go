@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const (
+	CMD_SEND_STRIPE_FIXTURE = "send-stripe-fixture" // The subcommand that sends a signed fixture to the webhook endpoint instead of running the server
+
+	STRIPE_FIXTURE_CHARGE_ID   = "ch_fixture" // The charge id used throughout the charge fixtures in fixtures/stripe
+	STRIPE_FIXTURE_TRANSFER_ID = "tr_fixture" // The transfer id used throughout the transfer fixtures in fixtures/stripe
+)
+
+// The ids that SendStripeFixture replaces; each fixture uses at most one of them
+var stripeFixtureObjectIds = []string{STRIPE_FIXTURE_CHARGE_ID, STRIPE_FIXTURE_TRANSFER_ID}
+
+// Signs a Stripe event fixture the way Stripe would and posts it to a webhook
+// url; returns the response. If objectId isn't empty, it replaces the fixture's
+// charge or transfer id, and with it the event id, so the fixture concerns a
+// real contribution or payout. Sending the same fixture twice shows off deduplication
+func SendStripeFixture(path string, objectId string, secret string, url string) (*http.Response, []byte, error) {
+	payload, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if objectId != "" {
+		for _, fixtureId := range stripeFixtureObjectIds {
+			payload = bytes.Replace(payload, []byte(fixtureId), []byte(objectId), -1)
+		}
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set(ContentType, ContentJSON)
+	req.Header.Set(STRIPE_SIGNATURE_HEADER, SignStripePayload(payload, secret, time.Now()))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	return res, bytes.TrimSpace(body), err
+}
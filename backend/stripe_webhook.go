@@ -0,0 +1,386 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	CMD_REPLAY_STRIPE_EVENTS = "replay-stripe-events" // The subcommand that processes stored Stripe events again instead of running the server
+
+	STRIPE_SIGNATURE_HEADER    = "Stripe-Signature" // The header Stripe signs webhook requests with
+	STRIPE_SIGNATURE_SCHEME    = "v1"               // The only signature scheme that is accepted; the others are for testing
+	STRIPE_SIGNATURE_TOLERANCE = 5 * time.Minute    // How old a signature may be before the request is taken to be a replay attack
+
+	// Types of Stripe events that affect contributions
+	STRIPE_EVENT_CHARGE_SUCCEEDED       = "charge.succeeded"       // A charge was authorized, and possibly captured
+	STRIPE_EVENT_CHARGE_CAPTURED        = "charge.captured"        // An authorized charge was captured
+	STRIPE_EVENT_CHARGE_REFUNDED        = "charge.refunded"        // A charge was refunded, or its authorization released
+	STRIPE_EVENT_CHARGE_DISPUTE_CREATED = "charge.dispute.created" // A customer disputed a charge with their bank
+	STRIPE_EVENT_PAYOUT_PAID            = "payout.paid"            // The platform balance was paid out to its bank account
+	STRIPE_EVENT_PAYOUT_FAILED          = "payout.failed"          // The platform balance could not be paid out to its bank account
+	STRIPE_EVENT_TRANSFER_PAID          = "transfer.paid"          // A payout arrived in its claimer's Stripe Connect account
+	STRIPE_EVENT_TRANSFER_FAILED        = "transfer.failed"        // A payout could not be made to its claimer's Stripe Connect account
+
+	// Statuses of Stripe transfers
+	STRIPE_TRANSFER_STATUS_PAID   = "paid"
+	STRIPE_TRANSFER_STATUS_FAILED = "failed"
+)
+
+// The envelope of a Stripe webhook event; only the object it concerns is processed
+type stripeWebhookEvent struct {
+	Id   string `json:"id"`
+	Type string `json:"type"`
+	Data struct {
+		Object json.RawMessage `json:"object"`
+	} `json:"data"`
+}
+
+// The parts of a Stripe charge object that concern contributions
+type stripeChargeObject struct {
+	Id       string `json:"id"`
+	Captured bool   `json:"captured"`
+	Refunded bool   `json:"refunded"` // True only once the entire charge has been refunded
+	Refunds  struct {
+		Data []struct {
+			Id string `json:"id"`
+		} `json:"data"`
+	} `json:"refunds"` // The refunds of the charge, newest first
+}
+
+// The parts of a Stripe dispute object that concern contributions
+type stripeDisputeObject struct {
+	Id     string `json:"id"`
+	Charge string `json:"charge"`
+	Reason string `json:"reason"`
+}
+
+// The parts of a Stripe payout object worth logging
+type stripePayoutObject struct {
+	Id             string `json:"id"`
+	Amount         int64  `json:"amount"`
+	Currency       string `json:"currency"`
+	FailureMessage string `json:"failure_message"`
+}
+
+// The parts of a Stripe transfer object that concern payouts
+type stripeTransferObject struct {
+	Id             string `json:"id"`
+	Status         string `json:"status"`
+	FailureMessage string `json:"failure_message"`
+}
+
+// Processes the object of a Stripe event within a transaction
+type stripeEventHandler func(tx *sql.Tx, object json.RawMessage) error
+
+// The handlers of the Stripe events that are processed; other events are stored, but otherwise ignored
+var stripeEventHandlers = map[string]stripeEventHandler{
+	STRIPE_EVENT_CHARGE_SUCCEEDED:       handleChargeCaptured,
+	STRIPE_EVENT_CHARGE_CAPTURED:        handleChargeCaptured,
+	STRIPE_EVENT_CHARGE_REFUNDED:        handleChargeRefunded,
+	STRIPE_EVENT_CHARGE_DISPUTE_CREATED: handleChargeDisputed,
+	STRIPE_EVENT_PAYOUT_PAID:            handlePayout,
+	STRIPE_EVENT_PAYOUT_FAILED:          handlePayout,
+	STRIPE_EVENT_TRANSFER_PAID:          handleTransfer,
+	STRIPE_EVENT_TRANSFER_FAILED:        handleTransfer,
+}
+
+// Computes the Stripe-Signature header of a webhook payload signed at the specified time
+func SignStripePayload(payload []byte, secret string, at time.Time) string {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	return "t=" + timestamp + "," + STRIPE_SIGNATURE_SCHEME + "=" + computeStripeSignature(payload, secret, timestamp)
+}
+
+// Checks the Stripe-Signature header of a webhook request: one of its
+// signatures has to match the payload, and it can't be too old
+func VerifyStripeSignature(payload []byte, header string, secret string, now time.Time) error {
+	var (
+		timestamp  string
+		signatures = make([]string, 0)
+	)
+	for _, part := range strings.Split(header, ",") {
+		pair := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(pair) != 2 {
+			continue
+		}
+		switch pair[0] {
+		case "t":
+			timestamp = pair[1]
+		case STRIPE_SIGNATURE_SCHEME:
+			signatures = append(signatures, pair[1])
+		}
+	}
+	signedAt, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) < 1 {
+		return errors.New(ERR_STRIPE_SIGNATURE_MALFORMED)
+	}
+	if age := now.Sub(time.Unix(signedAt, 0)); age > STRIPE_SIGNATURE_TOLERANCE || age < -STRIPE_SIGNATURE_TOLERANCE {
+		return errors.New(ERR_STRIPE_SIGNATURE_EXPIRED)
+	}
+	expected := []byte(computeStripeSignature(payload, secret, timestamp))
+	for _, signature := range signatures {
+		if hmac.Equal(expected, []byte(signature)) {
+			return nil
+		}
+	}
+	return errors.New(ERR_STRIPE_SIGNATURE_MISMATCH)
+}
+
+// Computes the hex encoded HMAC-SHA256 that Stripe signs payloads with
+func computeStripeSignature(payload []byte, secret string, timestamp string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Parses the envelope of a Stripe webhook event
+func parseStripeEvent(payload []byte) (*stripeWebhookEvent, error) {
+	var event stripeWebhookEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, err
+	}
+	if event.Id == "" || event.Type == "" {
+		return nil, errors.New(ERR_STRIPE_EVENT_MALFORMED)
+	}
+	return &event, nil
+}
+
+// Processes a stored Stripe event unless it was already processed; replayed
+// events are processed again regardless. Failures are recorded on the event
+func ProcessStripeEvent(db *sql.DB, id int64, replay bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	// Lock the event so that it isn't processed twice at the same time
+	event, err := GetStripeEventForUpdate(tx, id)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if event.ProcessedAt.Valid && !replay {
+		return tx.Rollback()
+	}
+	err = handleStripeEvent(tx, event)
+	if err == nil {
+		err = MarkStripeEventProcessed(tx, event.Id)
+	}
+	if err == nil {
+		return tx.Commit()
+	}
+	_ = tx.Rollback()
+	if recordErr := RecordStripeEventFailure(db, event.Id, err.Error()); recordErr != nil {
+		Debug(fmt.Sprintf("Could not record the failure of Stripe event \"%s\": ", event.StripeId), recordErr)
+	}
+	return err
+}
+
+// Passes the object of a stored event along to the handler of its type
+func handleStripeEvent(tx *sql.Tx, event *StripeEvent) error {
+	handler, ok := stripeEventHandlers[event.Type]
+	if !ok {
+		return nil
+	}
+	envelope, err := parseStripeEvent(event.Payload)
+	if err != nil {
+		return err
+	}
+	return handler(tx, envelope.Data.Object)
+}
+
+// Processes the stored Stripe events that haven't been processed yet. Each
+// event is processed on its own, so a failure is simply retried the next time
+// around, up to STRIPE_EVENT_MAX_ATTEMPTS times
+func ProcessStripeEvents(db *sql.DB) error {
+	ids, err := FindUnprocessedStripeEventIds(db, STRIPE_EVENT_MAX_ATTEMPTS)
+	if err != nil {
+		return err
+	}
+	return processStripeEventIds(db, ids, false)
+}
+
+// Processes stored Stripe events again. Given Stripe event ids, those events
+// are processed again even if they were processed before; otherwise every
+// unprocessed event is, including the ones that failed too many times
+func ReplayStripeEvents(db *sql.DB, stripeIds []string) error {
+	var (
+		ids []int64
+		err error
+	)
+	if len(stripeIds) > 0 {
+		ids, err = FindStripeEventIdsByStripeId(db, stripeIds)
+	} else {
+		ids, err = FindUnprocessedStripeEventIds(db, math.MaxInt32)
+	}
+	if err != nil {
+		return err
+	}
+	return processStripeEventIds(db, ids, true)
+}
+
+// Processes each of the specified stored events; returns the first failure
+func processStripeEventIds(db *sql.DB, ids []int64, replay bool) error {
+	var firstErr error
+	for _, id := range ids {
+		if err := ProcessStripeEvent(db, id, replay); err != nil {
+			Debug(fmt.Sprintf("Failed to process Stripe event %d: ", id), err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// Locks the contribution made with a charge; returns nil if there is none,
+// which happens for charges that were refunded because they couldn't be recorded
+func findChargedContribution(tx *sql.Tx, chargeId string) (*Contribution, error) {
+	contribution, err := GetContributionByStripeIdForUpdate(tx, chargeId)
+	if err == PUBERR_ENTITY_NOT_FOUND {
+		Debug("Stripe charge \"" + chargeId + "\" does not belong to any contribution")
+		return nil, nil
+	}
+	return contribution, err
+}
+
+// Records captures that were made, but never recorded; usually because the
+// server went down in between
+func handleChargeCaptured(tx *sql.Tx, object json.RawMessage) error {
+	var charge stripeChargeObject
+	if err := json.Unmarshal(object, &charge); err != nil {
+		return err
+	}
+	if !charge.Captured {
+		return nil
+	}
+	contribution, err := findChargedContribution(tx, charge.Id)
+	if err != nil || contribution == nil {
+		return err
+	}
+	switch contribution.Status {
+	case CONTRIBUTION_STATUS_AUTHORIZED:
+		err = SetContributionStatus(tx, contribution.Id, CONTRIBUTION_STATUS_CAPTURED)
+	case CONTRIBUTION_STATUS_FAILED:
+		// Failed captures were withdrawn, so they have to count again
+		err = reinstateContribution(tx, contribution, CONTRIBUTION_STATUS_CAPTURED)
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return PostContribution(tx, contribution)
+}
+
+// Withdraws contributions whose charges were refunded in full, or whose
+// authorizations were released, outside of the backend
+func handleChargeRefunded(tx *sql.Tx, object json.RawMessage) error {
+	var charge stripeChargeObject
+	if err := json.Unmarshal(object, &charge); err != nil {
+		return err
+	}
+	// The backend never refunds part of a charge, so partial refunds are left for a person to look into
+	if !charge.Refunded {
+		Debug("Stripe charge \"" + charge.Id + "\" was partially refunded")
+		return nil
+	}
+	contribution, err := findChargedContribution(tx, charge.Id)
+	if err != nil || contribution == nil {
+		return err
+	}
+	switch contribution.Status {
+	case CONTRIBUTION_STATUS_AUTHORIZED:
+		return withdrawContribution(tx, contribution, CONTRIBUTION_STATUS_RELEASED)
+	case CONTRIBUTION_STATUS_CAPTURED:
+		if err = withdrawContribution(tx, contribution, CONTRIBUTION_STATUS_REFUNDED); err != nil {
+			return err
+		}
+		refundId := charge.Id
+		if len(charge.Refunds.Data) > 0 {
+			refundId = charge.Refunds.Data[0].Id
+		}
+		return PostRefund(tx, contribution, refundId)
+	default:
+		return nil
+	}
+}
+
+// Withdraws captured contributions whose charges were disputed; the bank holds
+// on to the money until the dispute is settled
+func handleChargeDisputed(tx *sql.Tx, object json.RawMessage) error {
+	var dispute stripeDisputeObject
+	if err := json.Unmarshal(object, &dispute); err != nil {
+		return err
+	}
+	contribution, err := findChargedContribution(tx, dispute.Charge)
+	if err != nil || contribution == nil {
+		return err
+	}
+	if contribution.Status != CONTRIBUTION_STATUS_CAPTURED {
+		return nil
+	}
+	Debug(fmt.Sprintf("Contribution %d was disputed: ", contribution.Id), dispute.Reason)
+	if err = withdrawContribution(tx, contribution, CONTRIBUTION_STATUS_DISPUTED); err != nil {
+		return err
+	}
+	return PostDispute(tx, contribution, dispute.Id)
+}
+
+// Logs payouts of the platform balance. They move the money of many
+// contributions at once, so they are kept in the inbox for reconciliation
+// rather than matched against individual contributions
+func handlePayout(tx *sql.Tx, object json.RawMessage) error {
+	var payout stripePayoutObject
+	if err := json.Unmarshal(object, &payout); err != nil {
+		return err
+	}
+	amount := NewMoney(payout.Amount, strings.ToUpper(payout.Currency))
+	if payout.FailureMessage != "" {
+		Debug("Stripe payout \""+payout.Id+"\" of "+amount.String()+" failed: ", payout.FailureMessage)
+	} else {
+		Debug("Stripe payout \"" + payout.Id + "\" of " + amount.String() + " was paid")
+	}
+	return nil
+}
+
+// Records whether the transfer of a payout reached its claimer; the money of
+// failed transfers goes back into the campaign's escrow
+func handleTransfer(tx *sql.Tx, object json.RawMessage) error {
+	var transfer stripeTransferObject
+	if err := json.Unmarshal(object, &transfer); err != nil {
+		return err
+	}
+	payout, err := GetPayoutByStripeIdForUpdate(tx, transfer.Id)
+	if err == PUBERR_ENTITY_NOT_FOUND {
+		Debug("Stripe transfer \"" + transfer.Id + "\" does not belong to any payout")
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if payout.Status != PAYOUT_STATUS_TRANSFERRED {
+		return nil
+	}
+	switch transfer.Status {
+	case STRIPE_TRANSFER_STATUS_PAID:
+		return SetPayoutStatus(tx, payout.Id, PAYOUT_STATUS_PAID, "")
+	case STRIPE_TRANSFER_STATUS_FAILED:
+		Debug(fmt.Sprintf("Payout %d failed: ", payout.Id), transfer.FailureMessage)
+		if err = PostPayoutReversal(tx, payout.CampaignId, payout.ClaimerId, payout.Amount, transfer.Id); err != nil {
+			return err
+		}
+		return SetPayoutStatus(tx, payout.Id, PAYOUT_STATUS_FAILED, transfer.FailureMessage)
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const (
+	TEST_STRIPE_WEBHOOK_SECRET = "whsec_test"
+	TEST_STRIPE_FIXTURES       = "fixtures/stripe/*.json" // The signed fixture payloads that the webhook is tried out with
+)
+
+func TestVerifyStripeSignature(t *testing.T) {
+	var (
+		payload  = []byte(`{"id":"evt_test","type":"charge.succeeded"}`)
+		signedAt = time.Unix(1446000000, 0)
+		valid    = SignStripePayload(payload, TEST_STRIPE_WEBHOOK_SECRET, signedAt)
+		forged   = SignStripePayload(payload, "whsec_forged", signedAt)
+	)
+	// The header with the forged signature swapped for the valid one, alongside others
+	timestamp := "t=" + strconv.FormatInt(signedAt.Unix(), 10)
+	validSignature := valid[len(timestamp)+1:]
+	forgedSignature := forged[len(timestamp)+1:]
+	cases := []struct {
+		name    string
+		payload []byte
+		header  string
+		now     time.Time
+		want    string // The message of the error, or empty if the signature is accepted
+	}{
+		{"valid", payload, valid, signedAt, ""},
+		{"valid a while later", payload, valid, signedAt.Add(STRIPE_SIGNATURE_TOLERANCE), ""},
+		{"expired", payload, valid, signedAt.Add(STRIPE_SIGNATURE_TOLERANCE + time.Second), ERR_STRIPE_SIGNATURE_EXPIRED},
+		{"from the future", payload, valid, signedAt.Add(-STRIPE_SIGNATURE_TOLERANCE - time.Second), ERR_STRIPE_SIGNATURE_EXPIRED},
+		{"tampered body", []byte(`{"id":"evt_test","type":"charge.refunded"}`), valid, signedAt, ERR_STRIPE_SIGNATURE_MISMATCH},
+		{"wrong secret", payload, forged, signedAt, ERR_STRIPE_SIGNATURE_MISMATCH},
+		{"several signatures", payload, timestamp + "," + forgedSignature + "," + validSignature, signedAt, ""},
+		{"several wrong signatures", payload, timestamp + "," + forgedSignature + "," + forgedSignature, signedAt, ERR_STRIPE_SIGNATURE_MISMATCH},
+		{"other schemes ignored", payload, timestamp + ",v0=" + validSignature[3:], signedAt, ERR_STRIPE_SIGNATURE_MALFORMED},
+		{"no timestamp", payload, validSignature, signedAt, ERR_STRIPE_SIGNATURE_MALFORMED},
+		{"no header", payload, "", signedAt, ERR_STRIPE_SIGNATURE_MALFORMED},
+	}
+	for _, c := range cases {
+		err := VerifyStripeSignature(c.payload, c.header, TEST_STRIPE_WEBHOOK_SECRET, c.now)
+		if c.want == "" && err != nil {
+			t.Errorf("%s: rejected with %q, want it accepted", c.name, err)
+		} else if c.want != "" && (err == nil || err.Error() != c.want) {
+			t.Errorf("%s: got %v, want %q", c.name, err, c.want)
+		}
+	}
+}
+
+func TestStripeFixturesAreHandled(t *testing.T) {
+	paths, err := filepath.Glob(TEST_STRIPE_FIXTURES)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("found no fixtures in " + TEST_STRIPE_FIXTURES)
+	}
+	for _, path := range paths {
+		payload, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		event, err := parseStripeEvent(payload)
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+			continue
+		}
+		if _, ok := stripeEventHandlers[event.Type]; !ok {
+			t.Errorf("%s: no handler for %q events", path, event.Type)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"log"
+	"math"
 	"unicode"
 )
 
@@ -17,6 +18,26 @@ func String(i interface{}) (string, bool) {
 	}
 }
 
+func Float(i interface{}) (float64, bool) {
+	if i == nil {
+		return 0, false
+	}
+	if f, ok := i.(float64); ok {
+		return f, true
+	} else {
+		return 0, false
+	}
+}
+
+// Reads a JSON number that has no fractional part
+func Int(i interface{}) (int64, bool) {
+	f, ok := Float(i)
+	if !ok || f != math.Trunc(f) || math.Abs(f) >= math.MaxInt64 {
+		return 0, false
+	}
+	return int64(f), true
+}
+
 func IsCharLowerCase(char rune) bool {
 	return unicode.IsLower(char)
 }
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"math"
+)
+
+const (
+	// Ways that the votes of backers can be weighted
+	VOTING_METHOD_ONE_PERSON_ONE_VOTE = "one_person_one_vote" // Every backer counts the same
+	VOTING_METHOD_WEIGHTED            = "weighted"            // Backers count in proportion to how much they contributed
+	VOTING_METHOD_QUADRATIC           = "quadratic"           // Backers count in proportion to the square root of how much they contributed
+
+	DEFAULT_VOTING_METHOD    = VOTING_METHOD_ONE_PERSON_ONE_VOTE
+	DEFAULT_VOTING_QUORUM    = 50.0
+	DEFAULT_VOTING_THRESHOLD = 50.0
+)
+
+// VotingRules decide how the votes concerning the claims of a Campaign are tallied
+type VotingRules struct {
+	Method    string  `json:"method"`    // How votes are weighted; one of the VOTING_METHOD_* constants
+	Quorum    float64 `json:"quorum"`    // The percentage of contributed funds whose backers must vote for a tally to count
+	Threshold float64 `json:"threshold"` // A claim is approved when more than this percentage of the weighted votes are affirmative
+}
+
+// Ballot is a single vote concerning a claim along with how much its voter contributed
+type Ballot struct {
+	Affirmative bool  // True if in favor of the claim
+	Contributed int64 // The total the voter contributed to the campaign, in minor units of its currency
+}
+
+// ClaimTally is the outcome of the votes concerning a Claim
+type ClaimTally struct {
+	Affirmative       int64   `json:"affirmative"`       // The number of votes in favor of the claim
+	Negative          int64   `json:"negative"`          // The number of votes against the claim
+	AffirmativeWeight float64 `json:"affirmativeWeight"` // The weight of the votes in favor of the claim
+	NegativeWeight    float64 `json:"negativeWeight"`    // The weight of the votes against the claim
+	Participation     float64 `json:"participation"`     // The percentage of contributed funds whose backers voted
+	Approval          float64 `json:"approval"`          // The percentage of the weighted votes that are affirmative
+	QuorumMet         bool    `json:"quorumMet"`         // True if enough backers voted for the tally to count
+	Approved          bool    `json:"approved"`          // True if the quorum was met and the approval beat the threshold
+}
+
+// The default voting rules of new campaigns
+func DefaultVotingRules() VotingRules {
+	return VotingRules{
+		Method:    DEFAULT_VOTING_METHOD,
+		Quorum:    DEFAULT_VOTING_QUORUM,
+		Threshold: DEFAULT_VOTING_THRESHOLD,
+	}
+}
+
+// Returns true if method is one of the VOTING_METHOD_* constants
+func IsValidVotingMethod(method string) bool {
+	return method == VOTING_METHOD_ONE_PERSON_ONE_VOTE ||
+		method == VOTING_METHOD_WEIGHTED ||
+		method == VOTING_METHOD_QUADRATIC
+}
+
+// Returns true if the quorum is a percentage
+func IsValidVotingQuorum(quorum float64) bool {
+	return quorum >= 0 && quorum <= 100
+}
+
+// Returns true if the threshold is a percentage that some approval can beat
+func IsValidVotingThreshold(threshold float64) bool {
+	return threshold >= 0 && threshold < 100
+}
+
+// Returns how much the vote of a backer who contributed the specified amount counts for
+func (r VotingRules) Weight(contributed int64) float64 {
+	switch r.Method {
+	case VOTING_METHOD_WEIGHTED:
+		return float64(contributed)
+	case VOTING_METHOD_QUADRATIC:
+		return math.Sqrt(float64(contributed))
+	default:
+		return 1
+	}
+}
+
+// Tallies ballots according to the voting rules; funds is the total contributed to the campaign
+func TallyBallots(rules VotingRules, funds int64, ballots []Ballot) *ClaimTally {
+	var (
+		tally = ClaimTally{}
+		voted = int64(0)
+	)
+	for _, ballot := range ballots {
+		weight := rules.Weight(ballot.Contributed)
+		if ballot.Affirmative {
+			tally.Affirmative++
+			tally.AffirmativeWeight += weight
+		} else {
+			tally.Negative++
+			tally.NegativeWeight += weight
+		}
+		voted += ballot.Contributed
+	}
+	if funds > 0 {
+		tally.Participation = float64(voted) / float64(funds) * 100
+	}
+	if total := tally.AffirmativeWeight + tally.NegativeWeight; total > 0 {
+		tally.Approval = tally.AffirmativeWeight / total * 100
+	}
+	tally.QuorumMet = tally.Participation >= rules.Quorum
+	tally.Approved = tally.QuorumMet && tally.Approval > rules.Threshold
+	return &tally
+}